@@ -50,6 +50,8 @@ module "es_cluster" {
 
   key_name          = var.key_name
   target_group_arns = [module.es_target_group.target_group_arn]
+
+  tags = var.custom_tags
 }
 
 # ---------------------------------------------------------------------------------------------------------------------
@@ -178,6 +180,8 @@ module "alb" {
   aws_region     = var.aws_region
   vpc_id         = data.aws_vpc.default.id
   vpc_subnet_ids = data.aws_subnets.default_subnets.ids
+
+  custom_tags = var.custom_tags
 }
 
 locals {
@@ -9,3 +9,15 @@ output "server_asg_names" {
 output "lb_dns_name" {
   value = module.alb.alb_dns_name
 }
+
+output "backup_bucket_name" {
+  value = aws_s3_bucket.es_backup_bucket.bucket
+}
+
+output "backup_lambda_name" {
+  value = module.es_cluster_backup.lambda_name
+}
+
+output "restore_lambda_name" {
+  value = module.es_cluster_restore.lambda_name
+}
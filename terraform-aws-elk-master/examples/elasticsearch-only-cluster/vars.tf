@@ -100,3 +100,9 @@ variable "repository" {
   type        = string
   default     = "es-backup-repository"
 }
+
+variable "custom_tags" {
+  description = "A map of custom tags to apply to the Auto Scaling Groups, their instances and the ALB. The key is the tag name and the value is the tag value."
+  type        = map(string)
+  default     = {}
+}
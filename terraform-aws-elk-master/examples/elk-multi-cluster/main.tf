@@ -48,6 +48,8 @@ module "es_cluster" {
 
   key_name          = var.key_name
   target_group_arns = [module.es_target_group.target_group_arn]
+
+  tags = var.custom_tags
 }
 
 # Add IAM policy to be able to read the secrets for configuring authentication of Logstash and Kibana
@@ -147,6 +149,8 @@ module "logstash" {
 
   ssh_key_name         = var.key_name
   lb_target_group_arns = [module.logstash_target_group_collectd.target_group_arn]
+
+  tags = var.custom_tags
 }
 
 # Add IAM policy to be able to read the secrets for configuring authentication of Logstash to ES
@@ -171,9 +175,9 @@ data "aws_iam_policy_document" "logstash_secrets_manager_read_policy" {
 
 # ---------------------------------------------------------------------------------------------------------------------
 # CREATE AN S3 BUCKET FOR TESTING PURPOSES ONLY
-# We upload a simple text file into this bucket. The Logstash S3 input plugin will grab every line of every file in
-# this bucket and send it to the configured output. In production this won't be needed and the cloudtrail bucket should
-# be used directly.
+# The tests upload CloudTrail log files into this bucket. The Logstash S3 input plugin will grab every file in this
+# bucket and send each CloudTrail record in it to the configured output. In production this won't be needed and the
+# cloudtrail bucket should be used directly.
 # ---------------------------------------------------------------------------------------------------------------------
 
 resource "aws_s3_bucket" "s3_test_bucket" {
@@ -281,6 +285,8 @@ module "kibana_cluster" {
   ssh_key_name                      = var.key_name
   kibana_ui_port                    = var.kibana_ui_port
   target_group_arns                 = [module.kibana_target_group.target_group_arn]
+
+  tags = local.custom_asg_tags
 }
 
 # Add IAM policy to be able to read the secrets for configuring authentication of Logstash to ES
@@ -441,6 +447,8 @@ module "elastalert" {
   # To make testing easier, we allow SSH requests from any IP address here. In a production deployment, we strongly
   # recommend you limit this to the IP address ranges of known, trusted servers inside your VPC.
   allow_ssh_from_cidr_blocks = ["0.0.0.0/0"]
+
+  tags = local.custom_asg_tags
 }
 
 data "template_file" "elastalert_user_data" {
@@ -509,6 +517,8 @@ module "alb" {
 
   vpc_id         = data.aws_vpc.default.id
   vpc_subnet_ids = data.aws_subnets.default_subnets.ids
+
+  custom_tags = var.custom_tags
 }
 
 locals {
@@ -540,6 +550,15 @@ locals {
       },
     ]
   }
+
+  # The Kibana and ElastAlert modules take their tags as a list of tag blocks rather than a map
+  custom_asg_tags = [
+    for key, value in var.custom_tags : {
+      key                 = key
+      value               = value
+      propagate_at_launch = true
+    }
+  ]
 }
 
 # ---------------------------------------------------------------------------------------------------------------------
@@ -37,3 +37,11 @@ output "sns_topic_display_name" {
 output "sns_topic_arn" {
   value = module.sns.topic_arn
 }
+
+output "kibana_asg_name" {
+  value = module.kibana_cluster.kibana_asg_name
+}
+
+output "elastalert_asg_name" {
+  value = module.elastalert.elastalert_asg_name
+}
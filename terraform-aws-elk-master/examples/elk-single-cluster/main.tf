@@ -49,10 +49,13 @@ module "elk_cluster" {
     module.logstash_target_group_collectd.target_group_arn,
   ]
 
-  tags = {
-    Environment = "development"
-    Role        = "Cluster"
-  }
+  tags = merge(
+    {
+      Environment = "development"
+      Role        = "Cluster"
+    },
+    var.custom_tags,
+  )
 }
 
 data "template_file" "user_data" {
@@ -129,9 +132,9 @@ module "kibana_security_group_rules" {
 
 # ---------------------------------------------------------------------------------------------------------------------
 # CREATE AN S3 BUCKET FOR TESTING PURPOSES ONLY
-# We upload a simple text file into this bucket. The Logstash S3 input plugin will grab every line of every file in
-# this bucket and send it to the configured output. In production this won't be needed and the cloudtrail bucket should
-# be used directly.
+# The tests upload CloudTrail log files into this bucket. The Logstash S3 input plugin will grab every file in this
+# bucket and send each CloudTrail record in it to the configured output. In production this won't be needed and the
+# cloudtrail bucket should be used directly.
 # ---------------------------------------------------------------------------------------------------------------------
 
 resource "aws_s3_bucket" "s3_test_bucket" {
@@ -199,6 +202,8 @@ module "alb" {
   aws_region     = var.aws_region
   vpc_id         = data.aws_vpc.default.id
   vpc_subnet_ids = data.aws_subnets.default_subnets.ids
+
+  custom_tags = var.custom_tags
 }
 
 # ---------------------------------------------------------------------------------------------------------------------
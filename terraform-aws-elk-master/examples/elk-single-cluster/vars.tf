@@ -92,3 +92,9 @@ variable "alb_name" {
   type        = string
   default     = "elk-alb"
 }
+
+variable "custom_tags" {
+  description = "A map of custom tags to apply to the Auto Scaling Groups, their instances and the ALB. The key is the tag name and the value is the tag value."
+  type        = map(string)
+  default     = {}
+}
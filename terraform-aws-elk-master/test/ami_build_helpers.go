@@ -0,0 +1,442 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gruntwork-io/terratest/modules/aws"
+	"github.com/gruntwork-io/terratest/modules/git"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/packer"
+)
+
+// How many Packer builds buildAmis runs at once, unless AMI_BUILD_CONCURRENCY says otherwise
+const AMI_BUILD_DEFAULT_CONCURRENCY = 5
+
+// How many lines of the Packer output an AmiBuildError keeps
+const PACKER_LOG_TAIL_LINES = 30
+
+// Matches the line of the Packer machine-readable output with the ID of the artifact, e.g.
+// 1456332887,amazon-ebs,artifact,0,id,us-east-1:ami-b481b3de
+var packerArtifactIdRegexp = regexp.MustCompile(`^.+,artifact,\d+,id,(?:.+?:|)(.+)$`)
+
+type PackerInfo struct {
+	templatePath string
+	builderName  string
+}
+
+// AmiBuild is an AMI for buildAmis to build
+type AmiBuild struct {
+	// Identifies the build in the results and errors, e.g. elasticsearch
+	Name       string
+	PackerInfo PackerInfo
+	UseSsl     bool
+	// Always build the AMI, rather than reuse a cached one
+	Fresh bool
+}
+
+// AmiBuildResult is the AMI a build produced
+type AmiBuildResult struct {
+	AmiId string
+	// True if the AMI came from the AMI cache, so it isn't the build's to delete
+	Cached bool
+}
+
+// PackerError is a failed Packer run, with the end of its output
+type PackerError struct {
+	Err     error
+	LogTail []string
+}
+
+func (err PackerError) Error() string {
+	return err.Err.Error()
+}
+
+// AmiBuildError is why one AMI build failed
+type AmiBuildError struct {
+	Build AmiBuild
+	Err   error
+}
+
+func (err AmiBuildError) Error() string {
+	message := fmt.Sprintf("AMI %s (builder %s of %s) failed: %v", err.Build.Name, err.Build.PackerInfo.builderName, err.Build.PackerInfo.templatePath, err.Err)
+	if packerErr, ok := err.Err.(PackerError); ok && len(packerErr.LogTail) > 0 {
+		message += fmt.Sprintf("\nLast %d lines of the Packer output:\n    %s", len(packerErr.LogTail), strings.Join(packerErr.LogTail, "\n    "))
+	}
+	return message
+}
+
+// AmiBuildsError is what went wrong with a set of AMI builds: the builds that failed, the builds cancelled because of
+// them, and the AMIs that finished but couldn't be deleted
+type AmiBuildsError struct {
+	Failures      []AmiBuildError
+	Cancelled     []string
+	CleanupErrors []string
+}
+
+func (err AmiBuildsError) Error() string {
+	lines := []string{fmt.Sprintf("%d AMI builds failed", len(err.Failures))}
+	for _, failure := range err.Failures {
+		lines = append(lines, failure.Error())
+	}
+	if len(err.Cancelled) > 0 {
+		lines = append(lines, fmt.Sprintf("Cancelled the builds of: %s", strings.Join(err.Cancelled, ", ")))
+	}
+	for _, cleanupErr := range err.CleanupErrors {
+		lines = append(lines, fmt.Sprintf("Failed to clean up: %s", cleanupErr))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// buildAmi builds the AMI, or reuses the one an earlier run built from the same template, files, modules and vars. Set
+// DISABLE_AMI_CACHE to always build it.
+func buildAmi(t *testing.T, templatePath string, builderName string, awsRegion string, useSsl bool) string {
+	build := AmiBuild{Name: builderName, PackerInfo: PackerInfo{templatePath: templatePath, builderName: builderName}, UseSsl: useSsl}
+	result, err := buildAmiE(t, context.Background(), awsRegion, build)
+	if err != nil {
+		t.Fatal(AmiBuildError{Build: build, Err: err})
+	}
+	return result.AmiId
+}
+
+// buildAmis builds the AMIs concurrently and returns their IDs by build name. See buildAmisE.
+func buildAmis(t *testing.T, awsRegion string, builds []AmiBuild) map[string]string {
+	results, err := buildAmisE(t, awsRegion, builds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	amiIds := map[string]string{}
+	for name, result := range results {
+		amiIds[name] = result.AmiId
+	}
+	return amiIds
+}
+
+// buildAmisE builds the AMIs with at most AMI_BUILD_CONCURRENCY Packer builds at once. It never fails the test from
+// the build goroutines. On the first failure, it interrupts the other builds, deletes the AMIs that did finish, and
+// returns an AmiBuildsError that says which builds broke and why.
+func buildAmisE(t *testing.T, awsRegion string, builds []AmiBuild) (map[string]AmiBuildResult, error) {
+	build := func(ctx context.Context, build AmiBuild) (AmiBuildResult, error) {
+		return buildAmiE(t, ctx, awsRegion, build)
+	}
+	deleteAmi := func(amiId string) error {
+		logger.Logf(t, "Deleting AMI %s in %s, as the other AMI builds failed", amiId, awsRegion)
+		client, err := defaultAwsClients.ec2ClientE(awsRegion)
+		if err != nil {
+			return err
+		}
+		return deleteAmiE(context.Background(), client, amiId)
+	}
+	return runAmiBuildsE(context.Background(), builds, amiBuildConcurrency(t), build, deleteAmi)
+}
+
+// amiBuildConcurrency returns AMI_BUILD_CONCURRENCY, or AMI_BUILD_DEFAULT_CONCURRENCY if it isn't a positive number
+func amiBuildConcurrency(t *testing.T) int {
+	value := os.Getenv("AMI_BUILD_CONCURRENCY")
+	if value == "" {
+		return AMI_BUILD_DEFAULT_CONCURRENCY
+	}
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency < 1 {
+		logger.Logf(t, "Ignoring invalid AMI_BUILD_CONCURRENCY %q", value)
+		return AMI_BUILD_DEFAULT_CONCURRENCY
+	}
+	return concurrency
+}
+
+// runAmiBuildsE runs the builds with at most concurrency at once and cancels the context of the others when one fails.
+// If any build doesn't succeed, it deletes the AMIs that weren't cached, and returns no results.
+func runAmiBuildsE(
+	ctx context.Context,
+	builds []AmiBuild,
+	concurrency int,
+	build func(ctx context.Context, build AmiBuild) (AmiBuildResult, error),
+	deleteAmi func(amiId string) error,
+) (map[string]AmiBuildResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	semaphore := make(chan struct{}, concurrency)
+	var mutex sync.Mutex
+	var waitForBuilds sync.WaitGroup
+
+	results := map[string]AmiBuildResult{}
+	buildErrs := AmiBuildsError{}
+
+	for _, amiBuild := range builds {
+		// The following is necessary to make sure amiBuild's value doesn't
+		// get updated due to concurrency within the goroutine below
+		amiBuild := amiBuild
+		waitForBuilds.Add(1)
+
+		go func() {
+			defer waitForBuilds.Done()
+
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+			}
+
+			var result AmiBuildResult
+			err := ctx.Err()
+			if err == nil {
+				result, err = build(ctx, amiBuild)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			// A build may have finished its AMI even if it was cancelled, so it needs cleaning up
+			if result.AmiId != "" {
+				results[amiBuild.Name] = result
+			}
+			switch {
+			case err == nil:
+			case ctx.Err() != nil:
+				buildErrs.Cancelled = append(buildErrs.Cancelled, amiBuild.Name)
+			default:
+				buildErrs.Failures = append(buildErrs.Failures, AmiBuildError{Build: amiBuild, Err: err})
+				cancel()
+			}
+		}()
+	}
+	waitForBuilds.Wait()
+
+	if len(buildErrs.Failures) == 0 && len(buildErrs.Cancelled) == 0 {
+		return results, nil
+	}
+	if len(buildErrs.Failures) == 0 {
+		// Nothing failed, so whoever called us cancelled
+		buildErrs.Failures = append(buildErrs.Failures, AmiBuildError{Build: AmiBuild{Name: "all"}, Err: ctx.Err()})
+	}
+
+	sort.Strings(buildErrs.Cancelled)
+	for _, name := range sortedAmiBuildNames(results) {
+		if results[name].Cached {
+			continue
+		}
+		if err := deleteAmi(results[name].AmiId); err != nil {
+			buildErrs.CleanupErrors = append(buildErrs.CleanupErrors, fmt.Sprintf("AMI %s of %s: %v", results[name].AmiId, name, err))
+		}
+	}
+	return nil, buildErrs
+}
+
+func sortedAmiBuildNames(results map[string]AmiBuildResult) []string {
+	names := []string{}
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildAmiE reuses a cached AMI for the build unless it is Fresh, or runs Packer. It only uses helpers that return
+// errors, so it is safe to call from any goroutine.
+func buildAmiE(t *testing.T, ctx context.Context, awsRegion string, build AmiBuild) (AmiBuildResult, error) {
+	templatePath := build.PackerInfo.templatePath
+	builderName := build.PackerInfo.builderName
+
+	options, err := amiPackerOptionsE(t, templatePath, builderName, awsRegion, build.UseSsl)
+	if err != nil {
+		return AmiBuildResult{}, err
+	}
+
+	cacheKey := ""
+	if !build.Fresh {
+		var amiId string
+		cacheKey, amiId = lookUpCachedAmi(t, templatePath, builderName, awsRegion, options.Vars)
+		if amiId != "" {
+			logger.Logf(t, "Reusing AMI %s, which was built from %s %s with hash %s", amiId, templatePath, builderName, cacheKey)
+			return AmiBuildResult{AmiId: amiId, Cached: true}, nil
+		}
+	}
+
+	amiId, err := runPackerBuildE(t, ctx, "packer", build.Name, options)
+	if amiId != "" {
+		tagTestAmi(t, awsRegion, amiId, cacheKey)
+	}
+	return AmiBuildResult{AmiId: amiId}, err
+}
+
+func amiPackerOptionsE(t *testing.T, templatePath string, builderName string, awsRegion string, useSsl bool) (*packer.Options, error) {
+	curBranch, err := git.GetCurrentBranchNameE(t)
+	if err != nil {
+		return nil, err
+	}
+	smallInstanceType, err := aws.GetRecommendedInstanceTypeE(t, awsRegion, []string{"t2.small", "t3.small"})
+	if err != nil {
+		return nil, err
+	}
+	return &packer.Options{
+		Template: templatePath,
+		Only:     builderName,
+		Vars: map[string]string{
+			"aws_region":                  awsRegion,
+			"instance_type":               smallInstanceType,
+			"use_ssl":                     strconv.FormatBool(useSsl),
+			"module_branch":               curBranch,
+			"module_elasticsearch_branch": curBranch,
+			"module_filebeat_branch":      curBranch,
+			"module_kibana_branch":        curBranch,
+			"module_logstash_branch":      curBranch,
+			"module_collectd_branch":      curBranch,
+			"module_app_server_branch":    curBranch,
+		},
+	}, nil
+}
+
+// runPackerBuildE runs packer build like packer.BuildArtifactE, but interrupts Packer when the context is cancelled, so
+// it cleans up its builder instance, and returns a PackerError with the end of its output when it fails. It returns
+// the artifact ID if Packer printed one, even if it failed afterwards.
+func runPackerBuildE(t *testing.T, ctx context.Context, packerBinary string, name string, options *packer.Options) (string, error) {
+	logger.Logf(t, "Running Packer to build %s from template %s", name, options.Template)
+
+	cmd := exec.Command(packerBinary, packerBuildArgs(options)...)
+	cmd.Dir = options.WorkingDir
+	cmd.Env = os.Environ()
+	for key, value := range options.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			logger.Logf(t, "Interrupting the Packer build of %s: %v", name, ctx.Err())
+			cmd.Process.Signal(os.Interrupt)
+		case <-done:
+		}
+	}()
+
+	artifactId := ""
+	tail := []string{}
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if matches := packerArtifactIdRegexp.FindStringSubmatch(line); len(matches) == 2 {
+			artifactId = matches[1]
+		}
+		readableLine := readablePackerLine(line)
+		logger.Logf(t, "[%s] %s", name, readableLine)
+		tail = append(tail, readableLine)
+		if len(tail) > PACKER_LOG_TAIL_LINES {
+			tail = tail[1:]
+		}
+	}
+
+	err = cmd.Wait()
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil && artifactId == "" {
+		err = fmt.Errorf("Could not find the artifact ID in the Packer output")
+	}
+	if err != nil {
+		return artifactId, PackerError{Err: err, LogTail: tail}
+	}
+	return artifactId, nil
+}
+
+// packerBuildArgs returns the arguments of packer build for the options, with the vars sorted
+func packerBuildArgs(options *packer.Options) []string {
+	args := []string{"build", "-machine-readable"}
+
+	varNames := []string{}
+	for name := range options.Vars {
+		varNames = append(varNames, name)
+	}
+	sort.Strings(varNames)
+	for _, name := range varNames {
+		args = append(args, "-var", fmt.Sprintf("%s=%s", name, options.Vars[name]))
+	}
+	for _, varFile := range options.VarFiles {
+		args = append(args, "-var-file", varFile)
+	}
+	if options.Only != "" {
+		args = append(args, fmt.Sprintf("-only=%s", options.Only))
+	}
+	if options.Except != "" {
+		args = append(args, fmt.Sprintf("-except=%s", options.Except))
+	}
+	return append(args, options.Template)
+}
+
+// readablePackerLine returns the message of a ui line of the Packer machine-readable output, which has the format
+// <timestamp>,<target>,ui,<type>,<message>, and other lines as they are
+func readablePackerLine(line string) string {
+	fields := strings.SplitN(line, ",", 5)
+	if len(fields) != 5 || fields[2] != "ui" {
+		return line
+	}
+	message := strings.Replace(fields[4], "%!(PACKER_COMMA)", ",", -1)
+	message = strings.Replace(message, `\n`, "\n", -1)
+	return strings.TrimRight(strings.Replace(message, `\r`, "", -1), "\n")
+}
+
+func describeAmiE(ctx context.Context, client *ec2.EC2, amiId string) (*ec2.Image, error) {
+	output, err := client.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: awsgo.StringSlice([]string{amiId})})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Images) != 1 {
+		return nil, fmt.Errorf("Expected one AMI with ID %s but found %d", amiId, len(output.Images))
+	}
+	return output.Images[0], nil
+}
+
+func amiSnapshotIds(image *ec2.Image) []string {
+	snapshotIds := []string{}
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+			snapshotIds = append(snapshotIds, awsgo.StringValue(mapping.Ebs.SnapshotId))
+		}
+	}
+	return snapshotIds
+}
+
+// deleteAmiE deregisters the AMI and deletes its snapshots
+func deleteAmiE(ctx context.Context, client *ec2.EC2, amiId string) error {
+	image, err := describeAmiE(ctx, client, amiId)
+	if err != nil {
+		return err
+	}
+	return deregisterAmiE(ctx, client, amiId, amiSnapshotIds(image))
+}
+
+// deregisterAmiE deregisters the AMI, then deletes the given snapshots, which deregistering leaves behind
+func deregisterAmiE(ctx context.Context, client *ec2.EC2, amiId string, snapshotIds []string) error {
+	if _, err := client.DeregisterImageWithContext(ctx, &ec2.DeregisterImageInput{ImageId: awsgo.String(amiId)}); err != nil {
+		return err
+	}
+	for _, snapshotId := range snapshotIds {
+		if _, err := client.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{SnapshotId: awsgo.String(snapshotId)}); err != nil {
+			return fmt.Errorf("Deregistered AMI %s but failed to delete its snapshot %s: %v", amiId, snapshotId, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/packer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineRunAmiBuilds(t *testing.T) {
+	t.Parallel()
+
+	builds := []AmiBuild{{Name: "elasticsearch"}, {Name: "logstash"}, {Name: "kibana", Fresh: true}}
+	build := func(ctx context.Context, build AmiBuild) (AmiBuildResult, error) {
+		return AmiBuildResult{AmiId: "ami-" + build.Name, Cached: !build.Fresh}, nil
+	}
+	deleteAmi := func(amiId string) error {
+		t.Errorf("Deleted AMI %s although all builds succeeded", amiId)
+		return nil
+	}
+
+	results, err := runAmiBuildsE(context.Background(), builds, 2, build, deleteAmi)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]AmiBuildResult{
+		"elasticsearch": {AmiId: "ami-elasticsearch", Cached: true},
+		"logstash":      {AmiId: "ami-logstash", Cached: true},
+		"kibana":        {AmiId: "ami-kibana"},
+	}, results)
+}
+
+func TestOfflineRunAmiBuildsCancelsOnFirstFailure(t *testing.T) {
+	t.Parallel()
+
+	builds := []AmiBuild{
+		{Name: "cached"},
+		{Name: "finished"},
+		{Name: "interrupted"},
+		{Name: "broken", PackerInfo: PackerInfo{templatePath: "broken.json", builderName: "broken-ubuntu"}},
+		{Name: "queued"},
+	}
+	buildsStarted := make(chan struct{})
+	var startedOnce sync.WaitGroup
+	startedOnce.Add(3)
+	go func() {
+		startedOnce.Wait()
+		close(buildsStarted)
+	}()
+
+	build := func(ctx context.Context, build AmiBuild) (AmiBuildResult, error) {
+		switch build.Name {
+		case "cached":
+			return AmiBuildResult{AmiId: "ami-cached", Cached: true}, nil
+		case "finished":
+			return AmiBuildResult{AmiId: "ami-finished"}, nil
+		case "interrupted":
+			startedOnce.Done()
+			<-ctx.Done()
+			// Packer may have registered the AMI before the interrupt reached it
+			return AmiBuildResult{AmiId: "ami-interrupted"}, PackerError{Err: ctx.Err()}
+		case "broken":
+			startedOnce.Done()
+			<-buildsStarted
+			return AmiBuildResult{}, PackerError{Err: errors.New("exit status 1"), LogTail: []string{"Build 'broken-ubuntu' errored: apt-get failed"}}
+		default:
+			startedOnce.Done()
+			<-ctx.Done()
+			return AmiBuildResult{}, ctx.Err()
+		}
+	}
+
+	var mutex sync.Mutex
+	deleted := []string{}
+	deleteAmi := func(amiId string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		deleted = append(deleted, amiId)
+		if amiId == "ami-interrupted" {
+			return errors.New("InvalidAMIID.Unavailable")
+		}
+		return nil
+	}
+
+	results, err := runAmiBuildsE(context.Background(), builds, 5, build, deleteAmi)
+	assert.Nil(t, results)
+	require.IsType(t, AmiBuildsError{}, err)
+
+	buildErrs := err.(AmiBuildsError)
+	if assert.Len(t, buildErrs.Failures, 1) {
+		assert.Equal(t, "broken", buildErrs.Failures[0].Build.Name)
+	}
+	assert.Equal(t, []string{"interrupted", "queued"}, buildErrs.Cancelled)
+	assert.Equal(t, []string{"ami-finished", "ami-interrupted"}, deleted, "Only the AMIs the builds created are deleted")
+	assert.Len(t, buildErrs.CleanupErrors, 1)
+
+	message := err.Error()
+	assert.Contains(t, message, "AMI broken (builder broken-ubuntu of broken.json) failed: exit status 1")
+	assert.Contains(t, message, "Build 'broken-ubuntu' errored: apt-get failed")
+	assert.Contains(t, message, "Cancelled the builds of: interrupted, queued")
+	assert.Contains(t, message, "ami-interrupted of interrupted: InvalidAMIID.Unavailable")
+}
+
+func TestOfflineRunAmiBuildsConcurrency(t *testing.T) {
+	t.Parallel()
+
+	builds := []AmiBuild{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		builds = append(builds, AmiBuild{Name: name})
+	}
+
+	var mutex sync.Mutex
+	running := 0
+	maxRunning := 0
+	build := func(ctx context.Context, build AmiBuild) (AmiBuildResult, error) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return AmiBuildResult{AmiId: "ami-" + build.Name}, nil
+	}
+
+	results, err := runAmiBuildsE(context.Background(), builds, 3, build, func(string) error { return nil })
+	require.NoError(t, err)
+	assert.Len(t, results, 7)
+	assert.Equal(t, 3, maxRunning)
+}
+
+func TestOfflineRunPackerBuild(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		script        string
+		expectedAmiId string
+		expectedTail  []string
+	}{
+		{
+			"success",
+			`echo "1456332887,,ui,say,==> elasticsearch-ami-ubuntu-20: Creating AMI%!(PACKER_COMMA) please wait"
+echo "1456332887,elasticsearch-ami-ubuntu-20,artifact,0,id,us-east-1:ami-0123456789abcdef0"`,
+			"ami-0123456789abcdef0",
+			nil,
+		},
+		{
+			"failure",
+			`for i in $(seq 1 40); do echo "1456332887,,ui,message,    elasticsearch-ami-ubuntu-20: step $i"; done
+echo "apt-get failed" >&2
+exit 1`,
+			"",
+			append(packerTestSteps(12, 40), "apt-get failed"),
+		},
+		{
+			"no artifact",
+			`echo "1456332887,,ui,say,Build 'elasticsearch-ami-ubuntu-20' finished."`,
+			"",
+			[]string{"Build 'elasticsearch-ami-ubuntu-20' finished."},
+		},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			packerBinary := writeFakePacker(t, testCase.script)
+			amiId, err := runPackerBuildE(t, context.Background(), packerBinary, "elasticsearch", &packer.Options{Template: "elasticsearch.json"})
+			assert.Equal(t, testCase.expectedAmiId, amiId)
+			if testCase.expectedTail == nil {
+				assert.NoError(t, err)
+				return
+			}
+			require.IsType(t, PackerError{}, err)
+			assert.Equal(t, testCase.expectedTail, err.(PackerError).LogTail)
+		})
+	}
+}
+
+func TestOfflineRunPackerBuildInterruptsOnCancel(t *testing.T) {
+	t.Parallel()
+
+	packerBinary := writeFakePacker(t, `trap 'echo "Cleaning up the builder instance"; exit 1' INT
+echo "1456332887,,ui,say,Waiting for SSH"
+while true; do sleep 0.1; done`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := runPackerBuildE(t, ctx, packerBinary, "elasticsearch", &packer.Options{Template: "elasticsearch.json"})
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+	require.IsType(t, PackerError{}, err)
+	assert.Contains(t, err.(PackerError).LogTail, "Cleaning up the builder instance")
+}
+
+func TestOfflinePackerBuildArgs(t *testing.T) {
+	t.Parallel()
+
+	args := packerBuildArgs(&packer.Options{
+		Template: "elasticsearch.json",
+		Only:     "elasticsearch-ami-ubuntu-20",
+		Vars:     map[string]string{"use_ssl": "false", "aws_region": "us-east-1"},
+	})
+	assert.Equal(t, []string{
+		"build", "-machine-readable",
+		"-var", "aws_region=us-east-1",
+		"-var", "use_ssl=false",
+		"-only=elasticsearch-ami-ubuntu-20",
+		"elasticsearch.json",
+	}, args)
+}
+
+func TestOfflineReadablePackerLine(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "==> kibana: Creating AMI, please wait", readablePackerLine("1456332887,,ui,say,==> kibana: Creating AMI%!(PACKER_COMMA) please wait"))
+	assert.Equal(t, "first\nsecond", readablePackerLine(`1456332887,kibana,ui,error,first\nsecond\n`))
+	assert.Equal(t, "1456332887,kibana,artifact,0,id,us-east-1:ami-123", readablePackerLine("1456332887,kibana,artifact,0,id,us-east-1:ami-123"))
+	assert.Equal(t, "apt-get failed", readablePackerLine("apt-get failed"))
+}
+
+func packerTestSteps(from int, to int) []string {
+	steps := []string{}
+	for i := from; i <= to; i++ {
+		steps = append(steps, "    elasticsearch-ami-ubuntu-20: step "+strconv.Itoa(i))
+	}
+	return steps
+}
+
+// writeFakePacker writes a bash script that stands in for the packer binary
+func writeFakePacker(t *testing.T, script string) string {
+	dir, err := ioutil.TempDir("", "fake-packer")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "packer")
+	require.NoError(t, ioutil.WriteFile(path, []byte("#!/usr/bin/env bash\n"+script+"\n"), 0755))
+	return path
+}
@@ -0,0 +1,253 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+// The tag with the hash of everything an AMI was built from, which buildAmi looks AMIs up by
+const AMI_CACHE_TAG_KEY = "package-elk-ami-hash"
+
+// buildAmi only reuses AMIs younger than this, so the source AMIs get their updates and a reused AMI outlives the test
+const AMI_CACHE_REUSE_MAX_AGE = 6 * 24 * time.Hour
+
+// The janitor deletes cached AMIs older than this, rather than after JANITOR_DEFAULT_MIN_AGE
+const AMI_CACHE_MAX_AGE = 7 * 24 * time.Hour
+
+// Packer vars that don't change what ends up on the AMI
+var amiCacheIgnoredVars = map[string]bool{
+	"aws_region":    true,
+	"instance_type": true,
+}
+
+// The files the Packer templates copy to the AMI, relative to the folder of the template
+var packerTemplateDirRegexp = regexp.MustCompile(`\{\{template_dir\}\}/([^"]+)`)
+
+// The modules of this repo the templates and install scripts install with gruntwork-install
+var installedModuleRegexp = regexp.MustCompile(`\b(?:install|run)-[a-z0-9-]+\b`)
+
+// amiCacheDisabled returns true if DISABLE_AMI_CACHE is set, to always build the AMIs
+func amiCacheDisabled() bool {
+	return os.Getenv("DISABLE_AMI_CACHE") != ""
+}
+
+// amiCacheKeyE hashes the template, the files it copies to the AMI, the modules of this repo it installs, the builder
+// and the Packer vars. The ssl folder the tests generate keystores into is only part of the hash with use_ssl, as the
+// AMIs only use it then, and the tests generate new keystores on every run.
+func amiCacheKeyE(templatePath string, builderName string, vars map[string]string) (string, error) {
+	rootDir, err := findRepoRootE(templatePath)
+	if err != nil {
+		return "", err
+	}
+	inputs, err := amiCacheInputsE(rootDir, templatePath, vars["use_ssl"] == "true")
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "builder\x00%s\x00", builderName)
+
+	varNames := []string{}
+	for name := range vars {
+		if !amiCacheIgnoredVars[name] {
+			varNames = append(varNames, name)
+		}
+	}
+	sort.Strings(varNames)
+	for _, name := range varNames {
+		fmt.Fprintf(hash, "var\x00%s\x00%s\x00", name, vars[name])
+	}
+
+	for _, input := range inputs {
+		contents, err := ioutil.ReadFile(filepath.Join(rootDir, input))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "file\x00%s\x00%d\x00", filepath.ToSlash(input), len(contents))
+		hash.Write(contents)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// amiCacheInputsE returns the files an AMI is built from, relative to the root of the repo and sorted: every file in
+// the folder of the template and the folders it copies from, and the modules the template and those files install
+func amiCacheInputsE(rootDir string, templatePath string, useSsl bool) ([]string, error) {
+	templatePath, err := filepath.Abs(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	template, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	templateDir := filepath.Dir(templatePath)
+	paths := []string{templatePath, templateDir}
+	for _, match := range packerTemplateDirRegexp.FindAllStringSubmatch(string(template), -1) {
+		path := filepath.Join(templateDir, match[1])
+		if !useSsl && filepath.Base(path) == "ssl" {
+			continue
+		}
+		paths = append(paths, path)
+	}
+
+	inputs := map[string]bool{}
+	moduleNames := map[string]bool{}
+	for _, path := range paths {
+		files, err := listFilesE(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			relativePath, err := filepath.Rel(rootDir, file)
+			if err != nil {
+				return nil, err
+			}
+			if inputs[relativePath] {
+				continue
+			}
+			inputs[relativePath] = true
+
+			contents, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			for _, moduleName := range installedModuleRegexp.FindAllString(string(contents), -1) {
+				moduleNames[moduleName] = true
+			}
+		}
+	}
+
+	for moduleName := range moduleNames {
+		// Modules of other repos, such as install-open-jdk, aren't in this one
+		moduleDir := filepath.Join(rootDir, "modules", moduleName)
+		if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
+			continue
+		}
+		files, err := listFilesE(moduleDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			relativePath, err := filepath.Rel(rootDir, file)
+			if err != nil {
+				return nil, err
+			}
+			inputs[relativePath] = true
+		}
+	}
+
+	sorted := []string{}
+	for input := range inputs {
+		sorted = append(sorted, input)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// listFilesE returns the path if it is a file, or the regular files under it if it is a folder. Paths that don't
+// exist, such as the ssl folder before the tests generate it, have no files.
+func listFilesE(path string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, file)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// findRepoRootE returns the closest parent folder of the path with a modules folder, which works both in the repo and
+// in the copies test_structure.CopyTerraformFolderToTemp makes
+func findRepoRootE(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for dir := filepath.Dir(absPath); ; dir = filepath.Dir(dir) {
+		if info, err := os.Stat(filepath.Join(dir, "modules")); err == nil && info.IsDir() {
+			return dir, nil
+		}
+		if dir == filepath.Dir(dir) {
+			return "", fmt.Errorf("Found no modules folder above %s", path)
+		}
+	}
+}
+
+// findCachedAmiE returns the newest available AMI in the region tagged with the cache key that is young enough to
+// reuse, or an empty string if there is none
+func findCachedAmiE(t *testing.T, awsRegion string, cacheKey string) (string, error) {
+	client, err := defaultAwsClients.ec2ClientE(awsRegion)
+	if err != nil {
+		return "", err
+	}
+	output, err := client.DescribeImages(&ec2.DescribeImagesInput{
+		Owners: awsgo.StringSlice([]string{"self"}),
+		Filters: []*ec2.Filter{
+			{Name: awsgo.String(fmt.Sprintf("tag:%s", AMI_CACHE_TAG_KEY)), Values: awsgo.StringSlice([]string{cacheKey})},
+			{Name: awsgo.String("state"), Values: awsgo.StringSlice([]string{ec2.ImageStateAvailable})},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return newestReusableAmi(output.Images, time.Now()), nil
+}
+
+// newestReusableAmi returns the ID of the newest of the images younger than AMI_CACHE_REUSE_MAX_AGE
+func newestReusableAmi(images []*ec2.Image, now time.Time) string {
+	newestId := ""
+	var newestCreatedAt time.Time
+	for _, image := range images {
+		createdAt, err := time.Parse(time.RFC3339, awsgo.StringValue(image.CreationDate))
+		if err != nil || now.Sub(createdAt) > AMI_CACHE_REUSE_MAX_AGE {
+			continue
+		}
+		if newestId == "" || createdAt.After(newestCreatedAt) {
+			newestId = awsgo.StringValue(image.ImageId)
+			newestCreatedAt = createdAt
+		}
+	}
+	return newestId
+}
+
+// lookUpCachedAmi returns the cache key of the build and the cached AMI for it, if any. Failing to compute the key or
+// to look the AMI up only means building it.
+func lookUpCachedAmi(t *testing.T, templatePath string, builderName string, awsRegion string, vars map[string]string) (string, string) {
+	if amiCacheDisabled() {
+		return "", ""
+	}
+
+	cacheKey, err := amiCacheKeyE(templatePath, builderName, vars)
+	if err != nil {
+		logger.Logf(t, "Failed to compute the AMI cache key of %s %s, so it won't be cached: %v", templatePath, builderName, err)
+		return "", ""
+	}
+
+	amiId, err := findCachedAmiE(t, awsRegion, cacheKey)
+	if err != nil {
+		logger.Logf(t, "Failed to look up cached AMI %s in %s: %v", cacheKey, awsRegion, err)
+		return cacheKey, ""
+	}
+	return cacheKey, amiId
+}
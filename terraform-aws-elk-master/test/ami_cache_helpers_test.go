@@ -0,0 +1,121 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineAmiCacheKey(t *testing.T) {
+	t.Parallel()
+
+	rootDir, err := ioutil.TempDir("", "ami-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(rootDir)
+
+	files := map[string]string{
+		"examples/elk-amis/foo/foo.json":             `{"provisioners": [{"source": "{{template_dir}}/config"}, {"source": "{{template_dir}}/../ssl"}, {"source": "{{template_dir}}/../bar/bar-install-steps.sh"}]}`,
+		"examples/elk-amis/foo/config/foo.yml":       "foo: true",
+		"examples/elk-amis/bar/bar-install-steps.sh": "gruntwork-install --module-name 'install-foo'; gruntwork-install --module-name 'run-foo'; gruntwork-install --module-name 'install-open-jdk'",
+		"examples/elk-amis/bar/unrelated.sh":         "bar",
+		"examples/elk-amis/ssl/foo.keystore.jks":     "keystore",
+		"modules/install-foo/install-foo":            "install foo",
+		"modules/run-foo/run-foo":                    "run foo",
+		"modules/install-other/install-other":        "install other",
+	}
+	for name, contents := range files {
+		writeAmiCacheTestFile(t, rootDir, name, contents)
+	}
+
+	templatePath := filepath.Join(rootDir, "examples/elk-amis/foo/foo.json")
+	vars := map[string]string{"aws_region": "us-east-1", "instance_type": "t3.small", "use_ssl": "false", "module_branch": "master"}
+
+	inputs, err := amiCacheInputsE(rootDir, templatePath, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"examples/elk-amis/bar/bar-install-steps.sh",
+		"examples/elk-amis/foo/config/foo.yml",
+		"examples/elk-amis/foo/foo.json",
+		"modules/install-foo/install-foo",
+		"modules/run-foo/run-foo",
+	}, inputs)
+
+	key := func(builderName string, vars map[string]string) string {
+		cacheKey, err := amiCacheKeyE(templatePath, builderName, vars)
+		require.NoError(t, err)
+		return cacheKey
+	}
+	withVar := func(name string, value string) map[string]string {
+		changed := map[string]string{}
+		for varName, varValue := range vars {
+			changed[varName] = varValue
+		}
+		changed[name] = value
+		return changed
+	}
+
+	original := key("foo-ubuntu", vars)
+	assert.Equal(t, original, key("foo-ubuntu", vars), "The key is stable")
+	assert.NotEqual(t, original, key("foo-amazon-linux", vars), "The builder is part of the key")
+	assert.Equal(t, original, key("foo-ubuntu", withVar("aws_region", "eu-west-1")), "The region isn't part of the key")
+	assert.NotEqual(t, original, key("foo-ubuntu", withVar("module_branch", "feature")), "Other vars are part of the key")
+
+	writeAmiCacheTestFile(t, rootDir, "modules/install-other/install-other", "changed")
+	writeAmiCacheTestFile(t, rootDir, "examples/elk-amis/bar/unrelated.sh", "changed")
+	writeAmiCacheTestFile(t, rootDir, "examples/elk-amis/ssl/foo.keystore.jks", "new keystore")
+	assert.Equal(t, original, key("foo-ubuntu", vars), "Files the template doesn't use and the keystores without SSL aren't part of the key")
+
+	sslKey := key("foo-ubuntu", withVar("use_ssl", "true"))
+	writeAmiCacheTestFile(t, rootDir, "examples/elk-amis/ssl/foo.keystore.jks", "newer keystore")
+	assert.NotEqual(t, sslKey, key("foo-ubuntu", withVar("use_ssl", "true")), "The keystores are part of the key with SSL")
+
+	writeAmiCacheTestFile(t, rootDir, "modules/run-foo/run-foo", "changed")
+	assert.NotEqual(t, original, key("foo-ubuntu", vars), "The installed modules are part of the key")
+}
+
+func TestOfflineAmiCacheInputsOfRepoTemplates(t *testing.T) {
+	t.Parallel()
+
+	templatePath := filepath.Join("..", "examples", "elk-amis", "elasticsearch", "elasticsearch.json")
+	rootDir, err := findRepoRootE(templatePath)
+	require.NoError(t, err)
+
+	inputs, err := amiCacheInputsE(rootDir, templatePath, false)
+	require.NoError(t, err)
+	assert.Contains(t, inputs, "examples/elk-amis/elasticsearch/elasticsearch-install-steps.sh")
+	assert.Contains(t, inputs, "modules/install-elasticsearch/install.sh")
+	assert.Contains(t, inputs, "modules/run-elasticsearch/install.sh")
+	for _, input := range inputs {
+		assert.NotContains(t, input, "modules/install-logstash", "The Elasticsearch AMI doesn't install Logstash")
+	}
+}
+
+func TestOfflineNewestReusableAmi(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 6, 10, 0, 0, 0, 0, time.UTC)
+	image := func(id string, createdAt time.Time) *ec2.Image {
+		return &ec2.Image{ImageId: awsgo.String(id), CreationDate: awsgo.String(createdAt.Format("2006-01-02T15:04:05.000Z"))}
+	}
+
+	assert.Equal(t, "ami-new", newestReusableAmi([]*ec2.Image{
+		image("ami-old", now.Add(-48*time.Hour)),
+		image("ami-new", now.Add(-time.Hour)),
+		image("ami-older", now.Add(-72*time.Hour)),
+	}, now))
+	assert.Equal(t, "", newestReusableAmi([]*ec2.Image{image("ami-expired", now.Add(-AMI_CACHE_REUSE_MAX_AGE-time.Hour))}, now))
+	assert.Equal(t, "", newestReusableAmi(nil, now))
+}
+
+func writeAmiCacheTestFile(t *testing.T, rootDir string, name string, contents string) {
+	path := filepath.Join(rootDir, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+}
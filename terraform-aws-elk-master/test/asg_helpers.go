@@ -0,0 +1,334 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+)
+
+// How the test reaches instances
+const (
+	// Connect to the public IP of the instance
+	INSTANCE_ACCESS_PUBLIC = "public"
+	// Connect to the private IP of the instance, e.g. when the tests run in the same VPC
+	INSTANCE_ACCESS_PRIVATE = "private"
+	// Connect to the private IP of the instance through SSH to a bastion host with a public IP
+	INSTANCE_ACCESS_BASTION = "bastion"
+)
+
+// AsgInstance is an instance of an Auto Scaling Group
+type AsgInstance struct {
+	InstanceId       string
+	AvailabilityZone string
+	PrivateIp        string
+	// Empty if the instance runs in a private subnet
+	PublicIp       string
+	LifecycleState string
+	HealthStatus   string
+}
+
+// InstanceAccess says how to reach the instances of an ASG
+type InstanceAccess struct {
+	// One of the INSTANCE_ACCESS_* consts
+	Mode string
+	// The host to hop through when Mode is INSTANCE_ACCESS_BASTION
+	Bastion *ssh.Host
+}
+
+// The access all tests used before private subnets were supported
+var publicInstanceAccess = InstanceAccess{Mode: INSTANCE_ACCESS_PUBLIC}
+
+// addressE returns the IP to connect to the instance at. For INSTANCE_ACCESS_BASTION, that is the private IP, which is
+// only reachable through the bastion host.
+func (access InstanceAccess) addressE(instance AsgInstance) (string, error) {
+	switch access.Mode {
+	case INSTANCE_ACCESS_PUBLIC:
+		if instance.PublicIp == "" {
+			return "", fmt.Errorf("Instance %s in %s has no public IP. Use private or bastion access for instances in private subnets.", instance.InstanceId, instance.AvailabilityZone)
+		}
+		return instance.PublicIp, nil
+	case INSTANCE_ACCESS_PRIVATE:
+		return instance.PrivateIp, nil
+	case INSTANCE_ACCESS_BASTION:
+		if access.Bastion == nil {
+			return "", fmt.Errorf("Bastion access to instance %s requires a bastion host", instance.InstanceId)
+		}
+		return instance.PrivateIp, nil
+	default:
+		return "", fmt.Errorf("Unknown instance access mode %q", access.Mode)
+	}
+}
+
+// sshHostE returns the SSH connection details of the instance. Use checkSshCommandE to run commands on it, which
+// routes through the bastion host if needed.
+func (access InstanceAccess) sshHostE(instance AsgInstance, username string, keyPair *ssh.KeyPair) (ssh.Host, error) {
+	address, err := access.addressE(instance)
+	if err != nil {
+		return ssh.Host{}, err
+	}
+	return ssh.Host{Hostname: address, SshUserName: username, SshKeyPair: keyPair}, nil
+}
+
+// checkSshCommandE runs command on host, hopping through the bastion host for INSTANCE_ACCESS_BASTION
+func (access InstanceAccess) checkSshCommandE(t *testing.T, host ssh.Host, command string) (string, error) {
+	if access.Mode == INSTANCE_ACCESS_BASTION {
+		return ssh.CheckPrivateSshConnectionE(t, *access.Bastion, host, command)
+	}
+	return ssh.CheckSshCommandE(t, host, command)
+}
+
+// ASGDescriber is the part of the Auto Scaling API the ASG helpers use, so tests can replace it with a fake
+type ASGDescriber interface {
+	DescribeAutoScalingGroupsWithContext(ctx awsgo.Context, input *autoscaling.DescribeAutoScalingGroupsInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+}
+
+// InstanceDescriber is the part of the EC2 API the ASG helpers use, so tests can replace it with a fake
+type InstanceDescriber interface {
+	DescribeInstancesWithContext(ctx awsgo.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error)
+}
+
+// waitForAsgInstances waits until the ASG has as many healthy instances in service as its desired capacity and
+// returns them, sorted by instance id
+func waitForAsgInstances(t *testing.T, awsRegion string, asgName string) []AsgInstance {
+	asgClient, err := defaultAwsClients.asgClientE(awsRegion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec2Client, err := defaultAwsClients.ec2ClientE(awsRegion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var instances []AsgInstance
+	waitFor(t, asgWaitBudget, fmt.Sprintf("Auto Scaling Group %s to reach its desired capacity", asgName), func(ctx context.Context) error {
+		var err error
+		instances, err = getAsgInstancesE(ctx, asgClient, ec2Client, asgName)
+		return err
+	})
+
+	logger.Logf(t, "Auto Scaling Group %s has %d instances in service: %v", asgName, len(instances), instances)
+	return instances
+}
+
+// getAsgInstancesE returns the instances of the ASG, or an error if fewer than its desired capacity are in service
+// and healthy
+func getAsgInstancesE(ctx context.Context, asgClient ASGDescriber, ec2Client InstanceDescriber, asgName string) ([]AsgInstance, error) {
+	group, err := describeAsgE(ctx, asgClient, asgName)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceIds, err := inServiceAsgInstanceIdsE(group)
+	if err != nil {
+		return nil, err
+	}
+	if len(instanceIds) == 0 {
+		return []AsgInstance{}, nil
+	}
+
+	ec2Instances, err := describeEc2InstancesE(ctx, ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+
+	asgInstances := map[string]*autoscaling.Instance{}
+	for _, asgInstance := range group.Instances {
+		asgInstances[awsgo.StringValue(asgInstance.InstanceId)] = asgInstance
+	}
+
+	instances := []AsgInstance{}
+	for _, instanceId := range instanceIds {
+		ec2Instance, found := ec2Instances[instanceId]
+		if !found {
+			return nil, fmt.Errorf("Instance %s of Auto Scaling Group %s is not visible in EC2 yet", instanceId, asgName)
+		}
+		instances = append(instances, newAsgInstance(asgInstances[instanceId], ec2Instance))
+	}
+
+	return instances, nil
+}
+
+// getAllAsgInstancesE returns every instance of the ASG that EC2 knows about, whatever its state, sorted by instance
+// id. Unlike getAsgInstancesE, it doesn't wait for anything, which suits collecting diagnostics of a broken cluster.
+func getAllAsgInstancesE(ctx context.Context, asgClient ASGDescriber, ec2Client InstanceDescriber, asgName string) ([]AsgInstance, error) {
+	group, err := describeAsgE(ctx, asgClient, asgName)
+	if err != nil {
+		return nil, err
+	}
+	if len(group.Instances) == 0 {
+		return []AsgInstance{}, nil
+	}
+
+	instanceIds := []string{}
+	for _, asgInstance := range group.Instances {
+		instanceIds = append(instanceIds, awsgo.StringValue(asgInstance.InstanceId))
+	}
+
+	ec2Instances, err := describeEc2InstancesE(ctx, ec2Client, instanceIds)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []AsgInstance{}
+	for _, asgInstance := range group.Instances {
+		if ec2Instance, found := ec2Instances[awsgo.StringValue(asgInstance.InstanceId)]; found {
+			instances = append(instances, newAsgInstance(asgInstance, ec2Instance))
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].InstanceId < instances[j].InstanceId })
+
+	return instances, nil
+}
+
+// getAllAsgInstancesInRegionE is getAllAsgInstancesE with the clients of the region
+func getAllAsgInstancesInRegionE(ctx context.Context, awsRegion string, asgName string) ([]AsgInstance, error) {
+	asgClient, err := defaultAwsClients.asgClientE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	ec2Client, err := defaultAwsClients.ec2ClientE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	return getAllAsgInstancesE(ctx, asgClient, ec2Client, asgName)
+}
+
+// describeAsgE returns the ASG with exactly the given name, not one that merely starts with it, such as
+// es-cluster-abc-01 for es-cluster-abc-0
+func describeAsgE(ctx context.Context, asgClient ASGDescriber, asgName string) (*autoscaling.Group, error) {
+	output, err := asgClient.DescribeAutoScalingGroupsWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: awsgo.StringSlice([]string{asgName}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range output.AutoScalingGroups {
+		if awsgo.StringValue(group.AutoScalingGroupName) == asgName {
+			return group, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not find an Auto Scaling Group named %s", asgName)
+}
+
+// getInstanceE returns the instance with the given id, for instances that aren't part of an ASG. Its LifecycleState
+// and HealthStatus are empty.
+func getInstanceE(ctx context.Context, ec2Client InstanceDescriber, instanceId string) (AsgInstance, error) {
+	ec2Instances, err := describeEc2InstancesE(ctx, ec2Client, []string{instanceId})
+	if err != nil {
+		return AsgInstance{}, err
+	}
+	ec2Instance, found := ec2Instances[instanceId]
+	if !found {
+		return AsgInstance{}, fmt.Errorf("Could not find an instance with id %s", instanceId)
+	}
+
+	instance := AsgInstance{
+		InstanceId: instanceId,
+		PrivateIp:  awsgo.StringValue(ec2Instance.PrivateIpAddress),
+		PublicIp:   awsgo.StringValue(ec2Instance.PublicIpAddress),
+	}
+	if ec2Instance.Placement != nil {
+		instance.AvailabilityZone = awsgo.StringValue(ec2Instance.Placement.AvailabilityZone)
+	}
+	return instance, nil
+}
+
+// getInstanceInRegionE is getInstanceE with the EC2 client of the region
+func getInstanceInRegionE(awsRegion string, instanceId string) (AsgInstance, error) {
+	ec2Client, err := defaultAwsClients.ec2ClientE(awsRegion)
+	if err != nil {
+		return AsgInstance{}, err
+	}
+	return getInstanceE(context.Background(), ec2Client, instanceId)
+}
+
+// describeEc2InstancesE returns the EC2 instances with the given ids, by id
+func describeEc2InstancesE(ctx context.Context, ec2Client InstanceDescriber, instanceIds []string) (map[string]*ec2.Instance, error) {
+	described, err := ec2Client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: awsgo.StringSlice(instanceIds)})
+	if err != nil {
+		return nil, err
+	}
+
+	ec2Instances := map[string]*ec2.Instance{}
+	for _, reservation := range described.Reservations {
+		for _, instance := range reservation.Instances {
+			ec2Instances[awsgo.StringValue(instance.InstanceId)] = instance
+		}
+	}
+	return ec2Instances, nil
+}
+
+// inServiceAsgInstanceIdsE returns the ids of the healthy instances in service, sorted, or an error if there are
+// fewer of those than the desired capacity of the group
+func inServiceAsgInstanceIdsE(group *autoscaling.Group) ([]string, error) {
+	instanceIds := []string{}
+	for _, instance := range group.Instances {
+		if isInServiceAndHealthy(instance) {
+			instanceIds = append(instanceIds, awsgo.StringValue(instance.InstanceId))
+		}
+	}
+	sort.Strings(instanceIds)
+
+	desired := int(awsgo.Int64Value(group.DesiredCapacity))
+	if len(instanceIds) < desired {
+		return nil, fmt.Errorf("Auto Scaling Group %s has %d of %d instances in service and healthy", awsgo.StringValue(group.AutoScalingGroupName), len(instanceIds), desired)
+	}
+	return instanceIds, nil
+}
+
+func isInServiceAndHealthy(instance *autoscaling.Instance) bool {
+	return awsgo.StringValue(instance.LifecycleState) == autoscaling.LifecycleStateInService &&
+		awsgo.StringValue(instance.HealthStatus) == "Healthy"
+}
+
+func newAsgInstance(asgInstance *autoscaling.Instance, ec2Instance *ec2.Instance) AsgInstance {
+	return AsgInstance{
+		InstanceId:       awsgo.StringValue(asgInstance.InstanceId),
+		AvailabilityZone: awsgo.StringValue(asgInstance.AvailabilityZone),
+		PrivateIp:        awsgo.StringValue(ec2Instance.PrivateIpAddress),
+		PublicIp:         awsgo.StringValue(ec2Instance.PublicIpAddress),
+		LifecycleState:   awsgo.StringValue(asgInstance.LifecycleState),
+		HealthStatus:     awsgo.StringValue(asgInstance.HealthStatus),
+	}
+}
+
+// getAddressesForAsg waits for the ASG to reach its desired capacity and returns the address of each instance
+func getAddressesForAsg(t *testing.T, awsRegion string, asgName string, access InstanceAccess) []string {
+	addresses, err := instanceAddressesE(waitForAsgInstances(t, awsRegion, asgName), access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addresses
+}
+
+// instanceAddressesE returns the address to connect to each instance at
+func instanceAddressesE(instances []AsgInstance, access InstanceAccess) ([]string, error) {
+	addresses := []string{}
+	for _, instance := range instances {
+		address, err := access.addressE(instance)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// getIPForInstanceInAsg returns the public IP of the first instance of the ASG, waiting for the ASG to reach its
+// desired capacity first. Use getAddressesForAsg for every instance or for instances in private subnets.
+func getIPForInstanceInAsg(t *testing.T, asgName string, terraformOptions *terraform.Options) string {
+	addresses := getAddressesForAsg(t, terraformOptions.Vars["aws_region"].(string), asgName, publicInstanceAccess)
+	if len(addresses) == 0 {
+		t.Fatalf("Auto Scaling Group %s has no instances", asgName)
+	}
+	return addresses[0]
+}
@@ -0,0 +1,280 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAsgInstance(instanceId string, lifecycleState string, healthStatus string) *autoscaling.Instance {
+	return &autoscaling.Instance{
+		InstanceId:       awsgo.String(instanceId),
+		AvailabilityZone: awsgo.String("us-east-1a"),
+		LifecycleState:   awsgo.String(lifecycleState),
+		HealthStatus:     awsgo.String(healthStatus),
+	}
+}
+
+func TestOfflineInServiceAsgInstanceIds(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name            string
+		desiredCapacity int64
+		instances       []*autoscaling.Instance
+		expectedIds     []string
+		expectError     bool
+	}{
+		{
+			"all in service",
+			2,
+			[]*autoscaling.Instance{
+				newTestAsgInstance("i-2", autoscaling.LifecycleStateInService, "Healthy"),
+				newTestAsgInstance("i-1", autoscaling.LifecycleStateInService, "Healthy"),
+			},
+			[]string{"i-1", "i-2"},
+			false,
+		},
+		{
+			"one pending",
+			2,
+			[]*autoscaling.Instance{
+				newTestAsgInstance("i-1", autoscaling.LifecycleStateInService, "Healthy"),
+				newTestAsgInstance("i-2", autoscaling.LifecycleStatePending, "Healthy"),
+			},
+			nil,
+			true,
+		},
+		{
+			"one unhealthy",
+			2,
+			[]*autoscaling.Instance{
+				newTestAsgInstance("i-1", autoscaling.LifecycleStateInService, "Healthy"),
+				newTestAsgInstance("i-2", autoscaling.LifecycleStateInService, "Unhealthy"),
+			},
+			nil,
+			true,
+		},
+		{
+			"terminating instance beyond desired capacity",
+			1,
+			[]*autoscaling.Instance{
+				newTestAsgInstance("i-1", autoscaling.LifecycleStateTerminating, "Unhealthy"),
+				newTestAsgInstance("i-2", autoscaling.LifecycleStateInService, "Healthy"),
+			},
+			[]string{"i-2"},
+			false,
+		},
+		{
+			"scaled to zero",
+			0,
+			[]*autoscaling.Instance{},
+			[]string{},
+			false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			group := &autoscaling.Group{
+				AutoScalingGroupName: awsgo.String("es-cluster"),
+				DesiredCapacity:      awsgo.Int64(testCase.desiredCapacity),
+				Instances:            testCase.instances,
+			}
+
+			instanceIds, err := inServiceAsgInstanceIdsE(group)
+			if testCase.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedIds, instanceIds)
+		})
+	}
+}
+
+func TestOfflineInstanceAccessAddress(t *testing.T) {
+	t.Parallel()
+
+	bastion := &ssh.Host{Hostname: "203.0.113.10", SshUserName: "ubuntu"}
+	publicInstance := AsgInstance{InstanceId: "i-1", AvailabilityZone: "us-east-1a", PrivateIp: "10.0.1.5", PublicIp: "203.0.113.5"}
+	privateInstance := AsgInstance{InstanceId: "i-2", AvailabilityZone: "us-east-1b", PrivateIp: "10.0.2.5"}
+
+	testCases := []struct {
+		name            string
+		access          InstanceAccess
+		instance        AsgInstance
+		expectedAddress string
+		expectError     bool
+	}{
+		{"public", publicInstanceAccess, publicInstance, "203.0.113.5", false},
+		{"public without public IP", publicInstanceAccess, privateInstance, "", true},
+		{"private", InstanceAccess{Mode: INSTANCE_ACCESS_PRIVATE}, publicInstance, "10.0.1.5", false},
+		{"bastion", InstanceAccess{Mode: INSTANCE_ACCESS_BASTION, Bastion: bastion}, privateInstance, "10.0.2.5", false},
+		{"bastion without host", InstanceAccess{Mode: INSTANCE_ACCESS_BASTION}, privateInstance, "", true},
+		{"unknown mode", InstanceAccess{Mode: "vpn"}, publicInstance, "", true},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			address, err := testCase.access.addressE(testCase.instance)
+			if testCase.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedAddress, address)
+
+			host, err := testCase.access.sshHostE(testCase.instance, "ubuntu", nil)
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedAddress, host.Hostname)
+		})
+	}
+}
+
+func newTestEc2Instance(instanceId string, privateIp string, publicIp string) *ec2.Instance {
+	instance := &ec2.Instance{InstanceId: awsgo.String(instanceId), PrivateIpAddress: awsgo.String(privateIp)}
+	if publicIp != "" {
+		instance.PublicIpAddress = awsgo.String(publicIp)
+	}
+	return instance
+}
+
+func TestOfflineGetAsgInstances(t *testing.T) {
+	t.Parallel()
+
+	groups := []*autoscaling.Group{
+		{
+			AutoScalingGroupName: awsgo.String("es-cluster-abc-0"),
+			DesiredCapacity:      awsgo.Int64(2),
+			Instances: []*autoscaling.Instance{
+				newTestAsgInstance("i-2", autoscaling.LifecycleStateInService, "Healthy"),
+				newTestAsgInstance("i-1", autoscaling.LifecycleStateInService, "Healthy"),
+			},
+		},
+		{
+			AutoScalingGroupName: awsgo.String("es-cluster-abc-01"),
+			DesiredCapacity:      awsgo.Int64(1),
+			Instances:            []*autoscaling.Instance{newTestAsgInstance("i-3", autoscaling.LifecycleStateInService, "Healthy")},
+		},
+		{
+			AutoScalingGroupName: awsgo.String("es-cluster-private"),
+			DesiredCapacity:      awsgo.Int64(1),
+			Instances:            []*autoscaling.Instance{newTestAsgInstance("i-4", autoscaling.LifecycleStateInService, "Healthy")},
+		},
+		{
+			AutoScalingGroupName: awsgo.String("es-cluster-launching"),
+			DesiredCapacity:      awsgo.Int64(1),
+			Instances:            []*autoscaling.Instance{newTestAsgInstance("i-5", autoscaling.LifecycleStateInService, "Healthy")},
+		},
+	}
+	instances := []*ec2.Instance{
+		newTestEc2Instance("i-1", "10.0.1.1", "203.0.113.1"),
+		newTestEc2Instance("i-2", "10.0.1.2", "203.0.113.2"),
+		newTestEc2Instance("i-3", "10.0.1.3", "203.0.113.3"),
+		newTestEc2Instance("i-4", "10.0.1.4", ""),
+	}
+
+	testCases := []struct {
+		name              string
+		asgName           string
+		asgErr            error
+		ec2Err            error
+		expectedAddresses []string
+		expectedError     string
+	}{
+		{"sorted by instance id", "es-cluster-abc-0", nil, nil, []string{"203.0.113.1", "203.0.113.2"}, ""},
+		{"several ASGs with the same name prefix", "es-cluster-abc-01", nil, nil, []string{"203.0.113.3"}, ""},
+		{"no such ASG", "es-cluster-abc", nil, nil, nil, "Could not find an Auto Scaling Group named es-cluster-abc"},
+		{"missing public IP", "es-cluster-private", nil, nil, nil, "Instance i-4 in us-east-1a has no public IP"},
+		{"instance not in EC2 yet", "es-cluster-launching", nil, nil, nil, "Instance i-5 of Auto Scaling Group es-cluster-launching is not visible in EC2 yet"},
+		{"Auto Scaling API error", "es-cluster-abc-0", errors.New("Throttling: Rate exceeded"), nil, nil, "Throttling"},
+		{"EC2 API error", "es-cluster-abc-0", nil, errors.New("UnauthorizedOperation"), nil, "UnauthorizedOperation"},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			asgClient := &FakeAsgDescriber{Groups: groups, Err: testCase.asgErr}
+			ec2Client := &FakeInstanceDescriber{Instances: instances, Err: testCase.ec2Err}
+
+			asgInstances, err := getAsgInstancesE(context.Background(), asgClient, ec2Client, testCase.asgName)
+			var addresses []string
+			if err == nil {
+				addresses, err = instanceAddressesE(asgInstances, publicInstanceAccess)
+			}
+			if testCase.expectedError != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), testCase.expectedError)
+				}
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedAddresses, addresses)
+		})
+	}
+}
+
+func TestOfflineGetAllAsgInstances(t *testing.T) {
+	t.Parallel()
+
+	asgClient := &FakeAsgDescriber{Groups: []*autoscaling.Group{{
+		AutoScalingGroupName: awsgo.String("es-cluster"),
+		DesiredCapacity:      awsgo.Int64(3),
+		Instances: []*autoscaling.Instance{
+			newTestAsgInstance("i-3", autoscaling.LifecycleStateTerminating, "Unhealthy"),
+			newTestAsgInstance("i-1", autoscaling.LifecycleStatePending, "Healthy"),
+			newTestAsgInstance("i-2", autoscaling.LifecycleStateInService, "Healthy"),
+		},
+	}}}
+	ec2Client := &FakeInstanceDescriber{Instances: []*ec2.Instance{
+		newTestEc2Instance("i-1", "10.0.1.1", ""),
+		newTestEc2Instance("i-2", "10.0.1.2", "203.0.113.2"),
+	}}
+
+	instances, err := getAllAsgInstancesE(context.Background(), asgClient, ec2Client, "es-cluster")
+	require.NoError(t, err)
+	assert.Equal(t, []AsgInstance{
+		{InstanceId: "i-1", AvailabilityZone: "us-east-1a", PrivateIp: "10.0.1.1", LifecycleState: autoscaling.LifecycleStatePending, HealthStatus: "Healthy"},
+		{InstanceId: "i-2", AvailabilityZone: "us-east-1a", PrivateIp: "10.0.1.2", PublicIp: "203.0.113.2", LifecycleState: autoscaling.LifecycleStateInService, HealthStatus: "Healthy"},
+	}, instances, "Instances EC2 doesn't know about are left out")
+}
+
+func TestOfflineGetInstance(t *testing.T) {
+	t.Parallel()
+
+	ec2Instance := newTestEc2Instance("i-1", "10.0.1.1", "203.0.113.1")
+	ec2Instance.Placement = &ec2.Placement{AvailabilityZone: awsgo.String("us-east-1b")}
+	ec2Client := &FakeInstanceDescriber{Instances: []*ec2.Instance{ec2Instance}}
+
+	instance, err := getInstanceE(context.Background(), ec2Client, "i-1")
+	require.NoError(t, err)
+	assert.Equal(t, AsgInstance{InstanceId: "i-1", AvailabilityZone: "us-east-1b", PrivateIp: "10.0.1.1", PublicIp: "203.0.113.1"}, instance)
+
+	_, err = getInstanceE(context.Background(), ec2Client, "i-2")
+	assert.EqualError(t, err, "Could not find an instance with id i-2")
+}
@@ -0,0 +1,132 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/gruntwork-io/terratest/modules/aws"
+)
+
+// The env var that points the helpers at another AWS API endpoint, e.g. http://localhost:4566 for LocalStack
+const AWS_ENDPOINT_ENV_VAR = "AWS_ENDPOINT_URL"
+
+// The credentials the helpers sign requests to a custom endpoint with if there are none in the environment. LocalStack
+// accepts any.
+const AWS_ENDPOINT_FALLBACK_CREDENTIALS = "test"
+
+// AwsClients creates the AWS API clients of the helpers. It builds one session per region and reuses it for every
+// client, rather than a session per call.
+type AwsClients struct {
+	// The AWS API endpoint to send every request to, instead of the one of each service. Empty for real AWS.
+	Endpoint string
+
+	mutex    sync.Mutex
+	sessions map[string]*session.Session
+}
+
+// The clients of the helpers that don't take an AwsClients. Set AWS_ENDPOINT_URL to point them at e.g. LocalStack.
+var defaultAwsClients = newAwsClients(os.Getenv(AWS_ENDPOINT_ENV_VAR))
+
+func newAwsClients(endpoint string) *AwsClients {
+	return &AwsClients{Endpoint: endpoint, sessions: map[string]*session.Session{}}
+}
+
+// sessionE returns the session of the region. For real AWS, it is an authenticated terratest session, which assumes
+// TERRATEST_IAM_ROLE if set.
+func (clients *AwsClients) sessionE(awsRegion string) (*session.Session, error) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	if sess, ok := clients.sessions[awsRegion]; ok {
+		return sess, nil
+	}
+
+	sess, err := clients.newSessionE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	clients.sessions[awsRegion] = sess
+	return sess, nil
+}
+
+func (clients *AwsClients) newSessionE(awsRegion string) (*session.Session, error) {
+	if clients.Endpoint == "" {
+		return aws.NewAuthenticatedSession(awsRegion)
+	}
+
+	sess, err := session.NewSession(&awsgo.Config{
+		Region:   awsgo.String(awsRegion),
+		Endpoint: awsgo.String(clients.Endpoint),
+		// Emulators serve every bucket on the one endpoint, rather than on a subdomain per bucket
+		S3ForcePathStyle: awsgo.Bool(true),
+		Credentials: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvProvider{},
+			&credentials.StaticProvider{Value: credentials.Value{
+				AccessKeyID:     AWS_ENDPOINT_FALLBACK_CREDENTIALS,
+				SecretAccessKey: AWS_ENDPOINT_FALLBACK_CREDENTIALS,
+			}},
+		}),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create an AWS session for endpoint %s: %v", clients.Endpoint, err)
+	}
+	return sess, nil
+}
+
+func (clients *AwsClients) s3ClientE(awsRegion string) (*s3.S3, error) {
+	sess, err := clients.sessionE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+func (clients *AwsClients) cloudWatchLogsClientE(awsRegion string) (*cloudwatchlogs.CloudWatchLogs, error) {
+	sess, err := clients.sessionE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	return cloudwatchlogs.New(sess), nil
+}
+
+func (clients *AwsClients) ec2ClientE(awsRegion string) (*ec2.EC2, error) {
+	sess, err := clients.sessionE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	return ec2.New(sess), nil
+}
+
+func (clients *AwsClients) asgClientE(awsRegion string) (*autoscaling.AutoScaling, error) {
+	sess, err := clients.sessionE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	return autoscaling.New(sess), nil
+}
+
+func (clients *AwsClients) elbv2ClientE(awsRegion string) (*elbv2.ELBV2, error) {
+	sess, err := clients.sessionE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	return elbv2.New(sess), nil
+}
+
+func (clients *AwsClients) secretsManagerClientE(awsRegion string) (*secretsmanager.SecretsManager, error) {
+	sess, err := clients.sessionE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	return secretsmanager.New(sess), nil
+}
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineAwsClientsCacheSessionsPerRegion(t *testing.T) {
+	t.Parallel()
+
+	clients := newAwsClients("http://127.0.0.1:4566")
+
+	first, err := clients.sessionE("us-east-1")
+	require.NoError(t, err)
+	again, err := clients.sessionE("us-east-1")
+	require.NoError(t, err)
+	other, err := clients.sessionE("eu-west-1")
+	require.NoError(t, err)
+
+	assert.Same(t, first, again)
+	assert.NotSame(t, first, other)
+
+	s3Client, err := clients.s3ClientE("eu-west-1")
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:4566", s3Client.Endpoint)
+	assert.Equal(t, "eu-west-1", *s3Client.Config.Region)
+	assert.True(t, *s3Client.Config.S3ForcePathStyle)
+}
+
+// A request received by the stub AWS endpoint of the tests below
+type stubAwsRequest struct {
+	Method string
+	Path   string
+	Target string
+	Body   string
+	Signed bool
+}
+
+func TestOfflineAwsHelpersUseCustomEndpoint(t *testing.T) {
+	t.Parallel()
+
+	var mutex sync.Mutex
+	requests := []stubAwsRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		requests = append(requests, stubAwsRequest{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Target: r.Header.Get("X-Amz-Target"),
+			Body:   string(body),
+			Signed: r.Header.Get("Authorization") != "",
+		})
+		mutex.Unlock()
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "Logs_20140328.CreateLogStream":
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			w.Write([]byte(`{}`))
+		case "Logs_20140328.PutLogEvents":
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			w.Write([]byte(`{"nextSequenceToken": "43"}`))
+		}
+	}))
+	defer server.Close()
+
+	clients := newAwsClients(server.URL)
+
+	key, err := writeContentToS3BucketE(clients, "logs-bucket", "a log line", "us-east-1")
+	require.NoError(t, err)
+	require.NoError(t, deleteObjectFromS3BucketE(clients, "logs-bucket", key, "us-east-1"))
+	logsClient, err := clients.cloudWatchLogsClientE("us-east-1")
+	require.NoError(t, err)
+	written, err := writeLogEventsE(t, context.Background(), logsClient, cloudWatchLogsWaitBudget, LogEventsOptions{
+		LogGroup: "log-group",
+		Content:  "a log event",
+		Count:    1,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, requests, 4)
+	for _, request := range requests {
+		assert.True(t, request.Signed, "%s %s is signed", request.Method, request.Path)
+	}
+
+	assert.Equal(t, stubAwsRequest{Method: http.MethodPut, Path: "/logs-bucket/" + key, Body: "a log line", Signed: true}, requests[0])
+	assert.Equal(t, http.MethodDelete, requests[1].Method)
+	assert.Equal(t, "/logs-bucket/"+key, requests[1].Path)
+
+	var putLogEvents struct {
+		LogGroupName  string
+		LogStreamName string
+		SequenceToken string
+		LogEvents     []struct{ Message string }
+	}
+	assert.Equal(t, "Logs_20140328.CreateLogStream", requests[2].Target)
+	assert.Equal(t, "Logs_20140328.PutLogEvents", requests[3].Target)
+	require.NoError(t, json.Unmarshal([]byte(requests[3].Body), &putLogEvents))
+	assert.Equal(t, "log-group", putLogEvents.LogGroupName)
+	assert.Equal(t, written.LogStream, putLogEvents.LogStreamName)
+	assert.Empty(t, putLogEvents.SequenceToken)
+	if assert.Len(t, putLogEvents.LogEvents, 1) {
+		assert.Equal(t, written.Messages[0], putLogEvents.LogEvents[0].Message)
+	}
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// This test runs the helpers that feed the S3 and CloudWatch Logs inputs of the Logstash pipeline, and the Secrets
+// Manager helpers, against a LocalStack container, so they can be checked without an AWS account. It needs Docker. No
+// Logstash reads from LocalStack, so whether the pipeline picks the data up is only checked by TestELKEndToEnd.
+
+const LOCALSTACK_TEST_REGION = "us-east-1"
+
+func TestLocalDockerAwsHelpersWithLocalStack(t *testing.T) {
+	t.Parallel()
+
+	localStack := startLocalStack(t, []string{"s3", "logs", "secretsmanager"})
+	defer localStack.Close(t)
+	clients := localStack.Clients
+
+	uniqueId := strings.ToLower(random.UniqueId())
+
+	t.Run("S3", func(t *testing.T) {
+		s3Client, err := clients.s3ClientE(LOCALSTACK_TEST_REGION)
+		require.NoError(t, err)
+
+		bucket := fmt.Sprintf("cloudtrail-%s", uniqueId)
+		_, err = s3Client.CreateBucket(&s3.CreateBucketInput{Bucket: awsgo.String(bucket)})
+		require.NoError(t, err)
+
+		key, err := writeContentToS3BucketE(clients, bucket, "This is a log line_cloudtrail", LOCALSTACK_TEST_REGION)
+		require.NoError(t, err)
+
+		object, err := s3Client.GetObject(&s3.GetObjectInput{Bucket: awsgo.String(bucket), Key: awsgo.String(key)})
+		require.NoError(t, err)
+		defer object.Body.Close()
+		contents, err := ioutil.ReadAll(object.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "This is a log line_cloudtrail", string(contents))
+
+		require.NoError(t, deleteObjectFromS3BucketE(clients, bucket, key, LOCALSTACK_TEST_REGION))
+		objects, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: awsgo.String(bucket)})
+		require.NoError(t, err)
+		assert.Empty(t, objects.Contents)
+
+		logFile, err := writeCloudTrailLogFileE(t, clients, bucket, LOCALSTACK_TEST_REGION, CloudTrailFixtureOptions{Count: CLOUDTRAIL_TEST_RECORDS})
+		require.NoError(t, err)
+
+		object, err = s3Client.GetObject(&s3.GetObjectInput{Bucket: awsgo.String(bucket), Key: awsgo.String(logFile.Key)})
+		require.NoError(t, err)
+		defer object.Body.Close()
+		reader, err := gzip.NewReader(object.Body)
+		require.NoError(t, err)
+		var uploaded CloudTrailLogFile
+		require.NoError(t, json.NewDecoder(reader).Decode(&uploaded))
+		assert.Equal(t, logFile.Records, uploaded.Records)
+	})
+
+	t.Run("CloudWatchLogs", func(t *testing.T) {
+		logsClient, err := clients.cloudWatchLogsClientE(LOCALSTACK_TEST_REGION)
+		require.NoError(t, err)
+
+		logGroup := fmt.Sprintf("elk-%s", uniqueId)
+		_, err = logsClient.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{LogGroupName: awsgo.String(logGroup)})
+		require.NoError(t, err)
+
+		// Small batches, so the sequence token is passed on a few times
+		written, err := writeLogEventsE(t, context.Background(), logsClient, cloudWatchLogsWaitBudget, LogEventsOptions{
+			LogGroup:  logGroup,
+			Content:   "This is a log line_cloudwatch",
+			Count:     CLOUDWATCH_TEST_LOG_EVENTS,
+			BatchSize: 10,
+		})
+		require.NoError(t, err)
+
+		events, err := logsClient.GetLogEvents(&cloudwatchlogs.GetLogEventsInput{
+			LogGroupName:  awsgo.String(logGroup),
+			LogStreamName: awsgo.String(written.LogStream),
+			StartFromHead: awsgo.Bool(true),
+		})
+		require.NoError(t, err)
+		messages := []string{}
+		for _, event := range events.Events {
+			messages = append(messages, awsgo.StringValue(event.Message))
+		}
+		assert.Equal(t, written.Messages, messages)
+	})
+
+	t.Run("SecretsManager", func(t *testing.T) {
+		secretsClient, err := clients.secretsManagerClientE(LOCALSTACK_TEST_REGION)
+		require.NoError(t, err)
+
+		arn, err := createTestSecretE(t, clients, LOCALSTACK_TEST_REGION, "Password for kibana", fmt.Sprintf("Kibana_%s", uniqueId), "password")
+		require.NoError(t, err)
+
+		secret, err := secretsClient.DescribeSecret(&secretsmanager.DescribeSecretInput{SecretId: awsgo.String(arn)})
+		require.NoError(t, err)
+		tags := map[string]string{}
+		for _, tag := range secret.Tags {
+			tags[awsgo.StringValue(tag.Key)] = awsgo.StringValue(tag.Value)
+		}
+		assert.Equal(t, t.Name(), tags[TEST_RESOURCE_TAG_KEY])
+
+		require.NoError(t, deleteTestSecretE(t, clients, LOCALSTACK_TEST_REGION, arn))
+		_, err = secretsClient.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: awsgo.String(arn)})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,301 @@
+package test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/random"
+)
+
+// The port of the beats input of the Logstash pipeline in examples/elk-amis/logstash/config
+const LOGSTASH_BEATS_PORT = 5044
+
+// The frames of the Lumberjack v2 protocol the beats input speaks. Every frame starts with the version byte and a code.
+const (
+	LUMBERJACK_VERSION = '2'
+	// Followed by a uint32: how many events the client sends before waiting for an ACK
+	LUMBERJACK_CODE_WINDOW_SIZE = 'W'
+	// Followed by a uint32 sequence number, a uint32 length and a JSON event of that length
+	LUMBERJACK_CODE_JSON_DATA = 'J'
+	// Followed by a uint32 length and that many bytes of zlib compressed frames
+	LUMBERJACK_CODE_COMPRESSED = 'C'
+	// Followed by a uint32: the sequence number of the last event of the window that the server processed. 0 is a keep
+	// alive.
+	LUMBERJACK_CODE_ACK = 'A'
+)
+
+// How many events a BeatsClient sends before waiting for an ACK, unless the options say otherwise. Filebeat defaults
+// to 2048; a smaller window exercises the ACKs more.
+const BEATS_DEFAULT_WINDOW_SIZE = 100
+
+// How long a BeatsClient waits for each write and ACK, unless the options say otherwise. Logstash sends keep alive
+// ACKs while it processes a window, so this only needs to cover the time between two ACKs.
+const BEATS_DEFAULT_TIMEOUT = 30 * time.Second
+
+// How many events the validate_beats stage sends, in windows of BEATS_TEST_WINDOW_SIZE
+const BEATS_TEST_EVENTS = 25
+const BEATS_TEST_WINDOW_SIZE = 10
+
+// BeatsEvent is a structured event, sent to the beats input as a JSON document
+type BeatsEvent map[string]interface{}
+
+// newBeatsEvent returns an event with the given message and fields, timestamped now
+func newBeatsEvent(message string, fields map[string]interface{}) BeatsEvent {
+	event := BeatsEvent{
+		"@timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		"message":    message,
+	}
+	for key, value := range fields {
+		event[key] = value
+	}
+	return event
+}
+
+// newTestBeatsEvents returns count events with the messages "<content> <uniqueId>-<i>", so that the events of each run
+// can be told apart in the Logstash output
+func newTestBeatsEvents(content string, count int) []BeatsEvent {
+	uniqueId := random.UniqueId()
+	events := []BeatsEvent{}
+	for i := 0; i < count; i++ {
+		events = append(events, newBeatsEvent(fmt.Sprintf("%s %s-%d", content, uniqueId, i), map[string]interface{}{
+			"tags": []string{"terratest-beats"},
+		}))
+	}
+	return events
+}
+
+// beatsLogstashOutputContents returns what the Logstash JSON file output has for the message of each event
+func beatsLogstashOutputContents(events []BeatsEvent) []string {
+	contents := []string{}
+	for _, event := range events {
+		contents = append(contents, fmt.Sprintf("\"message\":\"%v\"", event["message"]))
+	}
+	return contents
+}
+
+// BeatsClientOptions configures how a BeatsClient connects to a beats input and sends events to it
+type BeatsClientOptions struct {
+	// host:port of the beats input
+	Address string
+	// If set, connect with TLS, trusting the CA of the keystore and presenting its certificate if it has one, which the
+	// beats input of the SSL scenarios asks for. The server certificate is verified against ServerName, or the host of
+	// Address if it is empty.
+	KeyStore *keystore
+	// Defaults to BEATS_DEFAULT_WINDOW_SIZE
+	WindowSize int
+	// The zlib level to compress each window with, from 1 (fastest) to 9 (smallest). 0 sends the events uncompressed.
+	CompressionLevel int
+	// Defaults to BEATS_DEFAULT_TIMEOUT
+	Timeout time.Duration
+}
+
+// BeatsClient is a Lumberjack v2 client, which sends events straight to the beats input of Logstash the way Filebeat
+// does
+type BeatsClient struct {
+	Options BeatsClientOptions
+	conn    net.Conn
+}
+
+// BeatsSendError is returned when not every event was ACKed. The events after the first Acked ones may or may not have
+// been processed.
+type BeatsSendError struct {
+	Acked int
+	Err   error
+}
+
+func (err BeatsSendError) Error() string {
+	return fmt.Sprintf("Logstash ACKed %d events before: %v", err.Acked, err.Err)
+}
+
+func (err BeatsSendError) Unwrap() error {
+	return err.Err
+}
+
+// sendBeatsEvents connects to the beats input, sends the events and fails the test unless Logstash ACKs all of them
+func sendBeatsEvents(t *testing.T, options BeatsClientOptions, events []BeatsEvent) {
+	ctx, cancel := testContext(t)
+	defer cancel()
+
+	client, err := dialBeatsE(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.SendE(ctx, events); err != nil {
+		t.Fatalf("Failed to send %d events to the beats input at %s: %v", len(events), options.Address, err)
+	}
+	logger.Logf(t, "Logstash at %s ACKed %d events", options.Address, len(events))
+}
+
+// dialBeatsE connects to the beats input, with TLS if the options have a keystore
+func dialBeatsE(ctx context.Context, options BeatsClientOptions) (*BeatsClient, error) {
+	if options.WindowSize <= 0 {
+		options.WindowSize = BEATS_DEFAULT_WINDOW_SIZE
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = BEATS_DEFAULT_TIMEOUT
+	}
+	if options.CompressionLevel < 0 || options.CompressionLevel > zlib.BestCompression {
+		return nil, fmt.Errorf("Invalid compression level %d. It must be between 0 and %d.", options.CompressionLevel, zlib.BestCompression)
+	}
+
+	var tlsConfig *tls.Config
+	if options.KeyStore != nil {
+		config, err := tlsClientConfigE(options.Address, options.KeyStore.CaFile, options.KeyStore.ServerName, options.KeyStore.CertFile, options.KeyStore.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = config
+	}
+
+	dialer := net.Dialer{Timeout: options.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", options.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to the beats input at %s: %v", options.Address, err)
+	}
+
+	if tlsConfig != nil {
+		tlsConn := tls.Client(conn, tlsConfig)
+		tlsConn.SetDeadline(beatsDeadline(ctx, options.Timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with the beats input at %s failed: %v", options.Address, err)
+		}
+		conn = tlsConn
+	}
+
+	return &BeatsClient{Options: options, conn: conn}, nil
+}
+
+func (client *BeatsClient) Close() error {
+	return client.conn.Close()
+}
+
+// SendE sends the events in windows of WindowSize and waits for Logstash to ACK each window before sending the next.
+// If not every event was ACKed, it returns a BeatsSendError.
+func (client *BeatsClient) SendE(ctx context.Context, events []BeatsEvent) error {
+	acked := 0
+	for start := 0; start < len(events); start += client.Options.WindowSize {
+		end := start + client.Options.WindowSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		windowAcked, err := client.sendWindowE(ctx, events[start:end])
+		acked += windowAcked
+		if err != nil {
+			return BeatsSendError{Acked: acked, Err: err}
+		}
+	}
+	return nil
+}
+
+// sendWindowE writes one window and returns how many of its events were ACKed
+func (client *BeatsClient) sendWindowE(ctx context.Context, events []BeatsEvent) (int, error) {
+	window, err := encodeLumberjackWindowE(events, client.Options.CompressionLevel)
+	if err != nil {
+		return 0, err
+	}
+
+	client.conn.SetWriteDeadline(beatsDeadline(ctx, client.Options.Timeout))
+	if _, err := client.conn.Write(window); err != nil {
+		return 0, fmt.Errorf("Failed to write a window of %d events: %v", len(events), err)
+	}
+
+	// Logstash may ACK part of the window, and sends keep alives while it is busy, so read until the last event is ACKed
+	acked := uint32(0)
+	for acked < uint32(len(events)) {
+		client.conn.SetReadDeadline(beatsDeadline(ctx, client.Options.Timeout))
+		sequence, err := readLumberjackAckE(client.conn)
+		if err != nil {
+			return int(acked), err
+		}
+		if sequence > uint32(len(events)) {
+			return int(acked), fmt.Errorf("Got an ACK for event %d of a window of %d events", sequence, len(events))
+		}
+		if sequence > acked {
+			acked = sequence
+		}
+	}
+	return int(acked), nil
+}
+
+// beatsDeadline returns the deadline of the next read or write: after the timeout, or when ctx expires if sooner
+func beatsDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+// encodeLumberjackWindowE returns the frames of a window: its size, then a JSON data frame per event numbered from 1,
+// compressed into one frame if compressionLevel is above 0
+func encodeLumberjackWindowE(events []BeatsEvent, compressionLevel int) ([]byte, error) {
+	var dataFrames bytes.Buffer
+	for i, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode event %d as JSON: %v", i+1, err)
+		}
+		dataFrames.Write([]byte{LUMBERJACK_VERSION, LUMBERJACK_CODE_JSON_DATA})
+		writeLumberjackUint32(&dataFrames, uint32(i+1))
+		writeLumberjackUint32(&dataFrames, uint32(len(payload)))
+		dataFrames.Write(payload)
+	}
+
+	var window bytes.Buffer
+	window.Write([]byte{LUMBERJACK_VERSION, LUMBERJACK_CODE_WINDOW_SIZE})
+	writeLumberjackUint32(&window, uint32(len(events)))
+
+	if compressionLevel == 0 {
+		window.Write(dataFrames.Bytes())
+		return window.Bytes(), nil
+	}
+
+	var compressed bytes.Buffer
+	writer, err := zlib.NewWriterLevel(&compressed, compressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(dataFrames.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	window.Write([]byte{LUMBERJACK_VERSION, LUMBERJACK_CODE_COMPRESSED})
+	writeLumberjackUint32(&window, uint32(compressed.Len()))
+	window.Write(compressed.Bytes())
+	return window.Bytes(), nil
+}
+
+// readLumberjackAckE reads an ACK frame and returns its sequence number
+func readLumberjackAckE(reader io.Reader) (uint32, error) {
+	frame := make([]byte, 6)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return 0, fmt.Errorf("Failed to read an ACK: %v", err)
+	}
+	if frame[0] != LUMBERJACK_VERSION || frame[1] != LUMBERJACK_CODE_ACK {
+		return 0, fmt.Errorf("Expected an ACK frame but got version %q and code %q", frame[0], frame[1])
+	}
+	return binary.BigEndian.Uint32(frame[2:]), nil
+}
+
+func writeLumberjackUint32(buffer *bytes.Buffer, value uint32) {
+	var encoded [4]byte
+	binary.BigEndian.PutUint32(encoded[:], value)
+	buffer.Write(encoded[:])
+}
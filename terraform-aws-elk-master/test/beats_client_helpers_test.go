@@ -0,0 +1,248 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBeatsEvents returns count events with distinct messages
+func testBeatsEvents(count int) []BeatsEvent {
+	events := []BeatsEvent{}
+	for i := 0; i < count; i++ {
+		events = append(events, newBeatsEvent(fmt.Sprintf("TEST_BEATS %d", i), map[string]interface{}{
+			"fields": map[string]interface{}{"test": "lumberjack"},
+		}))
+	}
+	return events
+}
+
+func TestOfflineBeatsClientSendsWindows(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name             string
+		serverOptions    FakeBeatsOptions
+		windowSize       int
+		compressionLevel int
+		count            int
+		expectedWindows  []FakeBeatsWindow
+	}{
+		{"one window", FakeBeatsOptions{}, 10, 0, 7, []FakeBeatsWindow{{7, false}}},
+		{"several windows", FakeBeatsOptions{}, 10, 0, 25, []FakeBeatsWindow{{10, false}, {10, false}, {5, false}}},
+		{"default window size", FakeBeatsOptions{}, 0, 0, BEATS_DEFAULT_WINDOW_SIZE + 1, []FakeBeatsWindow{{BEATS_DEFAULT_WINDOW_SIZE, false}, {1, false}}},
+		{"compressed", FakeBeatsOptions{}, 10, 6, 25, []FakeBeatsWindow{{10, true}, {10, true}, {5, true}}},
+		{"keep alives", FakeBeatsOptions{KeepAlives: 3}, 10, 0, 25, []FakeBeatsWindow{{10, false}, {10, false}, {5, false}}},
+		{"partial ACKs", FakeBeatsOptions{AckEvery: 3}, 10, 9, 25, []FakeBeatsWindow{{10, true}, {10, true}, {5, true}}},
+		{"no events", FakeBeatsOptions{}, 10, 0, 0, []FakeBeatsWindow{}},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := startFakeBeats(t, testCase.serverOptions)
+			defer server.Close()
+
+			client, err := dialBeatsE(context.Background(), BeatsClientOptions{
+				Address:          server.Address,
+				WindowSize:       testCase.windowSize,
+				CompressionLevel: testCase.compressionLevel,
+				Timeout:          5 * time.Second,
+			})
+			require.NoError(t, err)
+
+			events := testBeatsEvents(testCase.count)
+			require.NoError(t, client.SendE(context.Background(), events))
+			require.NoError(t, client.Close())
+
+			assert.Equal(t, testCase.expectedWindows, server.Windows())
+			received := server.Events()
+			require.Len(t, received, len(events))
+			for i, event := range events {
+				assert.Equal(t, event["message"], received[i]["message"])
+				assert.Equal(t, event["@timestamp"], received[i]["@timestamp"])
+				assert.Equal(t, map[string]interface{}{"test": "lumberjack"}, received[i]["fields"])
+			}
+			assert.Empty(t, server.Errors())
+		})
+	}
+}
+
+func TestOfflineBeatsClientAckErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		serverOptions FakeBeatsOptions
+		expectedAcked int
+		expectedError string
+	}{
+		{"connection closed mid way", FakeBeatsOptions{CloseAfterEvents: 15, AckEvery: 2}, 15, "Failed to read an ACK"},
+		{"ACK beyond the window", FakeBeatsOptions{AckBeyondWindow: true}, 0, "Got an ACK for event 11 of a window of 10 events"},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := startFakeBeats(t, testCase.serverOptions)
+			defer server.Close()
+
+			client, err := dialBeatsE(context.Background(), BeatsClientOptions{Address: server.Address, WindowSize: 10, Timeout: 5 * time.Second})
+			require.NoError(t, err)
+			defer client.Close()
+
+			err = client.SendE(context.Background(), testBeatsEvents(25))
+			require.Error(t, err)
+			sendErr, isSendErr := err.(BeatsSendError)
+			require.True(t, isSendErr, "Expected a BeatsSendError but got %v", err)
+			assert.Equal(t, testCase.expectedAcked, sendErr.Acked)
+			assert.Contains(t, err.Error(), testCase.expectedError)
+		})
+	}
+}
+
+func TestOfflineBeatsClientTimesOutWithoutAck(t *testing.T) {
+	t.Parallel()
+
+	// A server that reads everything and never ACKs
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ioutil.ReadAll(conn)
+	}()
+
+	client, err := dialBeatsE(context.Background(), BeatsClientOptions{Address: listener.Addr().String(), Timeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	defer client.Close()
+
+	start := time.Now()
+	err = client.SendE(context.Background(), testBeatsEvents(3))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "i/o timeout")
+	}
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestOfflineBeatsClientRejectsInvalidCompressionLevel(t *testing.T) {
+	t.Parallel()
+
+	_, err := dialBeatsE(context.Background(), BeatsClientOptions{Address: "127.0.0.1:1", CompressionLevel: 10})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Invalid compression level 10")
+	}
+}
+
+func TestOfflineBeatsClientTls(t *testing.T) {
+	t.Parallel()
+
+	amiDir, err := ioutil.TempDir("", "beats-tls")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(amiDir) })
+
+	keyStore := createKeyStoreFiles(t, "logstash", amiDir, "logstash.gruntwork.in")
+	otherKeyStore := createKeyStoreFiles(t, "other", fmt.Sprintf("%s/other", amiDir), "logstash.gruntwork.in")
+	caOnly := &keystore{CaFile: keyStore.CaFile}
+
+	testCases := []struct {
+		name                string
+		serverOptions       FakeBeatsOptions
+		clientKeyStore      *keystore
+		expectedClientNames []string
+		expectedError       string
+	}{
+		{"client certificate", FakeBeatsOptions{RequireClientCert: true}, keyStore, []string{"logstash.gruntwork.in"}, ""},
+		{"no client certificate", FakeBeatsOptions{}, caOnly, []string{""}, ""},
+		{"client certificate required", FakeBeatsOptions{RequireClientCert: true}, caOnly, nil, "certificate"},
+		{"server certificate from another CA", FakeBeatsOptions{}, &keystore{CaFile: otherKeyStore.CaFile}, nil, "certificate signed by unknown authority"},
+		{"server name mismatch", FakeBeatsOptions{}, &keystore{CaFile: keyStore.CaFile, ServerName: "kibana.gruntwork.in"}, nil, "kibana.gruntwork.in"},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := startFakeBeatsTLS(t, testCase.serverOptions, keyStore)
+			defer server.Close()
+
+			events := testBeatsEvents(5)
+			options := BeatsClientOptions{Address: server.Address, KeyStore: testCase.clientKeyStore, CompressionLevel: 3, Timeout: 5 * time.Second}
+
+			// With TLS 1.3, the server checks the client certificate after the client finished its handshake, so a
+			// missing one only shows when sending
+			client, err := dialBeatsE(context.Background(), options)
+			if err == nil {
+				err = client.SendE(context.Background(), events)
+				client.Close()
+			}
+
+			if testCase.expectedError != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), testCase.expectedError)
+				}
+				assert.Empty(t, server.Events())
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, server.Events(), len(events))
+			assert.Equal(t, testCase.expectedClientNames, server.ClientNames())
+		})
+	}
+}
+
+func TestOfflineNewTestBeatsEvents(t *testing.T) {
+	t.Parallel()
+
+	events := newTestBeatsEvents("This is a log line_beats", 3)
+	otherEvents := newTestBeatsEvents("This is a log line_beats", 3)
+
+	require.Len(t, events, 3)
+	contents := beatsLogstashOutputContents(events)
+	for i, event := range events {
+		assert.Regexp(t, fmt.Sprintf(`^This is a log line_beats [0-9A-Za-z]+-%d$`, i), event["message"])
+		assert.NotEqual(t, otherEvents[i]["message"], event["message"])
+		assert.Equal(t, []string{"terratest-beats"}, event["tags"])
+		assert.Equal(t, fmt.Sprintf(`"message":"%s"`, event["message"]), contents[i])
+	}
+}
+
+func TestOfflineEncodeLumberjackWindow(t *testing.T) {
+	t.Parallel()
+
+	window, err := encodeLumberjackWindowE([]BeatsEvent{{"message": "a"}, {"message": "b"}}, 0)
+	require.NoError(t, err)
+
+	// Version '2', code and big endian uint32s, with 15 byte JSON events
+	expected := []byte{'2', 'W', 0, 0, 0, 2}
+	expected = append(expected, '2', 'J', 0, 0, 0, 1, 0, 0, 0, 15)
+	expected = append(expected, `{"message":"a"}`...)
+	expected = append(expected, '2', 'J', 0, 0, 0, 2, 0, 0, 0, 15)
+	expected = append(expected, `{"message":"b"}`...)
+	assert.Equal(t, expected, window)
+}
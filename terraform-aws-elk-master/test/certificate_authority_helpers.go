@@ -0,0 +1,233 @@
+package test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// The subject used for all certificates generated by the tests
+var testCertificateSubject = pkix.Name{
+	Organization:       []string{"Gruntwork"},
+	OrganizationalUnit: []string{"Engineering"},
+	Locality:           []string{"Phoenix"},
+	Province:           []string{"AZ"},
+	Country:            []string{"US"},
+}
+
+const DEFAULT_CERTIFICATE_VALIDITY = 30 * 24 * time.Hour
+
+// The key algorithms the tests can generate keys with
+const KEY_ALGORITHM_RSA = "RSA"
+const KEY_ALGORITHM_ECDSA = "ECDSA"
+
+// CertificateAuthority signs certificates for the TLS tests in-process, so they don't need network access, a JDK or
+// OpenSSL to prepare their certificates
+type CertificateAuthority struct {
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+	// The certificates of the CAs above this one, starting with the one that signed Certificate. Empty for a root CA.
+	Chain []*x509.Certificate
+}
+
+// IssuedCertificate is a certificate signed by a CertificateAuthority, along with its private key
+type IssuedCertificate struct {
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+	// The certificates of the issuing CAs, starting with the one that signed Certificate
+	Chain []*x509.Certificate
+}
+
+// CertificateOptions configures a CA or a certificate issued by a CertificateAuthority
+type CertificateOptions struct {
+	CommonName  string
+	DnsNames    []string
+	IpAddresses []net.IP
+	// Defaults to DEFAULT_CERTIFICATE_VALIDITY
+	Validity time.Duration
+	// One of KEY_ALGORITHM_RSA (2048 bits) or KEY_ALGORITHM_ECDSA (P-256). Defaults to KEY_ALGORITHM_RSA.
+	KeyAlgorithm string
+}
+
+// newCertificateAuthorityE creates a self-signed root CA with a fresh key
+func newCertificateAuthorityE(options CertificateOptions) (*CertificateAuthority, error) {
+	privateKey, err := generatePrivateKeyE(options.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newCaTemplate(options)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := createCertificateE(template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{Certificate: certificate, PrivateKey: privateKey}, nil
+}
+
+// issueIntermediateCertificateAuthorityE creates a CA with a fresh key that is signed by this CA
+func (ca *CertificateAuthority) issueIntermediateCertificateAuthorityE(options CertificateOptions) (*CertificateAuthority, error) {
+	privateKey, err := generatePrivateKeyE(options.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newCaTemplate(options)
+	if err != nil {
+		return nil, err
+	}
+	// Only allow the intermediate to sign leaf certificates
+	template.MaxPathLenZero = true
+
+	certificate, err := createCertificateE(template, ca.Certificate, privateKey.Public(), ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertificateAuthority{
+		Certificate: certificate,
+		PrivateKey:  privateKey,
+		Chain:       append([]*x509.Certificate{ca.Certificate}, ca.Chain...),
+	}, nil
+}
+
+// issueCertificateE issues a certificate with a fresh key that can be used by both TLS servers and clients, since the
+// ELK components use the same certificate for both
+func (ca *CertificateAuthority) issueCertificateE(options CertificateOptions) (*IssuedCertificate, error) {
+	privateKey, err := generatePrivateKeyE(options.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := newCertificateTemplate(options.CommonName, options.Validity)
+	if err != nil {
+		return nil, err
+	}
+	template.DNSNames = options.DnsNames
+	template.IPAddresses = options.IpAddresses
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	// Key encipherment only applies to RSA key exchange
+	if _, isRsa := privateKey.(*rsa.PrivateKey); isRsa {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+
+	certificate, err := createCertificateE(template, ca.Certificate, privateKey.Public(), ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IssuedCertificate{
+		Certificate: certificate,
+		PrivateKey:  privateKey,
+		Chain:       append([]*x509.Certificate{ca.Certificate}, ca.Chain...),
+	}, nil
+}
+
+func generatePrivateKeyE(keyAlgorithm string) (crypto.Signer, error) {
+	switch keyAlgorithm {
+	case "", KEY_ALGORITHM_RSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KEY_ALGORITHM_ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("Unsupported key algorithm %s. Expected %s or %s.", keyAlgorithm, KEY_ALGORITHM_RSA, KEY_ALGORITHM_ECDSA)
+	}
+}
+
+func createCertificateE(template *x509.Certificate, parent *x509.Certificate, publicKey crypto.PublicKey, signer crypto.Signer) (*x509.Certificate, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func newCaTemplate(options CertificateOptions) (*x509.Certificate, error) {
+	template, err := newCertificateTemplate(options.CommonName, options.Validity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	return template, nil
+}
+
+func newCertificateTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	if validity == 0 {
+		validity = DEFAULT_CERTIFICATE_VALIDITY
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	subject := testCertificateSubject
+	subject.CommonName = commonName
+
+	// Backdate the certificate a little to tolerate clock skew between the test runner and the servers
+	notBefore := time.Now().Add(-1 * time.Hour)
+
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      subject,
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(validity),
+	}, nil
+}
+
+// writeCertificatesPemE writes the given certificates to path as a PEM bundle
+func writeCertificatesPemE(path string, certificates ...*x509.Certificate) error {
+	var contents []byte
+	for _, certificate := range certificates {
+		contents = append(contents, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})...)
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}
+
+// writePrivateKeyPemE writes the private key to path in the "traditional" format OpenSSL uses: PKCS#1 for RSA keys and
+// SEC 1 for ECDSA keys
+func writePrivateKeyPemE(path string, privateKey crypto.Signer) error {
+	var block *pem.Block
+
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		return fmt.Errorf("Unsupported private key type %T", privateKey)
+	}
+
+	return ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// writePkcs8PrivateKeyPemE writes the private key to path as an unencrypted PKCS#8 PEM, the format the Logstash beats
+// input requires
+func writePkcs8PrivateKeyPemE(path string, privateKey crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
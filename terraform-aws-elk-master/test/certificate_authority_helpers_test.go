@@ -0,0 +1,222 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineCreateKeyStoreFiles(t *testing.T) {
+	t.Parallel()
+
+	amiDir, err := ioutil.TempDir("", "keystore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(amiDir)
+
+	keyStore := createKeyStoreFiles(t, "elk", amiDir, "test.gruntwork.in")
+
+	// Both key formats must match the certificate
+	_, err = tls.LoadX509KeyPair(keyStore.CertFile, keyStore.KeyFile)
+	require.NoError(t, err)
+	_, err = tls.LoadX509KeyPair(keyStore.CertFile, keyStore.P8KeyFile)
+	require.NoError(t, err)
+
+	caPool := x509.NewCertPool()
+	caPem, err := ioutil.ReadFile(keyStore.CaFile)
+	require.NoError(t, err)
+	require.True(t, caPool.AppendCertsFromPEM(caPem))
+
+	cert := readFirstPemCertificate(t, keyStore.CertFile)
+	for _, name := range []string{"test.gruntwork.in", "127.0.0.1"} {
+		_, err = cert.Verify(x509.VerifyOptions{DNSName: name, Roots: caPool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+		assert.NoError(t, err, "Certificate should be valid for %s", name)
+	}
+
+	// The keystore must hold the private key of the certificate under the expected alias, protected by the password
+	keyStoreEntries := readJksForTest(t, keyStore.KeyStorePath, keyStore.KeyStorePassword)
+	require.Contains(t, keyStoreEntries, KEYSTORE_CERT_ALIAS)
+	p8Block, _ := pem.Decode(mustReadFile(t, keyStore.P8KeyFile))
+	assert.Equal(t, p8Block.Bytes, keyStoreEntries[KEYSTORE_CERT_ALIAS])
+
+	trustStoreEntries := readJksForTest(t, keyStore.TrustStorePath, keyStore.TrustStorePassword)
+	assert.Contains(t, trustStoreEntries, "caroot")
+}
+
+func TestOfflineFakeElasticsearchWithKeyStoreFiles(t *testing.T) {
+	t.Parallel()
+
+	amiDir, err := ioutil.TempDir("", "keystore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(amiDir)
+
+	keyStore := createKeyStoreFiles(t, "elasticsearch", amiDir, "localhost")
+
+	server := startFakeElasticsearchTLS(t, defaultFakeElasticsearchState(), keyStore)
+	defer server.Close()
+
+	checkElasticsearchRunning(t, "mock-elasticsearch-server", server.URL, keyStore, "")
+}
+
+func TestOfflineKeyStoreFilesRoundTripWithKeytool(t *testing.T) {
+	t.Parallel()
+
+	// readJksForTest only checks the Go writer against our reading of the format, so check both against keytool too
+	keytool, err := exec.LookPath("keytool")
+	if err != nil {
+		t.Skip("keytool is not installed")
+	}
+	runKeytool := func(args ...string) {
+		output, err := exec.Command(keytool, args...).CombinedOutput()
+		require.NoError(t, err, "keytool %s failed: %s", strings.Join(args, " "), output)
+	}
+
+	amiDir, err := ioutil.TempDir("", "keystore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(amiDir)
+
+	keyStore := createKeyStoreFiles(t, "elk", amiDir, "test.gruntwork.in")
+
+	// keytool can only convert the private key entry if it can undo the key protection of the Go writer
+	runKeytool(
+		"-importkeystore", "-noprompt",
+		"-srckeystore", keyStore.KeyStorePath, "-srcstoretype", "JKS", "-srcstorepass", keyStore.KeyStorePassword,
+		"-destkeystore", filepath.Join(amiDir, "keystore.p12"), "-deststoretype", "PKCS12", "-deststorepass", keyStore.KeyStorePassword,
+	)
+	runKeytool("-list", "-keystore", keyStore.TrustStorePath, "-storetype", "JKS", "-storepass", keyStore.TrustStorePassword, "-alias", "caroot")
+
+	// And the reader of the tests must read the stores keytool writes
+	generatedPath := filepath.Join(amiDir, "generated.jks")
+	runKeytool(
+		"-genkeypair", "-alias", "generated", "-keyalg", "RSA", "-keysize", "2048", "-dname", "CN=test.gruntwork.in", "-validity", "1",
+		"-keystore", generatedPath, "-storetype", "JKS", "-storepass", "password", "-keypass", "password",
+	)
+	runKeytool(
+		"-importcert", "-noprompt", "-alias", "caroot", "-file", keyStore.CaFile,
+		"-keystore", generatedPath, "-storetype", "JKS", "-storepass", "password",
+	)
+
+	entries := readJksForTest(t, generatedPath, "password")
+	require.Contains(t, entries, "generated")
+	_, err = x509.ParsePKCS8PrivateKey(entries["generated"])
+	assert.NoError(t, err)
+	caBlock, _ := pem.Decode(mustReadFile(t, keyStore.CaFile))
+	assert.Equal(t, caBlock.Bytes, entries["caroot"])
+}
+
+func readFirstPemCertificate(t *testing.T, path string) *x509.Certificate {
+	block, _ := pem.Decode(mustReadFile(t, path))
+	require.NotNil(t, block, "No PEM data in %s", path)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return contents
+}
+
+// readJksForTest checks the integrity digest of a JKS and returns its entries by alias: the decrypted PKCS#8 key for
+// private key entries and the DER certificate for trusted certificate entries
+func readJksForTest(t *testing.T, path string, password string) map[string][]byte {
+	contents := mustReadFile(t, path)
+	body, digest := contents[:len(contents)-sha1.Size], contents[len(contents)-sha1.Size:]
+
+	expectedDigest := sha1.New()
+	expectedDigest.Write(jksPasswordBytes(password))
+	expectedDigest.Write([]byte("Mighty Aphrodite"))
+	expectedDigest.Write(body)
+	require.Equal(t, expectedDigest.Sum(nil), digest, "JKS integrity check failed")
+
+	reader := bytes.NewReader(body)
+	readUint32 := func() uint32 {
+		var value uint32
+		require.NoError(t, binary.Read(reader, binary.BigEndian, &value))
+		return value
+	}
+	readBytes := func(length int) []byte {
+		value := make([]byte, length)
+		_, err := reader.Read(value)
+		require.NoError(t, err)
+		return value
+	}
+	readUtf := func() string {
+		var length uint16
+		require.NoError(t, binary.Read(reader, binary.BigEndian, &length))
+		return string(readBytes(int(length)))
+	}
+
+	require.Equal(t, uint32(jksMagic), readUint32())
+	require.Equal(t, uint32(jksVersion), readUint32())
+
+	entries := map[string][]byte{}
+	numEntries := readUint32()
+	for i := uint32(0); i < numEntries; i++ {
+		tag := readUint32()
+		alias := readUtf()
+		readBytes(8)
+
+		switch tag {
+		case jksPrivateKeyTag:
+			var encrypted struct {
+				Algorithm     asn1.RawValue
+				EncryptedData []byte
+			}
+			_, err := asn1.Unmarshal(readBytes(int(readUint32())), &encrypted)
+			require.NoError(t, err)
+			entries[alias] = jksUnprotectForTest(t, password, encrypted.EncryptedData)
+
+			numCerts := readUint32()
+			for j := uint32(0); j < numCerts; j++ {
+				readUtf()
+				readBytes(int(readUint32()))
+			}
+		case jksTrustedCertTag:
+			readUtf()
+			entries[alias] = readBytes(int(readUint32()))
+		default:
+			t.Fatalf("Unexpected JKS entry tag %d", tag)
+		}
+	}
+
+	return entries
+}
+
+func jksUnprotectForTest(t *testing.T, password string, protected []byte) []byte {
+	salt := protected[:sha1.Size]
+	encrypted := protected[sha1.Size : len(protected)-sha1.Size]
+	check := protected[len(protected)-sha1.Size:]
+
+	plain := make([]byte, len(encrypted))
+	digest := salt
+	for offset := 0; offset < len(encrypted); offset += sha1.Size {
+		hash := sha1.New()
+		hash.Write(jksPasswordBytes(password))
+		hash.Write(digest)
+		digest = hash.Sum(nil)
+		for i := 0; i < sha1.Size && offset+i < len(encrypted); i++ {
+			plain[offset+i] = encrypted[offset+i] ^ digest[i]
+		}
+	}
+
+	expectedCheck := sha1.New()
+	expectedCheck.Write(jksPasswordBytes(password))
+	expectedCheck.Write(plain)
+	require.Equal(t, expectedCheck.Sum(nil), check, "JKS key integrity check failed")
+
+	return plain
+}
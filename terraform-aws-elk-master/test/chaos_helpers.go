@@ -0,0 +1,110 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/gruntwork-io/terratest/modules/aws"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/random"
+)
+
+// How many documents checkElasticsearchSurvivesNodeFailure writes before killing a node
+const CHAOS_TEST_DOCUMENTS = 500
+
+// ElasticsearchRecoveryReport records how an Elasticsearch cluster recovered from losing a node
+type ElasticsearchRecoveryReport struct {
+	AsgName               string
+	TerminatedInstanceId  string
+	ReplacementInstanceId string
+	// From terminating the instance until the ASG had a replacement in service
+	TimeToReplace time.Duration
+	// From terminating the instance until the cluster was green with all its nodes and documents again
+	TimeToRecover time.Duration
+}
+
+// checkElasticsearchSurvivesNodeFailure writes a dataset, terminates a random instance of one of the ASGs of the
+// cluster and waits for the ASG to replace it. It then checks the cluster is green again with all its nodes and the
+// dataset is intact. The cluster is expected to run one node per ASG, like the elasticsearch-cluster module does.
+func checkElasticsearchSurvivesNodeFailure(t *testing.T, client *ElasticsearchClient, awsRegion string, asgNames []string) ElasticsearchRecoveryReport {
+	expectedNodes := len(asgNames)
+	checkElasticsearchClusterHealth(t, client, "green", expectedNodes)
+
+	index := fmt.Sprintf("chaos-test-%s", strings.ToLower(random.UniqueId()))
+	dataset := writeElasticsearchDataset(t, client, index, CHAOS_TEST_DOCUMENTS)
+
+	report := ElasticsearchRecoveryReport{AsgName: random.RandomString(asgNames)}
+	report.TerminatedInstanceId = terminateRandomInstanceInAsg(t, awsRegion, report.AsgName)
+	terminated := time.Now()
+
+	report.ReplacementInstanceId = waitForAsgReplacement(t, awsRegion, report.AsgName, report.TerminatedInstanceId)
+	report.TimeToReplace = time.Since(terminated)
+
+	checkElasticsearchClusterHealth(t, client, "green", expectedNodes)
+	waitForElasticsearchDataset(t, elasticsearchSearchWaitBudget, client, dataset)
+	report.TimeToRecover = time.Since(terminated)
+
+	logger.Logf(
+		t,
+		"Elasticsearch recovered from the termination of %s in ASG %s: replaced by %s after %s, green with %d nodes and all documents after %s",
+		report.TerminatedInstanceId, report.AsgName, report.ReplacementInstanceId, report.TimeToReplace, expectedNodes, report.TimeToRecover)
+
+	return report
+}
+
+// terminateRandomInstanceInAsg terminates a random instance of the ASG through EC2, the way a hardware failure would,
+// rather than through the ASG, and returns its id
+func terminateRandomInstanceInAsg(t *testing.T, awsRegion string, asgName string) string {
+	instanceIds := aws.GetInstanceIdsForAsg(t, asgName, awsRegion)
+	if len(instanceIds) == 0 {
+		t.Fatalf("Auto Scaling Group %s has no instances", asgName)
+	}
+
+	instanceId := random.RandomString(instanceIds)
+	logger.Logf(t, "Terminating instance %s of Auto Scaling Group %s", instanceId, asgName)
+	aws.TerminateInstance(t, awsRegion, instanceId)
+
+	return instanceId
+}
+
+// waitForAsgReplacement waits until the ASG has a healthy instance in service that isn't the terminated one, and
+// returns the id of that instance
+func waitForAsgReplacement(t *testing.T, awsRegion string, asgName string, terminatedInstanceId string) string {
+	asgClient, err := defaultAwsClients.asgClientE(awsRegion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replacementId string
+	description := fmt.Sprintf("Auto Scaling Group %s to replace instance %s", asgName, terminatedInstanceId)
+	waitFor(t, asgReplacementWaitBudget, description, func(ctx context.Context) error {
+		output, err := asgClient.DescribeAutoScalingGroupsWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: awsgo.StringSlice([]string{asgName}),
+		})
+		if err != nil {
+			return err
+		}
+		if len(output.AutoScalingGroups) == 0 {
+			return fmt.Errorf("Could not find an Auto Scaling Group named %s", asgName)
+		}
+
+		for _, instance := range output.AutoScalingGroups[0].Instances {
+			if awsgo.StringValue(instance.InstanceId) == terminatedInstanceId {
+				continue
+			}
+			if isInServiceAndHealthy(instance) {
+				replacementId = awsgo.StringValue(instance.InstanceId)
+				return nil
+			}
+		}
+
+		return fmt.Errorf("Auto Scaling Group %s has no replacement for instance %s in service yet", asgName, terminatedInstanceId)
+	})
+
+	return replacementId
+}
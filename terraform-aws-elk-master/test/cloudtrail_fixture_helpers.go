@@ -0,0 +1,362 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+// How many records the validate_cloudtrail stages write and expect as documents in the Logstash file output
+const CLOUDTRAIL_TEST_RECORDS = 12
+
+// The account id of the generated log files, unless the options say otherwise
+const CLOUDTRAIL_DEFAULT_ACCOUNT_ID = "123456789012"
+
+// The events, users and source IPs the generated records cycle through, unless the options say otherwise. Events are
+// named like IAM actions: <service>:<event name>.
+var defaultCloudTrailEventNames = []string{"signin:ConsoleLogin", "ec2:DescribeInstances", "iam:CreateAccessKey", "s3:PutBucketPolicy", "ec2:AuthorizeSecurityGroupIngress", "sts:AssumeRole"}
+var defaultCloudTrailUserNames = []string{"alice", "bob", "deploy-bot"}
+var defaultCloudTrailSourceIps = []string{"203.0.113.10", "198.51.100.24", "192.0.2.77", "203.0.113.200"}
+
+// CloudTrailFixtureOptions describes the CloudTrail log file generateCloudTrailLogFile creates
+type CloudTrailFixtureOptions struct {
+	// Defaults to CLOUDTRAIL_DEFAULT_ACCOUNT_ID
+	AccountId string
+	Region    string
+	// How many records the log file has
+	Count int
+	// Record i is for event EventNames[i % len(EventNames)], and likewise for the users and source IPs
+	EventNames []string
+	UserNames  []string
+	SourceIps  []string
+	// The time of the first event. Each next one is a second later. Defaults to a minute ago.
+	StartTime time.Time
+}
+
+// CloudTrailLogFile is a log file the way CloudTrail delivers it to S3
+type CloudTrailLogFile struct {
+	// The S3 key, under AWSLogs/<account id>/CloudTrail/<region>/YYYY/MM/DD/
+	Key     string             `json:"-"`
+	Records []CloudTrailRecord `json:"Records"`
+}
+
+// CloudTrailRecord is the part of a CloudTrail record the tests generate and check
+type CloudTrailRecord struct {
+	EventVersion       string                 `json:"eventVersion"`
+	UserIdentity       CloudTrailUserIdentity `json:"userIdentity"`
+	EventTime          string                 `json:"eventTime"`
+	EventSource        string                 `json:"eventSource"`
+	EventName          string                 `json:"eventName"`
+	AwsRegion          string                 `json:"awsRegion"`
+	SourceIPAddress    string                 `json:"sourceIPAddress"`
+	UserAgent          string                 `json:"userAgent"`
+	RequestID          string                 `json:"requestID"`
+	EventID            string                 `json:"eventID"`
+	ReadOnly           bool                   `json:"readOnly"`
+	EventType          string                 `json:"eventType"`
+	ManagementEvent    bool                   `json:"managementEvent"`
+	RecipientAccountId string                 `json:"recipientAccountId"`
+	ResponseElements   map[string]interface{} `json:"responseElements"`
+}
+
+type CloudTrailUserIdentity struct {
+	Type        string `json:"type"`
+	PrincipalId string `json:"principalId"`
+	Arn         string `json:"arn"`
+	AccountId   string `json:"accountId"`
+	AccessKeyId string `json:"accessKeyId,omitempty"`
+	UserName    string `json:"userName"`
+}
+
+// generateCloudTrailLogFile returns a log file with a record per event, named and keyed like CloudTrail does
+func generateCloudTrailLogFile(options CloudTrailFixtureOptions) (*CloudTrailLogFile, error) {
+	if options.AccountId == "" {
+		options.AccountId = CLOUDTRAIL_DEFAULT_ACCOUNT_ID
+	}
+	if options.Region == "" {
+		return nil, fmt.Errorf("The region of the CloudTrail log file is required")
+	}
+	if len(options.EventNames) == 0 {
+		options.EventNames = defaultCloudTrailEventNames
+	}
+	if len(options.UserNames) == 0 {
+		options.UserNames = defaultCloudTrailUserNames
+	}
+	if len(options.SourceIps) == 0 {
+		options.SourceIps = defaultCloudTrailSourceIps
+	}
+	if options.StartTime.IsZero() {
+		options.StartTime = time.Now().Add(-time.Minute)
+	}
+	startTime := options.StartTime.UTC().Truncate(time.Second)
+
+	logFile := &CloudTrailLogFile{Records: []CloudTrailRecord{}}
+	for i := 0; i < options.Count; i++ {
+		record, err := newCloudTrailRecord(
+			options.AccountId,
+			options.Region,
+			options.EventNames[i%len(options.EventNames)],
+			options.UserNames[i%len(options.UserNames)],
+			options.SourceIps[i%len(options.SourceIps)],
+			startTime.Add(time.Duration(i)*time.Second),
+		)
+		if err != nil {
+			return nil, err
+		}
+		logFile.Records = append(logFile.Records, record)
+	}
+
+	suffix, err := randomCloudTrailId(8)
+	if err != nil {
+		return nil, err
+	}
+	// E.g. AWSLogs/123456789012/CloudTrail/us-east-1/2021/05/01/123456789012_CloudTrail_us-east-1_20210501T1200Z_3f2a9c1e0b7d4a58.json.gz
+	logFile.Key = fmt.Sprintf(
+		"AWSLogs/%s/CloudTrail/%s/%s/%s_CloudTrail_%s_%s_%s.json.gz",
+		options.AccountId,
+		options.Region,
+		startTime.Format("2006/01/02"),
+		options.AccountId,
+		options.Region,
+		startTime.Format("20060102T1504Z"),
+		suffix,
+	)
+	return logFile, nil
+}
+
+func newCloudTrailRecord(accountId string, region string, event string, userName string, sourceIp string, eventTime time.Time) (CloudTrailRecord, error) {
+	parts := strings.SplitN(event, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return CloudTrailRecord{}, fmt.Errorf("CloudTrail event %s is not of the form <service>:<event name>", event)
+	}
+	service, eventName := parts[0], parts[1]
+
+	eventId, err := randomCloudTrailUuid()
+	if err != nil {
+		return CloudTrailRecord{}, err
+	}
+	requestId, err := randomCloudTrailUuid()
+	if err != nil {
+		return CloudTrailRecord{}, err
+	}
+	// IAM ids are a prefix and 16 upper case characters
+	iamId, err := randomCloudTrailId(8)
+	if err != nil {
+		return CloudTrailRecord{}, err
+	}
+	iamId = strings.ToUpper(iamId)
+
+	record := CloudTrailRecord{
+		EventVersion: "1.08",
+		UserIdentity: CloudTrailUserIdentity{
+			Type:        "IAMUser",
+			PrincipalId: "AIDA" + iamId,
+			Arn:         fmt.Sprintf("arn:aws:iam::%s:user/%s", accountId, userName),
+			AccountId:   accountId,
+			AccessKeyId: "AKIA" + iamId,
+			UserName:    userName,
+		},
+		EventTime:          eventTime.UTC().Format(time.RFC3339),
+		EventSource:        fmt.Sprintf("%s.amazonaws.com", service),
+		EventName:          eventName,
+		AwsRegion:          region,
+		SourceIPAddress:    sourceIp,
+		UserAgent:          "aws-cli/2.2.5 Python/3.8.8 Linux/5.4.0 exe/x86_64.ubuntu.20 prompt/off",
+		RequestID:          requestId,
+		EventID:            eventId,
+		ReadOnly:           strings.HasPrefix(eventName, "Describe") || strings.HasPrefix(eventName, "Get") || strings.HasPrefix(eventName, "List"),
+		EventType:          "AwsApiCall",
+		ManagementEvent:    true,
+		RecipientAccountId: accountId,
+	}
+
+	// Console sign-ins are a different kind of event, with their outcome in the response
+	if eventName == "ConsoleLogin" {
+		record.EventType = "AwsConsoleSignIn"
+		record.UserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:89.0) Gecko/20100101 Firefox/89.0"
+		record.UserIdentity.AccessKeyId = ""
+		record.ResponseElements = map[string]interface{}{"ConsoleLogin": "Success"}
+	}
+	return record, nil
+}
+
+// randomCloudTrailId returns size random bytes as hex
+func randomCloudTrailId(size int) (string, error) {
+	id := make([]byte, size)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", id), nil
+}
+
+// randomCloudTrailUuid returns a random id formatted like the event and request ids of CloudTrail
+func randomCloudTrailUuid() (string, error) {
+	id, err := randomCloudTrailId(16)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%s-%s-%s", id[:8], id[8:12], id[12:16], id[16:20], id[20:]), nil
+}
+
+// gzipE returns the log file as CloudTrail writes it: one line of JSON, gzipped
+func (logFile *CloudTrailLogFile) gzipE() ([]byte, error) {
+	contents, err := json.Marshal(logFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(contents); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeCloudTrailLogFile(t *testing.T, bucket string, awsRegion string, options CloudTrailFixtureOptions) *CloudTrailLogFile {
+	logFile, err := writeCloudTrailLogFileE(t, defaultAwsClients, bucket, awsRegion, options)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return logFile
+}
+
+// writeCloudTrailLogFileE generates a CloudTrail log file and uploads it to its key in the bucket
+func writeCloudTrailLogFileE(t *testing.T, clients *AwsClients, bucket string, awsRegion string, options CloudTrailFixtureOptions) (*CloudTrailLogFile, error) {
+	if options.Region == "" {
+		options.Region = awsRegion
+	}
+	logFile, err := generateCloudTrailLogFile(options)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := logFile.gzipE()
+	if err != nil {
+		return nil, err
+	}
+
+	s3Client, err := clients.s3ClientE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:               awsgo.String(bucket),
+		Key:                  awsgo.String(logFile.Key),
+		Body:                 bytes.NewReader(contents),
+		ContentType:          awsgo.String("application/x-gzip"),
+		ServerSideEncryption: awsgo.String("AES256"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to upload CloudTrail log file %s to bucket %s: %v", logFile.Key, bucket, err)
+	}
+
+	logger.Logf(t, "Uploaded CloudTrail log file with %d records to s3://%s/%s", len(logFile.Records), bucket, logFile.Key)
+	return logFile, nil
+}
+
+// checkLogstashCloudTrailRecords waits for the Logstash output log to have exactly one document per record of the log
+// file, with the fields of the record parsed
+func checkLogstashCloudTrailRecords(t *testing.T, executor RemoteExecutor, osProfile OsProfile, logPath string, logFile *CloudTrailLogFile) {
+	description := fmt.Sprintf("CloudTrail records in Logstash output log %s on %s", logPath, executor)
+
+	waitFor(t, logstashOutputLogWaitBudget, description, func(ctx context.Context) error {
+		contents, err := readLogstashOutputLogE(t, executor, osProfile, logPath)
+		if err != nil {
+			return err
+		}
+		return checkCloudTrailDocumentsE(contents, logFile.Records)
+	})
+}
+
+// The fields of a document in the Logstash output log that checkCloudTrailDocumentsE compares with the record
+type logstashCloudTrailDocument struct {
+	Timestamp  string            `json:"@timestamp"`
+	CloudTrail *CloudTrailRecord `json:"cloudtrail"`
+}
+
+// checkCloudTrailDocumentsE returns an error unless the Logstash output log, which has a JSON document per line, has
+// exactly one document per record
+func checkCloudTrailDocumentsE(contents string, records []CloudTrailRecord) error {
+	documents := map[string][]logstashCloudTrailDocument{}
+
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var document logstashCloudTrailDocument
+		// Other inputs write to the log too, and not always JSON objects
+		if err := json.Unmarshal(scanner.Bytes(), &document); err != nil || document.CloudTrail == nil {
+			continue
+		}
+		documents[document.CloudTrail.EventID] = append(documents[document.CloudTrail.EventID], document)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	problems := []string{}
+	for _, record := range records {
+		found := documents[record.EventID]
+		if len(found) != 1 {
+			problems = append(problems, fmt.Sprintf("%d documents for event %s", len(found), record.EventID))
+			continue
+		}
+		if problem := compareCloudTrailDocument(found[0], record); problem != "" {
+			problems = append(problems, fmt.Sprintf("event %s: %s", record.EventID, problem))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Logstash did not write %d of %d CloudTrail records as expected, e.g. %s", len(problems), len(records), problems[0])
+	}
+	return nil
+}
+
+// compareCloudTrailDocument returns what differs between the document and the record, or "" if nothing does
+func compareCloudTrailDocument(document logstashCloudTrailDocument, record CloudTrailRecord) string {
+	parsed := document.CloudTrail
+	fields := []struct {
+		name     string
+		actual   string
+		expected string
+	}{
+		{"eventName", parsed.EventName, record.EventName},
+		{"eventSource", parsed.EventSource, record.EventSource},
+		{"awsRegion", parsed.AwsRegion, record.AwsRegion},
+		{"sourceIPAddress", parsed.SourceIPAddress, record.SourceIPAddress},
+		{"userIdentity.userName", parsed.UserIdentity.UserName, record.UserIdentity.UserName},
+		{"userIdentity.arn", parsed.UserIdentity.Arn, record.UserIdentity.Arn},
+	}
+	for _, field := range fields {
+		if field.actual != field.expected {
+			return fmt.Sprintf("%s is '%s' instead of '%s'", field.name, field.actual, field.expected)
+		}
+	}
+
+	// The pipeline takes the time of the document from the event
+	timestamp, err := time.Parse(time.RFC3339Nano, document.Timestamp)
+	if err != nil {
+		return fmt.Sprintf("@timestamp '%s' is not a time: %v", document.Timestamp, err)
+	}
+	eventTime, err := time.Parse(time.RFC3339, record.EventTime)
+	if err != nil {
+		return fmt.Sprintf("eventTime '%s' is not a time: %v", record.EventTime, err)
+	}
+	if !timestamp.Equal(eventTime) {
+		return fmt.Sprintf("@timestamp is %s instead of the event time %s", document.Timestamp, record.EventTime)
+	}
+	return ""
+}
@@ -0,0 +1,221 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineGenerateCloudTrailLogFile(t *testing.T) {
+	t.Parallel()
+
+	startTime := time.Date(2021, 5, 1, 23, 59, 58, 500, time.UTC)
+	logFile, err := generateCloudTrailLogFile(CloudTrailFixtureOptions{
+		AccountId:  "111122223333",
+		Region:     "eu-west-1",
+		Count:      5,
+		EventNames: []string{"signin:ConsoleLogin", "ec2:DescribeInstances"},
+		UserNames:  []string{"alice", "bob", "carol"},
+		SourceIps:  []string{"203.0.113.10"},
+		StartTime:  startTime,
+	})
+	require.NoError(t, err)
+
+	keyRegexp := regexp.MustCompile(`^AWSLogs/111122223333/CloudTrail/eu-west-1/2021/05/01/111122223333_CloudTrail_eu-west-1_20210501T2359Z_[0-9a-f]{16}\.json\.gz$`)
+	assert.Regexp(t, keyRegexp, logFile.Key)
+
+	require.Len(t, logFile.Records, 5)
+	expected := []struct {
+		eventSource string
+		eventName   string
+		eventType   string
+		userName    string
+		eventTime   string
+		readOnly    bool
+	}{
+		{"signin.amazonaws.com", "ConsoleLogin", "AwsConsoleSignIn", "alice", "2021-05-01T23:59:58Z", false},
+		{"ec2.amazonaws.com", "DescribeInstances", "AwsApiCall", "bob", "2021-05-01T23:59:59Z", true},
+		{"signin.amazonaws.com", "ConsoleLogin", "AwsConsoleSignIn", "carol", "2021-05-02T00:00:00Z", false},
+		{"ec2.amazonaws.com", "DescribeInstances", "AwsApiCall", "alice", "2021-05-02T00:00:01Z", true},
+		{"signin.amazonaws.com", "ConsoleLogin", "AwsConsoleSignIn", "bob", "2021-05-02T00:00:02Z", false},
+	}
+
+	eventIds := map[string]bool{}
+	for i, record := range logFile.Records {
+		assert.Equal(t, expected[i].eventSource, record.EventSource)
+		assert.Equal(t, expected[i].eventName, record.EventName)
+		assert.Equal(t, expected[i].eventType, record.EventType)
+		assert.Equal(t, expected[i].userName, record.UserIdentity.UserName)
+		assert.Equal(t, expected[i].eventTime, record.EventTime)
+		assert.Equal(t, expected[i].readOnly, record.ReadOnly)
+		assert.Equal(t, fmt.Sprintf("arn:aws:iam::111122223333:user/%s", expected[i].userName), record.UserIdentity.Arn)
+		assert.Equal(t, "203.0.113.10", record.SourceIPAddress)
+		assert.Equal(t, "eu-west-1", record.AwsRegion)
+		assert.Equal(t, "111122223333", record.RecipientAccountId)
+		assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`, record.EventID)
+		eventIds[record.EventID] = true
+	}
+	assert.Len(t, eventIds, 5)
+
+	// Only API calls made with access keys have one
+	assert.Empty(t, logFile.Records[0].UserIdentity.AccessKeyId)
+	assert.Regexp(t, `^AKIA[0-9A-F]{16}$`, logFile.Records[1].UserIdentity.AccessKeyId)
+}
+
+func TestOfflineGenerateCloudTrailLogFileDefaults(t *testing.T) {
+	t.Parallel()
+
+	logFile, err := generateCloudTrailLogFile(CloudTrailFixtureOptions{Region: "us-east-1", Count: len(defaultCloudTrailEventNames)})
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(logFile.Key, fmt.Sprintf("AWSLogs/%s/CloudTrail/us-east-1/", CLOUDTRAIL_DEFAULT_ACCOUNT_ID)), logFile.Key)
+	for i, record := range logFile.Records {
+		assert.Equal(t, defaultCloudTrailEventNames[i], fmt.Sprintf("%s:%s", strings.TrimSuffix(record.EventSource, ".amazonaws.com"), record.EventName))
+		eventTime, err := time.Parse(time.RFC3339, record.EventTime)
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), eventTime, 2*time.Minute)
+	}
+}
+
+func TestOfflineGenerateCloudTrailLogFileErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		options       CloudTrailFixtureOptions
+		expectedError string
+	}{
+		{"no region", CloudTrailFixtureOptions{Count: 1}, "region"},
+		{"event without a service", CloudTrailFixtureOptions{Region: "us-east-1", Count: 1, EventNames: []string{"ConsoleLogin"}}, "ConsoleLogin is not of the form"},
+		{"event without a name", CloudTrailFixtureOptions{Region: "us-east-1", Count: 1, EventNames: []string{"ec2:"}}, "ec2: is not of the form"},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := generateCloudTrailLogFile(testCase.options)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), testCase.expectedError)
+			}
+		})
+	}
+}
+
+func TestOfflineCloudTrailLogFileGzip(t *testing.T) {
+	t.Parallel()
+
+	logFile, err := generateCloudTrailLogFile(CloudTrailFixtureOptions{Region: "us-east-1", Count: 3})
+	require.NoError(t, err)
+
+	contents, err := logFile.gzipE()
+	require.NoError(t, err)
+
+	reader, err := gzip.NewReader(bytes.NewReader(contents))
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+
+	// Like CloudTrail, one line with all the records
+	assert.True(t, strings.HasPrefix(string(decompressed), `{"Records":[{`), string(decompressed))
+	assert.NotContains(t, string(decompressed), "\n")
+
+	var parsed CloudTrailLogFile
+	require.NoError(t, json.Unmarshal(decompressed, &parsed))
+	assert.Equal(t, logFile.Records, parsed.Records)
+}
+
+func TestOfflineCheckCloudTrailDocuments(t *testing.T) {
+	t.Parallel()
+
+	logFile, err := generateCloudTrailLogFile(CloudTrailFixtureOptions{Region: "us-east-1", Count: 3})
+	require.NoError(t, err)
+	records := logFile.Records
+
+	// A document the way the Logstash pipeline writes a record to its file output
+	document := func(record CloudTrailRecord, timestamp string) string {
+		contents, err := json.Marshal(map[string]interface{}{
+			"@timestamp": timestamp,
+			"@version":   "1",
+			"cloudtrail": record,
+		})
+		require.NoError(t, err)
+		return string(contents)
+	}
+	logstashTimestamp := func(record CloudTrailRecord) string {
+		eventTime, err := time.Parse(time.RFC3339, record.EventTime)
+		require.NoError(t, err)
+		return eventTime.Format("2006-01-02T15:04:05.000Z")
+	}
+	documents := func(records ...CloudTrailRecord) []string {
+		lines := []string{}
+		for _, record := range records {
+			lines = append(lines, document(record, logstashTimestamp(record)))
+		}
+		return lines
+	}
+
+	otherUser := records[1]
+	otherUser.UserIdentity.UserName = "mallory"
+
+	unparsed, err := json.Marshal(logFile)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		lines         []string
+		expectedError string
+	}{
+		{"all records", documents(records...), ""},
+		{
+			"other inputs",
+			append([]string{`{"message":"This is a log line_cloudwatch 1"}`, "not json"}, documents(records...)...),
+			"",
+		},
+		{"missing record", documents(records[0], records[2]), fmt.Sprintf("1 of 3 CloudTrail records as expected, e.g. 0 documents for event %s", records[1].EventID)},
+		{"duplicate record", documents(records[0], records[1], records[2], records[1]), fmt.Sprintf("2 documents for event %s", records[1].EventID)},
+		{
+			"log file not split",
+			[]string{fmt.Sprintf(`{"@timestamp":"2021-05-01T12:00:00.000Z","message":%q,"tags":["_jsonparsefailure"]}`, unparsed)},
+			"3 of 3 CloudTrail records",
+		},
+		{"field not parsed", append(documents(records[0], records[2]), document(otherUser, logstashTimestamp(otherUser))), "userIdentity.userName is 'mallory' instead of"},
+		{
+			"time of ingestion",
+			append(documents(records[0], records[2]), document(records[1], "2031-05-01T12:00:00.000Z")),
+			"@timestamp is 2031-05-01T12:00:00.000Z instead of the event time",
+		},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := checkCloudTrailDocumentsE(strings.Join(testCase.lines, "\n")+"\n", records)
+			if testCase.expectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), testCase.expectedError)
+			}
+		})
+	}
+}
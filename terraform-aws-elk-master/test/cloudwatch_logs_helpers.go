@@ -0,0 +1,233 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/gruntwork-io/terratest/modules/retry"
+)
+
+// The most events a PutLogEvents call accepts
+const CLOUDWATCH_LOGS_MAX_BATCH_EVENTS = 10000
+
+// The most bytes a PutLogEvents call accepts, counting each message plus CLOUDWATCH_LOGS_EVENT_OVERHEAD_BYTES
+const CLOUDWATCH_LOGS_MAX_BATCH_BYTES = 1048576
+const CLOUDWATCH_LOGS_EVENT_OVERHEAD_BYTES = 26
+
+// How many events writeLogEvents sends per PutLogEvents call, unless the options say otherwise
+const CLOUDWATCH_LOGS_DEFAULT_BATCH_EVENTS = 100
+
+// How many events the validate_cloudwatch stages write and expect in the Logstash file output
+const CLOUDWATCH_TEST_LOG_EVENTS = 25
+
+// LogWriter is the part of the CloudWatch Logs API writeLogEventsE uses, so tests can replace it with a fake
+type LogWriter interface {
+	CreateLogStreamWithContext(ctx awsgo.Context, input *cloudwatchlogs.CreateLogStreamInput, opts ...request.Option) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	PutLogEventsWithContext(ctx awsgo.Context, input *cloudwatchlogs.PutLogEventsInput, opts ...request.Option) (*cloudwatchlogs.PutLogEventsOutput, error)
+}
+
+// LogEventsOptions describes the events writeLogEvents generates
+type LogEventsOptions struct {
+	LogGroup string
+	// The log stream is named <StreamPrefix>-<unique id>. Defaults to "test".
+	StreamPrefix string
+	// Each message is "<Content> <message id>"
+	Content string
+	Count   int
+	// Events per PutLogEvents call. Defaults to CLOUDWATCH_LOGS_DEFAULT_BATCH_EVENTS. Batches are also split to stay
+	// under CLOUDWATCH_LOGS_MAX_BATCH_BYTES.
+	BatchSize int
+	// Returns the time to stamp each event with. Defaults to time.Now.
+	Clock func() time.Time
+}
+
+// LogEventsWritten describes the events writeLogEvents wrote, in the order it wrote them
+type LogEventsWritten struct {
+	LogGroup  string
+	LogStream string
+	// The unique id each message ends with
+	MessageIds []string
+	Messages   []string
+}
+
+// logstashOutputContents returns what the Logstash JSON file output has for each message
+func (written *LogEventsWritten) logstashOutputContents() []string {
+	contents := []string{}
+	for _, message := range written.Messages {
+		contents = append(contents, fmt.Sprintf("\"message\":\"%s\"", message))
+	}
+	return contents
+}
+
+func writeLogEvents(t *testing.T, awsRegion string, logGroup string, content string, count int) *LogEventsWritten {
+	ctx, cancel := testContext(t)
+	defer cancel()
+
+	svc, err := defaultAwsClients.cloudWatchLogsClientE(awsRegion)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	written, err := writeLogEventsE(t, ctx, svc, cloudWatchLogsWaitBudget, LogEventsOptions{
+		LogGroup: logGroup,
+		Content:  content,
+		Count:    count,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return written
+}
+
+// writeLogEventsE creates a log stream of its own in the log group and writes Count events to it in batches. A batch
+// rejected for a stale sequence token, e.g. because of another writer, is retried with the token CloudWatch expects,
+// and one that was throttled is retried within the budget.
+func writeLogEventsE(t *testing.T, ctx context.Context, svc LogWriter, budget WaitBudget, options LogEventsOptions) (*LogEventsWritten, error) {
+	if options.StreamPrefix == "" {
+		options.StreamPrefix = "test"
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = CLOUDWATCH_LOGS_DEFAULT_BATCH_EVENTS
+	}
+	if options.BatchSize > CLOUDWATCH_LOGS_MAX_BATCH_EVENTS {
+		options.BatchSize = CLOUDWATCH_LOGS_MAX_BATCH_EVENTS
+	}
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+
+	uniqueId := strings.ToLower(random.UniqueId())
+	written := &LogEventsWritten{
+		LogGroup:   options.LogGroup,
+		LogStream:  fmt.Sprintf("%s-%s", options.StreamPrefix, uniqueId),
+		MessageIds: []string{},
+		Messages:   []string{},
+	}
+
+	description := fmt.Sprintf("creating log stream %s in %s", written.LogStream, written.LogGroup)
+	retrying := false
+	err := waitForE(t, ctx, budget, description, func(ctx context.Context) error {
+		_, err := svc.CreateLogStreamWithContext(ctx, &cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  awsgo.String(written.LogGroup),
+			LogStreamName: awsgo.String(written.LogStream),
+		})
+		// The name of the stream is unique to this call, so if it exists on a retry, an earlier attempt got through but
+		// its response was lost
+		if _, exists := err.(*cloudwatchlogs.ResourceAlreadyExistsException); exists && retrying {
+			return nil
+		}
+		retrying = true
+		if err != nil && !isRetryableLogsError(err) {
+			return retry.FatalError{Underlying: err}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*cloudwatchlogs.InputLogEvent{}
+	var lastTimestamp int64
+	for i := 0; i < options.Count; i++ {
+		messageId := fmt.Sprintf("%s-%d", uniqueId, i)
+		message := fmt.Sprintf("%s %s", options.Content, messageId)
+
+		// The events of a batch have to be in chronological order, so never go back in time
+		timestamp := options.Clock().UnixNano() / int64(time.Millisecond)
+		if timestamp < lastTimestamp {
+			timestamp = lastTimestamp
+		}
+		lastTimestamp = timestamp
+
+		written.MessageIds = append(written.MessageIds, messageId)
+		written.Messages = append(written.Messages, message)
+		events = append(events, &cloudwatchlogs.InputLogEvent{Message: awsgo.String(message), Timestamp: awsgo.Int64(timestamp)})
+	}
+
+	// A new log stream takes no sequence token
+	var sequenceToken *string
+	for _, batch := range logEventBatches(events, options.BatchSize) {
+		sequenceToken, err = putLogEventsE(t, ctx, svc, budget, written, batch, sequenceToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Logf(t, "Wrote %d events to log stream %s in %s", len(events), written.LogStream, written.LogGroup)
+	return written, nil
+}
+
+// putLogEventsE writes one batch and returns the sequence token of the next one
+func putLogEventsE(t *testing.T, ctx context.Context, svc LogWriter, budget WaitBudget, written *LogEventsWritten, batch []*cloudwatchlogs.InputLogEvent, sequenceToken *string) (*string, error) {
+	description := fmt.Sprintf("writing %d events to log stream %s in %s", len(batch), written.LogStream, written.LogGroup)
+	err := waitForE(t, ctx, budget, description, func(ctx context.Context) error {
+		output, err := svc.PutLogEventsWithContext(ctx, &cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  awsgo.String(written.LogGroup),
+			LogStreamName: awsgo.String(written.LogStream),
+			LogEvents:     batch,
+			SequenceToken: sequenceToken,
+		})
+
+		switch err := err.(type) {
+		case nil:
+			if output.RejectedLogEventsInfo != nil {
+				return retry.FatalError{Underlying: fmt.Errorf("CloudWatch Logs rejected events: %s", output.RejectedLogEventsInfo)}
+			}
+			sequenceToken = output.NextSequenceToken
+			return nil
+		case *cloudwatchlogs.DataAlreadyAcceptedException:
+			// An earlier attempt got through, but its response was lost
+			sequenceToken = err.ExpectedSequenceToken
+			return nil
+		case *cloudwatchlogs.InvalidSequenceTokenException:
+			sequenceToken = err.ExpectedSequenceToken
+			return err
+		default:
+			if !isRetryableLogsError(err) {
+				return retry.FatalError{Underlying: err}
+			}
+			return err
+		}
+	})
+	return sequenceToken, err
+}
+
+// logEventBatches splits the events into batches of at most batchSize events and CLOUDWATCH_LOGS_MAX_BATCH_BYTES
+func logEventBatches(events []*cloudwatchlogs.InputLogEvent, batchSize int) [][]*cloudwatchlogs.InputLogEvent {
+	batches := [][]*cloudwatchlogs.InputLogEvent{}
+	batch := []*cloudwatchlogs.InputLogEvent{}
+	batchBytes := 0
+
+	for _, event := range events {
+		eventBytes := len(awsgo.StringValue(event.Message)) + CLOUDWATCH_LOGS_EVENT_OVERHEAD_BYTES
+		if len(batch) > 0 && (len(batch) >= batchSize || batchBytes+eventBytes > CLOUDWATCH_LOGS_MAX_BATCH_BYTES) {
+			batches = append(batches, batch)
+			batch = []*cloudwatchlogs.InputLogEvent{}
+			batchBytes = 0
+		}
+		batch = append(batch, event)
+		batchBytes += eventBytes
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// isRetryableLogsError returns true for throttling and the other CloudWatch Logs errors that go away on their own
+func isRetryableLogsError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	return request.IsErrorThrottle(err) || awsErr.Code() == cloudwatchlogs.ErrCodeServiceUnavailableException || request.IsErrorRetryable(err)
+}
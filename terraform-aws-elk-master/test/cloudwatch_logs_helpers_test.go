@@ -0,0 +1,180 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineWriteLogEvents(t *testing.T) {
+	t.Parallel()
+
+	throttled := awserr.New("ThrottlingException", "Rate exceeded", nil)
+
+	testCases := []struct {
+		name             string
+		fake             *FakeLogWriter
+		count            int
+		batchSize        int
+		expectedAccepted int
+		expectedError    string
+	}{
+		{"one batch", &FakeLogWriter{}, 5, 0, 1, ""},
+		{"several batches", &FakeLogWriter{}, 25, 10, 3, ""},
+		{"batch size above the API limit", &FakeLogWriter{}, 3, 2 * CLOUDWATCH_LOGS_MAX_BATCH_EVENTS, 1, ""},
+		{"no events", &FakeLogWriter{}, 0, 0, 0, ""},
+		{"another writer", &FakeLogWriter{ConcurrentWrites: 2}, 25, 10, 3, ""},
+		{"throttled", &FakeLogWriter{PutErrs: []error{throttled, throttled}}, 25, 10, 3, ""},
+		{"lost response", &FakeLogWriter{LostResponses: 1}, 25, 10, 3, ""},
+		{"lost response of the new stream", &FakeLogWriter{LostCreateResponses: 1}, 25, 10, 3, ""},
+		{"permanent error", &FakeLogWriter{PutErr: awserr.New("AccessDeniedException", "Not authorized", nil)}, 5, 0, 0, "AccessDeniedException"},
+		{"no log group", &FakeLogWriter{LogStreams: map[string][]*cloudwatchlogs.LogStream{}}, 5, 0, 0, "ResourceNotFoundException"},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			if testCase.fake.LogStreams == nil {
+				testCase.fake.LogStreams = map[string][]*cloudwatchlogs.LogStream{"elk": {{LogStreamName: awsgo.String("other")}}}
+			}
+			budget := WaitBudget{Stage: "offline_cloudwatch_logs", Timeout: 10 * time.Second, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+			written, err := writeLogEventsE(t, context.Background(), testCase.fake, budget, LogEventsOptions{
+				LogGroup:  "elk",
+				Content:   "This is a log line_cloudwatch",
+				Count:     testCase.count,
+				BatchSize: testCase.batchSize,
+			})
+			if testCase.expectedError != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), testCase.expectedError)
+				}
+				assert.Empty(t, testCase.fake.Events())
+				return
+			}
+			require.NoError(t, err)
+
+			require.Len(t, written.MessageIds, testCase.count)
+			require.Len(t, written.Messages, testCase.count)
+			assert.True(t, strings.HasPrefix(written.LogStream, "test-"), written.LogStream)
+
+			events := testCase.fake.Events()
+			require.Len(t, events, testCase.expectedAccepted)
+
+			messages := []string{}
+			var lastTimestamp int64
+			for _, input := range events {
+				assert.Equal(t, "elk", awsgo.StringValue(input.LogGroupName))
+				assert.Equal(t, written.LogStream, awsgo.StringValue(input.LogStreamName))
+				for _, event := range input.LogEvents {
+					assert.GreaterOrEqual(t, awsgo.Int64Value(event.Timestamp), lastTimestamp)
+					lastTimestamp = awsgo.Int64Value(event.Timestamp)
+					messages = append(messages, awsgo.StringValue(event.Message))
+				}
+			}
+			assert.Equal(t, written.Messages, messages)
+
+			for i, messageId := range written.MessageIds {
+				assert.Equal(t, "This is a log line_cloudwatch "+messageId, written.Messages[i])
+			}
+		})
+	}
+}
+
+func TestOfflineWriteLogEventsUsesUniqueStreams(t *testing.T) {
+	t.Parallel()
+
+	fake := &FakeLogWriter{LogStreams: map[string][]*cloudwatchlogs.LogStream{"elk": {}}}
+	budget := WaitBudget{Stage: "offline_cloudwatch_logs", Timeout: 10 * time.Second, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	options := LogEventsOptions{LogGroup: "elk", StreamPrefix: "validate-cloudwatch", Content: "line", Count: 2}
+
+	first, err := writeLogEventsE(t, context.Background(), fake, budget, options)
+	require.NoError(t, err)
+	second, err := writeLogEventsE(t, context.Background(), fake, budget, options)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, first.LogStream, second.LogStream)
+	assert.NotEqual(t, first.MessageIds, second.MessageIds)
+	assert.Len(t, fake.LogStreams["elk"], 2)
+	assert.True(t, strings.HasPrefix(first.LogStream, "validate-cloudwatch-"), first.LogStream)
+}
+
+func TestOfflineWriteLogEventsTimestamps(t *testing.T) {
+	t.Parallel()
+
+	// A clock that jumps back, e.g. after an NTP adjustment
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	ticks := []time.Duration{0, time.Second, 500 * time.Millisecond, 2 * time.Second}
+	clock := func() time.Time {
+		tick := ticks[0]
+		ticks = ticks[1:]
+		return start.Add(tick)
+	}
+
+	fake := &FakeLogWriter{LogStreams: map[string][]*cloudwatchlogs.LogStream{"elk": {}}}
+	budget := WaitBudget{Stage: "offline_cloudwatch_logs", Timeout: 10 * time.Second, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	_, err := writeLogEventsE(t, context.Background(), fake, budget, LogEventsOptions{LogGroup: "elk", Content: "line", Count: 4, Clock: clock})
+	require.NoError(t, err)
+
+	events := fake.Events()
+	require.Len(t, events, 1)
+	timestamps := []int64{}
+	for _, event := range events[0].LogEvents {
+		timestamps = append(timestamps, awsgo.Int64Value(event.Timestamp))
+	}
+	startMillis := start.UnixNano() / int64(time.Millisecond)
+	assert.Equal(t, []int64{startMillis, startMillis + 1000, startMillis + 1000, startMillis + 2000}, timestamps)
+}
+
+func TestOfflineLogEventBatches(t *testing.T) {
+	t.Parallel()
+
+	bigMessage := strings.Repeat("x", CLOUDWATCH_LOGS_MAX_BATCH_BYTES/2)
+
+	testCases := []struct {
+		name          string
+		messages      []string
+		batchSize     int
+		expectedSizes []int
+	}{
+		{"empty", []string{}, 10, []int{}},
+		{"under the batch size", []string{"a", "b", "c"}, 10, []int{3}},
+		{"batch size", []string{"a", "b", "c", "d", "e"}, 2, []int{2, 2, 1}},
+		{"byte limit", []string{bigMessage, bigMessage, "a"}, 10, []int{1, 2}},
+		{"message above the byte limit", []string{bigMessage + bigMessage, "a"}, 10, []int{1, 1}},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			events := []*cloudwatchlogs.InputLogEvent{}
+			for _, message := range testCase.messages {
+				events = append(events, &cloudwatchlogs.InputLogEvent{Message: awsgo.String(message)})
+			}
+
+			sizes := []int{}
+			for _, batch := range logEventBatches(events, testCase.batchSize) {
+				sizes = append(sizes, len(batch))
+			}
+			assert.Equal(t, testCase.expectedSizes, sizes)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Command janitor finds and deletes the AWS resources that aborted test runs leaked: the key pairs, secrets and AMIs
+// the tests tag, and the ASGs, ALBs and DNS records named after a test. It only lists them unless you pass -delete.
+//
+//	go run ./cmd/janitor -min-age 12h
+//	go run ./cmd/janitor -regions us-east-1,eu-west-1 -delete
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/package-elk/test"
+)
+
+func main() {
+	regions := flag.String("regions", strings.Join(test.RegionsWithGruntworkINACM, ","), "Comma separated regions to look in")
+	minAge := flag.Duration("min-age", test.JANITOR_DEFAULT_MIN_AGE, "Only resources created longer ago than this are leaked")
+	zoneName := flag.String("zone", "gruntwork.in", "The Route 53 zone to delete the DNS records of leaked ALBs from. Empty to skip DNS records.")
+	deleteResources := flag.Bool("delete", false, "Delete the leaked resources. Without it, the janitor only lists them.")
+	flag.Parse()
+
+	janitorLogger := log.New(os.Stderr, "[janitor] ", log.LstdFlags)
+	options := test.JanitorOptions{
+		Regions:  strings.Split(*regions, ","),
+		MinAge:   *minAge,
+		ZoneName: *zoneName,
+		Logger:   janitorLogger,
+	}
+	ctx := context.Background()
+
+	resources, findErr := test.FindLeakedTestResources(ctx, options)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "KIND\tREGION\tNAME\tID\tCREATED\tREASON")
+	for _, resource := range resources {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", resource.Kind, resource.Region, resource.Name, resource.Id, resource.CreatedAt.UTC().Format(time.RFC3339), resource.Reason)
+	}
+	writer.Flush()
+
+	if findErr != nil {
+		janitorLogger.Print(findErr)
+	}
+
+	if !*deleteResources {
+		janitorLogger.Printf("Dry run: found %d leaked resources older than %s. Pass -delete to delete them.", len(resources), *minAge)
+	} else if err := test.DeleteTestResources(ctx, options, resources); err != nil {
+		janitorLogger.Fatal(err)
+	} else {
+		janitorLogger.Printf("Deleted %d leaked resources", len(resources))
+	}
+
+	if findErr != nil {
+		os.Exit(1)
+	}
+}
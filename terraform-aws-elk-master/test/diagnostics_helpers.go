@@ -0,0 +1,482 @@
+package test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+// The name of the index file at the root of a diagnostics bundle
+const DIAGNOSTICS_INDEX_FILE = "index.json"
+
+// How many lines of each journal collectDiagnostics keeps
+const DIAGNOSTICS_JOURNAL_LINES = 5000
+
+// How long collectDiagnostics waits for each local URL on an instance
+const DIAGNOSTICS_CURL_TIMEOUT = 10 * time.Second
+
+// An Elasticsearch API collectDiagnostics captures
+type ElasticsearchDiagnosticsApi struct {
+	File  string
+	Path  string
+	Query url.Values
+}
+
+var elasticsearchDiagnosticsApis = []ElasticsearchDiagnosticsApi{
+	{"cluster-health.json", "/_cluster/health", url.Values{"pretty": {"true"}}},
+	{"cat-shards.txt", "/_cat/shards", url.Values{"v": {"true"}}},
+	// Explains the first unassigned shard. Returns an error if every shard is assigned.
+	{"cluster-allocation-explain.json", "/_cluster/allocation/explain", url.Values{"pretty": {"true"}}},
+	{"nodes-stats.json", "/_nodes/stats", url.Values{"pretty": {"true"}}},
+}
+
+// DiagnosticsTier is a group of instances that run the same part of the stack, e.g. the Logstash servers
+type DiagnosticsTier struct {
+	// Names the folder of the tier in the bundle
+	Name     string
+	AsgNames []string
+	// Instances that aren't part of an ASG, such as the app server
+	InstanceIds []string
+	// Files under /var/log to collect, besides the system and user-data logs
+	LogFileNameFilters []string
+	// The systemd units to collect the journal of
+	JournalUnits []string
+	// URLs to request from the instance itself, such as APIs that only listen on localhost
+	LocalUrls []string
+}
+
+func elasticsearchDiagnosticsTier(asgNames []string) DiagnosticsTier {
+	return DiagnosticsTier{
+		Name:               "elasticsearch",
+		AsgNames:           asgNames,
+		LogFileNameFilters: []string{"es-cluster*", "elasticsearch*"},
+		JournalUnits:       []string{"elasticsearch"},
+	}
+}
+
+func logstashDiagnosticsTier(asgNames []string) DiagnosticsTier {
+	return DiagnosticsTier{
+		Name:               "logstash",
+		AsgNames:           asgNames,
+		LogFileNameFilters: []string{"logstash*"},
+		JournalUnits:       []string{"logstash"},
+		// The Logstash monitoring API only listens on localhost
+		LocalUrls: []string{"http://localhost:9600/_node/stats?pretty"},
+	}
+}
+
+// kibanaDiagnosticsTier collects the status of Kibana from kibanaUrl, e.g. https://localhost:5601
+func kibanaDiagnosticsTier(asgNames []string, kibanaUrl string) DiagnosticsTier {
+	return DiagnosticsTier{
+		Name:               "kibana",
+		AsgNames:           asgNames,
+		LogFileNameFilters: []string{"kibana*"},
+		JournalUnits:       []string{"kibana"},
+		LocalUrls:          []string{kibanaUrl + "/api/status"},
+	}
+}
+
+func elastalertDiagnosticsTier(asgNames []string) DiagnosticsTier {
+	return DiagnosticsTier{
+		Name:               "elastalert",
+		AsgNames:           asgNames,
+		LogFileNameFilters: []string{"elastalert*"},
+		JournalUnits:       []string{"elastalert"},
+	}
+}
+
+// appServerDiagnosticsTier collects the app servers, which ship logs and metrics with Filebeat and collectd
+func appServerDiagnosticsTier(instanceIds []string) DiagnosticsTier {
+	return DiagnosticsTier{
+		Name:               "app-server",
+		InstanceIds:        instanceIds,
+		LogFileNameFilters: []string{"filebeat*", "collectd*"},
+		JournalUnits:       []string{"filebeat", "collectd"},
+	}
+}
+
+// DiagnosticsOptions configures collectDiagnostics
+type DiagnosticsOptions struct {
+	// Names the bundle
+	Name       string
+	RemoteExec RemoteExecOptions
+	Tiers      []DiagnosticsTier
+	// The cluster to capture the state of. Optional.
+	Elasticsearch *ElasticsearchClient
+}
+
+// DiagnosticsIndex lists what a diagnostics bundle contains
+type DiagnosticsIndex struct {
+	Name      string                  `json:"name"`
+	CreatedAt string                  `json:"created_at"`
+	Entries   []DiagnosticsIndexEntry `json:"entries"`
+}
+
+// DiagnosticsIndexEntry is a file or folder of a diagnostics bundle, or the error that prevented collecting it
+type DiagnosticsIndexEntry struct {
+	Path        string `json:"path"`
+	Description string `json:"description"`
+	Error       string `json:"error,omitempty"`
+}
+
+// DiagnosticsBundle collects files into a folder and packs them into a tarball with an index
+type DiagnosticsBundle struct {
+	Dir   string
+	Index DiagnosticsIndex
+}
+
+// collectDiagnostics gathers the logs, journals and local API responses of every instance of every tier, the state
+// of the Elasticsearch cluster, the ASG activity history and the target group health into a timestamped tarball, and
+// returns its path. Failing to collect something is recorded in the index rather than failing the test.
+func collectDiagnostics(t *testing.T, options DiagnosticsOptions) string {
+	bundle, err := newDiagnosticsBundleE(options.Name, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create diagnostics bundle: %v", err)
+	}
+	defer os.RemoveAll(bundle.Dir)
+
+	if options.Elasticsearch != nil {
+		collectElasticsearchDiagnostics(t, bundle, options.Elasticsearch)
+	}
+	for _, tier := range options.Tiers {
+		collectTierDiagnostics(t, bundle, options.RemoteExec, tier)
+	}
+
+	tarballPath, err := bundle.writeTarballE(diagnosticsBaseDir(t))
+	if err != nil {
+		t.Fatalf("Failed to write diagnostics bundle: %v", err)
+	}
+
+	logger.Logf(t, "Wrote diagnostics to %s. See %s in it for its contents.", tarballPath, DIAGNOSTICS_INDEX_FILE)
+	return tarballPath
+}
+
+// diagnosticsBaseDir returns where to write diagnostics. On CircleCI, that is /tmp/logs, so they get artifacted.
+func diagnosticsBaseDir(t *testing.T) string {
+	if os.Getenv("CIRCLECI") != "" {
+		return filepath.Join("/tmp/logs", "debug", t.Name())
+	}
+	return filepath.Join(".", "debug", t.Name())
+}
+
+func newDiagnosticsBundleE(name string, createdAt time.Time) (*DiagnosticsBundle, error) {
+	dir, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		return nil, err
+	}
+	return &DiagnosticsBundle{
+		Dir: dir,
+		Index: DiagnosticsIndex{
+			Name:      name,
+			CreatedAt: createdAt.UTC().Format(time.RFC3339),
+			Entries:   []DiagnosticsIndexEntry{},
+		},
+	}, nil
+}
+
+// add writes what collect returns to the file at path in the bundle. If collect fails, whatever it returned is still
+// written and the error is recorded in the index.
+func (bundle *DiagnosticsBundle) add(t *testing.T, path string, description string, collect func() ([]byte, error)) {
+	contents, err := collect()
+	if len(contents) > 0 {
+		if writeErr := bundle.writeFileE(path, contents); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	bundle.record(t, path, description, err)
+}
+
+// addDir lets collect fill the folder at path in the bundle and records the folder in the index
+func (bundle *DiagnosticsBundle) addDir(t *testing.T, path string, description string, collect func(dir string) error) {
+	dir := filepath.Join(bundle.Dir, path)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = collect(dir)
+	}
+	bundle.record(t, path, description, err)
+}
+
+// addJson writes what collect returns as indented JSON
+func (bundle *DiagnosticsBundle) addJson(t *testing.T, path string, description string, collect func() (interface{}, error)) {
+	bundle.add(t, path, description, func() ([]byte, error) {
+		value, err := collect()
+		if err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(value, "", "  ")
+	})
+}
+
+func (bundle *DiagnosticsBundle) record(t *testing.T, path string, description string, err error) {
+	entry := DiagnosticsIndexEntry{Path: filepath.ToSlash(path), Description: description}
+	if err != nil {
+		entry.Error = err.Error()
+		logger.Logf(t, "Failed to collect %s (%s): %v", path, description, err)
+	}
+	bundle.Index.Entries = append(bundle.Index.Entries, entry)
+}
+
+func (bundle *DiagnosticsBundle) writeFileE(path string, contents []byte) error {
+	fullPath := filepath.Join(bundle.Dir, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fullPath, contents, 0644)
+}
+
+// writeTarballE writes the index and packs the bundle into diagnostics-<name>-<timestamp>.tar.gz in destDir, with
+// every file under a folder of the same name
+func (bundle *DiagnosticsBundle) writeTarballE(destDir string) (string, error) {
+	index, err := json.MarshalIndent(bundle.Index, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := bundle.writeFileE(DIAGNOSTICS_INDEX_FILE, index); err != nil {
+		return "", err
+	}
+
+	createdAt, err := time.Parse(time.RFC3339, bundle.Index.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("diagnostics-%s-%s", strings.Trim(nonAlphanumericRegexp.ReplaceAllString(bundle.Index.Name, "-"), "-"), createdAt.Format("20060102T150405Z"))
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return "", err
+	}
+	tarballPath := filepath.Join(destDir, name+".tar.gz")
+	tarball, err := os.Create(tarballPath)
+	if err != nil {
+		return "", err
+	}
+	defer tarball.Close()
+
+	gzipWriter := gzip.NewWriter(tarball)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err = filepath.Walk(bundle.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		relativePath, err := filepath.Rel(bundle.Dir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(name, relativePath))
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tarWriter, file)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return "", err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return "", err
+	}
+	return tarballPath, nil
+}
+
+func collectElasticsearchDiagnostics(t *testing.T, bundle *DiagnosticsBundle, client *ElasticsearchClient) {
+	for _, api := range elasticsearchDiagnosticsApis {
+		api := api
+		bundle.add(t, filepath.Join("elasticsearch-api", api.File), fmt.Sprintf("GET %s", api.Path), func() ([]byte, error) {
+			body, err := client.Get(api.Path, api.Query)
+			if esErr, ok := err.(ElasticsearchError); ok {
+				// Keep the error response, e.g. the reason allocation explain had nothing to explain
+				return []byte(esErr.Body), err
+			}
+			return body, err
+		})
+	}
+}
+
+func collectTierDiagnostics(t *testing.T, bundle *DiagnosticsBundle, remoteExec RemoteExecOptions, tier DiagnosticsTier) {
+	ctx := context.Background()
+
+	for _, asgName := range tier.AsgNames {
+		asgName := asgName
+		asgDir := filepath.Join(tier.Name, asgName)
+
+		bundle.addJson(t, filepath.Join(asgDir, "scaling-activities.json"), fmt.Sprintf("Activity history of ASG %s", asgName), func() (interface{}, error) {
+			return getAsgScalingActivitiesE(t, ctx, remoteExec.AwsRegion, asgName)
+		})
+		bundle.addJson(t, filepath.Join(asgDir, "target-health.json"), fmt.Sprintf("Health of the targets in the target groups of ASG %s", asgName), func() (interface{}, error) {
+			return getAsgTargetHealthE(t, ctx, remoteExec.AwsRegion, asgName)
+		})
+
+		instances, err := getAllAsgInstancesInRegionE(ctx, remoteExec.AwsRegion, asgName)
+		if err != nil {
+			bundle.record(t, asgDir, fmt.Sprintf("Instances of ASG %s", asgName), err)
+			continue
+		}
+		bundle.addJson(t, filepath.Join(asgDir, "instances.json"), fmt.Sprintf("Instances of ASG %s", asgName), func() (interface{}, error) {
+			return instances, nil
+		})
+		for _, instance := range instances {
+			collectInstanceDiagnostics(t, bundle, filepath.Join(asgDir, instance.InstanceId), remoteExec, instance, tier)
+		}
+	}
+
+	for _, instanceId := range tier.InstanceIds {
+		instanceDir := filepath.Join(tier.Name, instanceId)
+		instance, err := getInstanceInRegionE(remoteExec.AwsRegion, instanceId)
+		if err != nil {
+			bundle.record(t, instanceDir, fmt.Sprintf("Instance %s", instanceId), err)
+			continue
+		}
+		collectInstanceDiagnostics(t, bundle, instanceDir, remoteExec, instance, tier)
+	}
+}
+
+func collectInstanceDiagnostics(t *testing.T, bundle *DiagnosticsBundle, dir string, remoteExec RemoteExecOptions, instance AsgInstance, tier DiagnosticsTier) {
+	executor, err := remoteExec.executorE(instance)
+	if err != nil {
+		bundle.record(t, dir, fmt.Sprintf("Instance %s", instance.InstanceId), err)
+		return
+	}
+
+	filters := remoteExec.Os.logFileNameFilters(tier.LogFileNameFilters...)
+	bundle.addDir(t, filepath.Join(dir, "logs"), fmt.Sprintf("Files matching %v under /var/log on %s", filters, executor), func(localDir string) error {
+		return downloadRemoteFilesE(t, executor, "/var/log", filters, localDir)
+	})
+
+	commands := diagnosticsCommands(tier)
+	descriptions := []string{}
+	for _, command := range commands {
+		descriptions = append(descriptions, fmt.Sprintf("%s: %s", command.File, command.Command))
+	}
+	bundle.addDir(t, filepath.Join(dir, "commands"), fmt.Sprintf("Output of commands on %s. %s", executor, strings.Join(descriptions, ". ")), func(localDir string) error {
+		return runDiagnosticsCommandsE(t, executor, commands, localDir)
+	})
+}
+
+// DiagnosticsCommand is a command collectDiagnostics runs on an instance, and the file it writes its output to
+type DiagnosticsCommand struct {
+	File    string
+	Command string
+}
+
+// diagnosticsCommands returns the commands that capture the journals and local URLs of the tier
+func diagnosticsCommands(tier DiagnosticsTier) []DiagnosticsCommand {
+	commands := []DiagnosticsCommand{
+		{"journal.txt", fmt.Sprintf("sudo journalctl --no-pager -b -n %d", DIAGNOSTICS_JOURNAL_LINES)},
+	}
+	for _, unit := range tier.JournalUnits {
+		commands = append(commands, DiagnosticsCommand{
+			File:    fmt.Sprintf("journal-%s.txt", unit),
+			Command: fmt.Sprintf("sudo journalctl --no-pager -u %s -n %d", shellQuote(unit), DIAGNOSTICS_JOURNAL_LINES),
+		})
+	}
+	for _, localUrl := range tier.LocalUrls {
+		commands = append(commands, DiagnosticsCommand{
+			File:    fmt.Sprintf("%s.txt", strings.Trim(nonAlphanumericRegexp.ReplaceAllString(localUrl, "-"), "-")),
+			Command: fmt.Sprintf("curl -sSk --max-time %d %s", int(DIAGNOSTICS_CURL_TIMEOUT.Seconds()), shellQuote(localUrl)),
+		})
+	}
+	return commands
+}
+
+// runDiagnosticsCommandsE runs the commands on the instance, each writing to its own file in a temporary folder, and
+// downloads that folder. Output is captured to files first, so transports that limit the output can still fetch all
+// of it. A command that fails only leaves its error in its file.
+func runDiagnosticsCommandsE(t *testing.T, executor RemoteExecutor, commands []DiagnosticsCommand, localDir string) error {
+	script := []string{"set -e", "dir=$(mktemp -d)"}
+	for _, command := range commands {
+		script = append(script, fmt.Sprintf("(%s) > \"$dir\"/%s 2>&1 || true", command.Command, shellQuote(command.File)))
+	}
+	script = append(script, "echo \"$dir\"")
+
+	output, err := executor.RunCommandE(t, strings.Join(script, "; "))
+	if err != nil {
+		return err
+	}
+	remoteDir := strings.TrimSpace(output)
+	if remoteDir == "" {
+		return fmt.Errorf("Expected the folder with the command output on %s but got nothing", executor)
+	}
+	defer func() {
+		if _, err := executor.RunCommandE(t, fmt.Sprintf("rm -rf %s", shellQuote(remoteDir))); err != nil {
+			logger.Logf(t, "Failed to delete %s on %s: %v", remoteDir, executor, err)
+		}
+	}()
+
+	return downloadRemoteFilesE(t, executor, remoteDir, nil, localDir)
+}
+
+func getAsgScalingActivitiesE(t *testing.T, ctx context.Context, awsRegion string, asgName string) ([]*autoscaling.Activity, error) {
+	asgClient, err := defaultAwsClients.asgClientE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	activities := []*autoscaling.Activity{}
+	err = asgClient.DescribeScalingActivitiesPagesWithContext(ctx, &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: awsgo.String(asgName),
+	}, func(page *autoscaling.DescribeScalingActivitiesOutput, lastPage bool) bool {
+		activities = append(activities, page.Activities...)
+		return true
+	})
+	return activities, err
+}
+
+// getAsgTargetHealthE returns the health of the targets of every target group the ASG registers its instances with,
+// by target group ARN
+func getAsgTargetHealthE(t *testing.T, ctx context.Context, awsRegion string, asgName string) (map[string][]*elbv2.TargetHealthDescription, error) {
+	asgClient, err := defaultAwsClients.asgClientE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+	group, err := describeAsgE(ctx, asgClient, asgName)
+	if err != nil {
+		return nil, err
+	}
+
+	elbClient, err := defaultAwsClients.elbv2ClientE(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	health := map[string][]*elbv2.TargetHealthDescription{}
+	for _, targetGroupArn := range awsgo.StringValueSlice(group.TargetGroupARNs) {
+		output, err := elbClient.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+			TargetGroupArn: awsgo.String(targetGroupArn),
+		})
+		if err != nil {
+			return health, err
+		}
+		health[targetGroupArn] = output.TargetHealthDescriptions
+	}
+	return health, nil
+}
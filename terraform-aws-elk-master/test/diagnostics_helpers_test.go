@@ -0,0 +1,159 @@
+package test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineDiagnosticsBundleTarball(t *testing.T) {
+	t.Parallel()
+
+	createdAt := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	bundle, err := newDiagnosticsBundleE("TestFoo/bar", createdAt)
+	require.NoError(t, err)
+	defer os.RemoveAll(bundle.Dir)
+
+	bundle.add(t, "es/health.json", "health", func() ([]byte, error) {
+		return []byte(`{"status":"green"}`), nil
+	})
+	bundle.add(t, "es/explain.json", "explain", func() ([]byte, error) {
+		return []byte(`{"error":"nothing to explain"}`), errors.New("status 400")
+	})
+	bundle.addJson(t, "asg/instances.json", "instances", func() (interface{}, error) {
+		return []AsgInstance{{InstanceId: "i-1"}}, nil
+	})
+	bundle.addDir(t, "asg/i-1/logs", "logs", func(dir string) error {
+		return ioutil.WriteFile(filepath.Join(dir, "syslog"), []byte("syslog line"), 0644)
+	})
+	bundle.addDir(t, "asg/i-2/logs", "logs", func(dir string) error {
+		return errors.New("unreachable")
+	})
+
+	destDir, err := ioutil.TempDir("", "diagnostics-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(destDir)
+
+	tarballPath, err := bundle.writeTarballE(destDir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(destDir, "diagnostics-TestFoo-bar-20210304T050607Z.tar.gz"), tarballPath)
+
+	contents := readTarGz(t, tarballPath)
+	prefix := "diagnostics-TestFoo-bar-20210304T050607Z/"
+	assert.Equal(t, `{"status":"green"}`, contents[prefix+"es/health.json"])
+	assert.Equal(t, `{"error":"nothing to explain"}`, contents[prefix+"es/explain.json"], "The output of a failed collection is kept")
+	assert.Equal(t, "syslog line", contents[prefix+"asg/i-1/logs/syslog"])
+	assert.Contains(t, contents[prefix+"asg/instances.json"], `"InstanceId": "i-1"`)
+
+	var index DiagnosticsIndex
+	require.NoError(t, json.Unmarshal([]byte(contents[prefix+DIAGNOSTICS_INDEX_FILE]), &index))
+	assert.Equal(t, "TestFoo/bar", index.Name)
+	assert.Equal(t, "2021-03-04T05:06:07Z", index.CreatedAt)
+	assert.Equal(t, []DiagnosticsIndexEntry{
+		{Path: "es/health.json", Description: "health"},
+		{Path: "es/explain.json", Description: "explain", Error: "status 400"},
+		{Path: "asg/instances.json", Description: "instances"},
+		{Path: "asg/i-1/logs", Description: "logs"},
+		{Path: "asg/i-2/logs", Description: "logs", Error: "unreachable"},
+	}, index.Entries)
+}
+
+func TestOfflineCollectElasticsearchDiagnostics(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeElasticsearch(t, defaultFakeElasticsearchState())
+	defer server.Close()
+
+	bundle, err := newDiagnosticsBundleE("es", time.Now())
+	require.NoError(t, err)
+	defer os.RemoveAll(bundle.Dir)
+
+	collectElasticsearchDiagnostics(t, bundle, newElasticsearchClient(t, server.URL, nil, "", ""))
+
+	health, err := ioutil.ReadFile(filepath.Join(bundle.Dir, "elasticsearch-api", "cluster-health.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(health), `"status":"green"`)
+
+	// The fake doesn't implement the other APIs, so their error responses are kept and their errors recorded
+	shards, err := ioutil.ReadFile(filepath.Join(bundle.Dir, "elasticsearch-api", "cat-shards.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(shards), "fake_not_implemented")
+
+	require.Len(t, bundle.Index.Entries, len(elasticsearchDiagnosticsApis))
+	assert.Empty(t, bundle.Index.Entries[0].Error)
+	for _, entry := range bundle.Index.Entries[1:] {
+		assert.Contains(t, entry.Error, "404", entry.Path)
+	}
+}
+
+func TestOfflineRunDiagnosticsCommands(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("The archive commands use GNU options")
+	}
+
+	server := startFakeElasticsearch(t, defaultFakeElasticsearchState())
+	defer server.Close()
+
+	tier := kibanaDiagnosticsTier(nil, server.URL)
+	tier.JournalUnits = nil
+	commands := append(diagnosticsCommands(tier), DiagnosticsCommand{"fails.txt", "echo partial output; exit 3"})
+
+	localDir, err := ioutil.TempDir("", "diagnostics-commands")
+	require.NoError(t, err)
+	defer os.RemoveAll(localDir)
+
+	executor := &localExecutor{outputLimit: SSM_OUTPUT_LIMIT}
+	require.NoError(t, runDiagnosticsCommandsE(t, executor, commands, localDir))
+
+	status, err := ioutil.ReadFile(filepath.Join(localDir, commands[1].File))
+	require.NoError(t, err)
+	assert.Contains(t, string(status), "fake-kibana")
+
+	failed, err := ioutil.ReadFile(filepath.Join(localDir, "fails.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "partial output\n", string(failed))
+
+	// journalctl may not be available, but its file is always written
+	assert.FileExists(t, filepath.Join(localDir, "journal.txt"))
+
+	// The folder with the output is deleted
+	remoteDir := strings.Trim(strings.Fields(executor.commands[len(executor.commands)-1])[2], "'")
+	assert.NoDirExists(t, remoteDir)
+}
+
+// readTarGz returns the contents of the regular files of the archive by path
+func readTarGz(t *testing.T, path string) map[string]string {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+
+	contents := map[string]string{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return contents
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tarReader)
+		require.NoError(t, err)
+		contents[header.Name] = string(data)
+	}
+}
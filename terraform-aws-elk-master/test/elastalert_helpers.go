@@ -0,0 +1,193 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/gruntwork-io/terratest/modules/aws"
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+// The name of the rule in examples/elk-amis/elastalert/elastalert-rules/example_change.yml
+const ELASTALERT_EXAMPLE_CHANGE_RULE_NAME = "Test Alert"
+
+// SnsNotification is the envelope SNS wraps a message in when it delivers it to an SQS queue
+type SnsNotification struct {
+	Type      string
+	MessageId string
+	TopicArn  string
+	Subject   string
+	Message   string
+	Timestamp string
+}
+
+// SnsCapture is an SQS queue subscribed to an SNS topic, which lets a test read what was published to the topic
+type SnsCapture struct {
+	AwsRegion       string
+	QueueUrl        string
+	QueueArn        string
+	SubscriptionArn string
+}
+
+// captureSnsTopic creates an SQS queue and subscribes it to the SNS topic. Call delete on the result when done.
+func captureSnsTopic(t *testing.T, awsRegion string, topicArn string) SnsCapture {
+	capture := SnsCapture{AwsRegion: awsRegion}
+	capture.QueueUrl = aws.CreateRandomQueue(t, awsRegion, "elk-sns-capture")
+
+	sqsClient := aws.NewSqsClient(t, awsRegion)
+	attributes, err := sqsClient.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       awsgo.String(capture.QueueUrl),
+		AttributeNames: awsgo.StringSlice([]string{sqs.QueueAttributeNameQueueArn}),
+	})
+	if err != nil {
+		aws.DeleteQueue(t, awsRegion, capture.QueueUrl)
+		t.Fatalf("Failed to look up the ARN of queue %s: %v", capture.QueueUrl, err)
+	}
+	capture.QueueArn = awsgo.StringValue(attributes.Attributes[sqs.QueueAttributeNameQueueArn])
+
+	// SNS can only deliver to the queue if the queue policy allows the topic to send to it
+	policy := fmt.Sprintf(`{
+  "Version": "2012-10-17",
+  "Statement": [{
+    "Effect": "Allow",
+    "Principal": {"Service": "sns.amazonaws.com"},
+    "Action": "sqs:SendMessage",
+    "Resource": "%s",
+    "Condition": {"ArnEquals": {"aws:SourceArn": "%s"}}
+  }]
+}`, capture.QueueArn, topicArn)
+
+	_, err = sqsClient.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		QueueUrl:   awsgo.String(capture.QueueUrl),
+		Attributes: map[string]*string{sqs.QueueAttributeNamePolicy: awsgo.String(policy)},
+	})
+	if err != nil {
+		aws.DeleteQueue(t, awsRegion, capture.QueueUrl)
+		t.Fatalf("Failed to allow topic %s to send to queue %s: %v", topicArn, capture.QueueUrl, err)
+	}
+
+	subscription, err := aws.NewSnsClient(t, awsRegion).Subscribe(&sns.SubscribeInput{
+		TopicArn: awsgo.String(topicArn),
+		Protocol: awsgo.String("sqs"),
+		Endpoint: awsgo.String(capture.QueueArn),
+	})
+	if err != nil {
+		aws.DeleteQueue(t, awsRegion, capture.QueueUrl)
+		t.Fatalf("Failed to subscribe queue %s to topic %s: %v", capture.QueueArn, topicArn, err)
+	}
+	capture.SubscriptionArn = awsgo.StringValue(subscription.SubscriptionArn)
+
+	logger.Logf(t, "Capturing messages published to %s in queue %s", topicArn, capture.QueueUrl)
+	return capture
+}
+
+// delete unsubscribes the queue from the topic and deletes it
+func (capture SnsCapture) delete(t *testing.T) {
+	_, err := aws.NewSnsClient(t, capture.AwsRegion).Unsubscribe(&sns.UnsubscribeInput{
+		SubscriptionArn: awsgo.String(capture.SubscriptionArn),
+	})
+	if err != nil {
+		logger.Logf(t, "Failed to delete subscription %s: %v", capture.SubscriptionArn, err)
+	}
+	aws.DeleteQueue(t, capture.AwsRegion, capture.QueueUrl)
+}
+
+// waitForNotification waits for a message matching the given function to be published to the captured topic. Other
+// messages are deleted from the queue and ignored.
+func (capture SnsCapture) waitForNotification(t *testing.T, budget WaitBudget, description string, matches func(notification SnsNotification) bool) SnsNotification {
+	sqsClient := aws.NewSqsClient(t, capture.AwsRegion)
+
+	var found SnsNotification
+	waitFor(t, budget, description, func(ctx context.Context) error {
+		out, err := sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            awsgo.String(capture.QueueUrl),
+			MaxNumberOfMessages: awsgo.Int64(10),
+			WaitTimeSeconds:     awsgo.Int64(20),
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, message := range out.Messages {
+			notification, err := parseSnsNotification(awsgo.StringValue(message.Body))
+			if err != nil {
+				logger.Logf(t, "Ignoring message that is not an SNS notification: %v", err)
+			} else {
+				logger.Logf(t, "Received SNS notification %s: %s", notification.MessageId, notification.Subject)
+			}
+
+			aws.DeleteMessageFromQueue(t, capture.AwsRegion, capture.QueueUrl, awsgo.StringValue(message.ReceiptHandle))
+
+			if err == nil && matches(notification) {
+				found = notification
+				return nil
+			}
+		}
+
+		return fmt.Errorf("No matching notification in queue %s yet", capture.QueueUrl)
+	})
+
+	return found
+}
+
+func parseSnsNotification(body string) (SnsNotification, error) {
+	var notification SnsNotification
+	if err := json.Unmarshal([]byte(body), &notification); err != nil {
+		return notification, fmt.Errorf("Failed to parse SNS notification %q: %v", body, err)
+	}
+	if notification.Type != "Notification" {
+		return notification, fmt.Errorf("Expected an SNS message of type Notification but got %q", notification.Type)
+	}
+	return notification, nil
+}
+
+// newElastAlertChangeEvents returns two events for the given plugin whose values differ, which is what the change rule
+// in example_change.yml alerts on. Use a unique plugin, so the alert can be told apart from others.
+func newElastAlertChangeEvents(plugin string) []BeatsEvent {
+	// ElastAlert only looks at documents with recent timestamps, and compares them in the order of their timestamps
+	now := time.Now().UTC()
+	events := []BeatsEvent{}
+	for i, values := range []string{"1", "2"} {
+		event := newBeatsEvent(fmt.Sprintf("ElastAlert change test %s values=%s", plugin, values), map[string]interface{}{
+			"plugin": plugin,
+			"values": values,
+		})
+		event["@timestamp"] = now.Add(time.Duration(i-1) * time.Second).Format(time.RFC3339Nano)
+		events = append(events, event)
+	}
+	return events
+}
+
+// sendElastAlertChangeEvents sends the events of newElastAlertChangeEvents to the beats input, so that they reach the
+// logstash-* indices example_change.yml searches through the Logstash pipeline, like any other log
+func sendElastAlertChangeEvents(t *testing.T, options BeatsClientOptions, plugin string) {
+	sendBeatsEvents(t, options, newElastAlertChangeEvents(plugin))
+	logger.Logf(t, "Sent events for plugin %s to Logstash at %s to trigger the ElastAlert change rule", plugin, options.Address)
+}
+
+// isElastAlertNotification returns true if the notification is an alert of the given rule for the given query key.
+// ElastAlert uses "ElastAlert: <rule name> - <query key>" as subject and starts the message with the rule name.
+func isElastAlertNotification(notification SnsNotification, ruleName string, queryKey string) bool {
+	return strings.Contains(notification.Subject, ruleName) &&
+		strings.Contains(notification.Subject, queryKey) &&
+		strings.HasPrefix(strings.TrimSpace(notification.Message), ruleName)
+}
+
+// waitForElastAlertAlert waits for ElastAlert to publish an alert of the given rule for the given query key to the
+// captured topic
+func waitForElastAlertAlert(t *testing.T, capture SnsCapture, ruleName string, queryKey string) SnsNotification {
+	description := fmt.Sprintf("ElastAlert to send an alert for rule %q and query key %s", ruleName, queryKey)
+	notification := capture.waitForNotification(t, elastalertWaitBudget, description, func(notification SnsNotification) bool {
+		return isElastAlertNotification(notification, ruleName, queryKey)
+	})
+
+	logger.Logf(t, "ElastAlert sent alert %s: %s", notification.MessageId, notification.Message)
+	return notification
+}
@@ -0,0 +1,57 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineIsElastAlertNotification(t *testing.T) {
+	t.Parallel()
+
+	// An alert of example_change.yml as SNS delivers it to an SQS queue
+	body := `{
+  "Type" : "Notification",
+  "MessageId" : "5b0b0d5e-8d1f-5a3b-9c3e-3a1c1f6f2f1a",
+  "TopicArn" : "arn:aws:sns:us-east-1:000000000000:sns-abc123",
+  "Subject" : "ElastAlert: Test Alert - elastalert-test-abc123",
+  "Message" : "Test Alert\n\nplugin: elastalert-test-abc123\nvalues: 2\n",
+  "Timestamp" : "2021-06-01T12:00:00.000Z"
+}`
+
+	notification, err := parseSnsNotification(body)
+	require.NoError(t, err)
+
+	assert.True(t, isElastAlertNotification(notification, ELASTALERT_EXAMPLE_CHANGE_RULE_NAME, "elastalert-test-abc123"))
+	assert.False(t, isElastAlertNotification(notification, ELASTALERT_EXAMPLE_CHANGE_RULE_NAME, "elastalert-test-other"))
+	assert.False(t, isElastAlertNotification(notification, "Other Rule", "elastalert-test-abc123"))
+
+	_, err = parseSnsNotification(`{"Type": "SubscriptionConfirmation"}`)
+	assert.Error(t, err)
+	_, err = parseSnsNotification("not json")
+	assert.Error(t, err)
+}
+
+func TestOfflineSendElastAlertChangeEvents(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeBeats(t, FakeBeatsOptions{})
+	defer server.Close()
+
+	sendElastAlertChangeEvents(t, BeatsClientOptions{Address: server.Address}, "elastalert-test-abc123")
+
+	events := server.Events()
+	require.Len(t, events, 2)
+	for i, values := range []string{"1", "2"} {
+		assert.Equal(t, "elastalert-test-abc123", events[i]["plugin"])
+		assert.Equal(t, values, events[i]["values"])
+	}
+
+	first, err := time.Parse(time.RFC3339Nano, events[0]["@timestamp"].(string))
+	require.NoError(t, err)
+	second, err := time.Parse(time.RFC3339Nano, events[1]["@timestamp"].(string))
+	require.NoError(t, err)
+	assert.True(t, first.Before(second), "%s is not before %s", first, second)
+}
@@ -2,21 +2,14 @@ package test
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
-	"strconv"
 	"testing"
 
 	"github.com/gruntwork-io/terratest/modules/aws"
-	"github.com/gruntwork-io/terratest/modules/files"
 	"github.com/gruntwork-io/terratest/modules/random"
-	"github.com/gruntwork-io/terratest/modules/ssh"
 	"github.com/gruntwork-io/terratest/modules/terraform"
 	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
 )
 
-const GENERATE_KEYSTORE_SCRIPT_FOLDER = "generate-keystore"
-
 func TestAWSElasticsearch(t *testing.T) {
 	t.Parallel()
 
@@ -30,184 +23,100 @@ func TestAWSElasticsearch(t *testing.T) {
 	//zoneName := "gruntwork-sandbox.com" // Use this with Sandbox
 	zoneName := "gruntwork.in" // Use this with PhxDevops
 
-	var testcases = []struct {
-		testName                   string
-		packerTemplateFileName     string
-		packerBuilder              string
-		terraformDir               string
-		elasticsearchPort          int
-		elasticsearchDiscoveryPort int
-		useSsl                     bool
-		keystoreFile               string
-		keystorePass               string
-		certKeyPass                string
-		certAlias                  string
-		protocol                   string
-		checkerFunction            func(t *testing.T, messageToVerify string, webConsoleUrl string, keyStore *keystore, kibanaPass string)
-	}{
-		{
-			"TestElasticsearchUbuntu1804",
-			"elasticsearch.json",
-			"elasticsearch-ami-ubuntu-18",
-			"elasticsearch-only-cluster",
-			9200,
-			9300,
-			false,
-			"",
-			"",
-			"",
-			"",
-			"http",
-			validateGetHttp,
-		},
-		{
-			"TestElasticsearchSSLUbuntu2004",
-			"elasticsearch.json",
-			"elasticsearch-ami-ubuntu-20",
-			"elasticsearch-only-cluster",
-			9200,
-			9300,
-			true,
-			"elasticsearch.server.keystore.jks",
-			"password",
-			"password",
-			"localhost",
-			"https",
-			validateGetHttps,
-		},
-		{
-			"TestElasticsearchUbuntu2004",
-			"elasticsearch.json",
-			"elasticsearch-ami-ubuntu-20",
-			"elasticsearch-only-cluster",
-			9200,
-			9300,
-			false,
-			"",
-			"",
-			"",
-			"",
-			"http",
-			validateGetHttp,
-		},
-	}
+	runScenarios(t, SCENARIO_SUITE_ELASTICSEARCH_AWS, func(t *testing.T, scenario Scenario) {
+		examplesDir := test_structure.CopyTerraformFolderToTemp(t, "../", "examples")
+
+		defer test_structure.RunTestStage(t, "teardown", func() {
+			terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+			terraform.Destroy(t, terraformOptions)
+		})
+
+		defer test_structure.RunTestStage(t, "get_logs", func() {
+			terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+			keyPair := test_structure.LoadEc2KeyPair(t, examplesDir)
+			if t.Failed() {
+				client := newSimpleTestClient(t, examplesDir, terraformOptions, scenario.protocol(), scenario.Ports.Elasticsearch, scenario.useSsl())
+				collectElasticsearchClusterDiagnostics(t, terraformOptions, keyPair, scenario.osProfile(), client)
+			}
+		})
+
+		test_structure.RunTestStage(t, "generate_ssl_certs", func() {
+			tlsOutputDir := fmt.Sprintf("%s/elk-amis", examplesDir)
+			tlsCert := createKeyStoreFiles(t, "elasticsearch", tlsOutputDir, zoneName)
+			test_structure.SaveTestData(t, fmt.Sprintf("%s/.test-data/CERT.json", examplesDir), tlsCert)
+		})
+
+		test_structure.RunTestStage(t, "setup_ami", func() {
+
+			awsRegion := aws.GetRandomStableRegion(t, RegionsWithGruntworkINACM, nil)
+			packerInfo := scenario.packerInfo("elasticsearch", fmt.Sprintf("%s/elk-amis/elasticsearch/elasticsearch.json", examplesDir))
+			amiId := buildAmi(t, packerInfo.templatePath, packerInfo.builderName, awsRegion, scenario.useSsl())
+
+			clusterName := fmt.Sprintf("es-cluster-%s", random.UniqueId())
 
-	for _, testCase := range testcases {
-		// The following is necessary to make sure testCase's values don't
-		// get updated due to concurrency within the scope of t.Run(..) below
-		testCase := testCase
-
-		t.Run(testCase.testName, func(t *testing.T) {
-			t.Parallel()
-
-			examplesDir := test_structure.CopyTerraformFolderToTemp(t, "../", "examples")
-
-			defer test_structure.RunTestStage(t, "teardown", func() {
-				terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
-				terraform.Destroy(t, terraformOptions)
-			})
-
-			defer test_structure.RunTestStage(t, "get_logs", func() {
-				terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
-				keyPair := test_structure.LoadEc2KeyPair(t, examplesDir)
-				if t.Failed() {
-					snapshotLogs(t, terraformOptions, keyPair)
-				}
-			})
-
-			test_structure.RunTestStage(t, "generate_ssl_certs", func() {
-				tlsOutputDir := fmt.Sprintf("%s/elk-amis", examplesDir)
-				generateKeystoreDir := fmt.Sprintf("%s/%s", examplesDir, GENERATE_KEYSTORE_SCRIPT_FOLDER)
-				downloadGenerateKeystoreScript(t, generateKeystoreDir)
-				tlsCert := createKeyStoreFiles(t, "elasticsearch", generateKeystoreDir, tlsOutputDir, zoneName)
-				test_structure.SaveTestData(t, fmt.Sprintf("%s/.test-data/CERT.json", examplesDir), tlsCert)
-			})
-
-			test_structure.RunTestStage(t, "setup_ami", func() {
-
-				awsRegion := aws.GetRandomStableRegion(t, RegionsWithGruntworkINACM, nil)
-				templatePath := fmt.Sprintf("%s/elk-amis/elasticsearch/%s", examplesDir, testCase.packerTemplateFileName)
-				amiId := buildAmi(t, templatePath, testCase.packerBuilder, awsRegion, testCase.useSsl)
-
-				clusterName := fmt.Sprintf("es-cluster-%s", random.UniqueId())
-
-				keyPair := aws.CreateAndImportEC2KeyPair(t, awsRegion, random.UniqueId())
-				test_structure.SaveEc2KeyPair(t, examplesDir, keyPair)
-
-				terraformOptions := generateTerraformOptions(
-					t,
-					fmt.Sprintf("%s/%s", examplesDir, testCase.terraformDir),
-					awsRegion, amiId, clusterName, zoneName, keyPair.Name)
-
-				if testCase.useSsl {
-					terraformOptions.Vars["use_ssl"] = strconv.FormatBool(testCase.useSsl)
-					terraformOptions.Vars["java_keystore_filename"] = testCase.keystoreFile
-					terraformOptions.Vars["java_keystore_password"] = testCase.keystorePass
-					terraformOptions.Vars["java_keystore_certificate_password"] = testCase.certKeyPass
-					terraformOptions.Vars["java_keystore_cert_alias"] = testCase.certAlias
-				}
-
-				test_structure.SaveTerraformOptions(t, examplesDir, terraformOptions)
-			})
-
-			test_structure.RunTestStage(t, "deploy_to_aws", func() {
-				terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
-				terraform.InitAndApply(t, terraformOptions)
-			})
-
-			test_structure.RunTestStage(t, "validate", func() {
-				terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
-				var tlsCert keystore
-				test_structure.LoadTestData(t, fmt.Sprintf("%s/.test-data/CERT.json", examplesDir), &tlsCert)
-
-				// Run `terraform output` to get the value of an output variable
-				loadbalancerDNS := terraform.Output(t, terraformOptions, "lb_dns_name")
-				elasticsearchURL := fmt.Sprintf("%s://%s:%d", testCase.protocol, loadbalancerDNS, testCase.elasticsearchPort)
-
-				acceptableBody := fmt.Sprintf("\"cluster_name\" : \"%s\"", terraformOptions.Vars["cluster_name"])
-
-				testCase.checkerFunction(t, acceptableBody, elasticsearchURL, &tlsCert, "password")
-			})
+			keyPair := createTestKeyPair(t, awsRegion, random.UniqueId())
+			test_structure.SaveEc2KeyPair(t, examplesDir, keyPair)
+
+			terraformOptions := generateTerraformOptions(
+				t,
+				fmt.Sprintf("%s/elasticsearch-only-cluster", examplesDir),
+				awsRegion, amiId, clusterName, zoneName, keyPair.Name)
+
+			mergeTerraformVars(terraformOptions.Vars, scenario.keystoreTerraformVars())
+
+			test_structure.SaveTerraformOptions(t, examplesDir, terraformOptions)
+		})
+
+		test_structure.RunTestStage(t, "deploy_to_aws", func() {
+			terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+			terraform.InitAndApply(t, terraformOptions)
+		})
+
+		test_structure.RunTestStage(t, "validate", func() {
+			terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+			client := newSimpleTestClient(t, examplesDir, terraformOptions, scenario.protocol(), scenario.Ports.Elasticsearch, scenario.useSsl())
+
+			checkElasticsearchClusterName(t, client, terraformOptions.Vars["cluster_name"].(string))
 		})
+	})
+}
+
+// newSimpleTestClient creates a client for the cluster of the elasticsearch-only-cluster example
+func newSimpleTestClient(t *testing.T, examplesDir string, terraformOptions *terraform.Options, protocol string, elasticsearchPort int, useSsl bool) *ElasticsearchClient {
+	var tlsCert keystore
+	test_structure.LoadTestData(t, fmt.Sprintf("%s/.test-data/CERT.json", examplesDir), &tlsCert)
+	// This example has no Route 53 record, so we connect to the ALB by its AWS DNS name and verify its wildcard ACM
+	// certificate against a name in the zone instead
+	tlsCert.ServerName = fmt.Sprintf("%s.%s", terraformOptions.Vars["cluster_name"].(string), terraformOptions.Vars["route53_zone_name"].(string))
+
+	loadbalancerDNS := terraform.Output(t, terraformOptions, "lb_dns_name")
+	elasticsearchURL := fmt.Sprintf("%s://%s:%d", protocol, loadbalancerDNS, elasticsearchPort)
+
+	// Basic auth is only required to access ES when we introduce readonlyrest
+	username := ""
+	if useSsl {
+		username = "kibana"
 	}
+	return newElasticsearchClient(t, elasticsearchURL, &tlsCert, username, "password")
 }
 
-func snapshotLogs(
+// collectElasticsearchClusterDiagnostics collects a diagnostics bundle of the Elasticsearch cluster of an example with a
+// server_asg_names output. The client may be nil if the cluster isn't reachable from the tests.
+func collectElasticsearchClusterDiagnostics(
 	t *testing.T,
 	terraformOptions *terraform.Options,
 	keyPair *aws.Ec2Keypair,
+	osProfile OsProfile,
+	client *ElasticsearchClient,
 ) {
-	var localBaseDestDir string
-	if os.Getenv("CIRCLECI") != "" {
-		// On CircleCI, we want to store the logs in /tmp/logs so that they get artifacted
-		localBaseDestDir = filepath.Join("/tmp/logs", "debug", t.Name())
-	} else {
-		localBaseDestDir = filepath.Join(".", "debug", t.Name())
-	}
-
-	asgNames := terraform.OutputList(t, terraformOptions, "server_asg_names")
-
-	for _, asgName := range asgNames {
-		localDestDir := filepath.Join(localBaseDestDir, asgName)
-		if !files.FileExists(localBaseDestDir) {
-			os.MkdirAll(localBaseDestDir, 0755)
-		}
-
-		ip := getIPForInstanceInAsg(t, asgName, terraformOptions)
-
-		host := ssh.Host{
-			Hostname:    ip,
-			SshUserName: "ubuntu",
-			SshKeyPair:  keyPair.KeyPair,
-		}
-		scpOptions := ssh.ScpDownloadOptions{
-			RemoteHost:      host,
-			RemoteDir:       "/var/log",
-			LocalDir:        localDestDir,
-			FileNameFilters: []string{"syslog", "es-cluster*"},
-		}
-		ssh.ScpDirFrom(t, scpOptions, true)
-	}
+	collectDiagnostics(t, DiagnosticsOptions{
+		Name:       t.Name(),
+		RemoteExec: newRemoteExecOptions(t, terraformOptions.Vars["aws_region"].(string), keyPair, osProfile),
+		Tiers: []DiagnosticsTier{
+			elasticsearchDiagnosticsTier(terraform.OutputList(t, terraformOptions, "server_asg_names")),
+		},
+		Elasticsearch: client,
+	})
 }
 
 func generateTerraformOptions(t *testing.T, terraformDir string, awsRegion string, amiId string, clusterName string, zoneName string, keyPairName string) *terraform.Options {
@@ -222,6 +131,7 @@ func generateTerraformOptions(t *testing.T, terraformDir string, awsRegion strin
 			"cluster_name":      clusterName,
 			"key_name":          keyPairName,
 			"route53_zone_name": zoneName,
+			"custom_tags":       testResourceTerraformTags(t),
 		},
 	}
 }
@@ -0,0 +1,156 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/aws"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
+)
+
+const BACKUP_RESTORE_TEST_INDEX = "backup-restore-test"
+const BACKUP_RESTORE_TEST_DOCUMENTS = 250
+const BACKUP_RESTORE_TEST_CLUSTER_SIZE = 3
+const BACKUP_RESTORE_TEST_REPOSITORY = "es-backup-repository"
+
+// Deploys the elasticsearch-only-cluster example, backs it up to S3 with the backup Lambda, replaces the cluster with
+// an empty one and restores the backup into it with the restore Lambda
+func TestElasticsearchBackupRestore(t *testing.T) {
+	t.Parallel()
+
+	// For convenience - uncomment these as well as the "os" import
+	// when doing local testing if you need to skip any sections.
+	// os.Setenv("SKIP_setup_ami", "true")
+	// os.Setenv("SKIP_deploy_to_aws", "true")
+	// os.Setenv("SKIP_write_dataset", "true")
+	// os.Setenv("SKIP_backup", "true")
+	// os.Setenv("SKIP_recreate_cluster", "true")
+	// os.Setenv("SKIP_restore", "true")
+	// os.Setenv("SKIP_get_logs", "true")
+	// os.Setenv("SKIP_teardown", "true")
+
+	//zoneName := "gruntwork-sandbox.com" // Use this with Sandbox
+	zoneName := "gruntwork.in" // Use this with PhxDevops
+
+	examplesDir := test_structure.CopyTerraformFolderToTemp(t, "../", "examples")
+
+	defer test_structure.RunTestStage(t, "teardown", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		terraform.Destroy(t, terraformOptions)
+
+		keyPair := test_structure.LoadEc2KeyPair(t, examplesDir)
+		aws.DeleteEC2KeyPair(t, keyPair)
+	})
+
+	defer test_structure.RunTestStage(t, "get_logs", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		keyPair := test_structure.LoadEc2KeyPair(t, examplesDir)
+		if t.Failed() {
+			collectElasticsearchClusterDiagnostics(t, terraformOptions, keyPair, ubuntuOsProfile, newBackupRestoreTestClient(t, terraformOptions))
+		}
+	})
+
+	test_structure.RunTestStage(t, "setup_ami", func() {
+		awsRegion := aws.GetRandomStableRegion(t, RegionsWithGruntworkINACM, nil)
+		templatePath := fmt.Sprintf("%s/elk-amis/elasticsearch/elasticsearch.json", examplesDir)
+		amiId := buildAmi(t, templatePath, "elasticsearch-ami-ubuntu-20", awsRegion, false)
+
+		// The cluster name is also used for the S3 bucket name, which must be lower case
+		clusterName := fmt.Sprintf("es-backup-%s", strings.ToLower(random.UniqueId()))
+
+		keyPair := createTestKeyPair(t, awsRegion, clusterName)
+		test_structure.SaveEc2KeyPair(t, examplesDir, keyPair)
+
+		terraformOptions := generateTerraformOptions(
+			t,
+			fmt.Sprintf("%s/elasticsearch-only-cluster", examplesDir),
+			awsRegion, amiId, clusterName, zoneName, keyPair.Name)
+
+		// Only take the backups this test triggers, so a scheduled one can't race with it
+		terraformOptions.Vars["schedule_expression"] = "rate(1 day)"
+		terraformOptions.Vars["cluster_size"] = BACKUP_RESTORE_TEST_CLUSTER_SIZE
+		terraformOptions.Vars["repository"] = BACKUP_RESTORE_TEST_REPOSITORY
+
+		test_structure.SaveString(t, examplesDir, "awsRegion", awsRegion)
+		test_structure.SaveTerraformOptions(t, examplesDir, terraformOptions)
+	})
+
+	test_structure.RunTestStage(t, "deploy_to_aws", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		terraform.InitAndApply(t, terraformOptions)
+	})
+
+	test_structure.RunTestStage(t, "write_dataset", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		client := newBackupRestoreTestClient(t, terraformOptions)
+
+		checkElasticsearchClusterHealth(t, client, "green", BACKUP_RESTORE_TEST_CLUSTER_SIZE)
+
+		dataset := writeElasticsearchDataset(t, client, BACKUP_RESTORE_TEST_INDEX, BACKUP_RESTORE_TEST_DOCUMENTS)
+		test_structure.SaveTestData(t, fmt.Sprintf("%s/.test-data/DATASET.json", examplesDir), dataset)
+	})
+
+	test_structure.RunTestStage(t, "backup", func() {
+		awsRegion := test_structure.LoadString(t, examplesDir, "awsRegion")
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		client := newBackupRestoreTestClient(t, terraformOptions)
+
+		// The repository doesn't exist until the backup Lambda creates it on its first run
+		existingSnapshots, err := client.Snapshots(BACKUP_RESTORE_TEST_REPOSITORY)
+		if esErr, ok := err.(ElasticsearchError); ok && esErr.Type == "repository_missing_exception" {
+			existingSnapshots = nil
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		invokeBackupLambda(t, awsRegion, terraform.OutputRequired(t, terraformOptions, "backup_lambda_name"))
+
+		snapshot := waitForNewSnapshot(t, client, BACKUP_RESTORE_TEST_REPOSITORY, existingSnapshots)
+		waitForSnapshotInS3(t, awsRegion, terraform.OutputRequired(t, terraformOptions, "backup_bucket_name"), snapshot)
+
+		test_structure.SaveString(t, examplesDir, "snapshotId", snapshot.Snapshot)
+	})
+
+	test_structure.RunTestStage(t, "recreate_cluster", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+
+		// Only destroy the Elasticsearch nodes: the S3 bucket with the snapshots, the load balancer and the Lambda
+		// functions, which point at the load balancer, must survive
+		clusterOnlyOptions := *terraformOptions
+		clusterOnlyOptions.Targets = []string{"module.es_cluster"}
+		terraform.Destroy(t, &clusterOnlyOptions)
+
+		terraform.Apply(t, terraformOptions)
+
+		client := newBackupRestoreTestClient(t, terraformOptions)
+		checkElasticsearchClusterHealth(t, client, "green", BACKUP_RESTORE_TEST_CLUSTER_SIZE)
+
+		// Make sure we are really talking to an empty cluster before restoring
+		if _, err := client.Count(BACKUP_RESTORE_TEST_INDEX); err == nil {
+			t.Fatalf("Index %s still exists after recreating the cluster", BACKUP_RESTORE_TEST_INDEX)
+		}
+	})
+
+	test_structure.RunTestStage(t, "restore", func() {
+		awsRegion := test_structure.LoadString(t, examplesDir, "awsRegion")
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		client := newBackupRestoreTestClient(t, terraformOptions)
+		snapshotId := test_structure.LoadString(t, examplesDir, "snapshotId")
+
+		var dataset ElasticsearchDataset
+		test_structure.LoadTestData(t, fmt.Sprintf("%s/.test-data/DATASET.json", examplesDir), &dataset)
+
+		invokeRestoreLambda(t, awsRegion, terraform.OutputRequired(t, terraformOptions, "restore_lambda_name"), snapshotId)
+
+		checkElasticsearchDatasetRestored(t, client, dataset)
+		checkElasticsearchHitCount(t, client, BACKUP_RESTORE_TEST_INDEX, "environment:terratest", BACKUP_RESTORE_TEST_DOCUMENTS)
+	})
+}
+
+func newBackupRestoreTestClient(t *testing.T, terraformOptions *terraform.Options) *ElasticsearchClient {
+	loadbalancerDNS := terraform.OutputRequired(t, terraformOptions, "lb_dns_name")
+	return newElasticsearchClient(t, fmt.Sprintf("http://%s:9200", loadbalancerDNS), nil, "", "")
+}
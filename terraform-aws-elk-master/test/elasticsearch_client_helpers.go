@@ -0,0 +1,384 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+// ElasticsearchClient is a minimal, typed client for the handful of Elasticsearch APIs our tests need. It replaces
+// checking whether the raw response body happens to contain a given substring.
+type ElasticsearchClient struct {
+	BaseUrl    string
+	Username   string
+	Password   string
+	HttpClient *http.Client
+}
+
+// ElasticsearchInfo is the response of GET /
+type ElasticsearchInfo struct {
+	Name        string `json:"name"`
+	ClusterName string `json:"cluster_name"`
+	ClusterUuid string `json:"cluster_uuid"`
+	Version     struct {
+		Number string `json:"number"`
+	} `json:"version"`
+	Tagline string `json:"tagline"`
+}
+
+// ElasticsearchClusterHealth is the response of GET /_cluster/health
+type ElasticsearchClusterHealth struct {
+	ClusterName         string `json:"cluster_name"`
+	Status              string `json:"status"`
+	TimedOut            bool   `json:"timed_out"`
+	NumberOfNodes       int    `json:"number_of_nodes"`
+	NumberOfDataNodes   int    `json:"number_of_data_nodes"`
+	ActivePrimaryShards int    `json:"active_primary_shards"`
+	ActiveShards        int    `json:"active_shards"`
+	RelocatingShards    int    `json:"relocating_shards"`
+	InitializingShards  int    `json:"initializing_shards"`
+	UnassignedShards    int    `json:"unassigned_shards"`
+}
+
+// ElasticsearchNode is a single row of GET /_cat/nodes?format=json. The cat APIs return every value as a string.
+type ElasticsearchNode struct {
+	Ip          string `json:"ip"`
+	HeapPercent string `json:"heap.percent"`
+	RamPercent  string `json:"ram.percent"`
+	Cpu         string `json:"cpu"`
+	NodeRole    string `json:"node.role"`
+	Master      string `json:"master"`
+	Name        string `json:"name"`
+}
+
+// ElasticsearchSearchResult is the response of GET /<index>/_search
+type ElasticsearchSearchResult struct {
+	Took     int               `json:"took"`
+	TimedOut bool              `json:"timed_out"`
+	Hits     ElasticsearchHits `json:"hits"`
+}
+
+type ElasticsearchHits struct {
+	Total ElasticsearchHitsTotal `json:"total"`
+	Hits  []ElasticsearchHit     `json:"hits"`
+}
+
+type ElasticsearchHit struct {
+	Index  string                 `json:"_index"`
+	Type   string                 `json:"_type"`
+	Id     string                 `json:"_id"`
+	Source map[string]interface{} `json:"_source"`
+}
+
+// ElasticsearchHitsTotal accepts both the plain number returned by Elasticsearch 6.x and the {"value", "relation"}
+// object returned by 7.x.
+type ElasticsearchHitsTotal struct {
+	Value    int64  `json:"value"`
+	Relation string `json:"relation"`
+}
+
+func (total *ElasticsearchHitsTotal) UnmarshalJSON(data []byte) error {
+	var value int64
+	if err := json.Unmarshal(data, &value); err == nil {
+		total.Value = value
+		total.Relation = "eq"
+		return nil
+	}
+
+	type hitsTotal ElasticsearchHitsTotal
+	return json.Unmarshal(data, (*hitsTotal)(total))
+}
+
+// ElasticsearchSnapshot is a single snapshot as returned by GET /_snapshot/<repository>/<snapshot>
+type ElasticsearchSnapshot struct {
+	Snapshot string   `json:"snapshot"`
+	Uuid     string   `json:"uuid"`
+	State    string   `json:"state"`
+	Indices  []string `json:"indices"`
+}
+
+// ElasticsearchError is returned when Elasticsearch answers with a non-2xx status code
+type ElasticsearchError struct {
+	Method     string
+	Url        string
+	StatusCode int
+	Type       string
+	Reason     string
+	Body       string
+}
+
+func (err ElasticsearchError) Error() string {
+	if err.Type != "" {
+		return fmt.Sprintf("%s %s returned status %d: %s: %s", err.Method, err.Url, err.StatusCode, err.Type, err.Reason)
+	}
+	return fmt.Sprintf("%s %s returned status %d: %s", err.Method, err.Url, err.StatusCode, err.Body)
+}
+
+// newElasticsearchClient creates a client for the Elasticsearch cluster at baseUrl. The keyStore is only used for https
+// URLs and may be nil. Basic auth is only sent if username is not empty.
+func newElasticsearchClient(t *testing.T, baseUrl string, keyStore *keystore, username string, password string) *ElasticsearchClient {
+	client, err := newElasticsearchClientE(baseUrl, keyStore, username, password)
+	if err != nil {
+		t.Fatalf("Failed to create Elasticsearch client for %s: %v", baseUrl, err)
+	}
+	return client
+}
+
+func newElasticsearchClientE(baseUrl string, keyStore *keystore, username string, password string) (*ElasticsearchClient, error) {
+	transport := &http.Transport{}
+
+	if strings.HasPrefix(baseUrl, "https://") && keyStore != nil {
+		tlsConfig, err := keyStore.getTlsConfigE()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &ElasticsearchClient{
+		BaseUrl:  strings.TrimSuffix(baseUrl, "/"),
+		Username: username,
+		Password: password,
+		HttpClient: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// Info returns the basic cluster information served at GET /
+func (client *ElasticsearchClient) Info() (*ElasticsearchInfo, error) {
+	var info ElasticsearchInfo
+	if err := client.doJson("GET", "/", nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ClusterHealth returns the response of GET /_cluster/health
+func (client *ElasticsearchClient) ClusterHealth() (*ElasticsearchClusterHealth, error) {
+	var health ElasticsearchClusterHealth
+	if err := client.doJson("GET", "/_cluster/health", nil, nil, &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// CatNodes returns one entry per node in the cluster
+func (client *ElasticsearchClient) CatNodes() ([]ElasticsearchNode, error) {
+	var nodes []ElasticsearchNode
+	if err := client.doJson("GET", "/_cat/nodes", url.Values{"format": {"json"}}, nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Search runs a URI search (the q= Lucene query string syntax) against the given index
+func (client *ElasticsearchClient) Search(index string, query string) (*ElasticsearchSearchResult, error) {
+	var result ElasticsearchSearchResult
+	path := fmt.Sprintf("/%s/_search", url.PathEscape(index))
+	if err := client.doJson("GET", path, url.Values{"q": {query}}, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// CreateIndex creates an index with the given settings and mappings
+func (client *ElasticsearchClient) CreateIndex(index string, body interface{}) error {
+	return client.doJsonBody("PUT", fmt.Sprintf("/%s", url.PathEscape(index)), nil, body, nil)
+}
+
+// IndexDocument adds or replaces the document with the given id. The document only becomes searchable after the next
+// refresh of the index.
+func (client *ElasticsearchClient) IndexDocument(index string, id string, document interface{}) error {
+	path := fmt.Sprintf("/%s/_doc/%s", url.PathEscape(index), url.PathEscape(id))
+	return client.doJsonBody("PUT", path, nil, document, nil)
+}
+
+// Refresh makes all operations on the index since the last refresh visible to search and count
+func (client *ElasticsearchClient) Refresh(index string) error {
+	return client.doJson("POST", fmt.Sprintf("/%s/_refresh", url.PathEscape(index)), nil, nil, nil)
+}
+
+// Count returns the number of documents in the index
+func (client *ElasticsearchClient) Count(index string) (int64, error) {
+	var result struct {
+		Count int64 `json:"count"`
+	}
+	if err := client.doJson("GET", fmt.Sprintf("/%s/_count", url.PathEscape(index)), nil, nil, &result); err != nil {
+		return 0, err
+	}
+	return result.Count, nil
+}
+
+// Mapping returns the mappings of the index, keyed by index name as Elasticsearch returns them
+func (client *ElasticsearchClient) Mapping(index string) (map[string]interface{}, error) {
+	var mapping map[string]interface{}
+	if err := client.doJson("GET", fmt.Sprintf("/%s/_mapping", url.PathEscape(index)), nil, nil, &mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// Snapshots returns every snapshot in the given repository
+func (client *ElasticsearchClient) Snapshots(repository string) ([]ElasticsearchSnapshot, error) {
+	var result struct {
+		Snapshots []ElasticsearchSnapshot `json:"snapshots"`
+	}
+	if err := client.doJson("GET", fmt.Sprintf("/_snapshot/%s/_all", url.PathEscape(repository)), nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Snapshots, nil
+}
+
+// doJsonBody is doJson with body encoded as JSON
+func (client *ElasticsearchClient) doJsonBody(method string, path string, query url.Values, body interface{}, out interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return client.doJson(method, path, query, bytes.NewReader(encoded), out)
+}
+
+// Get sends a GET request to Elasticsearch and returns the raw response body, e.g. for cat APIs that return text
+func (client *ElasticsearchClient) Get(path string, query url.Values) ([]byte, error) {
+	return client.do(http.MethodGet, path, query, nil)
+}
+
+// doJson sends a request to Elasticsearch and decodes the JSON response into out. Non-2xx responses are returned as
+// an ElasticsearchError.
+func (client *ElasticsearchClient) doJson(method string, path string, query url.Values, body io.Reader, out interface{}) error {
+	respBody, err := client.do(method, path, query, body)
+	if err != nil {
+		return err
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("Failed to decode response from %s %s: %v. Body: %s", method, client.BaseUrl+path, err, string(respBody))
+	}
+	return nil
+}
+
+// do sends a request to Elasticsearch and returns the response body. Non-2xx responses are returned as an
+// ElasticsearchError.
+func (client *ElasticsearchClient) do(method string, path string, query url.Values, body io.Reader) ([]byte, error) {
+	requestUrl := client.BaseUrl + path
+	if len(query) > 0 {
+		requestUrl = fmt.Sprintf("%s?%s", requestUrl, query.Encode())
+	}
+
+	req, err := http.NewRequest(method, requestUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client.Username != "" {
+		req.SetBasicAuth(client.Username, client.Password)
+	}
+
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newElasticsearchError(method, requestUrl, resp.StatusCode, respBody)
+	}
+	return respBody, nil
+}
+
+func newElasticsearchError(method string, requestUrl string, statusCode int, body []byte) ElasticsearchError {
+	esErr := ElasticsearchError{
+		Method:     method,
+		Url:        requestUrl,
+		StatusCode: statusCode,
+		Body:       string(body),
+	}
+
+	// Elasticsearch errors look like {"error": {"type": "...", "reason": "..."}, "status": 404}, but proxies and
+	// plugins such as ReadonlyREST may respond with plain text, in which case we just keep the body.
+	var parsed struct {
+		Error struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		esErr.Type = parsed.Error.Type
+		esErr.Reason = parsed.Error.Reason
+	}
+
+	return esErr
+}
+
+// checkElasticsearchClusterName waits until the cluster at the client's URL reports the given cluster name
+func checkElasticsearchClusterName(t *testing.T, client *ElasticsearchClient, clusterName string) {
+	logger.Logf(t, "Checking for Elasticsearch cluster %s to be up at: %s", clusterName, client.BaseUrl)
+
+	waitFor(t, elasticsearchWaitBudget, fmt.Sprintf("Elasticsearch cluster %s at %s", clusterName, client.BaseUrl), func(ctx context.Context) error {
+		info, err := client.Info()
+		if err != nil {
+			return err
+		}
+		if info.ClusterName != clusterName {
+			return fmt.Errorf("Expected cluster name %s but got %s", clusterName, info.ClusterName)
+		}
+		return nil
+	})
+}
+
+// checkElasticsearchClusterHealth waits until the cluster has the given health status (e.g. green) and node count
+func checkElasticsearchClusterHealth(t *testing.T, client *ElasticsearchClient, expectedStatus string, expectedNodes int) {
+	logger.Logf(t, "Checking for Elasticsearch at %s to be %s with %d nodes", client.BaseUrl, expectedStatus, expectedNodes)
+
+	description := fmt.Sprintf("Elasticsearch at %s to be %s with %d nodes", client.BaseUrl, expectedStatus, expectedNodes)
+	waitFor(t, elasticsearchWaitBudget, description, func(ctx context.Context) error {
+		health, err := client.ClusterHealth()
+		if err != nil {
+			return err
+		}
+		if health.Status != expectedStatus || health.NumberOfNodes != expectedNodes {
+			return fmt.Errorf("Expected cluster to be %s with %d nodes but it is %s with %d nodes", expectedStatus, expectedNodes, health.Status, health.NumberOfNodes)
+		}
+		return nil
+	})
+}
+
+// checkElasticsearchHitCount waits until a search for query in index returns at least minHits documents
+func checkElasticsearchHitCount(t *testing.T, client *ElasticsearchClient, index string, query string, minHits int64) {
+	logger.Logf(t, "Checking for at least %d hits for query %s in index %s at %s", minHits, query, index, client.BaseUrl)
+
+	description := fmt.Sprintf("at least %d hits for query %s in index %s", minHits, query, index)
+	waitFor(t, elasticsearchSearchWaitBudget, description, func(ctx context.Context) error {
+		result, err := client.Search(index, query)
+		if err != nil {
+			return err
+		}
+		if result.Hits.Total.Value < minHits {
+			return fmt.Errorf("Expected at least %d hits for query %s but got %d", minHits, query, result.Hits.Total.Value)
+		}
+		return nil
+	})
+}
@@ -1,15 +1,10 @@
 package test
 
 import (
-	"crypto/tls"
 	"fmt"
 	"strconv"
-	"strings"
 	"testing"
-	"time"
 
-	http_helper "github.com/gruntwork-io/terratest/modules/http-helper"
-	"github.com/gruntwork-io/terratest/modules/logger"
 	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
 )
 
@@ -18,25 +13,22 @@ func TestTLSLocalDocker(t *testing.T) {
 	// we just can't seem to get the tests to run reliably on CircleCI's hardware
 	skipInCircleCi(t)
 
-	GENERATE_KEYSTORE_SCRIPT_DIR := "/tmp/generate-keystore"
-
 	examplesDir := "../examples"
 	workingDir := fmt.Sprintf("%s/elasticsearch-docker/ssl", examplesDir)
 
 	tlsOutputDir := fmt.Sprintf("%s/elasticsearch-ami", examplesDir)
-	downloadGenerateKeystoreScript(t, GENERATE_KEYSTORE_SCRIPT_DIR)
-	tlsCert := createKeyStoreFiles(t, "elasticsearch", GENERATE_KEYSTORE_SCRIPT_DIR, tlsOutputDir, "gruntwork.io")
+	tlsCert := createKeyStoreFiles(t, "elasticsearch", tlsOutputDir, "localhost")
 
 	var testcases = []struct {
 		testName                   string
 		packerBuilder              string
-		osName                     string
+		osProfile                  OsProfile
 		elasticsearchPort          int
 		elasticsearchDiscoveryPort int
 	}{
-		{"TestElasticsearchUbuntu1604Docker", "elasticsearch-ssl-docker-ubuntu", "ubuntu", 9208, 9308},
-		{"TestElasticsearchUbuntu1804Docker", "elasticsearch-ssl-docker-ubuntu-18", "ubuntu", 9208, 9308},
-		{"TestElasticsearchAmazonDocker", "elasticsearch-ssl-docker-amazon-linux", "amazon-linux", 9209, 9309},
+		{"TestElasticsearchUbuntu1604Docker", "elasticsearch-ssl-docker-ubuntu", ubuntuOsProfile, 9208, 9308},
+		{"TestElasticsearchUbuntu1804Docker", "elasticsearch-ssl-docker-ubuntu-18", ubuntuOsProfile, 9208, 9308},
+		{"TestElasticsearchAmazonDocker", "elasticsearch-ssl-docker-amazon-linux", amazonLinux2OsProfile, 9209, 9309},
 	}
 
 	for _, testCase := range testcases {
@@ -51,14 +43,14 @@ func TestTLSLocalDocker(t *testing.T) {
 			buildDockerImage(t, packerTemplatePath, testCase.packerBuilder)
 
 			envVars := map[string]string{
-				"OS_NAME":                      testCase.osName,
+				"OS_NAME":                      testCase.osProfile.Name,
 				"PROTOCOL":                     "https",
 				"ELASTICSEARCH_PORT":           strconv.Itoa(testCase.elasticsearchPort),
 				"ELASTICSEARCH_DISCOVERY_PORT": strconv.Itoa(testCase.elasticsearchDiscoveryPort),
 				"CONTAINER_BASE_NAME":          "elasticsearch-ssl",
 			}
 
-			runTestScript(t, testCase.testName, workingDir, envVars, tlsCert, validateGetHttps)
+			runTestScript(t, testCase.testName, workingDir, envVars, tlsCert, checkElasticsearchRunning)
 		})
 	}
 }
@@ -76,13 +68,13 @@ func TestLocalDockerElasticsearch(t *testing.T) {
 	var testcases = []struct {
 		testName                   string
 		packerBuilder              string
-		osName                     string
+		osProfile                  OsProfile
 		elasticsearchPort          int
 		elasticsearchDiscoveryPort int
 	}{
-		{"TestElasticsearchUbuntu1604Docker", "elasticsearch-docker-ubuntu", "ubuntu", 9202, 9302},
-		{"TestElasticsearchUbuntu1804Docker", "elasticsearch-docker-ubuntu-18", "ubuntu", 9202, 9302},
-		{"TestElasticsearchAmazonDocker", "elasticsearch-docker-amazon-linux", "amazon-linux", 9201, 9301},
+		{"TestElasticsearchUbuntu1604Docker", "elasticsearch-docker-ubuntu", ubuntuOsProfile, 9202, 9302},
+		{"TestElasticsearchUbuntu1804Docker", "elasticsearch-docker-ubuntu-18", ubuntuOsProfile, 9202, 9302},
+		{"TestElasticsearchAmazonDocker", "elasticsearch-docker-amazon-linux", amazonLinux2OsProfile, 9201, 9301},
 	}
 
 	for _, testCase := range testcases {
@@ -97,7 +89,7 @@ func TestLocalDockerElasticsearch(t *testing.T) {
 			buildDockerImage(t, templatePath, testCase.packerBuilder)
 
 			envVars := map[string]string{
-				"OS_NAME":                      testCase.osName,
+				"OS_NAME":                      testCase.osProfile.Name,
 				"PROTOCOL":                     "http",
 				"ELASTICSEARCH_PORT":           strconv.Itoa(testCase.elasticsearchPort),
 				"ELASTICSEARCH_DISCOVERY_PORT": strconv.Itoa(testCase.elasticsearchDiscoveryPort),
@@ -122,19 +114,11 @@ func runTestScript(t *testing.T, testName string, workingDir string, envVars map
 }
 
 func checkElasticsearchRunning(t *testing.T, clusterName string, webConsoleUrl string, keyStore *keystore, password string) {
-	maxRetries := 180
-	sleepBetweenRetries := 5 * time.Second
-
-	logger.Logf(t, "Checking for Elasticsearch to be up at: %s", webConsoleUrl)
-
-	http_helper.HttpGetWithRetryWithCustomValidation(
-		t,
-		webConsoleUrl,
-		&tls.Config{},
-		maxRetries,
-		sleepBetweenRetries,
-		func(status int, body string) bool {
-			return status == 200 && strings.Contains(body, fmt.Sprintf("\"cluster_name\" : \"%s\"", clusterName))
-		},
-	)
+	// Basic auth is only required to access ES when we introduce readonlyrest, which we only do with SSL
+	username := ""
+	if keyStore != nil {
+		username = "kibana"
+	}
+	client := newElasticsearchClient(t, webConsoleUrl, keyStore, username, password)
+	checkElasticsearchClusterName(t, client, clusterName)
 }
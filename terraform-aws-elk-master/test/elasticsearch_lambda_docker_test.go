@@ -0,0 +1,296 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests run the Node.js handlers of the backup and restore Lambda functions in a local Lambda runtime container
+// against a fake Elasticsearch and a fake AWS API, so every branch of the handlers can be checked without deploying
+// them. The container uses the host network, so they need Docker on Linux.
+
+const LAMBDA_TEST_REPOSITORY = "es-backup-repository"
+const LAMBDA_TEST_BUCKET = "es-backup-bucket"
+const LAMBDA_TEST_SNAPSHOT = "snapshot_lambda_test"
+
+func TestLocalDockerBackupLambda(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name                    string
+		setup                   func(t *testing.T, server *FakeElasticsearchServer)
+		expectRepositoryCreated bool
+		expectSnapshot          bool
+		expectError             bool
+		expectedResultPrefix    string
+	}{
+		{"RepositoryMissing", nil, true, true, false, "Backup was successful"},
+		{"RepositoryExists", createFakeBackupRepository, false, true, false, "Backup was successful"},
+		{
+			"CreateRepositoryFails",
+			func(t *testing.T, server *FakeElasticsearchServer) {
+				server.FailRequestsTo(http.MethodPut, fmt.Sprintf("/_snapshot/%s", LAMBDA_TEST_REPOSITORY), http.StatusInternalServerError)
+			},
+			true, false, true, "Failed to create repository",
+		},
+		{
+			"SnapshotFails",
+			func(t *testing.T, server *FakeElasticsearchServer) {
+				createFakeBackupRepository(t, server)
+				server.FailRequestsTo(http.MethodPut, fmt.Sprintf("/_snapshot/%s/", LAMBDA_TEST_REPOSITORY), http.StatusInternalServerError)
+			},
+			false, true, true, "Failed to backup cluster",
+		},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := startFakeElasticsearch(t, defaultFakeElasticsearchState())
+			defer server.Close()
+
+			if testCase.setup != nil {
+				testCase.setup(t, server)
+			}
+			requestsBefore := len(server.Requests())
+
+			env := lambdaElasticsearchEnv(t, server.URL)
+			env["REPOSITORY"] = LAMBDA_TEST_REPOSITORY
+			env["BUCKET"] = LAMBDA_TEST_BUCKET
+			env["S3_BUCKET_AWS_REGION"] = "eu-west-1"
+
+			result := runLambdaHandler(t, LambdaHandlerInvocation{
+				HandlerDir: "../modules/elasticsearch-cluster-backup/backup",
+				Env:        env,
+				Event:      map[string]interface{}{},
+			})
+
+			require.Len(t, result.Callbacks, 1, "Expected exactly one callback. Output:\n%s", result.Output)
+			callback := result.Callbacks[0]
+			assert.Equal(t, testCase.expectError, callback.Error != nil)
+			assert.True(t, strings.HasPrefix(fmt.Sprint(callback.Result), testCase.expectedResultPrefix), "Unexpected result: %v", callback.Result)
+
+			requests := server.Requests()[requestsBefore:]
+			require.NotEmpty(t, requests)
+			assert.Equal(t, http.MethodGet, requests[0].Method)
+			assert.Equal(t, fmt.Sprintf("/_snapshot/%s", LAMBDA_TEST_REPOSITORY), requests[0].Path)
+
+			createRepository := findFakeElasticsearchRequest(requests, http.MethodPut, fmt.Sprintf("/_snapshot/%s", LAMBDA_TEST_REPOSITORY))
+			assert.Equal(t, testCase.expectRepositoryCreated, createRepository != nil)
+			if createRepository != nil {
+				assert.JSONEq(t, fmt.Sprintf(`{"type": "s3", "settings": {"bucket": "%s", "region": "eu-west-1"}}`, LAMBDA_TEST_BUCKET), createRepository.Body)
+			}
+
+			snapshot := findFakeElasticsearchRequestWithPrefix(requests, http.MethodPut, fmt.Sprintf("/_snapshot/%s/snapshot_", LAMBDA_TEST_REPOSITORY))
+			assert.Equal(t, testCase.expectSnapshot, snapshot != nil)
+			if snapshot != nil {
+				assert.Equal(t, "wait_for_completion=false", snapshot.Query)
+			}
+			if testCase.expectSnapshot && !testCase.expectError {
+				assert.Len(t, server.Snapshots(LAMBDA_TEST_REPOSITORY), 1)
+			}
+		})
+	}
+}
+
+func TestLocalDockerRestoreLambda(t *testing.T) {
+	t.Parallel()
+
+	type expectedCallback struct {
+		isError      bool
+		resultPrefix string
+	}
+
+	testCases := []struct {
+		name                    string
+		setup                   func(t *testing.T, server *FakeElasticsearchServer, awsServer *FakeAwsServer)
+		expectRepositoryCreated bool
+		expectRestore           bool
+		expectNotification      bool
+		expectedCallbacks       []expectedCallback
+		expectedOutput          string
+	}{
+		{
+			"Restores",
+			func(t *testing.T, server *FakeElasticsearchServer, awsServer *FakeAwsServer) {
+				createFakeBackupSnapshot(t, server)
+			},
+			false, true, true,
+			[]expectedCallback{{false, RESTORE_LAMBDA_STARTED_MESSAGE}},
+			"",
+		},
+		{
+			// The handler creates the missing repository, but it is empty, so the restore fails
+			"RepositoryMissing",
+			nil,
+			true, true, false,
+			[]expectedCallback{{false, "Failed to restore snapshot"}},
+			"",
+		},
+		{
+			// The restore handler reports every failure as a successful invocation
+			"CreateRepositoryFails",
+			func(t *testing.T, server *FakeElasticsearchServer, awsServer *FakeAwsServer) {
+				server.FailRequestsTo(http.MethodPut, fmt.Sprintf("/_snapshot/%s", LAMBDA_TEST_REPOSITORY), http.StatusInternalServerError)
+			},
+			true, false, false,
+			[]expectedCallback{{false, "Failed to create repository"}},
+			"",
+		},
+		{
+			"RestoreOverOpenIndexFails",
+			func(t *testing.T, server *FakeElasticsearchServer, awsServer *FakeAwsServer) {
+				createFakeBackupSnapshot(t, server)
+				server.UpdateState(func(state *FakeElasticsearchState) {
+					state.Documents[BACKUP_RESTORE_TEST_INDEX] = []map[string]interface{}{}
+				})
+			},
+			false, true, false,
+			[]expectedCallback{{false, "Failed to restore snapshot"}},
+			"",
+		},
+		{
+			// The handler reports the restore as started before the update of the notification Lambda completes, so
+			// a failed update leads to a second, failed callback
+			"UpdateNotificationFunctionFails",
+			func(t *testing.T, server *FakeElasticsearchServer, awsServer *FakeAwsServer) {
+				createFakeBackupSnapshot(t, server)
+				awsServer.FailAction("lambda:UpdateFunctionConfiguration", http.StatusNotFound, "ResourceNotFoundException")
+			},
+			false, true, true,
+			[]expectedCallback{
+				{false, RESTORE_LAMBDA_STARTED_MESSAGE},
+				{true, "An error occurred when updating notification lambda function env vars"},
+			},
+			"",
+		},
+		{
+			// A failure to enable the notification schedule is only logged
+			"EnableNotificationRuleFails",
+			func(t *testing.T, server *FakeElasticsearchServer, awsServer *FakeAwsServer) {
+				createFakeBackupSnapshot(t, server)
+				awsServer.FailAction("events:PutRule", http.StatusBadRequest, "ValidationException")
+			},
+			false, true, true,
+			[]expectedCallback{{false, RESTORE_LAMBDA_STARTED_MESSAGE}},
+			"An error occurred when enabling Cloudwatch event rule",
+		},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := startFakeElasticsearch(t, defaultFakeElasticsearchState())
+			defer server.Close()
+
+			awsServer := startFakeAws(t)
+			defer awsServer.Close()
+
+			if testCase.setup != nil {
+				testCase.setup(t, server, awsServer)
+			}
+			requestsBefore := len(server.Requests())
+
+			env := lambdaElasticsearchEnv(t, server.URL)
+			env["REPOSITORY"] = LAMBDA_TEST_REPOSITORY
+			env["BUCKET"] = LAMBDA_TEST_BUCKET
+			env["CLOUDWATCH_EVENT_RULE_NAME"] = "es-restore-notification"
+			env["NOTIFICATION_FUNCTION_NAME"] = "es-restore-notification"
+
+			result := runLambdaHandler(t, LambdaHandlerInvocation{
+				HandlerDir:  "../modules/elasticsearch-cluster-restore/restore",
+				Env:         env,
+				Event:       map[string]interface{}{"snapshotId": LAMBDA_TEST_SNAPSHOT},
+				AwsEndpoint: awsServer.URL,
+			})
+
+			require.Len(t, result.Callbacks, len(testCase.expectedCallbacks), "Unexpected callbacks %v. Output:\n%s", result.Callbacks, result.Output)
+			for i, expected := range testCase.expectedCallbacks {
+				callback := result.Callbacks[i]
+				assert.Equal(t, expected.isError, callback.Error != nil, "Unexpected error in callback %d: %v", i, callback.Error)
+				assert.True(t, strings.HasPrefix(fmt.Sprint(callback.Result), expected.resultPrefix), "Unexpected result in callback %d: %v", i, callback.Result)
+			}
+			assert.Contains(t, result.Output, testCase.expectedOutput)
+
+			requests := server.Requests()[requestsBefore:]
+			createRepository := findFakeElasticsearchRequest(requests, http.MethodPut, fmt.Sprintf("/_snapshot/%s", LAMBDA_TEST_REPOSITORY))
+			assert.Equal(t, testCase.expectRepositoryCreated, createRepository != nil)
+
+			restore := findFakeElasticsearchRequest(requests, http.MethodPost, fmt.Sprintf("/_snapshot/%s/%s/_restore", LAMBDA_TEST_REPOSITORY, LAMBDA_TEST_SNAPSHOT))
+			assert.Equal(t, testCase.expectRestore, restore != nil)
+
+			updates := awsServer.Requests("lambda:UpdateFunctionConfiguration")
+			rules := awsServer.Requests("events:PutRule")
+			if !testCase.expectNotification {
+				assert.Empty(t, updates)
+				assert.Empty(t, rules)
+				return
+			}
+
+			require.Len(t, updates, 1)
+			assert.Equal(t, "/2015-03-31/functions/es-restore-notification/configuration", updates[0].Path)
+			variables := updates[0].Body["Environment"].(map[string]interface{})["Variables"].(map[string]interface{})
+			assert.Equal(t, LAMBDA_TEST_SNAPSHOT, variables["SNAPSHOT_ID"])
+			assert.Equal(t, LAMBDA_TEST_REPOSITORY, variables["REPOSITORY"])
+			assert.Equal(t, "es-restore-notification", variables["CLOUDWATCH_EVENT_RULE_NAME"])
+
+			require.Len(t, rules, 1)
+			assert.Equal(t, "es-restore-notification", rules[0].Body["Name"])
+			assert.Equal(t, "rate(5 minutes)", rules[0].Body["ScheduleExpression"])
+			assert.Equal(t, "ENABLED", rules[0].Body["State"])
+		})
+	}
+}
+
+func createFakeBackupRepository(t *testing.T, server *FakeElasticsearchServer) {
+	client := newElasticsearchClient(t, server.URL, nil, "", "")
+	repository := map[string]interface{}{"type": "s3", "settings": map[string]interface{}{"bucket": LAMBDA_TEST_BUCKET}}
+	require.NoError(t, client.doJsonBody(http.MethodPut, fmt.Sprintf("/_snapshot/%s", LAMBDA_TEST_REPOSITORY), nil, repository, nil))
+}
+
+// createFakeBackupSnapshot stores LAMBDA_TEST_SNAPSHOT with a small dataset in the backup repository and then deletes
+// the dataset, like recreating the cluster would
+func createFakeBackupSnapshot(t *testing.T, server *FakeElasticsearchServer) {
+	client := newElasticsearchClient(t, server.URL, nil, "", "")
+	writeElasticsearchDataset(t, client, BACKUP_RESTORE_TEST_INDEX, 5)
+
+	createFakeBackupRepository(t, server)
+	snapshotPath := fmt.Sprintf("/_snapshot/%s/%s", LAMBDA_TEST_REPOSITORY, LAMBDA_TEST_SNAPSHOT)
+	require.NoError(t, client.doJsonBody(http.MethodPut, snapshotPath, nil, map[string]interface{}{}, nil))
+	require.NoError(t, client.doJson(http.MethodDelete, fmt.Sprintf("/%s", BACKUP_RESTORE_TEST_INDEX), nil, nil, nil))
+}
+
+func findFakeElasticsearchRequest(requests []FakeElasticsearchRequest, method string, path string) *FakeElasticsearchRequest {
+	for _, request := range requests {
+		if request.Method == method && request.Path == path {
+			request := request
+			return &request
+		}
+	}
+	return nil
+}
+
+func findFakeElasticsearchRequestWithPrefix(requests []FakeElasticsearchRequest, method string, pathPrefix string) *FakeElasticsearchRequest {
+	for _, request := range requests {
+		if request.Method == method && strings.HasPrefix(request.Path, pathPrefix) {
+			request := request
+			return &request
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package test
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+const DEFAULT_PROBE_INTERVAL = 500 * time.Millisecond
+
+// How many distinct errors a probe report keeps, so a long outage doesn't flood the test output
+const MAX_PROBE_REPORT_ERRORS = 20
+
+// ElasticsearchProberOptions configures an ElasticsearchProber
+type ElasticsearchProberOptions struct {
+	// The index the prober writes to. It must not exist yet.
+	Index string
+	// How long to wait between two probes. Defaults to DEFAULT_PROBE_INTERVAL.
+	Interval time.Duration
+}
+
+// ElasticsearchProbeReport summarizes what an ElasticsearchProber observed while it was running
+type ElasticsearchProbeReport struct {
+	Duration     time.Duration
+	Writes       int
+	FailedWrites int
+	Reads        int
+	FailedReads  int
+	// The longest time between a failed request and the next successful one
+	MaxUnavailability time.Duration
+	// Ids of documents Elasticsearch acknowledged, but which weren't in the index when the prober stopped
+	LostDocuments []string
+	// Distinct errors and how often each occurred
+	Errors map[string]int
+}
+
+func (report ElasticsearchProbeReport) String() string {
+	return fmt.Sprintf(
+		"%d writes (%d failed) and %d reads (%d failed) in %s. Max unavailability: %s. Lost documents: %d",
+		report.Writes, report.FailedWrites, report.Reads, report.FailedReads, report.Duration, report.MaxUnavailability, len(report.LostDocuments))
+}
+
+// ElasticsearchProber continuously writes documents to Elasticsearch and reads them back in the background, to
+// measure the impact of an operation such as a rolling deploy on the clients of the cluster
+type ElasticsearchProber struct {
+	client  *ElasticsearchClient
+	options ElasticsearchProberOptions
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	mutex            sync.Mutex
+	report           ElasticsearchProbeReport
+	started          time.Time
+	acknowledged     []string
+	unavailableSince time.Time
+}
+
+// startElasticsearchProber creates the probe index and starts probing. Call stop to end probing and get the report.
+func startElasticsearchProber(t *testing.T, client *ElasticsearchClient, options ElasticsearchProberOptions) *ElasticsearchProber {
+	if options.Interval == 0 {
+		options.Interval = DEFAULT_PROBE_INTERVAL
+	}
+
+	createIndex := map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"_doc": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"probe_id":   map[string]interface{}{"type": "keyword"},
+					"@timestamp": map[string]interface{}{"type": "date"},
+				},
+			},
+		},
+	}
+	if err := client.CreateIndex(options.Index, createIndex); err != nil {
+		t.Fatalf("Failed to create probe index %s: %v", options.Index, err)
+	}
+
+	prober := &ElasticsearchProber{
+		client:  client,
+		options: options,
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+		started: time.Now(),
+		report:  ElasticsearchProbeReport{Errors: map[string]int{}},
+	}
+
+	logger.Logf(t, "Probing Elasticsearch at %s every %s using index %s", client.BaseUrl, options.Interval, options.Index)
+	go prober.run()
+
+	return prober
+}
+
+func (prober *ElasticsearchProber) run() {
+	defer close(prober.doneCh)
+
+	ticker := time.NewTicker(prober.options.Interval)
+	defer ticker.Stop()
+
+	for sequence := 0; ; sequence++ {
+		prober.probe(sequence)
+
+		select {
+		case <-prober.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe writes a new document and searches for the one written before it, which had time to be refreshed
+func (prober *ElasticsearchProber) probe(sequence int) {
+	id := elasticsearchProbeId(sequence)
+	document := map[string]interface{}{
+		"probe_id":   id,
+		"@timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	writeErr := prober.client.IndexDocument(prober.options.Index, id, document)
+
+	var readErr error
+	if sequence > 0 {
+		_, readErr = prober.client.Search(prober.options.Index, fmt.Sprintf("probe_id:%s", elasticsearchProbeId(sequence-1)))
+	}
+
+	prober.mutex.Lock()
+	defer prober.mutex.Unlock()
+
+	prober.report.Writes++
+	if writeErr == nil {
+		prober.acknowledged = append(prober.acknowledged, id)
+	} else {
+		prober.report.FailedWrites++
+	}
+	if sequence > 0 {
+		prober.report.Reads++
+		if readErr != nil {
+			prober.report.FailedReads++
+		}
+	}
+
+	prober.recordResult(time.Now(), writeErr, readErr)
+}
+
+// recordResult tracks unavailability windows. Must be called with the mutex held.
+func (prober *ElasticsearchProber) recordResult(now time.Time, errs ...error) {
+	failed := false
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed = true
+		message := probeErrorKey(err)
+		if _, seen := prober.report.Errors[message]; seen || len(prober.report.Errors) < MAX_PROBE_REPORT_ERRORS {
+			prober.report.Errors[message]++
+		}
+	}
+
+	if failed {
+		if prober.unavailableSince.IsZero() {
+			prober.unavailableSince = now
+		}
+		return
+	}
+	prober.closeUnavailabilityWindow(now)
+}
+
+// Must be called with the mutex held
+func (prober *ElasticsearchProber) closeUnavailabilityWindow(now time.Time) {
+	if prober.unavailableSince.IsZero() {
+		return
+	}
+	if window := now.Sub(prober.unavailableSince); window > prober.report.MaxUnavailability {
+		prober.report.MaxUnavailability = window
+	}
+	prober.unavailableSince = time.Time{}
+}
+
+// stop ends probing, checks that every acknowledged document is still in the index and returns the report
+func (prober *ElasticsearchProber) stop(t *testing.T) ElasticsearchProbeReport {
+	close(prober.stopCh)
+	<-prober.doneCh
+
+	prober.mutex.Lock()
+	defer prober.mutex.Unlock()
+
+	// If the cluster was still unavailable at the end, the window lasts until now
+	prober.closeUnavailabilityWindow(time.Now())
+	prober.report.Duration = time.Since(prober.started)
+
+	lost, err := prober.findLostDocumentsE()
+	if err != nil {
+		t.Fatalf("Failed to check for lost documents in index %s: %v", prober.options.Index, err)
+	}
+	prober.report.LostDocuments = lost
+
+	logger.Logf(t, "Elasticsearch probe report: %s", prober.report.String())
+	for _, message := range sortedErrorMessages(prober.report.Errors) {
+		logger.Logf(t, "Probe error (%d times): %s", prober.report.Errors[message], message)
+	}
+
+	return prober.report
+}
+
+// findLostDocumentsE returns the acknowledged documents that can't be found in the index. Must be called with the
+// mutex held.
+func (prober *ElasticsearchProber) findLostDocumentsE() ([]string, error) {
+	if err := prober.client.Refresh(prober.options.Index); err != nil {
+		return nil, err
+	}
+
+	// Failed writes may still have been persisted, so only a matching count with no failed writes rules out losses
+	count, err := prober.client.Count(prober.options.Index)
+	if err != nil {
+		return nil, err
+	}
+	if count == int64(len(prober.acknowledged)) && prober.report.FailedWrites == 0 {
+		return []string{}, nil
+	}
+
+	lost := []string{}
+	for _, id := range prober.acknowledged {
+		result, err := prober.client.Search(prober.options.Index, fmt.Sprintf("probe_id:%s", id))
+		if err != nil {
+			return nil, err
+		}
+		if result.Hits.Total.Value == 0 {
+			lost = append(lost, id)
+		}
+	}
+	return lost, nil
+}
+
+// probeErrorKey describes an error without the URL of the request, which differs for every probe, so the same
+// failure is only reported once
+func probeErrorKey(err error) string {
+	switch typedErr := err.(type) {
+	case ElasticsearchError:
+		return fmt.Sprintf("%s returned status %d: %s", typedErr.Method, typedErr.StatusCode, typedErr.Type)
+	case *url.Error:
+		return fmt.Sprintf("%s: %v", typedErr.Op, typedErr.Err)
+	default:
+		return err.Error()
+	}
+}
+
+// Ids are zero padded, so no id is a substring of another one, and avoid characters the query string syntax treats
+// as operators
+func elasticsearchProbeId(sequence int) string {
+	return fmt.Sprintf("probe_%08d", sequence)
+}
+
+func sortedErrorMessages(errors map[string]int) []string {
+	messages := []string{}
+	for message := range errors {
+		messages = append(messages, message)
+	}
+	sort.Strings(messages)
+	return messages
+}
+
+// checkElasticsearchProbeReport fails the test if documents were lost or the cluster was unavailable for longer than
+// maxUnavailability
+func checkElasticsearchProbeReport(t *testing.T, report ElasticsearchProbeReport, maxUnavailability time.Duration) {
+	if len(report.LostDocuments) > 0 {
+		t.Errorf("%d acknowledged documents were lost: %s", len(report.LostDocuments), strings.Join(report.LostDocuments, ", "))
+	}
+	if report.MaxUnavailability > maxUnavailability {
+		t.Errorf("Elasticsearch was unavailable for %s, which is more than the allowed %s", report.MaxUnavailability, maxUnavailability)
+	}
+}
@@ -0,0 +1,62 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineElasticsearchProber(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeElasticsearch(t, defaultFakeElasticsearchState())
+	defer server.Close()
+
+	client := newElasticsearchClient(t, server.URL, nil, "", "")
+	prober := startElasticsearchProber(t, client, ElasticsearchProberOptions{Index: "probe", Interval: 10 * time.Millisecond})
+
+	time.Sleep(100 * time.Millisecond)
+	server.FailNextRequests(6, http.StatusServiceUnavailable)
+	time.Sleep(200 * time.Millisecond)
+
+	report := prober.stop(t)
+
+	assert.NotZero(t, report.Writes)
+	assert.NotZero(t, report.FailedWrites)
+	assert.NotZero(t, report.Reads)
+	assert.NotZero(t, report.FailedReads)
+	assert.NotZero(t, report.MaxUnavailability)
+	assert.Empty(t, report.LostDocuments)
+	// One entry for the failed writes and one for the failed reads, however many requests failed
+	assert.Len(t, report.Errors, 2)
+	assert.Contains(t, report.Errors, "PUT returned status 503: fake_failure")
+
+	checkElasticsearchProbeReport(t, report, time.Minute)
+}
+
+func TestOfflineElasticsearchProberReportsLostDocuments(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeElasticsearch(t, defaultFakeElasticsearchState())
+	defer server.Close()
+
+	client := newElasticsearchClient(t, server.URL, nil, "", "")
+	prober := startElasticsearchProber(t, client, ElasticsearchProberOptions{Index: "probe", Interval: 10 * time.Millisecond})
+
+	time.Sleep(50 * time.Millisecond)
+	// Drop everything written so far, like a node that lost unreplicated shards would
+	server.UpdateState(func(state *FakeElasticsearchState) {
+		state.Documents["probe"] = []map[string]interface{}{}
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	report := prober.stop(t)
+
+	require.NotEmpty(t, report.LostDocuments)
+	assert.Equal(t, elasticsearchProbeId(0), report.LostDocuments[0])
+	assert.Less(t, len(report.LostDocuments), report.Writes)
+	assert.Zero(t, report.MaxUnavailability)
+}
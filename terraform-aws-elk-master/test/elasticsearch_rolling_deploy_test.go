@@ -0,0 +1,120 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/aws"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
+)
+
+const ROLLING_DEPLOY_TEST_CLUSTER_SIZE = 3
+
+// How long the cluster may be unavailable to clients during the rolling deploy. Clients retry, so a node that the
+// load balancer keeps routing to for a couple of health checks after it started shutting down is acceptable.
+const ROLLING_DEPLOY_MAX_UNAVAILABILITY = 1 * time.Minute
+
+// Deploys the elasticsearch-only-cluster example, then rolls out a new AMI to it while a prober writes and reads
+// through the load balancer, and checks the rollout lost no acknowledged writes
+func TestElasticsearchRollingDeploy(t *testing.T) {
+	t.Parallel()
+
+	// For convenience - uncomment these as well as the "os" import
+	// when doing local testing if you need to skip any sections.
+	// os.Setenv("SKIP_setup_ami", "true")
+	// os.Setenv("SKIP_deploy_to_aws", "true")
+	// os.Setenv("SKIP_rolling_deploy", "true")
+	// os.Setenv("SKIP_get_logs", "true")
+	// os.Setenv("SKIP_teardown", "true")
+
+	//zoneName := "gruntwork-sandbox.com" // Use this with Sandbox
+	zoneName := "gruntwork.in" // Use this with PhxDevops
+
+	examplesDir := test_structure.CopyTerraformFolderToTemp(t, "../", "examples")
+
+	defer test_structure.RunTestStage(t, "teardown", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		terraform.Destroy(t, terraformOptions)
+
+		keyPair := test_structure.LoadEc2KeyPair(t, examplesDir)
+		aws.DeleteEC2KeyPair(t, keyPair)
+	})
+
+	defer test_structure.RunTestStage(t, "get_logs", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		keyPair := test_structure.LoadEc2KeyPair(t, examplesDir)
+		if t.Failed() {
+			collectElasticsearchClusterDiagnostics(t, terraformOptions, keyPair, ubuntuOsProfile, newBackupRestoreTestClient(t, terraformOptions))
+		}
+	})
+
+	test_structure.RunTestStage(t, "setup_ami", func() {
+		awsRegion := aws.GetRandomStableRegion(t, RegionsWithGruntworkINACM, nil)
+		templatePath := fmt.Sprintf("%s/elk-amis/elasticsearch/elasticsearch.json", examplesDir)
+
+		// Build the same template twice, like the monthly rebuild of our AMIs, to get an AMI to roll out
+		packerInfo := PackerInfo{templatePath: templatePath, builderName: "elasticsearch-ami-ubuntu-20"}
+		amiIds := buildAmis(t, awsRegion, []AmiBuild{
+			{Name: "initial", PackerInfo: packerInfo},
+			// The AMI cache would return the initial AMI
+			{Name: "updated", PackerInfo: packerInfo, Fresh: true},
+		})
+		amiId := amiIds["initial"]
+		updatedAmiId := amiIds["updated"]
+
+		clusterName := fmt.Sprintf("es-rolling-%s", strings.ToLower(random.UniqueId()))
+
+		keyPair := createTestKeyPair(t, awsRegion, clusterName)
+		test_structure.SaveEc2KeyPair(t, examplesDir, keyPair)
+
+		terraformOptions := generateTerraformOptions(
+			t,
+			fmt.Sprintf("%s/elasticsearch-only-cluster", examplesDir),
+			awsRegion, amiId, clusterName, zoneName, keyPair.Name)
+		terraformOptions.Vars["cluster_size"] = ROLLING_DEPLOY_TEST_CLUSTER_SIZE
+
+		test_structure.SaveString(t, examplesDir, "updatedAmiId", updatedAmiId)
+		test_structure.SaveTerraformOptions(t, examplesDir, terraformOptions)
+	})
+
+	test_structure.RunTestStage(t, "deploy_to_aws", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		terraform.InitAndApply(t, terraformOptions)
+	})
+
+	test_structure.RunTestStage(t, "rolling_deploy", func() {
+		terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
+		updatedAmiId := test_structure.LoadString(t, examplesDir, "updatedAmiId")
+
+		loadbalancerDNS := terraform.OutputRequired(t, terraformOptions, "lb_dns_name")
+		client := newElasticsearchClient(t, fmt.Sprintf("http://%s:9200", loadbalancerDNS), nil, "", "")
+
+		checkElasticsearchClusterHealth(t, client, "green", ROLLING_DEPLOY_TEST_CLUSTER_SIZE)
+
+		prober := startElasticsearchProber(t, client, ElasticsearchProberOptions{
+			Index: fmt.Sprintf("rolling-deploy-probe-%s", strings.ToLower(random.UniqueId())),
+		})
+
+		// The rolling deploy replaces the servers one at a time and only returns once all of them were replaced
+		terraformOptions.Vars["ami_id"] = updatedAmiId
+		_, applyErr := terraform.ApplyE(t, terraformOptions)
+
+		// Save the options even if the apply failed, so teardown and later runs see the new AMI
+		test_structure.SaveTerraformOptions(t, examplesDir, terraformOptions)
+
+		if applyErr == nil {
+			checkElasticsearchClusterHealth(t, client, "green", ROLLING_DEPLOY_TEST_CLUSTER_SIZE)
+		}
+
+		report := prober.stop(t)
+
+		if applyErr != nil {
+			t.Fatalf("Failed to roll out AMI %s: %v", updatedAmiId, applyErr)
+		}
+		checkElasticsearchProbeReport(t, report, ROLLING_DEPLOY_MAX_UNAVAILABILITY)
+	})
+}
@@ -0,0 +1,234 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gruntwork-io/terratest/modules/aws"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+)
+
+// The message the restore Lambda returns when Elasticsearch accepted the restore. The handler also reports failures
+// through a successful invocation, so this is the only way to tell the two apart.
+const RESTORE_LAMBDA_STARTED_MESSAGE = "Restore operation started"
+
+// ElasticsearchDataset records what a backup must preserve for each index: the number of documents and the mappings
+type ElasticsearchDataset struct {
+	Counts   map[string]int64
+	Mappings map[string]map[string]interface{}
+}
+
+// writeElasticsearchDataset creates index with a known mapping, writes numDocuments documents to it and returns the
+// resulting dataset once they are all searchable
+func writeElasticsearchDataset(t *testing.T, client *ElasticsearchClient, index string, numDocuments int) ElasticsearchDataset {
+	logger.Logf(t, "Writing %d documents to index %s at %s", numDocuments, index, client.BaseUrl)
+
+	// Elasticsearch 6.x requires a mapping type, for which _doc is the recommended name
+	createIndex := map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"_doc": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"message":     map[string]interface{}{"type": "text"},
+					"sequence":    map[string]interface{}{"type": "integer"},
+					"environment": map[string]interface{}{"type": "keyword"},
+				},
+			},
+		},
+	}
+	if err := client.CreateIndex(index, createIndex); err != nil {
+		t.Fatalf("Failed to create index %s: %v", index, err)
+	}
+
+	for i := 0; i < numDocuments; i++ {
+		document := map[string]interface{}{
+			"message":     fmt.Sprintf("Backup and restore test document %d", i),
+			"sequence":    i,
+			"environment": "terratest",
+		}
+		if err := client.IndexDocument(index, fmt.Sprintf("%d", i), document); err != nil {
+			t.Fatalf("Failed to write document %d to index %s: %v", i, index, err)
+		}
+	}
+
+	if err := client.Refresh(index); err != nil {
+		t.Fatalf("Failed to refresh index %s: %v", index, err)
+	}
+
+	dataset, err := captureElasticsearchDatasetE(client, []string{index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataset.Counts[index] != int64(numDocuments) {
+		t.Fatalf("Expected %d documents in index %s after writing them, but found %d", numDocuments, index, dataset.Counts[index])
+	}
+	return dataset
+}
+
+// captureElasticsearchDatasetE returns the document count and mappings of each of the given indices
+func captureElasticsearchDatasetE(client *ElasticsearchClient, indices []string) (ElasticsearchDataset, error) {
+	dataset := ElasticsearchDataset{
+		Counts:   map[string]int64{},
+		Mappings: map[string]map[string]interface{}{},
+	}
+
+	for _, index := range indices {
+		count, err := client.Count(index)
+		if err != nil {
+			return dataset, err
+		}
+		mapping, err := client.Mapping(index)
+		if err != nil {
+			return dataset, err
+		}
+		dataset.Counts[index] = count
+		dataset.Mappings[index] = mapping
+	}
+
+	return dataset, nil
+}
+
+func (dataset ElasticsearchDataset) indices() []string {
+	indices := []string{}
+	for index := range dataset.Counts {
+		indices = append(indices, index)
+	}
+	return indices
+}
+
+// invokeElasticsearchLambdaE synchronously invokes one of the backup or restore Lambda functions and returns the
+// message it passed to its callback
+func invokeElasticsearchLambdaE(t *testing.T, awsRegion string, functionName string, payload interface{}) (string, error) {
+	logger.Logf(t, "Invoking Lambda function %s with payload %v", functionName, payload)
+
+	out, err := aws.InvokeFunctionE(t, awsRegion, functionName, payload)
+	if functionErr, isFunctionErr := err.(*aws.FunctionError); isFunctionErr {
+		return "", fmt.Errorf("Lambda function %s failed with %s: %s", functionName, functionErr.Message, string(functionErr.Payload))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var message string
+	if err := json.Unmarshal(out, &message); err != nil {
+		return "", fmt.Errorf("Expected Lambda function %s to return a string but got %s", functionName, string(out))
+	}
+
+	logger.Logf(t, "Lambda function %s returned: %s", functionName, message)
+	return message, nil
+}
+
+// invokeBackupLambda runs the backup Lambda once and waits for it to start a snapshot. The backup runs asynchronously
+// in Elasticsearch, so use waitForNewSnapshot to wait for it to finish.
+func invokeBackupLambda(t *testing.T, awsRegion string, functionName string) {
+	if _, err := invokeElasticsearchLambdaE(t, awsRegion, functionName, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// invokeRestoreLambda runs the restore Lambda for the given snapshot and fails the test unless Elasticsearch accepted
+// the restore
+func invokeRestoreLambda(t *testing.T, awsRegion string, functionName string, snapshotId string) {
+	message, err := invokeElasticsearchLambdaE(t, awsRegion, functionName, map[string]interface{}{"snapshotId": snapshotId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != RESTORE_LAMBDA_STARTED_MESSAGE {
+		t.Fatalf("Restore Lambda function %s did not start the restore of snapshot %s: %s", functionName, snapshotId, message)
+	}
+}
+
+// waitForNewSnapshot waits for a snapshot that is not in existingSnapshots to complete successfully in the repository
+// and returns it. A snapshot that fails or completes partially fails the test immediately.
+func waitForNewSnapshot(t *testing.T, client *ElasticsearchClient, repository string, existingSnapshots []ElasticsearchSnapshot) ElasticsearchSnapshot {
+	existing := map[string]bool{}
+	for _, snapshot := range existingSnapshots {
+		existing[snapshot.Snapshot] = true
+	}
+
+	var newSnapshot ElasticsearchSnapshot
+	waitFor(t, snapshotWaitBudget, fmt.Sprintf("a new snapshot in repository %s", repository), func(ctx context.Context) error {
+		snapshots, err := client.Snapshots(repository)
+		if err != nil {
+			return err
+		}
+
+		for _, snapshot := range snapshots {
+			if existing[snapshot.Snapshot] {
+				continue
+			}
+			switch snapshot.State {
+			case "SUCCESS":
+				newSnapshot = snapshot
+				return nil
+			case "FAILED", "PARTIAL", "INCOMPATIBLE":
+				return retry.FatalError{Underlying: fmt.Errorf("Snapshot %s finished with state %s", snapshot.Snapshot, snapshot.State)}
+			default:
+				return fmt.Errorf("Snapshot %s is in state %s", snapshot.Snapshot, snapshot.State)
+			}
+		}
+
+		return fmt.Errorf("No new snapshot in repository %s yet", repository)
+	})
+
+	logger.Logf(t, "Snapshot %s (%s) of indices %v completed", newSnapshot.Snapshot, newSnapshot.Uuid, newSnapshot.Indices)
+	return newSnapshot
+}
+
+// waitForSnapshotInS3 waits for the metadata file Elasticsearch writes to the root of an S3 repository when it
+// finishes a snapshot
+func waitForSnapshotInS3(t *testing.T, awsRegion string, bucket string, snapshot ElasticsearchSnapshot) {
+	s3Client := aws.NewS3Client(t, awsRegion)
+	key := fmt.Sprintf("snap-%s.dat", snapshot.Uuid)
+
+	waitFor(t, snapshotWaitBudget, fmt.Sprintf("s3://%s/%s", bucket, key), func(ctx context.Context) error {
+		out, err := s3Client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: awsgo.String(bucket),
+			Prefix: awsgo.String(key),
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Contents) == 0 {
+			return fmt.Errorf("Snapshot %s not found in bucket %s", key, bucket)
+		}
+		return nil
+	})
+}
+
+// checkElasticsearchDatasetRestored waits until every index of the expected dataset has the same number of documents
+// and the same mappings as when it was backed up
+func checkElasticsearchDatasetRestored(t *testing.T, client *ElasticsearchClient, expected ElasticsearchDataset) {
+	logger.Logf(t, "Checking that indices %v were restored at %s", expected.indices(), client.BaseUrl)
+	waitForElasticsearchDataset(t, restoreWaitBudget, client, expected)
+}
+
+// waitForElasticsearchDataset waits until every index of the expected dataset has the expected number of documents.
+// A changed mapping fails the test immediately, as waiting won't fix it.
+func waitForElasticsearchDataset(t *testing.T, budget WaitBudget, client *ElasticsearchClient, expected ElasticsearchDataset) {
+	indices := expected.indices()
+
+	waitFor(t, budget, fmt.Sprintf("indices %v to match the expected dataset", indices), func(ctx context.Context) error {
+		actual, err := captureElasticsearchDatasetE(client, indices)
+		if err != nil {
+			return err
+		}
+
+		for _, index := range indices {
+			if actual.Counts[index] != expected.Counts[index] {
+				return fmt.Errorf("Expected %d documents in index %s but found %d", expected.Counts[index], index, actual.Counts[index])
+			}
+			expectedMapping, _ := json.Marshal(expected.Mappings[index])
+			actualMapping, _ := json.Marshal(actual.Mappings[index])
+			if string(expectedMapping) != string(actualMapping) {
+				return retry.FatalError{Underlying: fmt.Errorf("Mapping of index %s changed. Expected %s but got %s", index, expectedMapping, actualMapping)}
+			}
+		}
+
+		return nil
+	})
+}
@@ -7,7 +7,6 @@ import (
 
 	"github.com/gruntwork-io/terratest/modules/aws"
 	"github.com/gruntwork-io/terratest/modules/random"
-	"github.com/gruntwork-io/terratest/modules/ssh"
 	"github.com/gruntwork-io/terratest/modules/terraform"
 	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
 )
@@ -36,6 +35,7 @@ func TestELKAIOEndToEnd(t *testing.T) {
 		elasticsearchDiscoveryPort int
 		kibanaUIPort               int
 		elkPackerInfo              PackerInfo
+		osProfile                  OsProfile
 	}{
 		{
 			"TestElasticsearchUbuntu2004",
@@ -45,6 +45,7 @@ func TestELKAIOEndToEnd(t *testing.T) {
 			PackerInfo{
 				builderName: "elk-aio-ami-ubuntu-20",
 			},
+			ubuntuOsProfile,
 		},
 		{
 			"TestElasticsearchUbuntu1804",
@@ -54,6 +55,7 @@ func TestELKAIOEndToEnd(t *testing.T) {
 			PackerInfo{
 				builderName: "elk-aio-ami-ubuntu-18",
 			},
+			ubuntuOsProfile,
 		},
 	}
 
@@ -84,7 +86,7 @@ func TestELKAIOEndToEnd(t *testing.T) {
 				elkClusterName := fmt.Sprintf("es-%s", uniqueId)
 				albName := fmt.Sprintf("alb-%s", uniqueId)
 
-				keyPair := aws.CreateAndImportEC2KeyPair(t, awsRegion, uniqueId)
+				keyPair := createTestKeyPair(t, awsRegion, uniqueId)
 				test_structure.SaveEc2KeyPair(t, examplesDir, keyPair)
 
 				terraformOptions := &terraform.Options{
@@ -97,6 +99,7 @@ func TestELKAIOEndToEnd(t *testing.T) {
 						"filebeat_log_path": "/var/log/source.log",
 						"key_name":          keyPair.Name,
 						"alb_name":          albName,
+						"custom_tags":       testResourceTerraformTags(t),
 					},
 				}
 
@@ -109,35 +112,32 @@ func TestELKAIOEndToEnd(t *testing.T) {
 			})
 
 			test_structure.RunTestStage(t, "validate", func() {
+				awsRegion := test_structure.LoadString(t, examplesDir, "awsRegion")
 				terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
 				asgName := terraform.OutputList(t, terraformOptions, "server_asg_names")[0]
 
-				ip := getIPForInstanceInAsg(t, asgName, terraformOptions)
 				keyPair := test_structure.LoadEc2KeyPair(t, examplesDir)
+				executor := remoteExecutorForAsg(t, newRemoteExecOptions(t, awsRegion, keyPair, testCase.osProfile), asgName)
 
-				host := ssh.Host{
-					Hostname:    ip,
-					SshUserName: "ubuntu",
-					SshKeyPair:  keyPair.KeyPair,
-				}
-
-				randomMessage := writeAppServerLog(t, host, terraformOptions.Vars["filebeat_log_path"].(string))
+				randomMessage := writeAppServerLog(t, executor, terraformOptions.Vars["filebeat_log_path"].(string))
 
 				loadbalancerDns := terraform.Output(t, terraformOptions, "alb_dns_name")
 				elasticsearchUrl := fmt.Sprintf("http://%s:%d", loadbalancerDns, testCase.elasticsearchPort)
-				queryUrl := fmt.Sprintf("%s/_all/_search?q=message:%s", elasticsearchUrl, randomMessage)
+				client := newElasticsearchClient(t, elasticsearchUrl, nil, "", "")
 
-				validateGetHttp(t, randomMessage, queryUrl, nil, "")
+				checkElasticsearchHitCount(t, client, "_all", fmt.Sprintf("message:%s", randomMessage), 1)
 			})
 
 			test_structure.RunTestStage(t, "validate_collectd", func() {
+				awsRegion := test_structure.LoadString(t, examplesDir, "awsRegion")
 				terraformOptions := test_structure.LoadTerraformOptions(t, examplesDir)
 				keyPair := test_structure.LoadEc2KeyPair(t, examplesDir)
 
 				asgName := terraform.OutputList(t, terraformOptions, "server_asg_names")[0]
 				publicInstanceIP := getIPForInstanceInAsg(t, asgName, terraformOptions)
+				executor := remoteExecutorForAsg(t, newRemoteExecOptions(t, awsRegion, keyPair, testCase.osProfile), asgName)
 
-				checkLogstashOutputLog(t, publicInstanceIP, "ubuntu", *keyPair, LogstashFileOutputPath, fmt.Sprintf("\"x_forwarded_for\":\"%s\"", publicInstanceIP))
+				checkLogstashOutputLog(t, executor, testCase.osProfile, LogstashFileOutputPath, fmt.Sprintf("\"x_forwarded_for\":\"%s\"", publicInstanceIP))
 			})
 
 			test_structure.RunTestStage(t, "validate_cloudwatch", func() {
@@ -146,14 +146,12 @@ func TestELKAIOEndToEnd(t *testing.T) {
 				awsRegion := test_structure.LoadString(t, examplesDir, "awsRegion")
 
 				logGroup := terraform.Output(t, terraformOptions, "log_group")
-				logContent := "This is a log line_cloudwatch"
-
-				writeContentToLogStream(t, logGroup, logContent, awsRegion)
+				written := writeLogEvents(t, awsRegion, logGroup, "This is a log line_cloudwatch", CLOUDWATCH_TEST_LOG_EVENTS)
 
 				asgName := terraform.OutputList(t, terraformOptions, "server_asg_names")[0]
-				publicInstanceIP := getIPForInstanceInAsg(t, asgName, terraformOptions)
+				executor := remoteExecutorForAsg(t, newRemoteExecOptions(t, awsRegion, keyPair, testCase.osProfile), asgName)
 
-				checkLogstashOutputLog(t, publicInstanceIP, "ubuntu", *keyPair, LogstashFileOutputPath, fmt.Sprintf("\"message\":\"%s\"", logContent))
+				checkLogstashOutputLog(t, executor, testCase.osProfile, LogstashFileOutputPath, written.logstashOutputContents()...)
 			})
 
 			test_structure.RunTestStage(t, "validate_cloudtrail", func() {
@@ -161,16 +159,17 @@ func TestELKAIOEndToEnd(t *testing.T) {
 				keyPair := test_structure.LoadEc2KeyPair(t, examplesDir)
 				awsRegion := test_structure.LoadString(t, examplesDir, "awsRegion")
 
-				logContent := "This is a log line_cloudtrail"
-
 				bucket := terraform.Output(t, terraformOptions, "bucket")
-				key := writeContentToS3Bucket(t, bucket, logContent, awsRegion)
+				logFile := writeCloudTrailLogFile(t, bucket, awsRegion, CloudTrailFixtureOptions{
+					AccountId: aws.GetAccountId(t),
+					Count:     CLOUDTRAIL_TEST_RECORDS,
+				})
 
 				asgName := terraform.OutputList(t, terraformOptions, "server_asg_names")[0]
-				publicInstanceIP := getIPForInstanceInAsg(t, asgName, terraformOptions)
+				executor := remoteExecutorForAsg(t, newRemoteExecOptions(t, awsRegion, keyPair, testCase.osProfile), asgName)
 
-				checkLogstashOutputLog(t, publicInstanceIP, "ubuntu", *keyPair, LogstashFileOutputPath, fmt.Sprintf("\"message\":\"%s\"", logContent))
-				deleteObjectFromS3Bucket(t, bucket, key, awsRegion)
+				checkLogstashCloudTrailRecords(t, executor, testCase.osProfile, LogstashFileOutputPath, logFile)
+				deleteObjectFromS3Bucket(t, bucket, logFile.Key, awsRegion)
 			})
 
 			test_structure.RunTestStage(t, "validate_kibana", func() {
@@ -0,0 +1,190 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// FakeAsgDescriber is an in-memory ASGDescriber. Like the real API, it returns the groups named in the input.
+type FakeAsgDescriber struct {
+	Groups []*autoscaling.Group
+	// Returned by every call, if set
+	Err error
+}
+
+func (fake *FakeAsgDescriber) DescribeAutoScalingGroupsWithContext(ctx awsgo.Context, input *autoscaling.DescribeAutoScalingGroupsInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	if fake.Err != nil {
+		return nil, fake.Err
+	}
+
+	names := map[string]bool{}
+	for _, name := range input.AutoScalingGroupNames {
+		names[awsgo.StringValue(name)] = true
+	}
+
+	output := &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []*autoscaling.Group{}}
+	for _, group := range fake.Groups {
+		if len(names) == 0 || names[awsgo.StringValue(group.AutoScalingGroupName)] {
+			output.AutoScalingGroups = append(output.AutoScalingGroups, group)
+		}
+	}
+	return output, nil
+}
+
+// FakeInstanceDescriber is an in-memory InstanceDescriber. Like the real API, it leaves out instances it doesn't know
+// about, e.g. ones an ASG launched a moment ago.
+type FakeInstanceDescriber struct {
+	Instances []*ec2.Instance
+	// Returned by every call, if set
+	Err error
+}
+
+func (fake *FakeInstanceDescriber) DescribeInstancesWithContext(ctx awsgo.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	if fake.Err != nil {
+		return nil, fake.Err
+	}
+
+	ids := map[string]bool{}
+	for _, id := range input.InstanceIds {
+		ids[awsgo.StringValue(id)] = true
+	}
+
+	reservation := &ec2.Reservation{Instances: []*ec2.Instance{}}
+	for _, instance := range fake.Instances {
+		if ids[awsgo.StringValue(instance.InstanceId)] {
+			reservation.Instances = append(reservation.Instances, instance)
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, nil
+}
+
+// FakeLogWriter is an in-memory LogWriter. Like the real API, it checks sequence tokens and the order of timestamps,
+// and records the events it accepts.
+type FakeLogWriter struct {
+	// The log streams of each log group. Streams created with CreateLogStream are added to it.
+	LogStreams map[string][]*cloudwatchlogs.LogStream
+	// Returned by every call to PutLogEvents, if set
+	PutErr error
+	// Returned, in order, by the next calls to PutLogEvents, e.g. to throttle them
+	PutErrs []error
+	// How many calls to PutLogEvents another writer gets in first, which makes the sequence token of the caller stale
+	ConcurrentWrites int
+	// How many calls to PutLogEvents accept the events but fail as if the response was lost
+	LostResponses int
+	// How many calls to CreateLogStream create the stream but fail as if the response was lost
+	LostCreateResponses int
+
+	mutex    sync.Mutex
+	sequence int
+	// The sequence token the last accepted batch of each log stream was sent with
+	acceptedWith map[*cloudwatchlogs.LogStream]string
+	events       []*cloudwatchlogs.PutLogEventsInput
+}
+
+func (fake *FakeLogWriter) CreateLogStreamWithContext(ctx awsgo.Context, input *cloudwatchlogs.CreateLogStreamInput, opts ...request.Option) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	group := awsgo.StringValue(input.LogGroupName)
+	streams, ok := fake.LogStreams[group]
+	if !ok {
+		return nil, &cloudwatchlogs.ResourceNotFoundException{Message_: awsgo.String("The specified log group does not exist.")}
+	}
+	if fake.findLogStream(group, awsgo.StringValue(input.LogStreamName)) != nil {
+		return nil, &cloudwatchlogs.ResourceAlreadyExistsException{Message_: awsgo.String("The specified log stream already exists")}
+	}
+
+	fake.LogStreams[group] = append(streams, &cloudwatchlogs.LogStream{LogStreamName: input.LogStreamName})
+
+	if fake.LostCreateResponses > 0 {
+		fake.LostCreateResponses--
+		return nil, awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset by peer"))
+	}
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+func (fake *FakeLogWriter) PutLogEventsWithContext(ctx awsgo.Context, input *cloudwatchlogs.PutLogEventsInput, opts ...request.Option) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if fake.PutErr != nil {
+		return nil, fake.PutErr
+	}
+	if len(fake.PutErrs) > 0 {
+		err := fake.PutErrs[0]
+		fake.PutErrs = fake.PutErrs[1:]
+		return nil, err
+	}
+
+	stream := fake.findLogStream(awsgo.StringValue(input.LogGroupName), awsgo.StringValue(input.LogStreamName))
+	if stream == nil {
+		return nil, &cloudwatchlogs.ResourceNotFoundException{Message_: awsgo.String("The specified log stream does not exist.")}
+	}
+
+	if fake.ConcurrentWrites > 0 {
+		fake.ConcurrentWrites--
+		fake.advanceSequenceToken(stream)
+	}
+
+	token := awsgo.StringValue(input.SequenceToken)
+	if token != awsgo.StringValue(stream.UploadSequenceToken) {
+		if acceptedWith, ok := fake.acceptedWith[stream]; ok && acceptedWith == token {
+			return nil, &cloudwatchlogs.DataAlreadyAcceptedException{
+				Message_:              awsgo.String("The given batch of log events has already been accepted."),
+				ExpectedSequenceToken: stream.UploadSequenceToken,
+			}
+		}
+		return nil, &cloudwatchlogs.InvalidSequenceTokenException{
+			Message_:              awsgo.String("The given sequenceToken is invalid."),
+			ExpectedSequenceToken: stream.UploadSequenceToken,
+		}
+	}
+
+	for i := 1; i < len(input.LogEvents); i++ {
+		if awsgo.Int64Value(input.LogEvents[i].Timestamp) < awsgo.Int64Value(input.LogEvents[i-1].Timestamp) {
+			return nil, &cloudwatchlogs.InvalidParameterException{Message_: awsgo.String("Log events in a single PutLogEvents request must be in chronological order.")}
+		}
+	}
+
+	if fake.acceptedWith == nil {
+		fake.acceptedWith = map[*cloudwatchlogs.LogStream]string{}
+	}
+	fake.acceptedWith[stream] = token
+	fake.events = append(fake.events, input)
+	fake.advanceSequenceToken(stream)
+
+	if fake.LostResponses > 0 {
+		fake.LostResponses--
+		return nil, awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset by peer"))
+	}
+	return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: stream.UploadSequenceToken}, nil
+}
+
+func (fake *FakeLogWriter) findLogStream(group string, name string) *cloudwatchlogs.LogStream {
+	for _, stream := range fake.LogStreams[group] {
+		if awsgo.StringValue(stream.LogStreamName) == name {
+			return stream
+		}
+	}
+	return nil
+}
+
+func (fake *FakeLogWriter) advanceSequenceToken(stream *cloudwatchlogs.LogStream) {
+	fake.sequence++
+	stream.UploadSequenceToken = awsgo.String(fmt.Sprintf("%d", fake.sequence))
+}
+
+// Events returns every call to PutLogEvents that was accepted
+func (fake *FakeLogWriter) Events() []*cloudwatchlogs.PutLogEventsInput {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]*cloudwatchlogs.PutLogEventsInput{}, fake.events...)
+}
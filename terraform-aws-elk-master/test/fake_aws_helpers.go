@@ -0,0 +1,134 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// FakeAwsRequest is an AWS API call recorded by a FakeAwsServer
+type FakeAwsRequest struct {
+	// The IAM style name of the call, e.g. lambda:UpdateFunctionConfiguration
+	Action string
+	Path   string
+	Body   map[string]interface{}
+}
+
+// FakeAwsServer is an in-process HTTP server that answers the few AWS API calls made by the Lambda functions in this
+// repo, so their handlers can run against it instead of a real AWS account. Point an AWS SDK at it by setting its
+// endpoint to URL.
+type FakeAwsServer struct {
+	Server *httptest.Server
+	URL    string
+
+	mutex    sync.Mutex
+	failures map[string]fakeAwsFailure
+	requests []FakeAwsRequest
+}
+
+// A failure injected with FailAction
+type fakeAwsFailure struct {
+	status    int
+	errorCode string
+}
+
+// Lambda uses a REST API, so its calls are identified by method and path
+var fakeAwsLambdaUpdateFunctionConfigurationPath = regexp.MustCompile(`^/2015-03-31/functions/([^/]+)/configuration$`)
+
+// CloudWatch Events uses a JSON RPC API, so its calls are identified by the X-Amz-Target header
+const FAKE_AWS_EVENTS_TARGET_PREFIX = "AWSEvents."
+
+// startFakeAws starts a fake AWS API. Callers must Close it when done.
+func startFakeAws(t *testing.T) *FakeAwsServer {
+	server := &FakeAwsServer{failures: map[string]fakeAwsFailure{}}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	server.URL = server.Server.URL
+	return server
+}
+
+func (server *FakeAwsServer) Close() {
+	server.Server.Close()
+}
+
+// FailAction makes every call to action, e.g. events:PutRule, fail with the given HTTP status code and AWS error code
+func (server *FakeAwsServer) FailAction(action string, status int, errorCode string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.failures[action] = fakeAwsFailure{status: status, errorCode: errorCode}
+}
+
+// Requests returns every call to action the fake has received so far
+func (server *FakeAwsServer) Requests(action string) []FakeAwsRequest {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	requests := []FakeAwsRequest{}
+	for _, request := range server.requests {
+		if request.Action == action {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func (server *FakeAwsServer) handle(w http.ResponseWriter, r *http.Request) {
+	rawBody, _ := ioutil.ReadAll(r.Body)
+	body := map[string]interface{}{}
+	json.Unmarshal(rawBody, &body)
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	target := r.Header.Get("X-Amz-Target")
+	isJsonRpc := strings.HasPrefix(target, FAKE_AWS_EVENTS_TARGET_PREFIX)
+
+	var action string
+	var response map[string]interface{}
+
+	switch {
+	case isJsonRpc && target == FAKE_AWS_EVENTS_TARGET_PREFIX+"PutRule":
+		action = "events:PutRule"
+		response = map[string]interface{}{"RuleArn": fmt.Sprintf("arn:aws:events:us-east-1:000000000000:rule/%v", body["Name"])}
+	case r.Method == http.MethodPut && fakeAwsLambdaUpdateFunctionConfigurationPath.MatchString(r.URL.Path):
+		functionName := fakeAwsLambdaUpdateFunctionConfigurationPath.FindStringSubmatch(r.URL.Path)[1]
+		action = "lambda:UpdateFunctionConfiguration"
+		response = map[string]interface{}{"FunctionName": functionName, "Environment": body["Environment"]}
+	default:
+		writeFakeAwsError(w, isJsonRpc, http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("%s %s %s is not implemented by the fake", r.Method, r.URL.Path, target))
+		return
+	}
+
+	server.requests = append(server.requests, FakeAwsRequest{Action: action, Path: r.URL.Path, Body: body})
+
+	if failure, ok := server.failures[action]; ok {
+		writeFakeAwsError(w, isJsonRpc, failure.status, failure.errorCode, "Failure injected by the fake AWS server")
+		return
+	}
+
+	if isJsonRpc {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeFakeAwsError writes an error the way the JSON RPC and REST JSON AWS APIs do, so the SDKs surface errorCode as
+// the code of the error
+func writeFakeAwsError(w http.ResponseWriter, isJsonRpc bool, status int, errorCode string, message string) {
+	if isJsonRpc {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Amzn-ErrorType", errorCode)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"__type": errorCode, "message": message})
+}
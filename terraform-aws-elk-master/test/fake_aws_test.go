@@ -0,0 +1,104 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests check that the fake AWS API speaks the wire protocols of the real one, using the Go SDK as the client
+
+func newFakeAwsSession(t *testing.T, server *FakeAwsServer) *session.Session {
+	sess, err := session.NewSession(&awsgo.Config{
+		Region:      awsgo.String("us-east-1"),
+		Endpoint:    awsgo.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("fake", "fake", ""),
+		MaxRetries:  awsgo.Int(0),
+	})
+	require.NoError(t, err)
+	return sess
+}
+
+func TestOfflineFakeAws(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeAws(t)
+	defer server.Close()
+
+	sess := newFakeAwsSession(t, server)
+
+	_, err := lambda.New(sess).UpdateFunctionConfiguration(&lambda.UpdateFunctionConfigurationInput{
+		FunctionName: awsgo.String("es-restore-notification"),
+		Environment:  &lambda.Environment{Variables: map[string]*string{"SNAPSHOT_ID": awsgo.String("snapshot_1")}},
+	})
+	require.NoError(t, err)
+
+	_, err = cloudwatchevents.New(sess).PutRule(&cloudwatchevents.PutRuleInput{
+		Name:               awsgo.String("es-restore-notification"),
+		ScheduleExpression: awsgo.String("rate(5 minutes)"),
+		State:              awsgo.String("ENABLED"),
+	})
+	require.NoError(t, err)
+
+	updates := server.Requests("lambda:UpdateFunctionConfiguration")
+	require.Len(t, updates, 1)
+	assert.Equal(t, "/2015-03-31/functions/es-restore-notification/configuration", updates[0].Path)
+
+	rules := server.Requests("events:PutRule")
+	require.Len(t, rules, 1)
+	assert.Equal(t, "ENABLED", rules[0].Body["State"])
+}
+
+func TestOfflineFakeAwsFailAction(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeAws(t)
+	defer server.Close()
+
+	server.FailAction("lambda:UpdateFunctionConfiguration", http.StatusNotFound, "ResourceNotFoundException")
+	server.FailAction("events:PutRule", http.StatusBadRequest, "ValidationException")
+
+	sess := newFakeAwsSession(t, server)
+
+	_, err := lambda.New(sess).UpdateFunctionConfiguration(&lambda.UpdateFunctionConfigurationInput{
+		FunctionName: awsgo.String("es-restore-notification"),
+	})
+	awsErr, ok := err.(awserr.Error)
+	require.True(t, ok, "Expected an awserr.Error but got %v", err)
+	assert.Equal(t, "ResourceNotFoundException", awsErr.Code())
+
+	_, err = cloudwatchevents.New(sess).PutRule(&cloudwatchevents.PutRuleInput{Name: awsgo.String("es-restore-notification")})
+	awsErr, ok = err.(awserr.Error)
+	require.True(t, ok, "Expected an awserr.Error but got %v", err)
+	assert.Equal(t, "ValidationException", awsErr.Code())
+
+	// Failed calls are still recorded
+	assert.Len(t, server.Requests("lambda:UpdateFunctionConfiguration"), 1)
+	assert.Len(t, server.Requests("events:PutRule"), 1)
+}
+
+func TestOfflineParseLambdaHarnessOutput(t *testing.T) {
+	t.Parallel()
+
+	output := "Using protocol: http\n" +
+		LAMBDA_HARNESS_RESULT_PREFIX + `{"callbacks": [{"error": null, "result": "Restore operation started"}, {"error": {"message": "boom", "code": "ResourceNotFoundException"}, "result": "failed"}]}` + "\n"
+
+	result, err := parseLambdaHarnessOutput(output)
+	require.NoError(t, err)
+	require.Len(t, result.Callbacks, 2)
+	assert.Nil(t, result.Callbacks[0].Error)
+	assert.Equal(t, "Restore operation started", result.Callbacks[0].Result)
+	assert.NotNil(t, result.Callbacks[1].Error)
+	assert.Equal(t, output, result.Output)
+
+	_, err = parseLambdaHarnessOutput("Using protocol: http\n")
+	assert.Error(t, err)
+}
@@ -0,0 +1,375 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+)
+
+// FakeBeatsOptions configures how a FakeBeatsServer ACKs the windows it receives
+type FakeBeatsOptions struct {
+	// How many keep alive ACKs to send before the ACKs of each window, like Logstash does while it is busy
+	KeepAlives int
+	// ACK every AckEvery events of a window, rather than only the whole window
+	AckEvery int
+	// Close the connection once this many events were received in total, after ACKing them. 0 never does.
+	CloseAfterEvents int
+	// ACK one event more than the window has instead of the last event, like a broken server
+	AckBeyondWindow bool
+	// Require a client certificate signed by the CA of the keystore, like ssl_verify_mode => force_peer. Otherwise a
+	// client certificate is verified if the client presents one, like ssl_verify_mode => peer.
+	RequireClientCert bool
+}
+
+// FakeBeatsWindow is a window received by a FakeBeatsServer
+type FakeBeatsWindow struct {
+	Size       int
+	Compressed bool
+}
+
+// FakeBeatsServer is an in-process Lumberjack v2 server that records the events it receives and ACKs them like the
+// beats input of Logstash, so the BeatsClient can be tested without Logstash
+type FakeBeatsServer struct {
+	Address string
+	// Set when the server speaks TLS. Its CA signed the server certificate.
+	KeyStore *keystore
+
+	options  FakeBeatsOptions
+	listener net.Listener
+	waiter   sync.WaitGroup
+
+	mutex       sync.Mutex
+	conns       []net.Conn
+	events      []BeatsEvent
+	windows     []FakeBeatsWindow
+	clientNames []string
+	errors      []error
+}
+
+// startFakeBeats starts a fake beats input that speaks plain TCP. Callers must Close it when done.
+func startFakeBeats(t *testing.T, options FakeBeatsOptions) *FakeBeatsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start the fake beats input: %v", err)
+	}
+	return newFakeBeatsServer(listener, options, nil)
+}
+
+// startFakeBeatsTLS starts a fake beats input that serves the CertFile and KeyFile of the keystore, e.g. as produced
+// by createKeyStoreFiles, and verifies client certificates against its CaFile. Callers must Close it when done.
+func startFakeBeatsTLS(t *testing.T, options FakeBeatsOptions, keyStore *keystore) *FakeBeatsServer {
+	cert, err := tls.LoadX509KeyPair(keyStore.CertFile, keyStore.KeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load TLS cert %s and key %s: %v", keyStore.CertFile, keyStore.KeyFile, err)
+	}
+	caCert, err := ioutil.ReadFile(keyStore.CaFile)
+	if err != nil {
+		t.Fatalf("Failed to read CA file %s: %v", keyStore.CaFile, err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caCert) {
+		t.Fatalf("No PEM certificates found in CA file %s", keyStore.CaFile)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	if options.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Failed to start the fake beats input: %v", err)
+	}
+	return newFakeBeatsServer(listener, options, keyStore)
+}
+
+func newFakeBeatsServer(listener net.Listener, options FakeBeatsOptions, keyStore *keystore) *FakeBeatsServer {
+	server := &FakeBeatsServer{
+		Address:  listener.Addr().String(),
+		KeyStore: keyStore,
+		options:  options,
+		listener: listener,
+	}
+
+	server.waiter.Add(1)
+	go func() {
+		defer server.waiter.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mutex.Lock()
+			server.conns = append(server.conns, conn)
+			server.mutex.Unlock()
+
+			server.waiter.Add(1)
+			go func() {
+				defer server.waiter.Done()
+				defer conn.Close()
+				if err := server.serve(conn); err != nil {
+					server.mutex.Lock()
+					server.errors = append(server.errors, err)
+					server.mutex.Unlock()
+				}
+			}()
+		}
+	}()
+
+	return server
+}
+
+func (server *FakeBeatsServer) Close() {
+	server.listener.Close()
+	server.mutex.Lock()
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.mutex.Unlock()
+	server.waiter.Wait()
+}
+
+// Events returns the events received so far, in order
+func (server *FakeBeatsServer) Events() []BeatsEvent {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]BeatsEvent{}, server.events...)
+}
+
+// Windows returns the windows received so far, in order
+func (server *FakeBeatsServer) Windows() []FakeBeatsWindow {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]FakeBeatsWindow{}, server.windows...)
+}
+
+// ClientNames returns the common name of the verified client certificate of each TLS connection, or "" if the client
+// presented none
+func (server *FakeBeatsServer) ClientNames() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.clientNames...)
+}
+
+// Errors returns the protocol errors of the connections the server closed
+func (server *FakeBeatsServer) Errors() []error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]error{}, server.errors...)
+}
+
+func (server *FakeBeatsServer) serve(conn net.Conn) error {
+	if tlsConn, isTls := conn.(*tls.Conn); isTls {
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		clientName := ""
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			clientName = certs[0].Subject.CommonName
+		}
+		server.mutex.Lock()
+		server.clientNames = append(server.clientNames, clientName)
+		server.mutex.Unlock()
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		window, events, err := readFakeBeatsWindowE(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		server.mutex.Lock()
+		closing := false
+		if limit := server.options.CloseAfterEvents; limit > 0 && len(server.events)+len(events) >= limit {
+			events = events[:limit-len(server.events)]
+			closing = true
+		}
+		server.windows = append(server.windows, window)
+		server.events = append(server.events, events...)
+		server.mutex.Unlock()
+
+		if err := server.ackE(conn, window.Size, len(events)); err != nil {
+			return err
+		}
+		if closing {
+			return nil
+		}
+	}
+}
+
+// ackE sends the ACKs of a window of which the first processed events were processed
+func (server *FakeBeatsServer) ackE(conn net.Conn, windowSize int, processed int) error {
+	sequences := []int{}
+	for i := 0; i < server.options.KeepAlives; i++ {
+		sequences = append(sequences, 0)
+	}
+	if server.options.AckEvery > 0 {
+		for sequence := server.options.AckEvery; sequence < processed; sequence += server.options.AckEvery {
+			sequences = append(sequences, sequence)
+		}
+	}
+	if server.options.AckBeyondWindow {
+		sequences = append(sequences, windowSize+1)
+	} else if processed > 0 {
+		sequences = append(sequences, processed)
+	}
+
+	for _, sequence := range sequences {
+		frame := []byte{LUMBERJACK_VERSION, LUMBERJACK_CODE_ACK, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(frame[2:], uint32(sequence))
+		if _, err := conn.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFakeBeatsWindowE reads a window size frame and the data frames of the window. It returns io.EOF if the client
+// closed the connection between windows.
+func readFakeBeatsWindowE(reader io.Reader) (FakeBeatsWindow, []BeatsEvent, error) {
+	window := FakeBeatsWindow{}
+
+	code, err := readFakeBeatsFrameCodeE(reader)
+	if err != nil {
+		return window, nil, err
+	}
+	if code != LUMBERJACK_CODE_WINDOW_SIZE {
+		return window, nil, fmt.Errorf("Expected a window size frame but got code %q", code)
+	}
+	size, err := readFakeBeatsUint32E(reader)
+	if err != nil {
+		return window, nil, err
+	}
+	window.Size = int(size)
+
+	events := []BeatsEvent{}
+	for len(events) < window.Size {
+		code, err := readFakeBeatsFrameCodeE(reader)
+		if err != nil {
+			return window, nil, unexpectedEof(err)
+		}
+
+		switch code {
+		case LUMBERJACK_CODE_JSON_DATA:
+			event, err := readFakeBeatsJsonE(reader, len(events)+1)
+			if err != nil {
+				return window, nil, err
+			}
+			events = append(events, event)
+		case LUMBERJACK_CODE_COMPRESSED:
+			window.Compressed = true
+			compressed, err := readFakeBeatsPayloadE(reader)
+			if err != nil {
+				return window, nil, err
+			}
+			decompressed, err := zlib.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				return window, nil, fmt.Errorf("Failed to decompress a compressed frame: %v", err)
+			}
+			for {
+				code, err := readFakeBeatsFrameCodeE(decompressed)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return window, nil, err
+				}
+				if code != LUMBERJACK_CODE_JSON_DATA {
+					return window, nil, fmt.Errorf("Expected a JSON data frame in a compressed frame but got code %q", code)
+				}
+				event, err := readFakeBeatsJsonE(decompressed, len(events)+1)
+				if err != nil {
+					return window, nil, err
+				}
+				events = append(events, event)
+			}
+		default:
+			return window, nil, fmt.Errorf("Unexpected frame code %q", code)
+		}
+	}
+
+	if len(events) != window.Size {
+		return window, nil, fmt.Errorf("Got %d events in a window of %d", len(events), window.Size)
+	}
+	return window, events, nil
+}
+
+// readFakeBeatsJsonE reads the rest of a JSON data frame, which must have the given sequence number
+func readFakeBeatsJsonE(reader io.Reader, expectedSequence int) (BeatsEvent, error) {
+	sequence, err := readFakeBeatsUint32E(reader)
+	if err != nil {
+		return nil, err
+	}
+	if int(sequence) != expectedSequence {
+		return nil, fmt.Errorf("Expected event %d of the window but got event %d", expectedSequence, sequence)
+	}
+	payload, err := readFakeBeatsPayloadE(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var event BeatsEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("Event %d is not a JSON object: %v", sequence, err)
+	}
+	return event, nil
+}
+
+// readFakeBeatsFrameCodeE reads the version and code that start every frame. It returns io.EOF if there are no more
+// frames.
+func readFakeBeatsFrameCodeE(reader io.Reader) (byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, err
+	}
+	if header[0] != LUMBERJACK_VERSION {
+		return 0, fmt.Errorf("Unsupported Lumberjack version %q", header[0])
+	}
+	return header[1], nil
+}
+
+func readFakeBeatsPayloadE(reader io.Reader) ([]byte, error) {
+	length, err := readFakeBeatsUint32E(reader)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, unexpectedEof(err)
+	}
+	return payload, nil
+}
+
+func readFakeBeatsUint32E(reader io.Reader) (uint32, error) {
+	var value [4]byte
+	if _, err := io.ReadFull(reader, value[:]); err != nil {
+		return 0, unexpectedEof(err)
+	}
+	return binary.BigEndian.Uint32(value[:]), nil
+}
+
+// unexpectedEof turns io.EOF into io.ErrUnexpectedEOF, for reads in the middle of a window
+func unexpectedEof(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
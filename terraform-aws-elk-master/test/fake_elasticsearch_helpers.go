@@ -0,0 +1,490 @@
+package test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// FakeElasticsearchState is the configurable state served by a FakeElasticsearchServer
+type FakeElasticsearchState struct {
+	ClusterName   string
+	ClusterStatus string
+	NumberOfNodes int
+	KibanaState   string
+
+	// Documents by index name, searched by GET /_search and GET /<index>/_search
+	Documents map[string][]map[string]interface{}
+
+	// If Username is set, every request must use basic auth with these credentials
+	Username string
+	Password string
+}
+
+// FakeElasticsearchSnapshot is a snapshot stored in a repository of a FakeElasticsearchServer
+type FakeElasticsearchSnapshot struct {
+	Snapshot string   `json:"snapshot"`
+	Uuid     string   `json:"uuid"`
+	State    string   `json:"state"`
+	Indices  []string `json:"indices"`
+
+	// The contents of the snapshotted indices, which a restore copies back
+	documents map[string][]map[string]interface{}
+	mappings  map[string]json.RawMessage
+}
+
+// FakeElasticsearchRequest is a request recorded by a FakeElasticsearchServer
+type FakeElasticsearchRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Body   string
+}
+
+// FakeElasticsearchServer is an in-process HTTP server that answers the Elasticsearch and Kibana APIs used by the
+// helpers in this package, so the retry, TLS and basic auth logic of those helpers can be tested without AWS or Docker.
+type FakeElasticsearchServer struct {
+	Server *httptest.Server
+	URL    string
+
+	// Set when the server speaks TLS. Points at the CA that signed the server certificate.
+	KeyStore *keystore
+
+	mutex             sync.Mutex
+	state             FakeElasticsearchState
+	mappings          map[string]json.RawMessage
+	repositories      map[string]json.RawMessage
+	snapshots         map[string]map[string]FakeElasticsearchSnapshot
+	failuresRemaining int
+	failureStatus     int
+	pathFailures      []fakeElasticsearchPathFailure
+	requests          []FakeElasticsearchRequest
+}
+
+// A failure injected with FailRequestsTo
+type fakeElasticsearchPathFailure struct {
+	method     string
+	pathPrefix string
+	status     int
+}
+
+func defaultFakeElasticsearchState() FakeElasticsearchState {
+	return FakeElasticsearchState{
+		ClusterName:   "mock-elasticsearch-server",
+		ClusterStatus: "green",
+		NumberOfNodes: 1,
+		KibanaState:   "green",
+		Documents:     map[string][]map[string]interface{}{},
+	}
+}
+
+func newFakeElasticsearchServer(state FakeElasticsearchState) *FakeElasticsearchServer {
+	if state.Documents == nil {
+		state.Documents = map[string][]map[string]interface{}{}
+	}
+
+	return &FakeElasticsearchServer{
+		state:        state,
+		mappings:     map[string]json.RawMessage{},
+		repositories: map[string]json.RawMessage{},
+		snapshots:    map[string]map[string]FakeElasticsearchSnapshot{},
+	}
+}
+
+// startFakeElasticsearch starts a plain HTTP fake Elasticsearch. Callers must Close it when done.
+func startFakeElasticsearch(t *testing.T, state FakeElasticsearchState) *FakeElasticsearchServer {
+	server := newFakeElasticsearchServer(state)
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	server.URL = server.Server.URL
+	return server
+}
+
+// startFakeElasticsearchTLS starts an HTTPS fake Elasticsearch. If keyStore is set, the server uses its CertFile and
+// KeyFile, e.g. as produced by createKeyStoreFiles. Otherwise the server uses the httptest certificate and a CaFile
+// trusting it is written to a temp dir. Either way, server.KeyStore can be passed to the validators.
+func startFakeElasticsearchTLS(t *testing.T, state FakeElasticsearchState, keyStore *keystore) *FakeElasticsearchServer {
+	server := newFakeElasticsearchServer(state)
+	server.Server = httptest.NewUnstartedServer(http.HandlerFunc(server.handle))
+
+	if keyStore != nil {
+		cert, err := tls.LoadX509KeyPair(keyStore.CertFile, keyStore.KeyFile)
+		if err != nil {
+			t.Fatalf("Failed to load TLS cert %s and key %s: %v", keyStore.CertFile, keyStore.KeyFile, err)
+		}
+		server.Server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.Server.StartTLS()
+		server.KeyStore = keyStore
+	} else {
+		server.Server.StartTLS()
+
+		tmpDir, err := ioutil.TempDir("", "fake-elasticsearch")
+		if err != nil {
+			t.Fatalf("Couldn't create temp dir: %v", err)
+		}
+		caFile := filepath.Join(tmpDir, "caFile")
+		caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Server.Certificate().Raw})
+		if err := ioutil.WriteFile(caFile, caPem, 0644); err != nil {
+			t.Fatalf("Couldn't write CA file %s: %v", caFile, err)
+		}
+		server.KeyStore = &keystore{CaFile: caFile}
+	}
+
+	server.URL = server.Server.URL
+	return server
+}
+
+func (server *FakeElasticsearchServer) Close() {
+	server.Server.Close()
+}
+
+// UpdateState changes the state served by the fake while it is running
+func (server *FakeElasticsearchServer) UpdateState(update func(state *FakeElasticsearchState)) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	update(&server.state)
+}
+
+// FailNextRequests makes the next count requests return the given HTTP status code
+func (server *FakeElasticsearchServer) FailNextRequests(count int, status int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.failuresRemaining = count
+	server.failureStatus = status
+}
+
+// FailRequestsTo makes every request with the given method whose path starts with pathPrefix return the given HTTP
+// status code, e.g. to fail creating snapshots but not reading the repository they are in
+func (server *FakeElasticsearchServer) FailRequestsTo(method string, pathPrefix string, status int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.pathFailures = append(server.pathFailures, fakeElasticsearchPathFailure{method: method, pathPrefix: pathPrefix, status: status})
+}
+
+// Requests returns every request the fake has received so far
+func (server *FakeElasticsearchServer) Requests() []FakeElasticsearchRequest {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]FakeElasticsearchRequest{}, server.requests...)
+}
+
+// Snapshots returns the snapshots stored in the given repository
+func (server *FakeElasticsearchServer) Snapshots(repository string) []FakeElasticsearchSnapshot {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	snapshots := []FakeElasticsearchSnapshot{}
+	for _, snapshot := range server.snapshots[repository] {
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+func (server *FakeElasticsearchServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.requests = append(server.requests, FakeElasticsearchRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Body:   string(body),
+	})
+
+	if server.failuresRemaining > 0 {
+		server.failuresRemaining--
+		writeFakeElasticsearchError(w, server.failureStatus, "fake_failure", "Failure injected by the fake Elasticsearch server")
+		return
+	}
+
+	for _, failure := range server.pathFailures {
+		if r.Method == failure.method && strings.HasPrefix(r.URL.Path, failure.pathPrefix) {
+			writeFakeElasticsearchError(w, failure.status, "fake_failure", "Failure injected by the fake Elasticsearch server")
+			return
+		}
+	}
+
+	if server.state.Username != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != server.state.Username || password != server.state.Password {
+			writeFakeElasticsearchError(w, http.StatusUnauthorized, "security_exception", "missing or invalid authentication credentials")
+			return
+		}
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.URL.Path == "/":
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{
+			"name":         "fake-node-0",
+			"cluster_name": server.state.ClusterName,
+			"cluster_uuid": "fake-cluster-uuid",
+			"version":      map[string]interface{}{"number": "6.8.21"},
+			"tagline":      "You Know, for Search",
+		})
+	case r.URL.Path == "/_cluster/health":
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{
+			"cluster_name":         server.state.ClusterName,
+			"status":               server.state.ClusterStatus,
+			"timed_out":            false,
+			"number_of_nodes":      server.state.NumberOfNodes,
+			"number_of_data_nodes": server.state.NumberOfNodes,
+		})
+	case r.URL.Path == "/_cat/nodes":
+		nodes := []ElasticsearchNode{}
+		for i := 0; i < server.state.NumberOfNodes; i++ {
+			nodes = append(nodes, ElasticsearchNode{Ip: fmt.Sprintf("10.0.0.%d", i+1), NodeRole: "mdi", Name: fmt.Sprintf("fake-node-%d", i)})
+		}
+		writeFakeElasticsearchJson(w, http.StatusOK, nodes)
+	case r.URL.Path == "/api/status":
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{
+			"name":   "fake-kibana",
+			"status": map[string]interface{}{"overall": map[string]interface{}{"state": server.state.KibanaState}},
+		})
+	case segments[0] == "_snapshot":
+		server.handleSnapshot(w, r, segments[1:], body)
+	case segments[len(segments)-1] == "_search":
+		server.handleSearch(w, r, segments[:len(segments)-1])
+	case !strings.HasPrefix(segments[0], "_"):
+		server.handleIndex(w, r, segments, body)
+	default:
+		writeFakeElasticsearchError(w, http.StatusNotFound, "fake_not_implemented", fmt.Sprintf("%s %s is not implemented by the fake", r.Method, r.URL.Path))
+	}
+}
+
+func (server *FakeElasticsearchServer) handleSearch(w http.ResponseWriter, r *http.Request, indices []string) {
+	query := r.URL.Query().Get("q")
+
+	hits := []ElasticsearchHit{}
+	for index, documents := range server.state.Documents {
+		if len(indices) > 0 && indices[0] != "_all" && indices[0] != index {
+			continue
+		}
+		for i, document := range documents {
+			if fakeElasticsearchDocumentMatches(document, query) {
+				hits = append(hits, ElasticsearchHit{Index: index, Type: "_doc", Id: fmt.Sprintf("%d", i), Source: document})
+			}
+		}
+	}
+
+	writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"hits": map[string]interface{}{
+			"total": len(hits),
+			"hits":  hits,
+		},
+	})
+}
+
+// fakeElasticsearchDocumentMatches supports the subset of the Lucene query string syntax our tests use: an empty or *
+// query matches everything and field:value matches documents whose field contains value.
+func fakeElasticsearchDocumentMatches(document map[string]interface{}, query string) bool {
+	if query == "" || query == "*" {
+		return true
+	}
+
+	parts := strings.SplitN(query, ":", 2)
+	if len(parts) != 2 {
+		for _, value := range document {
+			if strings.Contains(fmt.Sprint(value), query) {
+				return true
+			}
+		}
+		return false
+	}
+
+	value, ok := document[parts[0]]
+	return ok && strings.Contains(fmt.Sprint(value), parts[1])
+}
+
+// handleIndex implements the index APIs our tests use: creating and deleting an index, adding a document (which always
+// appends, even if the id exists), refresh, count and mapping.
+func (server *FakeElasticsearchServer) handleIndex(w http.ResponseWriter, r *http.Request, segments []string, body []byte) {
+	index := segments[0]
+	_, hasDocuments := server.state.Documents[index]
+	_, hasMappings := server.mappings[index]
+	indexExists := hasDocuments || hasMappings
+
+	switch {
+	case len(segments) == 1 && r.Method == http.MethodPut:
+		if indexExists {
+			writeFakeElasticsearchError(w, http.StatusBadRequest, "resource_already_exists_exception", fmt.Sprintf("index [%s] already exists", index))
+			return
+		}
+		var createIndex struct {
+			Mappings json.RawMessage `json:"mappings"`
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &createIndex); err != nil {
+				writeFakeElasticsearchError(w, http.StatusBadRequest, "parse_exception", err.Error())
+				return
+			}
+		}
+		if createIndex.Mappings == nil {
+			createIndex.Mappings = json.RawMessage("{}")
+		}
+		server.mappings[index] = createIndex.Mappings
+		server.state.Documents[index] = []map[string]interface{}{}
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "index": index})
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		if !indexExists {
+			writeFakeElasticsearchError(w, http.StatusNotFound, "index_not_found_exception", fmt.Sprintf("no such index [%s]", index))
+			return
+		}
+		delete(server.mappings, index)
+		delete(server.state.Documents, index)
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+	case len(segments) == 3 && segments[1] == "_doc" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		var document map[string]interface{}
+		if err := json.Unmarshal(body, &document); err != nil {
+			writeFakeElasticsearchError(w, http.StatusBadRequest, "mapper_parsing_exception", err.Error())
+			return
+		}
+		if !hasMappings {
+			server.mappings[index] = json.RawMessage("{}")
+		}
+		server.state.Documents[index] = append(server.state.Documents[index], document)
+		writeFakeElasticsearchJson(w, http.StatusCreated, map[string]interface{}{"_index": index, "_id": segments[2], "result": "created"})
+	case len(segments) == 2 && !indexExists:
+		writeFakeElasticsearchError(w, http.StatusNotFound, "index_not_found_exception", fmt.Sprintf("no such index [%s]", index))
+	case len(segments) == 2 && segments[1] == "_refresh":
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"_shards": map[string]interface{}{"total": 1, "successful": 1, "failed": 0}})
+	case len(segments) == 2 && segments[1] == "_count":
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"count": len(server.state.Documents[index])})
+	case len(segments) == 2 && segments[1] == "_mapping":
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{index: map[string]interface{}{"mappings": server.mappings[index]}})
+	default:
+		writeFakeElasticsearchError(w, http.StatusNotFound, "fake_not_implemented", fmt.Sprintf("%s %s is not implemented by the fake", r.Method, r.URL.Path))
+	}
+}
+
+func (server *FakeElasticsearchServer) handleSnapshot(w http.ResponseWriter, r *http.Request, segments []string, body []byte) {
+	if len(segments) == 0 || segments[0] == "" {
+		writeFakeElasticsearchJson(w, http.StatusOK, server.repositories)
+		return
+	}
+
+	repository := segments[0]
+	settings, repositoryExists := server.repositories[repository]
+
+	if len(segments) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			if !repositoryExists {
+				writeFakeElasticsearchError(w, http.StatusNotFound, "repository_missing_exception", fmt.Sprintf("[%s] missing", repository))
+				return
+			}
+			writeFakeElasticsearchJson(w, http.StatusOK, map[string]json.RawMessage{repository: settings})
+		case http.MethodPut, http.MethodPost:
+			server.repositories[repository] = json.RawMessage(body)
+			writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+		case http.MethodDelete:
+			delete(server.repositories, repository)
+			delete(server.snapshots, repository)
+			writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+		default:
+			writeFakeElasticsearchError(w, http.StatusMethodNotAllowed, "fake_not_implemented", r.Method)
+		}
+		return
+	}
+
+	if !repositoryExists {
+		writeFakeElasticsearchError(w, http.StatusNotFound, "repository_missing_exception", fmt.Sprintf("[%s] missing", repository))
+		return
+	}
+
+	snapshotName := segments[1]
+	snapshots := server.snapshots[repository]
+
+	if len(segments) == 3 && segments[2] == "_restore" && r.Method == http.MethodPost {
+		snapshot, ok := snapshots[snapshotName]
+		if !ok {
+			writeFakeElasticsearchError(w, http.StatusNotFound, "snapshot_missing_exception", fmt.Sprintf("[%s:%s] is missing", repository, snapshotName))
+			return
+		}
+		// Like Elasticsearch, refuse to restore over an open index
+		for _, index := range snapshot.Indices {
+			if _, exists := server.state.Documents[index]; exists {
+				writeFakeElasticsearchError(w, http.StatusInternalServerError, "snapshot_restore_exception", fmt.Sprintf("[%s:%s] cannot restore index [%s] because an open index with same name already exists in the cluster", repository, snapshotName, index))
+				return
+			}
+		}
+		for _, index := range snapshot.Indices {
+			server.state.Documents[index] = append([]map[string]interface{}{}, snapshot.documents[index]...)
+			server.mappings[index] = snapshot.mappings[index]
+		}
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"accepted": true})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		result := []FakeElasticsearchSnapshot{}
+		for name, snapshot := range snapshots {
+			if snapshotName == "_all" || snapshotName == name {
+				result = append(result, snapshot)
+			}
+		}
+		if len(result) == 0 && snapshotName != "_all" {
+			writeFakeElasticsearchError(w, http.StatusNotFound, "snapshot_missing_exception", fmt.Sprintf("[%s:%s] is missing", repository, snapshotName))
+			return
+		}
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"snapshots": result})
+	case http.MethodPut, http.MethodPost:
+		if snapshots == nil {
+			snapshots = map[string]FakeElasticsearchSnapshot{}
+			server.snapshots[repository] = snapshots
+		}
+		snapshot := FakeElasticsearchSnapshot{
+			Snapshot:  snapshotName,
+			Uuid:      fmt.Sprintf("fake-%s-%s", repository, snapshotName),
+			State:     "SUCCESS",
+			Indices:   []string{},
+			documents: map[string][]map[string]interface{}{},
+			mappings:  map[string]json.RawMessage{},
+		}
+		for index, documents := range server.state.Documents {
+			snapshot.Indices = append(snapshot.Indices, index)
+			snapshot.documents[index] = append([]map[string]interface{}{}, documents...)
+			snapshot.mappings[index] = server.mappings[index]
+			if snapshot.mappings[index] == nil {
+				snapshot.mappings[index] = json.RawMessage("{}")
+			}
+		}
+		snapshots[snapshotName] = snapshot
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"accepted": true})
+	case http.MethodDelete:
+		delete(snapshots, snapshotName)
+		writeFakeElasticsearchJson(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+	default:
+		writeFakeElasticsearchError(w, http.StatusMethodNotAllowed, "fake_not_implemented", r.Method)
+	}
+}
+
+func writeFakeElasticsearchJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeFakeElasticsearchError(w http.ResponseWriter, status int, errorType string, reason string) {
+	writeFakeElasticsearchJson(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"root_cause": []map[string]interface{}{{"type": errorType, "reason": reason}},
+			"type":       errorType,
+			"reason":     reason,
+		},
+		"status": status,
+	})
+}
@@ -0,0 +1,164 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests exercise the validators in this package against an in-process fake Elasticsearch, so they run offline
+// and don't need AWS or Docker.
+
+func TestOfflineCheckElasticsearchRunningRetries(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeElasticsearch(t, defaultFakeElasticsearchState())
+	defer server.Close()
+
+	server.FailNextRequests(1, http.StatusServiceUnavailable)
+
+	checkElasticsearchRunning(t, "mock-elasticsearch-server", server.URL, nil, "")
+
+	assert.Len(t, server.Requests(), 2)
+}
+
+func TestOfflineCheckElasticsearchRunningTLSWithBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	state := defaultFakeElasticsearchState()
+	state.Username = "kibana"
+	state.Password = "password"
+
+	server := startFakeElasticsearchTLS(t, state, nil)
+	defer server.Close()
+
+	checkElasticsearchRunning(t, "mock-elasticsearch-server", server.URL, server.KeyStore, "password")
+}
+
+func TestOfflineValidateGetHttp(t *testing.T) {
+	t.Parallel()
+
+	state := defaultFakeElasticsearchState()
+	state.Documents["filebeat-6.8.21"] = []map[string]interface{}{{"message": "TEST_123_abc"}}
+
+	server := startFakeElasticsearch(t, state)
+	defer server.Close()
+
+	queryUrl := fmt.Sprintf("%s/_all/_search?q=message:%s", server.URL, "TEST_123_abc")
+	validateGetHttp(t, "TEST_123_abc", queryUrl, nil, "")
+}
+
+func TestOfflineValidateGetHttps(t *testing.T) {
+	t.Parallel()
+
+	state := defaultFakeElasticsearchState()
+	state.Username = "kibana"
+	state.Password = "kibana-pass"
+
+	server := startFakeElasticsearchTLS(t, state, nil)
+	defer server.Close()
+
+	server.FailNextRequests(1, http.StatusBadGateway)
+
+	validateGetHttps(t, "mock-elasticsearch-server", server.URL, server.KeyStore, "kibana-pass")
+
+	assert.Len(t, server.Requests(), 2)
+}
+
+func TestOfflineCheckAWSKibanaRunning(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeElasticsearch(t, defaultFakeElasticsearchState())
+	defer server.Close()
+
+	checkAWSKibanaRunning(t, fmt.Sprintf("%s/api/status", server.URL))
+}
+
+func TestOfflineElasticsearchClient(t *testing.T) {
+	t.Parallel()
+
+	state := defaultFakeElasticsearchState()
+	state.NumberOfNodes = 3
+	state.Documents["logstash-2021.01.01"] = []map[string]interface{}{
+		{"message": "first"},
+		{"message": "second"},
+	}
+
+	server := startFakeElasticsearch(t, state)
+	defer server.Close()
+
+	client := newElasticsearchClient(t, server.URL, nil, "", "")
+
+	health, err := client.ClusterHealth()
+	require.NoError(t, err)
+	assert.Equal(t, "green", health.Status)
+	assert.Equal(t, 3, health.NumberOfNodes)
+
+	nodes, err := client.CatNodes()
+	require.NoError(t, err)
+	assert.Len(t, nodes, 3)
+
+	result, err := client.Search("_all", "message:second")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), result.Hits.Total.Value)
+	assert.Equal(t, "second", result.Hits.Hits[0].Source["message"])
+
+	checkElasticsearchClusterHealth(t, client, "green", 3)
+	checkElasticsearchHitCount(t, client, "logstash-2021.01.01", "message:first", 1)
+}
+
+func TestOfflineElasticsearchClientReturnsStructuredErrors(t *testing.T) {
+	t.Parallel()
+
+	state := defaultFakeElasticsearchState()
+	state.Username = "kibana"
+	state.Password = "right"
+
+	server := startFakeElasticsearch(t, state)
+	defer server.Close()
+
+	client := newElasticsearchClient(t, server.URL, nil, "kibana", "wrong")
+
+	_, err := client.Info()
+	require.Error(t, err)
+
+	esErr, ok := err.(ElasticsearchError)
+	require.True(t, ok, "Expected an ElasticsearchError but got %T", err)
+	assert.Equal(t, http.StatusUnauthorized, esErr.StatusCode)
+	assert.Equal(t, "security_exception", esErr.Type)
+}
+
+func TestOfflineElasticsearchBackupRestore(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeElasticsearch(t, defaultFakeElasticsearchState())
+	defer server.Close()
+
+	client := newElasticsearchClient(t, server.URL, nil, "", "")
+
+	dataset := writeElasticsearchDataset(t, client, "backup-restore-test", 10)
+	assert.Equal(t, int64(10), dataset.Counts["backup-restore-test"])
+
+	// This is what the backup and restore Lambda functions send to Elasticsearch
+	require.NoError(t, client.doJsonBody("PUT", "/_snapshot/es-backup-repository", nil, map[string]interface{}{"type": "s3"}, nil))
+	require.NoError(t, client.doJsonBody("PUT", "/_snapshot/es-backup-repository/snapshot-1", nil, map[string]interface{}{}, nil))
+
+	snapshot := waitForNewSnapshot(t, client, "es-backup-repository", nil)
+	assert.Equal(t, "snapshot-1", snapshot.Snapshot)
+	assert.Equal(t, []string{"backup-restore-test"}, snapshot.Indices)
+
+	err := client.doJson("POST", "/_snapshot/es-backup-repository/snapshot-1/_restore", nil, nil, nil)
+	esErr, ok := err.(ElasticsearchError)
+	require.True(t, ok, "Expected restoring over an open index to fail with an ElasticsearchError but got %v", err)
+	assert.Equal(t, "snapshot_restore_exception", esErr.Type)
+
+	require.NoError(t, client.doJson("DELETE", "/backup-restore-test", nil, nil, nil))
+	_, err = client.Count("backup-restore-test")
+	require.Error(t, err)
+
+	require.NoError(t, client.doJson("POST", "/_snapshot/es-backup-repository/snapshot-1/_restore", nil, nil, nil))
+	checkElasticsearchDatasetRestored(t, client, dataset)
+}
@@ -0,0 +1,706 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/gruntwork-io/terratest/modules/aws"
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+// The tag the tests put on the key pairs, secrets and AMIs they create, and on the ASGs and ALBs of the examples through
+// their custom_tags var, with the name of the test as its value
+const TEST_RESOURCE_TAG_KEY = "package-elk-test"
+
+// The tag with the time the tests created a resource at, in RFC 3339, for resources AWS doesn't report the creation
+// time of, such as key pairs
+const TEST_RESOURCE_CREATED_AT_TAG_KEY = "package-elk-test-created-at"
+
+// The janitor only deletes test resources older than this by default, which leaves running tests alone
+const JANITOR_DEFAULT_MIN_AGE = 6 * time.Hour
+
+// The kinds of resources the janitor cleans up
+const (
+	TEST_RESOURCE_DNS_RECORD = "dns-record"
+	TEST_RESOURCE_ASG        = "asg"
+	TEST_RESOURCE_ALB        = "alb"
+	TEST_RESOURCE_AMI        = "ami"
+	TEST_RESOURCE_KEY_PAIR   = "key-pair"
+	TEST_RESOURCE_SECRET     = "secret"
+)
+
+// The order to delete the kinds of resources in, so nothing is deleted while something else still uses it: the DNS
+// records point at the ALBs, the ASGs register with the target groups of the ALBs, and the instances of the ASGs run
+// the AMIs with the key pairs
+var testResourceDeletionOrder = []string{
+	TEST_RESOURCE_DNS_RECORD,
+	TEST_RESOURCE_ASG,
+	TEST_RESOURCE_ALB,
+	TEST_RESOURCE_AMI,
+	TEST_RESOURCE_KEY_PAIR,
+	TEST_RESOURCE_SECRET,
+}
+
+// The exact names the tests give the resources they create, by kind, which finds the ones created before the tests
+// tagged them. The first group of a pattern is a random.UniqueId() the test didn't lowercase, which only counts if
+// isUniqueId says so. Names built from lowercased IDs, such as those of the end-to-end and all-in-one tests, look too
+// much like names people pick, so only the TEST_RESOURCE_TAG_KEY tag finds those.
+var testResourceNamePatterns = map[string][]*regexp.Regexp{
+	// The server groups of the elasticsearch-only-cluster example, which TestElasticsearchAWSSimple names es-cluster-<id>
+	TEST_RESOURCE_ASG: {
+		regexp.MustCompile("^es-cluster-([A-Za-z0-9]{6})-[0-9]+$"),
+	},
+	TEST_RESOURCE_ALB: {
+		regexp.MustCompile("^es-cluster-([A-Za-z0-9]{6})-alb$"),
+	},
+	// The ami_name of every Packer template in examples/elk-amis
+	TEST_RESOURCE_AMI: {
+		regexp.MustCompile("^gruntwork-.+-example-"),
+	},
+	TEST_RESOURCE_SECRET: {
+		regexp.MustCompile("^(?:Kibana|Logstash)_([A-Za-z0-9]{6})$"),
+	},
+}
+
+// TestResource is an AWS resource that a test may have leaked
+type TestResource struct {
+	// One of the TEST_RESOURCE_* consts
+	Kind   string
+	Region string
+	// What AWS identifies the resource by: the name of an ASG, key pair or DNS record, the ARN of an ALB or secret, or
+	// the ID of an AMI
+	Id   string
+	Name string
+	// Zero if neither AWS nor the TEST_RESOURCE_CREATED_AT_TAG_KEY tag tells
+	CreatedAt time.Time
+	Tags      map[string]string
+	// Why the janitor considers it a test resource
+	Reason string
+
+	// The snapshots of an AMI
+	snapshotIds []string
+	// The DNS name of an ALB
+	dnsName string
+	// The zone and record set of a DNS record
+	hostedZoneId string
+	recordSet    *route53.ResourceRecordSet
+}
+
+func (resource TestResource) String() string {
+	return fmt.Sprintf("%s %s in %s", resource.Kind, resource.Name, resource.Region)
+}
+
+// JanitorOptions configures FindLeakedTestResources
+type JanitorOptions struct {
+	Regions []string
+	// Only resources created longer ago than this are leaked
+	MinAge time.Duration
+	// The Route 53 zone the tests create DNS records in. Optional.
+	ZoneName string
+	// What MinAge is relative to. Defaults to now.
+	Now time.Time
+	// Where to log what the janitor does. Defaults to discarding it.
+	Logger *log.Logger
+}
+
+// FindLeakedTestResources returns the test resources older than the minimum age in the regions, and the DNS records in
+// the zone that point at the leaked ALBs, in the order to delete them in. A resource is a test resource if it has the
+// TEST_RESOURCE_TAG_KEY tag, or its name is one of testResourceNamePatterns. Resources of unknown age are
+// never leaked. If listing some resources fails, it returns the others along with the error.
+func FindLeakedTestResources(ctx context.Context, options JanitorOptions) ([]TestResource, error) {
+	janitorLogger := options.logger()
+	now := options.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	leaked := []TestResource{}
+	errs := []string{}
+	for _, region := range options.Regions {
+		janitorLogger.Printf("Looking for test resources in %s", region)
+		candidates, err := listTestResourceCandidatesE(ctx, region)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", region, err))
+		}
+		leaked = append(leaked, selectLeakedTestResources(candidates, options.MinAge, now)...)
+	}
+
+	if options.ZoneName != "" {
+		janitorLogger.Printf("Looking for DNS records of leaked ALBs in %s", options.ZoneName)
+		records, err := listDnsRecordsOfAlbsE(ctx, options.ZoneName, leaked)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", options.ZoneName, err))
+		}
+		leaked = append(leaked, records...)
+	}
+
+	sortTestResourcesForDeletion(leaked)
+
+	if len(errs) > 0 {
+		return leaked, fmt.Errorf("Failed to list some test resources: %s", strings.Join(errs, "; "))
+	}
+	return leaked, nil
+}
+
+// DeleteTestResources deletes the resources in the order given, and carries on when deleting one fails
+func DeleteTestResources(ctx context.Context, options JanitorOptions, resources []TestResource) error {
+	janitorLogger := options.logger()
+
+	errs := []string{}
+	for _, resource := range resources {
+		janitorLogger.Printf("Deleting %s", resource)
+		if err := deleteTestResourceE(ctx, resource); err != nil {
+			janitorLogger.Printf("Failed to delete %s: %v", resource, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", resource, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to delete %d of %d test resources: %s", len(errs), len(resources), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (options JanitorOptions) logger() *log.Logger {
+	if options.Logger == nil {
+		return log.New(ioutil.Discard, "", 0)
+	}
+	return options.Logger
+}
+
+// selectLeakedTestResources returns the candidates that are test resources older than minAge, with the reason set
+func selectLeakedTestResources(candidates []TestResource, minAge time.Duration, now time.Time) []TestResource {
+	leaked := []TestResource{}
+	for _, candidate := range candidates {
+		reason, isTestResource := identifyTestResource(candidate)
+		if !isTestResource {
+			continue
+		}
+		createdAt := testResourceCreatedAt(candidate)
+		if createdAt.IsZero() || now.Sub(createdAt) < testResourceMinAge(candidate, minAge) {
+			continue
+		}
+
+		candidate.Reason = reason
+		candidate.CreatedAt = createdAt
+		leaked = append(leaked, candidate)
+	}
+	return leaked
+}
+
+// testResourceMinAge returns how old the resource has to be to be leaked. Cached AMIs are meant to outlive the tests
+// that built them, so they are kept for at least AMI_CACHE_MAX_AGE.
+func testResourceMinAge(resource TestResource, minAge time.Duration) time.Duration {
+	if _, isCached := resource.Tags[AMI_CACHE_TAG_KEY]; isCached && minAge < AMI_CACHE_MAX_AGE {
+		return AMI_CACHE_MAX_AGE
+	}
+	return minAge
+}
+
+// identifyTestResource returns why the resource is a test resource, if it is one
+func identifyTestResource(resource TestResource) (string, bool) {
+	if testName, hasTag := resource.Tags[TEST_RESOURCE_TAG_KEY]; hasTag {
+		return fmt.Sprintf("tagged by %s", testName), true
+	}
+	for _, pattern := range testResourceNamePatterns[resource.Kind] {
+		match := pattern.FindStringSubmatch(resource.Name)
+		if match == nil || (len(match) > 1 && !isUniqueId(match[1])) {
+			continue
+		}
+		return fmt.Sprintf("name matches %s", pattern), true
+	}
+	return "", false
+}
+
+// isUniqueId returns true if id looks like a random.UniqueId(): 6 letters and digits, with both upper and lower case
+// letters. A few IDs have letters of one case only, so the janitor misses those resources unless they are tagged, but
+// words such as "public" or "master" never pass.
+func isUniqueId(id string) bool {
+	if len(id) != 6 {
+		return false
+	}
+	hasUpper := false
+	hasLower := false
+	for _, char := range id {
+		switch {
+		case char >= 'A' && char <= 'Z':
+			hasUpper = true
+		case char >= 'a' && char <= 'z':
+			hasLower = true
+		case char < '0' || char > '9':
+			return false
+		}
+	}
+	return hasUpper && hasLower
+}
+
+// testResourceCreatedAt returns when AWS says the resource was created, or else what its TEST_RESOURCE_CREATED_AT_TAG_KEY
+// tag says
+func testResourceCreatedAt(resource TestResource) time.Time {
+	if !resource.CreatedAt.IsZero() {
+		return resource.CreatedAt
+	}
+	createdAt, err := time.Parse(time.RFC3339, resource.Tags[TEST_RESOURCE_CREATED_AT_TAG_KEY])
+	if err != nil {
+		return time.Time{}
+	}
+	return createdAt
+}
+
+// sortTestResourcesForDeletion sorts the resources by testResourceDeletionOrder, then by region and name
+func sortTestResourcesForDeletion(resources []TestResource) {
+	rank := map[string]int{}
+	for i, kind := range testResourceDeletionOrder {
+		rank[kind] = i
+	}
+	sort.SliceStable(resources, func(i, j int) bool {
+		if rank[resources[i].Kind] != rank[resources[j].Kind] {
+			return rank[resources[i].Kind] < rank[resources[j].Kind]
+		}
+		if resources[i].Region != resources[j].Region {
+			return resources[i].Region < resources[j].Region
+		}
+		return resources[i].Name < resources[j].Name
+	})
+}
+
+// listTestResourceCandidatesE lists every resource of the kinds the janitor cleans up in the region, whether or not the
+// tests created it
+func listTestResourceCandidatesE(ctx context.Context, region string) ([]TestResource, error) {
+	sess, err := defaultAwsClients.sessionE(region)
+	if err != nil {
+		return nil, err
+	}
+
+	listers := []func(context.Context, *session.Session, string) ([]TestResource, error){
+		listAsgCandidatesE,
+		listAlbCandidatesE,
+		listAmiCandidatesE,
+		listKeyPairCandidatesE,
+		listSecretCandidatesE,
+	}
+
+	candidates := []TestResource{}
+	errs := []string{}
+	for _, lister := range listers {
+		resources, err := lister(ctx, sess, region)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		candidates = append(candidates, resources...)
+	}
+
+	if len(errs) > 0 {
+		return candidates, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return candidates, nil
+}
+
+func listAsgCandidatesE(ctx context.Context, sess *session.Session, region string) ([]TestResource, error) {
+	resources := []TestResource{}
+	err := autoscaling.New(sess).DescribeAutoScalingGroupsPagesWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{}, func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+		for _, group := range page.AutoScalingGroups {
+			tags := map[string]string{}
+			for _, tag := range group.Tags {
+				tags[awsgo.StringValue(tag.Key)] = awsgo.StringValue(tag.Value)
+			}
+			resources = append(resources, TestResource{
+				Kind:      TEST_RESOURCE_ASG,
+				Region:    region,
+				Id:        awsgo.StringValue(group.AutoScalingGroupName),
+				Name:      awsgo.StringValue(group.AutoScalingGroupName),
+				CreatedAt: awsgo.TimeValue(group.CreatedTime),
+				Tags:      tags,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list ASGs: %v", err)
+	}
+	return resources, nil
+}
+
+// DescribeTags of the elbv2 API takes at most this many ARNs
+const ALB_DESCRIBE_TAGS_MAX_ARNS = 20
+
+func listAlbCandidatesE(ctx context.Context, sess *session.Session, region string) ([]TestResource, error) {
+	client := elbv2.New(sess)
+
+	resources := []TestResource{}
+	err := client.DescribeLoadBalancersPagesWithContext(ctx, &elbv2.DescribeLoadBalancersInput{}, func(page *elbv2.DescribeLoadBalancersOutput, lastPage bool) bool {
+		for _, loadBalancer := range page.LoadBalancers {
+			resources = append(resources, TestResource{
+				Kind:      TEST_RESOURCE_ALB,
+				Region:    region,
+				Id:        awsgo.StringValue(loadBalancer.LoadBalancerArn),
+				Name:      awsgo.StringValue(loadBalancer.LoadBalancerName),
+				CreatedAt: awsgo.TimeValue(loadBalancer.CreatedTime),
+				Tags:      map[string]string{},
+				dnsName:   awsgo.StringValue(loadBalancer.DNSName),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list ALBs: %v", err)
+	}
+
+	// DescribeLoadBalancers doesn't return the tags
+	for start := 0; start < len(resources); start += ALB_DESCRIBE_TAGS_MAX_ARNS {
+		end := start + ALB_DESCRIBE_TAGS_MAX_ARNS
+		if end > len(resources) {
+			end = len(resources)
+		}
+		batch := resources[start:end]
+		arns := []string{}
+		for _, resource := range batch {
+			arns = append(arns, resource.Id)
+		}
+		output, err := client.DescribeTagsWithContext(ctx, &elbv2.DescribeTagsInput{ResourceArns: awsgo.StringSlice(arns)})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list the tags of ALBs: %v", err)
+		}
+		addAlbTags(batch, output.TagDescriptions)
+	}
+	return resources, nil
+}
+
+// addAlbTags adds the tags of each description to the ALB with its ARN
+func addAlbTags(resources []TestResource, descriptions []*elbv2.TagDescription) {
+	for _, description := range descriptions {
+		for _, resource := range resources {
+			if resource.Id != awsgo.StringValue(description.ResourceArn) {
+				continue
+			}
+			for _, tag := range description.Tags {
+				resource.Tags[awsgo.StringValue(tag.Key)] = awsgo.StringValue(tag.Value)
+			}
+		}
+	}
+}
+
+func listAmiCandidatesE(ctx context.Context, sess *session.Session, region string) ([]TestResource, error) {
+	output, err := ec2.New(sess).DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{Owners: awsgo.StringSlice([]string{"self"})})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list AMIs: %v", err)
+	}
+
+	resources := []TestResource{}
+	for _, image := range output.Images {
+		createdAt, _ := time.Parse(time.RFC3339, awsgo.StringValue(image.CreationDate))
+		resources = append(resources, TestResource{
+			Kind:        TEST_RESOURCE_AMI,
+			Region:      region,
+			Id:          awsgo.StringValue(image.ImageId),
+			Name:        awsgo.StringValue(image.Name),
+			CreatedAt:   createdAt,
+			Tags:        ec2TagsToMap(image.Tags),
+			snapshotIds: amiSnapshotIds(image),
+		})
+	}
+	return resources, nil
+}
+
+// listKeyPairCandidatesE lists the key pairs, which AWS doesn't report the creation time of, so only tagged ones can be
+// leaked
+func listKeyPairCandidatesE(ctx context.Context, sess *session.Session, region string) ([]TestResource, error) {
+	output, err := ec2.New(sess).DescribeKeyPairsWithContext(ctx, &ec2.DescribeKeyPairsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list key pairs: %v", err)
+	}
+
+	resources := []TestResource{}
+	for _, keyPair := range output.KeyPairs {
+		resources = append(resources, TestResource{
+			Kind:   TEST_RESOURCE_KEY_PAIR,
+			Region: region,
+			Id:     awsgo.StringValue(keyPair.KeyName),
+			Name:   awsgo.StringValue(keyPair.KeyName),
+			Tags:   ec2TagsToMap(keyPair.Tags),
+		})
+	}
+	return resources, nil
+}
+
+func listSecretCandidatesE(ctx context.Context, sess *session.Session, region string) ([]TestResource, error) {
+	resources := []TestResource{}
+	err := secretsmanager.New(sess).ListSecretsPagesWithContext(ctx, &secretsmanager.ListSecretsInput{}, func(page *secretsmanager.ListSecretsOutput, lastPage bool) bool {
+		for _, secret := range page.SecretList {
+			// Secrets pending deletion are already taken care of
+			if secret.DeletedDate != nil {
+				continue
+			}
+			tags := map[string]string{}
+			for _, tag := range secret.Tags {
+				tags[awsgo.StringValue(tag.Key)] = awsgo.StringValue(tag.Value)
+			}
+			resources = append(resources, TestResource{
+				Kind:      TEST_RESOURCE_SECRET,
+				Region:    region,
+				Id:        awsgo.StringValue(secret.ARN),
+				Name:      awsgo.StringValue(secret.Name),
+				CreatedAt: awsgo.TimeValue(secret.CreatedDate),
+				Tags:      tags,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list secrets: %v", err)
+	}
+	return resources, nil
+}
+
+// listDnsRecordsOfAlbsE returns the alias records in the zone that point at one of the ALBs among the resources. DNS
+// records have no creation time, so they are as old as their ALB.
+func listDnsRecordsOfAlbsE(ctx context.Context, zoneName string, resources []TestResource) ([]TestResource, error) {
+	albsByDnsName := map[string]TestResource{}
+	for _, resource := range resources {
+		if resource.Kind == TEST_RESOURCE_ALB {
+			albsByDnsName[normalizeDnsName(resource.dnsName)] = resource
+		}
+	}
+	if len(albsByDnsName) == 0 {
+		return nil, nil
+	}
+
+	// Route 53 is global, but its API lives in us-east-1
+	sess, err := defaultAwsClients.sessionE("us-east-1")
+	if err != nil {
+		return nil, err
+	}
+	client := route53.New(sess)
+
+	zones, err := client.ListHostedZonesByNameWithContext(ctx, &route53.ListHostedZonesByNameInput{DNSName: awsgo.String(zoneName)})
+	if err != nil {
+		return nil, err
+	}
+	var hostedZoneId string
+	for _, zone := range zones.HostedZones {
+		if normalizeDnsName(awsgo.StringValue(zone.Name)) == normalizeDnsName(zoneName) {
+			hostedZoneId = awsgo.StringValue(zone.Id)
+			break
+		}
+	}
+	if hostedZoneId == "" {
+		return nil, fmt.Errorf("Found no hosted zone named %s", zoneName)
+	}
+
+	records := []TestResource{}
+	err = client.ListResourceRecordSetsPagesWithContext(ctx, &route53.ListResourceRecordSetsInput{HostedZoneId: awsgo.String(hostedZoneId)}, func(page *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+		for _, recordSet := range page.ResourceRecordSets {
+			if recordSet.AliasTarget == nil {
+				continue
+			}
+			alb, pointsAtAlb := albsByDnsName[normalizeDnsName(awsgo.StringValue(recordSet.AliasTarget.DNSName))]
+			if !pointsAtAlb {
+				continue
+			}
+			name := normalizeDnsName(awsgo.StringValue(recordSet.Name))
+			records = append(records, TestResource{
+				Kind:         TEST_RESOURCE_DNS_RECORD,
+				Region:       "global",
+				Id:           name,
+				Name:         fmt.Sprintf("%s %s", name, awsgo.StringValue(recordSet.Type)),
+				CreatedAt:    alb.CreatedAt,
+				Tags:         map[string]string{},
+				Reason:       fmt.Sprintf("points at %s", alb),
+				hostedZoneId: hostedZoneId,
+				recordSet:    recordSet,
+			})
+		}
+		return true
+	})
+	return records, err
+}
+
+// normalizeDnsName lowercases the name and strips the trailing dot and the dualstack prefix Route 53 adds to aliases of
+// load balancers
+func normalizeDnsName(name string) string {
+	return strings.TrimPrefix(strings.TrimSuffix(strings.ToLower(name), "."), "dualstack.")
+}
+
+func ec2TagsToMap(tags []*ec2.Tag) map[string]string {
+	tagMap := map[string]string{}
+	for _, tag := range tags {
+		tagMap[awsgo.StringValue(tag.Key)] = awsgo.StringValue(tag.Value)
+	}
+	return tagMap
+}
+
+func deleteTestResourceE(ctx context.Context, resource TestResource) error {
+	region := resource.Region
+	if resource.Kind == TEST_RESOURCE_DNS_RECORD {
+		region = "us-east-1"
+	}
+	sess, err := defaultAwsClients.sessionE(region)
+	if err != nil {
+		return err
+	}
+
+	switch resource.Kind {
+	case TEST_RESOURCE_DNS_RECORD:
+		_, err := route53.New(sess).ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+			HostedZoneId: awsgo.String(resource.hostedZoneId),
+			ChangeBatch: &route53.ChangeBatch{
+				Changes: []*route53.Change{{Action: awsgo.String(route53.ChangeActionDelete), ResourceRecordSet: resource.recordSet}},
+			},
+		})
+		return err
+	case TEST_RESOURCE_ASG:
+		// Terminates the instances too
+		_, err := autoscaling.New(sess).DeleteAutoScalingGroupWithContext(ctx, &autoscaling.DeleteAutoScalingGroupInput{
+			AutoScalingGroupName: awsgo.String(resource.Id),
+			ForceDelete:          awsgo.Bool(true),
+		})
+		return err
+	case TEST_RESOURCE_ALB:
+		_, err := elbv2.New(sess).DeleteLoadBalancerWithContext(ctx, &elbv2.DeleteLoadBalancerInput{LoadBalancerArn: awsgo.String(resource.Id)})
+		return err
+	case TEST_RESOURCE_AMI:
+		return deregisterAmiE(ctx, ec2.New(sess), resource.Id, resource.snapshotIds)
+	case TEST_RESOURCE_KEY_PAIR:
+		_, err := ec2.New(sess).DeleteKeyPairWithContext(ctx, &ec2.DeleteKeyPairInput{KeyName: awsgo.String(resource.Id)})
+		return err
+	case TEST_RESOURCE_SECRET:
+		_, err := secretsmanager.New(sess).DeleteSecretWithContext(ctx, &secretsmanager.DeleteSecretInput{
+			SecretId:                   awsgo.String(resource.Id),
+			ForceDeleteWithoutRecovery: awsgo.Bool(true),
+		})
+		return err
+	default:
+		return fmt.Errorf("Unknown test resource kind %q", resource.Kind)
+	}
+}
+
+// testResourceTags returns the tags that mark a resource as created by the test now
+func testResourceTags(t *testing.T) map[string]string {
+	return map[string]string{
+		TEST_RESOURCE_TAG_KEY:            t.Name(),
+		TEST_RESOURCE_CREATED_AT_TAG_KEY: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// testResourceTerraformTags returns the custom_tags var of the examples, which tags the ASGs, their instances and the ALB
+// with the name of the test, so the janitor can clean them up if the test never gets to. AWS reports when those were
+// created, so unlike testResourceTags it leaves out the creation time.
+func testResourceTerraformTags(t *testing.T) map[string]string {
+	return map[string]string{TEST_RESOURCE_TAG_KEY: t.Name()}
+}
+
+// createTestKeyPair creates a key pair like aws.CreateAndImportEC2KeyPair and tags it, so the janitor can clean it up
+// if the test never gets to
+func createTestKeyPair(t *testing.T, awsRegion string, name string) *aws.Ec2Keypair {
+	keyPair := aws.CreateAndImportEC2KeyPair(t, awsRegion, name)
+
+	client, err := defaultAwsClients.ec2ClientE(awsRegion)
+	if err != nil {
+		logger.Logf(t, "Failed to tag key pair %s, so the janitor won't find it: %v", name, err)
+		return keyPair
+	}
+	output, err := client.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{KeyNames: awsgo.StringSlice([]string{name})})
+	if err == nil && len(output.KeyPairs) == 1 {
+		err = aws.AddTagsToResourceE(t, awsRegion, awsgo.StringValue(output.KeyPairs[0].KeyPairId), testResourceTags(t))
+	}
+	if err != nil {
+		logger.Logf(t, "Failed to tag key pair %s, so the janitor won't find it: %v", name, err)
+	}
+	return keyPair
+}
+
+// createTestSecret creates a secret like aws.CreateSecretStringWithDefaultKey, tagged so the janitor can clean it up
+// if the test never gets to
+func createTestSecret(t *testing.T, awsRegion string, description string, name string, secretString string) string {
+	arn, err := createTestSecretE(t, defaultAwsClients, awsRegion, description, name, secretString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return arn
+}
+
+func createTestSecretE(t *testing.T, clients *AwsClients, awsRegion string, description string, name string, secretString string) (string, error) {
+	logger.Logf(t, "Creating new secret in secrets manager named %s", name)
+
+	client, err := clients.secretsManagerClientE(awsRegion)
+	if err != nil {
+		return "", err
+	}
+
+	tags := []*secretsmanager.Tag{}
+	for key, value := range testResourceTags(t) {
+		tags = append(tags, &secretsmanager.Tag{Key: awsgo.String(key), Value: awsgo.String(value)})
+	}
+	output, err := client.CreateSecret(&secretsmanager.CreateSecretInput{
+		Description:  awsgo.String(description),
+		Name:         awsgo.String(name),
+		SecretString: awsgo.String(secretString),
+		Tags:         tags,
+	})
+	if err != nil {
+		return "", err
+	}
+	return awsgo.StringValue(output.ARN), nil
+}
+
+// deleteTestSecret deletes the secret without a recovery window, like aws.DeleteSecret with forceDelete
+func deleteTestSecret(t *testing.T, awsRegion string, id string) {
+	if err := deleteTestSecretE(t, defaultAwsClients, awsRegion, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func deleteTestSecretE(t *testing.T, clients *AwsClients, awsRegion string, id string) error {
+	logger.Logf(t, "Deleting secret %s", id)
+
+	client, err := clients.secretsManagerClientE(awsRegion)
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteSecret(&secretsmanager.DeleteSecretInput{
+		ForceDeleteWithoutRecovery: awsgo.Bool(true),
+		SecretId:                   awsgo.String(id),
+	})
+	return err
+}
+
+// tagTestAmi tags the AMI and its snapshots, so the janitor can clean them up, and with the cache key, if any, so
+// buildAmi can reuse the AMI
+func tagTestAmi(t *testing.T, awsRegion string, amiId string, cacheKey string) {
+	client, err := defaultAwsClients.ec2ClientE(awsRegion)
+	if err != nil {
+		logger.Logf(t, "Failed to tag AMI %s, so the janitor won't find it: %v", amiId, err)
+		return
+	}
+	image, err := describeAmiE(context.Background(), client, amiId)
+	if err != nil {
+		logger.Logf(t, "Failed to tag AMI %s, so the janitor won't find it: %v", amiId, err)
+		return
+	}
+	ids := append([]string{amiId}, amiSnapshotIds(image)...)
+
+	tags := testResourceTags(t)
+	if cacheKey != "" {
+		tags[AMI_CACHE_TAG_KEY] = cacheKey
+	}
+	for _, id := range ids {
+		if err := aws.AddTagsToResourceE(t, awsRegion, id, tags); err != nil {
+			logger.Logf(t, "Failed to tag %s of AMI %s, so the janitor won't find it: %v", id, amiId, err)
+		}
+	}
+}
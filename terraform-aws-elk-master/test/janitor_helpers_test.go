@@ -0,0 +1,120 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	awsgo "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineSelectLeakedTestResources(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-JANITOR_DEFAULT_MIN_AGE - time.Minute)
+	recent := now.Add(-time.Minute)
+
+	testCases := []struct {
+		name     string
+		resource TestResource
+		leaked   bool
+	}{
+		{"tagged AMI", TestResource{Kind: TEST_RESOURCE_AMI, Name: "my-ami", CreatedAt: old, Tags: map[string]string{TEST_RESOURCE_TAG_KEY: "TestFoo"}}, true},
+		{"recent tagged AMI", TestResource{Kind: TEST_RESOURCE_AMI, Name: "my-ami", CreatedAt: recent, Tags: map[string]string{TEST_RESOURCE_TAG_KEY: "TestFoo"}}, false},
+		{"untagged AMI of a test template", TestResource{Kind: TEST_RESOURCE_AMI, Name: "gruntwork-ubuntu-20-elasticsearch-example-abc", CreatedAt: old}, true},
+		{"someone else's AMI", TestResource{Kind: TEST_RESOURCE_AMI, Name: "production-elasticsearch", CreatedAt: old}, false},
+		{"ASG of the simple test", TestResource{Kind: TEST_RESOURCE_ASG, Name: "es-cluster-aB3xY9-0", CreatedAt: old}, true},
+		{"ASG of the all-in-one test tagged by Terraform", TestResource{Kind: TEST_RESOURCE_ASG, Name: "es-ab3xy9-0", CreatedAt: old, Tags: map[string]string{TEST_RESOURCE_TAG_KEY: "TestELKAIOEndToEnd"}}, true},
+		{"untagged ASG with a lowercased ID", TestResource{Kind: TEST_RESOURCE_ASG, Name: "es-ab3xy9", CreatedAt: old}, false},
+		{"ASG with a longer name", TestResource{Kind: TEST_RESOURCE_ASG, Name: "es-production-cluster", CreatedAt: old}, false},
+		{"ASG named logstash-backup", TestResource{Kind: TEST_RESOURCE_ASG, Name: "logstash-backup", CreatedAt: old}, false},
+		{"ASG named kibana-server-1", TestResource{Kind: TEST_RESOURCE_ASG, Name: "kibana-server-1", CreatedAt: old}, false},
+		{"ASG named es-master-0", TestResource{Kind: TEST_RESOURCE_ASG, Name: "es-master-0", CreatedAt: old}, false},
+		{"ASG of a cluster named with a lowercase word", TestResource{Kind: TEST_RESOURCE_ASG, Name: "es-cluster-search-0", CreatedAt: old}, false},
+		{"ALB named alb-public", TestResource{Kind: TEST_RESOURCE_ALB, Name: "alb-public", CreatedAt: old}, false},
+		{"untagged ALB of the end-to-end test", TestResource{Kind: TEST_RESOURCE_ALB, Name: "alb-ab3xy9", CreatedAt: old}, false},
+		{"ALB of the end-to-end test tagged by Terraform", TestResource{Kind: TEST_RESOURCE_ALB, Name: "alb-ab3xy9", CreatedAt: old, Tags: map[string]string{TEST_RESOURCE_TAG_KEY: "TestELKEndToEnd"}}, true},
+		{"ALB of a cluster named with digits", TestResource{Kind: TEST_RESOURCE_ALB, Name: "es-cluster-201906-alb", CreatedAt: old}, false},
+		{"ALB of the simple test", TestResource{Kind: TEST_RESOURCE_ALB, Name: "es-cluster-aB3xY9-alb", CreatedAt: old}, true},
+		{"secret of the end-to-end test", TestResource{Kind: TEST_RESOURCE_SECRET, Name: "Kibana_aB3xY9", CreatedAt: old}, true},
+		{"ASG pattern doesn't apply to secrets", TestResource{Kind: TEST_RESOURCE_SECRET, Name: "kibana-aB3xY9", CreatedAt: old}, false},
+		{"key pair with a created at tag", TestResource{Kind: TEST_RESOURCE_KEY_PAIR, Name: "ab3xy9", Tags: map[string]string{TEST_RESOURCE_TAG_KEY: "TestFoo", TEST_RESOURCE_CREATED_AT_TAG_KEY: old.Format(time.RFC3339)}}, true},
+		{"cached AMI younger than the cache max age", TestResource{Kind: TEST_RESOURCE_AMI, Name: "my-ami", CreatedAt: old, Tags: map[string]string{TEST_RESOURCE_TAG_KEY: "TestFoo", AMI_CACHE_TAG_KEY: "abc"}}, false},
+		{"key pair of unknown age", TestResource{Kind: TEST_RESOURCE_KEY_PAIR, Name: "es-backup-ab3xy9"}, false},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			leaked := selectLeakedTestResources([]TestResource{testCase.resource}, JANITOR_DEFAULT_MIN_AGE, now)
+			if !testCase.leaked {
+				assert.Empty(t, leaked)
+				return
+			}
+			if assert.Len(t, leaked, 1) {
+				assert.NotEmpty(t, leaked[0].Reason)
+				assert.Equal(t, old, leaked[0].CreatedAt)
+			}
+		})
+	}
+}
+
+func TestOfflineAddAlbTags(t *testing.T) {
+	t.Parallel()
+
+	resources := []TestResource{
+		{Kind: TEST_RESOURCE_ALB, Id: "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/alb-ab3xy9/1", Name: "alb-ab3xy9", Tags: map[string]string{}},
+		{Kind: TEST_RESOURCE_ALB, Id: "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/alb-public/2", Name: "alb-public", Tags: map[string]string{}},
+	}
+	descriptions := []*elbv2.TagDescription{
+		{
+			ResourceArn: awsgo.String(resources[0].Id),
+			Tags:        []*elbv2.Tag{{Key: awsgo.String(TEST_RESOURCE_TAG_KEY), Value: awsgo.String(t.Name())}},
+		},
+		{
+			ResourceArn: awsgo.String(resources[1].Id),
+			Tags:        []*elbv2.Tag{{Key: awsgo.String("Environment"), Value: awsgo.String("production")}},
+		},
+	}
+
+	addAlbTags(resources, descriptions)
+
+	assert.Equal(t, testResourceTerraformTags(t), resources[0].Tags)
+	assert.Equal(t, map[string]string{"Environment": "production"}, resources[1].Tags)
+}
+
+func TestOfflineSortTestResourcesForDeletion(t *testing.T) {
+	t.Parallel()
+
+	resources := []TestResource{
+		{Kind: TEST_RESOURCE_SECRET, Region: "us-east-1", Name: "Kibana_a"},
+		{Kind: TEST_RESOURCE_AMI, Region: "us-west-2", Name: "b"},
+		{Kind: TEST_RESOURCE_ASG, Region: "us-east-1", Name: "es-cluster-b"},
+		{Kind: TEST_RESOURCE_KEY_PAIR, Region: "us-east-1", Name: "a"},
+		{Kind: TEST_RESOURCE_AMI, Region: "us-east-1", Name: "c"},
+		{Kind: TEST_RESOURCE_ALB, Region: "us-east-1", Name: "alb-a"},
+		{Kind: TEST_RESOURCE_DNS_RECORD, Region: "global", Name: "a.gruntwork.in A"},
+		{Kind: TEST_RESOURCE_ASG, Region: "us-east-1", Name: "es-cluster-a"},
+	}
+	sortTestResourcesForDeletion(resources)
+
+	names := []string{}
+	for _, resource := range resources {
+		names = append(names, resource.Name)
+	}
+	assert.Equal(t, []string{"a.gruntwork.in A", "es-cluster-a", "es-cluster-b", "alb-a", "c", "b", "a", "Kibana_a"}, names)
+}
+
+func TestOfflineNormalizeDnsName(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "alb-ab3xy9-123.us-east-1.elb.amazonaws.com", normalizeDnsName("dualstack.ALB-ab3xy9-123.us-east-1.elb.amazonaws.com."))
+	assert.Equal(t, "ab3xy9.gruntwork.in", normalizeDnsName("ab3xy9.gruntwork.in"))
+}
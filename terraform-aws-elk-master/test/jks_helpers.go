@@ -0,0 +1,158 @@
+package test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// This file writes Java KeyStores (JKS) in Go, so the tests don't need keytool. The format is documented by the
+// OpenJDK sources of sun.security.provider.JavaKeyStore and sun.security.provider.KeyProtector.
+
+const jksMagic = 0xfeedfeed
+const jksVersion = 2
+const jksPrivateKeyTag = 1
+const jksTrustedCertTag = 2
+
+// The OID of Sun's proprietary key protection algorithm, which is what keytool uses for JKS private keys
+var jksKeyProtectorOid = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// writeJavaKeyStoreE writes a JKS containing a single private key entry with its certificate chain. The key is
+// protected by the same password as the store.
+func writeJavaKeyStoreE(path string, password string, alias string, privateKey crypto.Signer, chain []*x509.Certificate) error {
+	protectedKey, err := jksProtectPrivateKey(password, privateKey)
+	if err != nil {
+		return err
+	}
+
+	buf := newJksBuffer(1)
+	buf.writeUint32(jksPrivateKeyTag)
+	buf.writeUtf(strings.ToLower(alias))
+	buf.writeUint64(uint64(time.Now().UnixNano() / int64(time.Millisecond)))
+	buf.writeUint32(uint32(len(protectedKey)))
+	buf.Write(protectedKey)
+	buf.writeUint32(uint32(len(chain)))
+	for _, certificate := range chain {
+		buf.writeCertificate(certificate)
+	}
+
+	return ioutil.WriteFile(path, buf.sign(password), 0600)
+}
+
+// writeJavaTrustStoreE writes a JKS containing one trusted certificate entry per alias
+func writeJavaTrustStoreE(path string, password string, trustedCertificates map[string]*x509.Certificate) error {
+	buf := newJksBuffer(len(trustedCertificates))
+	for alias, certificate := range trustedCertificates {
+		buf.writeUint32(jksTrustedCertTag)
+		buf.writeUtf(strings.ToLower(alias))
+		buf.writeUint64(uint64(time.Now().UnixNano() / int64(time.Millisecond)))
+		buf.writeCertificate(certificate)
+	}
+
+	return ioutil.WriteFile(path, buf.sign(password), 0644)
+}
+
+type jksBuffer struct {
+	bytes.Buffer
+}
+
+func newJksBuffer(numEntries int) *jksBuffer {
+	buf := &jksBuffer{}
+	buf.writeUint32(jksMagic)
+	buf.writeUint32(jksVersion)
+	buf.writeUint32(uint32(numEntries))
+	return buf
+}
+
+func (buf *jksBuffer) writeUint32(value uint32) {
+	binary.Write(buf, binary.BigEndian, value)
+}
+
+func (buf *jksBuffer) writeUint64(value uint64) {
+	binary.Write(buf, binary.BigEndian, value)
+}
+
+// writeUtf mimics Java's DataOutputStream.writeUTF, which is identical to UTF-8 for the ASCII aliases we use
+func (buf *jksBuffer) writeUtf(value string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+}
+
+func (buf *jksBuffer) writeCertificate(certificate *x509.Certificate) {
+	buf.writeUtf("X.509")
+	buf.writeUint32(uint32(len(certificate.Raw)))
+	buf.Write(certificate.Raw)
+}
+
+// sign appends the integrity check: a SHA-1 over the password, the string "Mighty Aphrodite" and the store contents
+func (buf *jksBuffer) sign(password string) []byte {
+	digest := sha1.New()
+	digest.Write(jksPasswordBytes(password))
+	digest.Write([]byte("Mighty Aphrodite"))
+	digest.Write(buf.Bytes())
+	return append(buf.Bytes(), digest.Sum(nil)...)
+}
+
+// jksPasswordBytes encodes the password the way Java does: each char as two big-endian bytes
+func jksPasswordBytes(password string) []byte {
+	var passwordBytes []byte
+	for _, char := range password {
+		passwordBytes = append(passwordBytes, byte(char>>8), byte(char))
+	}
+	return passwordBytes
+}
+
+// jksProtectPrivateKey encrypts the PKCS#8 encoding of privateKey with Sun's KeyProtector: the key is XORed with a
+// stream of chained SHA-1 digests of the password and a random salt, and followed by a SHA-1 of the password and the
+// plain key as an integrity check. The result is wrapped in an EncryptedPrivateKeyInfo.
+func jksProtectPrivateKey(password string, privateKey crypto.Signer) ([]byte, error) {
+	plainKey, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	passwordBytes := jksPasswordBytes(password)
+
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	encryptedKey := make([]byte, len(plainKey))
+	digest := salt
+	for offset := 0; offset < len(plainKey); offset += sha1.Size {
+		hash := sha1.New()
+		hash.Write(passwordBytes)
+		hash.Write(digest)
+		digest = hash.Sum(nil)
+
+		for i := 0; i < sha1.Size && offset+i < len(plainKey); i++ {
+			encryptedKey[offset+i] = plainKey[offset+i] ^ digest[i]
+		}
+	}
+
+	check := sha1.New()
+	check.Write(passwordBytes)
+	check.Write(plainKey)
+
+	protected := append(append(salt, encryptedKey...), check.Sum(nil)...)
+
+	return asn1.Marshal(struct {
+		Algorithm     pkix.AlgorithmIdentifier
+		EncryptedData []byte
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  jksKeyProtectorOid,
+			Parameters: asn1.RawValue{Tag: asn1.TagNull},
+		},
+		EncryptedData: protected,
+	})
+}
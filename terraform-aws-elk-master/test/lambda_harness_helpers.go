@@ -0,0 +1,186 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/docker"
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+// The image of the Lambda runtime our backup and restore modules default to (nodejs14.x). Like the real runtime, it
+// ships with the AWS SDK.
+const LAMBDA_NODE_RUNTIME_IMAGE = "public.ecr.aws/lambda/nodejs:14"
+
+// The module search path the Lambda Node.js runtime sets up, so handlers find the AWS SDK bundled with the image
+const LAMBDA_NODE_PATH = "/opt/nodejs/node14/node_modules:/opt/nodejs/node_modules:/var/runtime/node_modules:/var/runtime:/var/task"
+
+// The prefix of the line in which the harness reports the calls to the handler's callback
+const LAMBDA_HARNESS_RESULT_PREFIX = "LAMBDA_HARNESS_RESULT "
+
+// lambdaHarnessScript invokes the handler in /var/task with the event in LAMBDA_EVENT and, once the handler has no more
+// work scheduled, prints every call it made to its callback. Handlers may call back more than once, or keep working
+// after calling back, so we don't stop at the first call like the Lambda runtime would.
+const lambdaHarnessScript = `'use strict';
+
+if (process.env.AWS_STUB_ENDPOINT) {
+  const AWS = require('aws-sdk');
+  AWS.config.update({ endpoint: process.env.AWS_STUB_ENDPOINT, maxRetries: 0 });
+}
+
+const callbacks = [];
+let reported = false;
+
+process.on('beforeExit', function () {
+  if (reported) {
+    return;
+  }
+  reported = true;
+  process.stdout.write(process.env.LAMBDA_HARNESS_RESULT_PREFIX + JSON.stringify({ callbacks: callbacks }) + '\n');
+});
+
+const serializeError = function (err) {
+  if (err === null || err === undefined) {
+    return null;
+  }
+  if (err instanceof Error) {
+    return { message: err.message, code: err.code };
+  }
+  return err;
+};
+
+const handler = require('/var/task/index.js').handler;
+handler(JSON.parse(process.env.LAMBDA_EVENT || '{}'), {}, function (err, result) {
+  callbacks.push({ error: serializeError(err), result: result === undefined ? null : result });
+});
+`
+
+// LambdaHandlerInvocation describes a single local run of a Node.js Lambda handler
+type LambdaHandlerInvocation struct {
+	// The folder with the index.js that exports the handler, e.g. modules/elasticsearch-cluster-backup/backup
+	HandlerDir string
+	// The environment variables of the Lambda function
+	Env map[string]string
+	// The event to pass to the handler
+	Event interface{}
+	// If set, every AWS SDK client the handler creates talks to this endpoint, e.g. a FakeAwsServer
+	AwsEndpoint string
+}
+
+// LambdaCallback is one call the handler made to its callback
+type LambdaCallback struct {
+	Error  interface{} `json:"error"`
+	Result interface{} `json:"result"`
+}
+
+// LambdaHandlerResult is what a handler did during a local run
+type LambdaHandlerResult struct {
+	Callbacks []LambdaCallback `json:"callbacks"`
+	// Everything the handler logged
+	Output string `json:"-"`
+}
+
+// runLambdaHandler runs a Node.js Lambda handler in a Docker container with the Lambda Node.js runtime and returns the
+// calls it made to its callback. The container uses the host network, so the handler can reach fakes started by the
+// test on localhost.
+func runLambdaHandler(t *testing.T, invocation LambdaHandlerInvocation) LambdaHandlerResult {
+	result, err := runLambdaHandlerE(t, invocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func runLambdaHandlerE(t *testing.T, invocation LambdaHandlerInvocation) (LambdaHandlerResult, error) {
+	var result LambdaHandlerResult
+
+	handlerDir, err := filepath.Abs(invocation.HandlerDir)
+	if err != nil {
+		return result, err
+	}
+
+	harnessDir, err := ioutil.TempDir("", "lambda-harness")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(harnessDir)
+
+	if err := ioutil.WriteFile(filepath.Join(harnessDir, "harness.js"), []byte(lambdaHarnessScript), 0644); err != nil {
+		return result, err
+	}
+
+	event, err := json.Marshal(invocation.Event)
+	if err != nil {
+		return result, err
+	}
+
+	envVars := []string{
+		"NODE_PATH=" + LAMBDA_NODE_PATH,
+		"LAMBDA_HARNESS_RESULT_PREFIX=" + LAMBDA_HARNESS_RESULT_PREFIX,
+		"LAMBDA_EVENT=" + string(event),
+		// The SDK refuses to sign requests without credentials, even for a fake endpoint
+		"AWS_ACCESS_KEY_ID=fake",
+		"AWS_SECRET_ACCESS_KEY=fake",
+		"AWS_REGION=us-east-1",
+	}
+	if invocation.AwsEndpoint != "" {
+		envVars = append(envVars, "AWS_STUB_ENDPOINT="+invocation.AwsEndpoint)
+	}
+	for name, value := range invocation.Env {
+		envVars = append(envVars, fmt.Sprintf("%s=%s", name, value))
+	}
+
+	logger.Logf(t, "Running Lambda handler in %s with event %s", handlerDir, string(event))
+
+	output, err := docker.RunE(t, LAMBDA_NODE_RUNTIME_IMAGE, &docker.RunOptions{
+		Entrypoint:           "node",
+		Command:              []string{"/harness/harness.js"},
+		EnvironmentVariables: envVars,
+		Volumes:              []string{handlerDir + ":/var/task:ro", harnessDir + ":/harness:ro"},
+		Remove:               true,
+		OtherOptions:         []string{"--network", "host"},
+	})
+	if err != nil {
+		return result, err
+	}
+
+	return parseLambdaHarnessOutput(output)
+}
+
+// parseLambdaHarnessOutput extracts the result line printed by lambdaHarnessScript from the output of the container
+func parseLambdaHarnessOutput(output string) (LambdaHandlerResult, error) {
+	result := LambdaHandlerResult{Output: output}
+
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, LAMBDA_HARNESS_RESULT_PREFIX) {
+			continue
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, LAMBDA_HARNESS_RESULT_PREFIX)), &result); err != nil {
+			return result, fmt.Errorf("Failed to parse Lambda harness result %q: %v", line, err)
+		}
+		return result, nil
+	}
+
+	return result, fmt.Errorf("The Lambda handler exited without the harness reporting a result. Output:\n%s", output)
+}
+
+// lambdaElasticsearchEnv returns the environment variables that point the backup and restore Lambda functions at the
+// Elasticsearch cluster at esUrl
+func lambdaElasticsearchEnv(t *testing.T, esUrl string) map[string]string {
+	parsedUrl, err := url.Parse(esUrl)
+	if err != nil {
+		t.Fatalf("Failed to parse Elasticsearch URL %s: %v", esUrl, err)
+	}
+
+	return map[string]string{
+		"ELASTICSEARCH_DNS":  parsedUrl.Hostname(),
+		"ELASTICSEARCH_PORT": parsedUrl.Port(),
+		"PROTOCOL":           parsedUrl.Scheme,
+	}
+}
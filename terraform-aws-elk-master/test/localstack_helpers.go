@@ -0,0 +1,102 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/docker"
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+// The LocalStack release the LocalStack tests run against
+const LOCALSTACK_IMAGE = "localstack/localstack:0.12.17"
+
+// The port LocalStack serves every AWS API on
+const LOCALSTACK_EDGE_PORT = 4566
+
+// LocalStack is a LocalStack container started by a test, which emulates the AWS APIs on one endpoint
+type LocalStack struct {
+	ContainerId string
+	// The URL of the AWS APIs, e.g. http://127.0.0.1:49153
+	Endpoint string
+	// Clients that send every request to Endpoint
+	Clients *AwsClients
+}
+
+// startLocalStack starts a LocalStack container with the given services, e.g. s3 and logs, on a random port and waits
+// for them to be up. Callers must Close it when done.
+func startLocalStack(t *testing.T, services []string) *LocalStack {
+	containerId, err := docker.RunE(t, LOCALSTACK_IMAGE, &docker.RunOptions{
+		Detach:               true,
+		Remove:               true,
+		EnvironmentVariables: []string{fmt.Sprintf("SERVICES=%s", strings.Join(services, ","))},
+		OtherOptions:         []string{"--publish", fmt.Sprintf("127.0.0.1::%d", LOCALSTACK_EDGE_PORT)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start LocalStack: %v", err)
+	}
+	containerId = strings.TrimSpace(containerId)
+
+	localStack := &LocalStack{ContainerId: containerId}
+
+	container, err := docker.InspectE(t, containerId)
+	if err != nil {
+		localStack.Close(t)
+		t.Fatalf("Failed to inspect LocalStack container %s: %v", containerId, err)
+	}
+	port := container.GetExposedHostPort(LOCALSTACK_EDGE_PORT)
+	if port == 0 {
+		localStack.Close(t)
+		t.Fatalf("LocalStack container %s doesn't publish port %d", containerId, LOCALSTACK_EDGE_PORT)
+	}
+
+	localStack.Endpoint = fmt.Sprintf("http://127.0.0.1:%d", port)
+	localStack.Clients = newAwsClients(localStack.Endpoint)
+	logger.Logf(t, "Started LocalStack container %s at %s", containerId, localStack.Endpoint)
+
+	healthUrl := fmt.Sprintf("%s/health", localStack.Endpoint)
+	err = waitForE(t, context.Background(), localStackWaitBudget, fmt.Sprintf("LocalStack services %s", strings.Join(services, ", ")), func(ctx context.Context) error {
+		return checkLocalStackServicesE(ctx, healthUrl, services)
+	})
+	if err != nil {
+		localStack.Close(t)
+		t.Fatal(err)
+	}
+	return localStack
+}
+
+// checkLocalStackServicesE returns an error unless the health endpoint reports every service as running
+func checkLocalStackServicesE(ctx context.Context, healthUrl string, services []string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, healthUrl, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var health struct {
+		Services map[string]string `json:"services"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&health); err != nil {
+		return fmt.Errorf("Failed to parse the LocalStack health from %s: %v", healthUrl, err)
+	}
+	for _, service := range services {
+		if health.Services[service] != "running" {
+			return fmt.Errorf("LocalStack service %s is %q", service, health.Services[service])
+		}
+	}
+	return nil
+}
+
+func (localStack *LocalStack) Close(t *testing.T) {
+	if _, err := docker.StopE(t, []string{localStack.ContainerId}, &docker.StopOptions{}); err != nil {
+		logger.Logf(t, "Failed to stop LocalStack container %s: %v", localStack.ContainerId, err)
+	}
+}
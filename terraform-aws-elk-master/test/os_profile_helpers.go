@@ -0,0 +1,59 @@
+package test
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Package managers an OsProfile can use
+const (
+	PACKAGE_MANAGER_APT = "apt"
+	PACKAGE_MANAGER_YUM = "yum"
+)
+
+// OsProfile describes what the tests need to know about the operating system an AMI or Docker image is built on
+type OsProfile struct {
+	// The OS_NAME the Docker examples expect
+	Name           string
+	SshUserName    string
+	PackageManager string
+	// Where the OS writes the system log
+	SystemLogPath string
+}
+
+var (
+	ubuntuOsProfile = OsProfile{
+		Name:           "ubuntu",
+		SshUserName:    "ubuntu",
+		PackageManager: PACKAGE_MANAGER_APT,
+		SystemLogPath:  "/var/log/syslog",
+	}
+	amazonLinux2OsProfile = OsProfile{
+		Name:           "amazon-linux",
+		SshUserName:    "ec2-user",
+		PackageManager: PACKAGE_MANAGER_YUM,
+		SystemLogPath:  "/var/log/messages",
+	}
+)
+
+// installPackageCommand returns a command that installs the package non-interactively
+func (profile OsProfile) installPackageCommand(packageName string) string {
+	switch profile.PackageManager {
+	case PACKAGE_MANAGER_YUM:
+		return fmt.Sprintf("sudo yum install -y %s", shellQuote(packageName))
+	default:
+		return fmt.Sprintf("sudo DEBIAN_FRONTEND=noninteractive apt-get install -y %s", shellQuote(packageName))
+	}
+}
+
+// serviceStatusCommand returns a command that exits with a non-zero status if the service isn't running. Every OS the
+// tests support runs systemd.
+func (profile OsProfile) serviceStatusCommand(service string) string {
+	return fmt.Sprintf("systemctl is-active --quiet %s", shellQuote(service))
+}
+
+// logFileNameFilters returns the filters that match the system log and the user-data log, plus the given ones, to
+// download the logs of an instance with downloadRemoteFiles
+func (profile OsProfile) logFileNameFilters(extraFilters ...string) []string {
+	return append([]string{filepath.Base(profile.SystemLogPath), "user-data*"}, extraFilters...)
+}
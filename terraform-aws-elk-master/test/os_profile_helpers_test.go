@@ -0,0 +1,35 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineOsProfiles(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name                   string
+		profile                OsProfile
+		expectedFilters        []string
+		expectedInstallCommand string
+	}{
+		{"ubuntu", ubuntuOsProfile, []string{"syslog", "user-data*", "es-cluster*"}, "sudo DEBIAN_FRONTEND=noninteractive apt-get install -y 'jq'"},
+		{"amazon linux 2", amazonLinux2OsProfile, []string{"messages", "user-data*", "es-cluster*"}, "sudo yum install -y 'jq'"},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, testCase.expectedFilters, testCase.profile.logFileNameFilters("es-cluster*"))
+			assert.Equal(t, testCase.expectedInstallCommand, testCase.profile.installPackageCommand("jq"))
+			assert.Equal(t, "systemctl is-active --quiet 'logstash'", testCase.profile.serviceStatusCommand("logstash"))
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+)
+
+const DEFAULT_PROBE_DIAL_TIMEOUT = 10 * time.Second
+
+// ProbeOptions configures a single probe of a TCP endpoint
+type ProbeOptions struct {
+	// The host:port to connect to
+	Address string
+
+	// How long the dial, TLS handshake and Beats handshake may take together. Defaults to DEFAULT_PROBE_DIAL_TIMEOUT.
+	Timeout time.Duration
+
+	// If set, perform a TLS handshake and verify the server certificate against this CA file
+	TlsCaFile string
+	// The name to verify the server certificate against. Defaults to the host in Address.
+	TlsServerName string
+	// If set, present this client certificate and key during the TLS handshake, e.g. for a Logstash beats input with
+	// ssl_verify_mode => "peer"
+	TlsClientCertFile string
+	TlsClientKeyFile  string
+
+	// If set, send this event using the Beats (Lumberjack v2) protocol and wait for Logstash to ACK it. Logstash writes
+	// the event to its outputs like any other, so only set it if you check for the event, e.g. with a unique message and
+	// checkLogstashOutputLog. Otherwise the probe stops after the TCP and TLS handshakes and writes nothing.
+	BeatsEvent BeatsEvent
+}
+
+// probeE connects to options.Address once, closes the connection and returns the error of whichever step failed
+func probeE(ctx context.Context, options ProbeOptions) error {
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_PROBE_DIAL_TIMEOUT
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", options.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	if options.TlsCaFile != "" {
+		tlsConfig, err := tlsClientConfigE(options.Address, options.TlsCaFile, options.TlsServerName, options.TlsClientCertFile, options.TlsClientKeyFile)
+		if err != nil {
+			return err
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake with %s failed: %v", options.Address, err)
+		}
+		conn = tlsConn
+	}
+
+	if options.BeatsEvent != nil {
+		if err := beatsHandshake(ctx, conn, timeout, options.BeatsEvent); err != nil {
+			return fmt.Errorf("Beats handshake with %s failed: %v", options.Address, err)
+		}
+	}
+
+	return nil
+}
+
+// tlsClientConfigE returns a TLS config that only trusts the CA in caFile and verifies the server certificate against
+// serverName, or the host of address if it is empty. If certFile and keyFile are set, it presents that client
+// certificate, e.g. to a Logstash beats input with ssl_verify_mode => "peer".
+func tlsClientConfigE(address string, caFile string, serverName string, certFile string, keyFile string) (*tls.Config, error) {
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA file %s due to error: %v", caFile, err)
+	}
+
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No PEM certificates found in CA file %s", caFile)
+	}
+
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address %s: %v", address, err)
+		}
+		serverName = host
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:    caCertPool,
+		ServerName: serverName,
+	}
+
+	if certFile != "" && keyFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client cert %s and key %s: %v", certFile, keyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// beatsHandshake sends a window of the one event with the BeatsClient and waits for Logstash to ACK it. Logstash may
+// send keep-alive ACKs (sequence 0) while the event is in flight.
+func beatsHandshake(ctx context.Context, conn net.Conn, timeout time.Duration, event BeatsEvent) error {
+	client := &BeatsClient{
+		Options: BeatsClientOptions{WindowSize: 1, Timeout: timeout},
+		conn:    conn,
+	}
+	return client.SendE(ctx, []BeatsEvent{event})
+}
+
+// probeWithRetryE probes until it succeeds or the budget runs out. On failure it returns a WaitTimeoutError whose
+// LastError is the underlying dial, TLS or Beats error of the last attempt.
+func probeWithRetryE(t *testing.T, ctx context.Context, budget WaitBudget, options ProbeOptions) error {
+	return waitForE(t, ctx, budget, fmt.Sprintf("probe of %s", options.Address), func(ctx context.Context) error {
+		return probeE(ctx, options)
+	})
+}
+
+func probeWithRetry(t *testing.T, budget WaitBudget, options ProbeOptions) {
+	ctx, cancel := testContext(t)
+	defer cancel()
+
+	if err := probeWithRetryE(t, ctx, budget, options); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkBeatsInputRunning waits until the beats input a BeatsClient with the options would send to accepts connections,
+// without sending events
+func checkBeatsInputRunning(t *testing.T, options BeatsClientOptions) {
+	logger.Logf(t, "Checking for Logstash to be up at: %s", options.Address)
+	probeWithRetry(t, logstashWaitBudget, beatsProbeOptions(options, nil))
+}
+
+// checkBeatsInputAcksEvent waits until the beats input a BeatsClient with the options would send to ACKs the event.
+// Logstash writes the event to its outputs, so give it a unique message and check that it arrives. As the probe retries,
+// the event may arrive more than once.
+func checkBeatsInputAcksEvent(t *testing.T, options BeatsClientOptions, event BeatsEvent) {
+	logger.Logf(t, "Checking for Logstash at %s to ACK the event %v", options.Address, event["message"])
+	probeWithRetry(t, logstashWaitBudget, beatsProbeOptions(options, event))
+}
+
+func beatsProbeOptions(options BeatsClientOptions, event BeatsEvent) ProbeOptions {
+	probeOptions := ProbeOptions{
+		Address:    options.Address,
+		BeatsEvent: event,
+	}
+
+	if options.KeyStore != nil {
+		probeOptions.TlsCaFile = options.KeyStore.CaFile
+		probeOptions.TlsServerName = options.KeyStore.ServerName
+		probeOptions.TlsClientCertFile = options.KeyStore.CertFile
+		probeOptions.TlsClientKeyFile = options.KeyStore.KeyFile
+	}
+	return probeOptions
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineProbeBeatsHandshake(t *testing.T) {
+	t.Parallel()
+
+	// Logstash sends a keep alive ACK before the ACK of the event when it is busy
+	server := startFakeBeats(t, FakeBeatsOptions{KeepAlives: 1})
+	defer server.Close()
+
+	event := newBeatsEvent("This is a log line_probe", nil)
+	err := probeE(context.Background(), ProbeOptions{Address: server.Address, BeatsEvent: event})
+	require.NoError(t, err)
+
+	assert.Equal(t, []FakeBeatsWindow{{1, false}}, server.Windows())
+	events := server.Events()
+	require.Len(t, events, 1)
+	assert.Equal(t, "This is a log line_probe", events[0]["message"])
+}
+
+func TestOfflineProbeWithoutBeatsEventSendsNothing(t *testing.T) {
+	t.Parallel()
+
+	server := startFakeBeats(t, FakeBeatsOptions{})
+
+	err := probeE(context.Background(), ProbeOptions{Address: server.Address})
+	require.NoError(t, err)
+
+	// Close waits for the connection handlers, so that a late window would show up below
+	server.Close()
+	assert.Empty(t, server.Windows())
+	assert.Empty(t, server.Events())
+}
+
+func TestOfflineProbeBeatsHandshakeWithTls(t *testing.T) {
+	t.Parallel()
+
+	amiDir, err := ioutil.TempDir("", "probe-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(amiDir)
+
+	keyStore := createKeyStoreFiles(t, "logstash", amiDir, "logstash.gruntwork.in")
+	server := startFakeBeatsTLS(t, FakeBeatsOptions{RequireClientCert: true}, keyStore)
+	defer server.Close()
+
+	err = probeE(context.Background(), ProbeOptions{
+		Address:           server.Address,
+		TlsCaFile:         keyStore.CaFile,
+		TlsServerName:     "logstash.gruntwork.in",
+		TlsClientCertFile: keyStore.CertFile,
+		TlsClientKeyFile:  keyStore.KeyFile,
+		BeatsEvent:        newBeatsEvent("This is a log line_probe", nil),
+	})
+	require.NoError(t, err)
+
+	assert.Len(t, server.Events(), 1)
+	assert.Equal(t, []string{"logstash.gruntwork.in"}, server.ClientNames())
+}
+
+func TestOfflineProbeBeatsHandshakeFailsWithoutAck(t *testing.T) {
+	t.Parallel()
+
+	// A listener that accepts connections but never speaks the Beats protocol
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	err = probeE(context.Background(), ProbeOptions{Address: listener.Addr().String(), BeatsEvent: newBeatsEvent("This is a log line_probe", nil), Timeout: 500 * time.Millisecond})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Beats handshake")
+}
+
+func TestOfflineProbeWithRetryReportsLastDialError(t *testing.T) {
+	t.Parallel()
+
+	// Grab a free port and close it again so that nothing is listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	budget := WaitBudget{Stage: "offline_probe", Timeout: 300 * time.Millisecond, InitialBackoff: 50 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	err = probeWithRetryE(t, context.Background(), budget, ProbeOptions{Address: address})
+
+	require.Error(t, err)
+	timeoutErr, ok := err.(WaitTimeoutError)
+	require.True(t, ok, "Expected a WaitTimeoutError but got %T", err)
+	assert.Contains(t, timeoutErr.LastError.Error(), "connection refused")
+}
@@ -0,0 +1,316 @@
+package test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/aws"
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/ssh"
+)
+
+// How the tests run commands on instances. Set REMOTE_EXEC_TRANSPORT to choose one.
+const (
+	// SSH with an EC2 key pair, through the InstanceAccess of the RemoteExecOptions
+	REMOTE_EXEC_TRANSPORT_SSH = "ssh"
+	// AWS Systems Manager Run Command, which needs no inbound port and no key pair, but requires the SSM agent and an
+	// instance profile that allows it, e.g. with the AmazonSSMManagedInstanceCore policy
+	REMOTE_EXEC_TRANSPORT_SSM = "ssm"
+)
+
+// How long to wait for an SSM command to finish
+const SSM_COMMAND_TIMEOUT = 5 * time.Minute
+
+// SSM truncates the stdout it returns to this many characters
+const SSM_OUTPUT_LIMIT = 24000
+
+// How many bytes of an archive downloadRemoteFilesE fetches per command when the transport limits the output. Base64
+// grows this by a third, which has to fit in SSM_OUTPUT_LIMIT.
+const REMOTE_DOWNLOAD_CHUNK_BYTES = 16 * 1024
+
+// RemoteExecutor runs shell commands on an instance
+type RemoteExecutor interface {
+	// RunCommandE runs the command and returns its stdout. It returns an error if the command exits with a non-zero
+	// status. SSM runs commands as root and SSH as the SSH user, so use sudo for commands that need root.
+	RunCommandE(t *testing.T, command string) (string, error)
+	// OutputLimit is the most bytes of stdout RunCommandE returns, or 0 if it returns all of it
+	OutputLimit() int
+	// String describes the instance for log messages
+	String() string
+}
+
+// SshExecutor runs commands over SSH
+type SshExecutor struct {
+	Host   ssh.Host
+	Access InstanceAccess
+}
+
+func (executor SshExecutor) RunCommandE(t *testing.T, command string) (string, error) {
+	return executor.Access.checkSshCommandE(t, executor.Host, command)
+}
+
+func (executor SshExecutor) OutputLimit() int {
+	return 0
+}
+
+func (executor SshExecutor) String() string {
+	return fmt.Sprintf("%s@%s", executor.Host.SshUserName, executor.Host.Hostname)
+}
+
+// SsmExecutor runs commands with AWS Systems Manager Run Command
+type SsmExecutor struct {
+	AwsRegion  string
+	InstanceId string
+}
+
+func (executor SsmExecutor) RunCommandE(t *testing.T, command string) (string, error) {
+	output, err := aws.CheckSsmCommandE(t, executor.AwsRegion, executor.InstanceId, command, SSM_COMMAND_TIMEOUT)
+	if err != nil {
+		if output != nil && output.Stderr != "" {
+			return output.Stdout, fmt.Errorf("%v. Stderr: %s", err, output.Stderr)
+		}
+		if output != nil {
+			return output.Stdout, err
+		}
+		return "", err
+	}
+	return output.Stdout, nil
+}
+
+func (executor SsmExecutor) OutputLimit() int {
+	return SSM_OUTPUT_LIMIT
+}
+
+func (executor SsmExecutor) String() string {
+	return fmt.Sprintf("%s (via SSM)", executor.InstanceId)
+}
+
+// RemoteExecOptions configures how the tests reach instances
+type RemoteExecOptions struct {
+	// One of the REMOTE_EXEC_TRANSPORT_* consts
+	Transport string
+	AwsRegion string
+	Os        OsProfile
+	// Only used for REMOTE_EXEC_TRANSPORT_SSH
+	SshUserName string
+	SshKeyPair  *ssh.KeyPair
+	Access      InstanceAccess
+}
+
+// newRemoteExecOptions returns the options for the transport chosen with REMOTE_EXEC_TRANSPORT, which defaults to
+// SSH over public IPs as the user of the OS profile. Override that user with REMOTE_EXEC_SSH_USER. The key pair may be
+// nil with SSM.
+func newRemoteExecOptions(t *testing.T, awsRegion string, keyPair *aws.Ec2Keypair, osProfile OsProfile) RemoteExecOptions {
+	options := RemoteExecOptions{
+		Transport:   REMOTE_EXEC_TRANSPORT_SSH,
+		AwsRegion:   awsRegion,
+		Os:          osProfile,
+		SshUserName: osProfile.SshUserName,
+		Access:      publicInstanceAccess,
+	}
+	if transport := os.Getenv("REMOTE_EXEC_TRANSPORT"); transport != "" {
+		options.Transport = transport
+	}
+	if userName := os.Getenv("REMOTE_EXEC_SSH_USER"); userName != "" {
+		options.SshUserName = userName
+	}
+	if keyPair != nil {
+		options.SshKeyPair = keyPair.KeyPair
+	}
+
+	if options.Transport != REMOTE_EXEC_TRANSPORT_SSH && options.Transport != REMOTE_EXEC_TRANSPORT_SSM {
+		t.Fatalf("Unknown REMOTE_EXEC_TRANSPORT %q. Expected %s or %s.", options.Transport, REMOTE_EXEC_TRANSPORT_SSH, REMOTE_EXEC_TRANSPORT_SSM)
+	}
+	return options
+}
+
+// executorE returns an executor for the instance
+func (options RemoteExecOptions) executorE(instance AsgInstance) (RemoteExecutor, error) {
+	switch options.Transport {
+	case REMOTE_EXEC_TRANSPORT_SSM:
+		return SsmExecutor{AwsRegion: options.AwsRegion, InstanceId: instance.InstanceId}, nil
+	case REMOTE_EXEC_TRANSPORT_SSH:
+		if options.SshKeyPair == nil {
+			return nil, fmt.Errorf("SSH to instance %s requires a key pair", instance.InstanceId)
+		}
+		host, err := options.Access.sshHostE(instance, options.SshUserName, options.SshKeyPair)
+		if err != nil {
+			return nil, err
+		}
+		return SshExecutor{Host: host, Access: options.Access}, nil
+	default:
+		return nil, fmt.Errorf("Unknown remote exec transport %q", options.Transport)
+	}
+}
+
+// remoteExecutorForAsg returns an executor for the first instance of the ASG, once the ASG reached its desired
+// capacity
+func remoteExecutorForAsg(t *testing.T, options RemoteExecOptions, asgName string) RemoteExecutor {
+	instances := waitForAsgInstances(t, options.AwsRegion, asgName)
+	if len(instances) == 0 {
+		t.Fatalf("Auto Scaling Group %s has no instances", asgName)
+	}
+
+	executor, err := options.executorE(instances[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return executor
+}
+
+// remoteExecutorForInstance returns an executor for an instance that isn't part of an ASG, such as the app server
+func remoteExecutorForInstance(t *testing.T, options RemoteExecOptions, instanceId string) RemoteExecutor {
+	instance, err := getInstanceInRegionE(options.AwsRegion, instanceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executor, err := options.executorE(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return executor
+}
+
+// downloadRemoteFiles copies the files under remoteDir whose names match one of the filters into localDir, keeping
+// their paths relative to remoteDir. The filters may contain shell wildcards. Files are read with sudo.
+func downloadRemoteFiles(t *testing.T, executor RemoteExecutor, remoteDir string, fileNameFilters []string, localDir string) {
+	if err := downloadRemoteFilesE(t, executor, remoteDir, fileNameFilters, localDir); err != nil {
+		t.Fatalf("Failed to download %s from %s: %v", remoteDir, executor, err)
+	}
+}
+
+// downloadRemoteFilesE archives the files on the instance and streams the archive back as base64 text, in chunks if
+// the transport limits the output, which works the same over SSH, a bastion or SSM
+func downloadRemoteFilesE(t *testing.T, executor RemoteExecutor, remoteDir string, fileNameFilters []string, localDir string) error {
+	logger.Logf(t, "Downloading %v from %s on %s to %s", fileNameFilters, remoteDir, executor, localDir)
+
+	output, err := executor.RunCommandE(t, remoteArchiveCommand(remoteDir, fileNameFilters))
+	if err != nil {
+		return err
+	}
+	archivePath, archiveSize, err := parseRemoteArchiveOutput(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := executor.RunCommandE(t, fmt.Sprintf("sudo rm -f %s", shellQuote(archivePath))); err != nil {
+			logger.Logf(t, "Failed to delete archive %s on %s: %v", archivePath, executor, err)
+		}
+	}()
+
+	chunkSize := archiveSize
+	if executor.OutputLimit() > 0 {
+		chunkSize = REMOTE_DOWNLOAD_CHUNK_BYTES
+	}
+
+	var archive bytes.Buffer
+	for offset := 0; offset < archiveSize; offset += chunkSize {
+		// tail counts bytes from 1
+		command := fmt.Sprintf("sudo tail -c +%d %s | head -c %d | base64 -w 0", offset+1, shellQuote(archivePath), chunkSize)
+		encoded, err := executor.RunCommandE(t, command)
+		if err != nil {
+			return err
+		}
+		chunk, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return fmt.Errorf("Failed to decode bytes %d to %d of archive %s: %v", offset, offset+chunkSize, archivePath, err)
+		}
+		archive.Write(chunk)
+	}
+
+	if archive.Len() != archiveSize {
+		return fmt.Errorf("Expected %d bytes of archive %s but got %d", archiveSize, archivePath, archive.Len())
+	}
+
+	return extractTarGzE(archive.Bytes(), localDir)
+}
+
+// remoteArchiveCommand returns a command that writes the matching files to a temporary tar.gz and prints its path and
+// size
+func remoteArchiveCommand(remoteDir string, fileNameFilters []string) string {
+	findArgs := []string{"find", ".", "-type", "f"}
+	if len(fileNameFilters) > 0 {
+		findArgs = append(findArgs, "\\(")
+		for i, filter := range fileNameFilters {
+			if i > 0 {
+				findArgs = append(findArgs, "-o")
+			}
+			findArgs = append(findArgs, "-name", shellQuote(filter))
+		}
+		findArgs = append(findArgs, "\\)")
+	}
+	findArgs = append(findArgs, "-print0")
+
+	return fmt.Sprintf(
+		"set -e; archive=$(mktemp); cd %s; sudo %s | sudo tar czf \"$archive\" --null -T -; echo \"$archive $(sudo stat -c %%s \"$archive\")\"",
+		shellQuote(remoteDir), strings.Join(findArgs, " "))
+}
+
+func parseRemoteArchiveOutput(output string) (string, int, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("Expected the path and size of the archive but got %q", output)
+	}
+	size, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid archive size in %q: %v", output, err)
+	}
+	return fields[0], size, nil
+}
+
+// extractTarGzE extracts the regular files of the archive into localDir, rejecting paths that would end up outside it
+func extractTarGzE(archive []byte, localDir string) error {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		relativePath := filepath.Clean(header.Name)
+		if filepath.IsAbs(relativePath) || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("Refusing to extract %s outside of %s", header.Name, localDir)
+		}
+
+		destination := filepath.Join(localDir, relativePath)
+		if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(destination, contents, 0644); err != nil {
+			return err
+		}
+	}
+}
+
+// shellQuote quotes the value for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// localExecutor runs commands with the local bash, with sudo as a no-op, to stand in for an instance
+type localExecutor struct {
+	outputLimit int
+	commands    []string
+}
+
+func (executor *localExecutor) RunCommandE(t *testing.T, command string) (string, error) {
+	executor.commands = append(executor.commands, command)
+	output, err := exec.Command("bash", "-c", `sudo() { "$@"; }; `+command).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(output), fmt.Errorf("%q failed: %v. Stderr: %s", command, err, exitErr.Stderr)
+	}
+	return string(output), err
+}
+
+func (executor *localExecutor) OutputLimit() int {
+	return executor.outputLimit
+}
+
+func (executor *localExecutor) String() string {
+	return "localhost"
+}
+
+func TestOfflineDownloadRemoteFiles(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("The archive commands use GNU options")
+	}
+
+	remoteDir, err := ioutil.TempDir("", "remote-exec-remote")
+	require.NoError(t, err)
+	// The parallel subtests only run once this function returned
+	t.Cleanup(func() { os.RemoveAll(remoteDir) })
+
+	// Big enough to need several chunks even when compressed
+	random := make([]byte, 3*REMOTE_DOWNLOAD_CHUNK_BYTES)
+	rand.New(rand.NewSource(1)).Read(random)
+	remoteFiles := map[string]string{
+		"syslog":                 "syslog line",
+		"es-cluster/es.log":      "es log line",
+		"logstash-stdout.log":    string(random),
+		"it's quoted.log":        "not matched",
+		"unrelated/user-data.sh": "not matched either",
+	}
+	for name, contents := range remoteFiles {
+		path := filepath.Join(remoteDir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+
+	testCases := []struct {
+		name        string
+		outputLimit int
+	}{
+		{"unlimited output", 0},
+		{"limited output", SSM_OUTPUT_LIMIT},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			localDir, err := ioutil.TempDir("", "remote-exec-local")
+			require.NoError(t, err)
+			defer os.RemoveAll(localDir)
+
+			executor := &localExecutor{outputLimit: testCase.outputLimit}
+			require.NoError(t, downloadRemoteFilesE(t, executor, remoteDir, []string{"syslog", "es*.log", "logstash*"}, localDir))
+
+			for _, name := range []string{"syslog", "es-cluster/es.log", "logstash-stdout.log"} {
+				contents, err := ioutil.ReadFile(filepath.Join(localDir, name))
+				require.NoError(t, err)
+				assert.Equal(t, remoteFiles[name], string(contents), name)
+			}
+			assert.NoFileExists(t, filepath.Join(localDir, "it's quoted.log"))
+			assert.NoFileExists(t, filepath.Join(localDir, "unrelated", "user-data.sh"))
+
+			// One command creates the archive, one deletes it and the rest fetch it
+			fetches := len(executor.commands) - 2
+			if testCase.outputLimit > 0 {
+				assert.Greater(t, fetches, 1)
+			} else {
+				assert.Equal(t, 1, fetches)
+			}
+
+			// The archive is deleted
+			archivePath := strings.Fields(executor.commands[len(executor.commands)-1])[3]
+			assert.NoFileExists(t, strings.Trim(archivePath, "'"))
+		})
+	}
+}
+
+func TestOfflineExtractTarGzRejectsPathsOutsideDir(t *testing.T) {
+	t.Parallel()
+
+	var archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+	contents := []byte("escaped")
+	require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: "../escaped", Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}))
+	_, err := tarWriter.Write(contents)
+	require.NoError(t, err)
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+
+	localDir, err := ioutil.TempDir("", "remote-exec-local")
+	require.NoError(t, err)
+	defer os.RemoveAll(localDir)
+
+	assert.Error(t, extractTarGzE(archive.Bytes(), filepath.Join(localDir, "logs")))
+	assert.NoFileExists(t, filepath.Join(localDir, "escaped"))
+}
+
+func TestOfflineRemoteExecOptionsExecutor(t *testing.T) {
+	t.Parallel()
+
+	keyPair := &ssh.KeyPair{PublicKey: "public", PrivateKey: "private"}
+	instance := AsgInstance{InstanceId: "i-1", PrivateIp: "10.0.1.5", PublicIp: "203.0.113.5"}
+
+	executor, err := RemoteExecOptions{Transport: REMOTE_EXEC_TRANSPORT_SSM, AwsRegion: "us-east-1"}.executorE(instance)
+	require.NoError(t, err)
+	assert.Equal(t, SsmExecutor{AwsRegion: "us-east-1", InstanceId: "i-1"}, executor)
+	assert.Equal(t, SSM_OUTPUT_LIMIT, executor.OutputLimit())
+
+	sshOptions := RemoteExecOptions{Transport: REMOTE_EXEC_TRANSPORT_SSH, SshUserName: "ec2-user", SshKeyPair: keyPair, Access: InstanceAccess{Mode: INSTANCE_ACCESS_PRIVATE}}
+	executor, err = sshOptions.executorE(instance)
+	require.NoError(t, err)
+	assert.Equal(t, "ec2-user@10.0.1.5", executor.String())
+	assert.Equal(t, 0, executor.OutputLimit())
+
+	_, err = RemoteExecOptions{Transport: REMOTE_EXEC_TRANSPORT_SSH, Access: publicInstanceAccess}.executorE(instance)
+	assert.Error(t, err, "SSH without a key pair")
+
+	_, err = RemoteExecOptions{Transport: "telnet"}.executorE(instance)
+	assert.Error(t, err)
+}
+
+func TestOfflineShellQuote(t *testing.T) {
+	t.Parallel()
+
+	output, err := exec.Command("bash", "-c", "printf %s "+shellQuote("it's $HOME `and` \"more\"")).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "it's $HOME `and` \"more\"", string(output))
+}
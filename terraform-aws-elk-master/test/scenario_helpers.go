@@ -0,0 +1,276 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The folder with a folder of scenario files per test, relative to the test folder
+const SCENARIOS_DIR = "scenarios"
+
+// The test suites that read their test cases from a folder in SCENARIOS_DIR
+const (
+	SCENARIO_SUITE_ELK_END_TO_END    = "elk-end-to-end"
+	SCENARIO_SUITE_ELASTICSEARCH_AWS = "elasticsearch-aws"
+)
+
+// The checkers a scenario can verify the Kibana status with
+const (
+	SCENARIO_CHECKER_HTTP  = "http"
+	SCENARIO_CHECKER_HTTPS = "https"
+)
+
+// The SSL policy of the ALB listeners of the elk-multi-cluster example with SSL
+const ELK_ALB_SSL_POLICY = "ELBSecurityPolicy-2015-05"
+
+// The OsProfile the os of a scenario names
+var scenarioOsProfiles = map[string]OsProfile{
+	ubuntuOsProfile.Name:       ubuntuOsProfile,
+	amazonLinux2OsProfile.Name: amazonLinux2OsProfile,
+}
+
+var scenarioCheckers = map[string]func(t *testing.T, messageToVerify string, queryUrl string, keyStore *keystore, kibanaPass string){
+	SCENARIO_CHECKER_HTTP:  validateGetHttp,
+	SCENARIO_CHECKER_HTTPS: validateGetHttps,
+}
+
+// Scenario is a test case of a suite, read from a JSON file in the folder of the suite in SCENARIOS_DIR
+type Scenario struct {
+	// The name of the subtest
+	Name string `json:"name"`
+	// The name of an OsProfile, e.g. ubuntu
+	Os string `json:"os"`
+	// The suffix of the Packer builders, e.g. ubuntu-20 for elasticsearch-ami-ubuntu-20
+	BuilderSuffix string        `json:"builder_suffix"`
+	Ports         ScenarioPorts `json:"ports"`
+	// Leave out to test without SSL
+	Ssl *ScenarioSsl `json:"ssl"`
+	// How to check the Kibana status: http or https
+	Checker string `json:"checker"`
+	// How long to wait before starting, to stagger the scenarios
+	StartDelaySeconds int `json:"start_delay_seconds"`
+}
+
+type ScenarioPorts struct {
+	Elasticsearch int `json:"elasticsearch"`
+	KibanaUI      int `json:"kibana_ui"`
+}
+
+type ScenarioSsl struct {
+	Keystore ScenarioKeystore `json:"keystore"`
+	// Where each component finds its certificates on the instances. Only the elk-multi-cluster example uses them.
+	Certs ScenarioCerts `json:"certs"`
+}
+
+// ScenarioKeystore is the Java keystore the tests generate and bake into the Elasticsearch AMI
+type ScenarioKeystore struct {
+	File         string `json:"file"`
+	Password     string `json:"password"`
+	CertPassword string `json:"cert_password"`
+	CertAlias    string `json:"cert_alias"`
+}
+
+type ScenarioCerts struct {
+	Logstash   ScenarioCertPaths `json:"logstash"`
+	Kibana     ScenarioCertPaths `json:"kibana"`
+	Filebeat   ScenarioCertPaths `json:"filebeat"`
+	Elastalert ScenarioCertPaths `json:"elastalert"`
+	Collectd   ScenarioCertPaths `json:"collectd"`
+}
+
+// ScenarioCertPaths are the paths of the certificate files of a component. Each component only uses some of them.
+type ScenarioCertPaths struct {
+	CaAuth   string `json:"ca_auth,omitempty"`
+	CertPem  string `json:"cert_pem,omitempty"`
+	CertKey  string `json:"cert_key,omitempty"`
+	KeyP8    string `json:"key_p8,omitempty"`
+	Keystore string `json:"keystore,omitempty"`
+}
+
+// runScenarios runs every scenario of the suite as a parallel subtest
+func runScenarios(t *testing.T, suite string, run func(t *testing.T, scenario Scenario)) {
+	scenarios, err := loadScenariosE(filepath.Join(SCENARIOS_DIR, suite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, scenario := range scenarios {
+		// The following is necessary to make sure scenario's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		scenario := scenario
+
+		t.Run(scenario.Name, func(t *testing.T) {
+			t.Parallel()
+
+			// This is terrible - but attempt to stagger the test cases to
+			// avoid a concurrency issue
+			time.Sleep(time.Duration(scenario.StartDelaySeconds) * time.Second)
+
+			run(t, scenario)
+		})
+	}
+}
+
+// loadScenariosE reads the *.json scenario files in the folder, sorted by file name. It rejects fields it doesn't know,
+// so a typo in a file fails the test instead of silently testing something else.
+func loadScenariosE(dir string) ([]Scenario, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("Found no scenario files in %s", dir)
+	}
+	sort.Strings(paths)
+
+	scenarios := []Scenario{}
+	names := map[string]string{}
+	for _, path := range paths {
+		scenario, err := loadScenarioE(path)
+		if err != nil {
+			return nil, err
+		}
+		if otherPath, ok := names[scenario.Name]; ok {
+			return nil, fmt.Errorf("Scenarios %s and %s have the same name %s", otherPath, path, scenario.Name)
+		}
+		names[scenario.Name] = path
+		scenarios = append(scenarios, scenario)
+	}
+	return scenarios, nil
+}
+
+func loadScenarioE(path string) (Scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	defer file.Close()
+
+	var scenario Scenario
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&scenario); err != nil {
+		return Scenario{}, fmt.Errorf("Failed to parse scenario %s: %v", path, err)
+	}
+	if err := scenario.validate(); err != nil {
+		return Scenario{}, fmt.Errorf("Invalid scenario %s: %v", path, err)
+	}
+	return scenario, nil
+}
+
+func (scenario Scenario) validate() error {
+	if scenario.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if _, ok := scenarioOsProfiles[scenario.Os]; !ok {
+		return fmt.Errorf("unknown os %q", scenario.Os)
+	}
+	if scenario.BuilderSuffix == "" {
+		return fmt.Errorf("builder_suffix is required")
+	}
+	if scenario.Ports.Elasticsearch == 0 {
+		return fmt.Errorf("ports.elasticsearch is required")
+	}
+	if _, ok := scenarioCheckers[scenario.Checker]; scenario.Checker != "" && !ok {
+		return fmt.Errorf("unknown checker %q", scenario.Checker)
+	}
+	if scenario.Ssl != nil && scenario.Ssl.Keystore.File == "" {
+		return fmt.Errorf("ssl.keystore.file is required")
+	}
+	return nil
+}
+
+func (scenario Scenario) useSsl() bool {
+	return scenario.Ssl != nil
+}
+
+// protocol returns the protocol Elasticsearch and Kibana serve on
+func (scenario Scenario) protocol() string {
+	if scenario.useSsl() {
+		return "https"
+	}
+	return "http"
+}
+
+func (scenario Scenario) osProfile() OsProfile {
+	return scenarioOsProfiles[scenario.Os]
+}
+
+func (scenario Scenario) checker() func(t *testing.T, messageToVerify string, queryUrl string, keyStore *keystore, kibanaPass string) {
+	return scenarioCheckers[scenario.Checker]
+}
+
+// packerInfo returns the builder of the component for the OS of the scenario in the template
+func (scenario Scenario) packerInfo(component string, templatePath string) PackerInfo {
+	return PackerInfo{
+		builderName:  fmt.Sprintf("%s-ami-%s", component, scenario.BuilderSuffix),
+		templatePath: templatePath,
+	}
+}
+
+// keystoreTerraformVars returns the Terraform vars of the Java keystore of Elasticsearch, which the examples only take
+// with SSL
+func (scenario Scenario) keystoreTerraformVars() map[string]interface{} {
+	if !scenario.useSsl() {
+		return map[string]interface{}{}
+	}
+	javaKeystore := scenario.Ssl.Keystore
+	return map[string]interface{}{
+		"use_ssl":                            strconv.FormatBool(true),
+		"java_keystore_filename":             javaKeystore.File,
+		"java_keystore_password":             javaKeystore.Password,
+		"java_keystore_certificate_password": javaKeystore.CertPassword,
+		"java_keystore_cert_alias":           javaKeystore.CertAlias,
+	}
+}
+
+// elkTerraformVars returns the Terraform vars of the elk-multi-cluster example that depend on the scenario. The
+// secrets hold the passwords Logstash and Kibana log in to Elasticsearch with, which only SSL turns on.
+func (scenario Scenario) elkTerraformVars(kibanaPassSecretsManagerARN string, logstashPassSecretsManagerARN string) map[string]interface{} {
+	vars := scenario.keystoreTerraformVars()
+	vars["kibana_ui_port"] = scenario.Ports.KibanaUI
+	vars["use_ssl"] = strconv.FormatBool(scenario.useSsl())
+	vars["alb_target_group_protocol"] = "HTTP"
+	if !scenario.useSsl() {
+		return vars
+	}
+
+	certs := scenario.Ssl.Certs
+	vars["alb_target_group_protocol"] = "HTTPS"
+	vars["ssl_policy"] = ELK_ALB_SSL_POLICY
+
+	vars["logstash_keystore_path"] = certs.Logstash.Keystore
+	vars["logstash_ca_auth_path"] = certs.Logstash.CaAuth
+	vars["logstash_cert_pem_path"] = certs.Logstash.CertPem
+	vars["logstash_key_p8_path"] = certs.Logstash.KeyP8
+	vars["elasticsearch_password_for_logstash_secrets_manager_arn"] = logstashPassSecretsManagerARN
+
+	vars["kibana_ca_auth_path"] = certs.Kibana.CaAuth
+	vars["kibana_cert_pem_path"] = certs.Kibana.CertPem
+	vars["kibana_cert_key_path"] = certs.Kibana.CertKey
+	vars["elasticsearch_password_for_kibana_secrets_manager_arn"] = kibanaPassSecretsManagerARN
+
+	vars["filebeat_ca_auth_path"] = certs.Filebeat.CaAuth
+	vars["filebeat_cert_pem_path"] = certs.Filebeat.CertPem
+	vars["filebeat_cert_key_path"] = certs.Filebeat.CertKey
+
+	vars["elastalert_ca_auth_path"] = certs.Elastalert.CaAuth
+	vars["elastalert_cert_pem_path"] = certs.Elastalert.CertPem
+	vars["elastalert_cert_key_path"] = certs.Elastalert.CertKey
+
+	vars["collectd_ca_path"] = certs.Collectd.CaAuth
+	return vars
+}
+
+// mergeTerraformVars copies the overrides into the vars, replacing any that are already set
+func mergeTerraformVars(vars map[string]interface{}, overrides map[string]interface{}) {
+	for name, value := range overrides {
+		vars[name] = value
+	}
+}
@@ -0,0 +1,124 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineLoadRepoScenarios(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		suite         string
+		expectedNames []string
+	}{
+		{SCENARIO_SUITE_ELK_END_TO_END, []string{"TestElasticsearchUbuntu1804", "TestElasticsearchUbuntu2004SSL", "TestElasticsearchUbuntu2004"}},
+		{SCENARIO_SUITE_ELASTICSEARCH_AWS, []string{"TestElasticsearchUbuntu1804", "TestElasticsearchSSLUbuntu2004", "TestElasticsearchUbuntu2004"}},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.suite, func(t *testing.T) {
+			t.Parallel()
+
+			scenarios, err := loadScenariosE(filepath.Join(SCENARIOS_DIR, testCase.suite))
+			require.NoError(t, err)
+
+			names := []string{}
+			for _, scenario := range scenarios {
+				names = append(names, scenario.Name)
+			}
+			assert.Equal(t, testCase.expectedNames, names)
+		})
+	}
+}
+
+func TestOfflineElkScenarioTerraformVars(t *testing.T) {
+	t.Parallel()
+
+	scenarios, err := loadScenariosE(filepath.Join(SCENARIOS_DIR, SCENARIO_SUITE_ELK_END_TO_END))
+	require.NoError(t, err)
+	scenariosByName := map[string]Scenario{}
+	for _, scenario := range scenarios {
+		scenariosByName[scenario.Name] = scenario
+	}
+
+	plain := scenariosByName["TestElasticsearchUbuntu2004"]
+	assert.Equal(t, "http", plain.protocol())
+	assert.Equal(t, ubuntuOsProfile, plain.osProfile())
+	assert.NotNil(t, plain.checker())
+	assert.Equal(t, PackerInfo{templatePath: "kibana.json", builderName: "kibana-ami-ubuntu-20"}, plain.packerInfo("kibana", "kibana.json"))
+	assert.Equal(t, map[string]interface{}{
+		"kibana_ui_port":            5601,
+		"use_ssl":                   "false",
+		"alb_target_group_protocol": "HTTP",
+	}, plain.elkTerraformVars("kibana-arn", "logstash-arn"))
+	assert.Empty(t, plain.keystoreTerraformVars())
+
+	ssl := scenariosByName["TestElasticsearchUbuntu2004SSL"]
+	assert.Equal(t, "https", ssl.protocol())
+	vars := ssl.elkTerraformVars("kibana-arn", "logstash-arn")
+	assert.Equal(t, "true", vars["use_ssl"])
+	assert.Equal(t, "HTTPS", vars["alb_target_group_protocol"])
+	assert.Equal(t, ELK_ALB_SSL_POLICY, vars["ssl_policy"])
+	assert.Equal(t, "elk.server.keystore.jks", vars["java_keystore_filename"])
+	assert.Equal(t, "/etc/logstash/localhost.p8", vars["logstash_key_p8_path"])
+	assert.Equal(t, "/etc/kibana/localhost.key", vars["kibana_cert_key_path"])
+	assert.Equal(t, "/etc/collectd/caFile", vars["collectd_ca_path"])
+	assert.Equal(t, "kibana-arn", vars["elasticsearch_password_for_kibana_secrets_manager_arn"])
+	assert.Equal(t, "logstash-arn", vars["elasticsearch_password_for_logstash_secrets_manager_arn"])
+	for name, value := range vars {
+		assert.NotEmpty(t, value, "Terraform var %s", name)
+	}
+}
+
+func TestOfflineLoadInvalidScenarios(t *testing.T) {
+	t.Parallel()
+
+	valid := `{"name": "TestFoo", "os": "ubuntu", "builder_suffix": "ubuntu-20", "ports": {"elasticsearch": 9200}}`
+
+	testCases := []struct {
+		name          string
+		files         map[string]string
+		expectedError string
+	}{
+		{"no files", map[string]string{}, "Found no scenario files"},
+		{"unknown field", map[string]string{"foo.json": `{"name": "TestFoo", "os": "ubuntu", "builder_suffix": "ubuntu-20", "ports": {"elasticsearch": 9200}, "use_ssl": true}`}, `unknown field "use_ssl"`},
+		{"unknown os", map[string]string{"foo.json": `{"name": "TestFoo", "os": "windows", "builder_suffix": "windows", "ports": {"elasticsearch": 9200}}`}, `unknown os "windows"`},
+		{"unknown checker", map[string]string{"foo.json": `{"name": "TestFoo", "os": "ubuntu", "builder_suffix": "ubuntu-20", "ports": {"elasticsearch": 9200}, "checker": "ftp"}`}, `unknown checker "ftp"`},
+		{"no elasticsearch port", map[string]string{"foo.json": `{"name": "TestFoo", "os": "ubuntu", "builder_suffix": "ubuntu-20"}`}, "ports.elasticsearch is required"},
+		{"ssl without keystore", map[string]string{"foo.json": `{"name": "TestFoo", "os": "ubuntu", "builder_suffix": "ubuntu-20", "ports": {"elasticsearch": 9200}, "ssl": {}}`}, "ssl.keystore.file is required"},
+		{"duplicate names", map[string]string{"bar.json": valid, "foo.json": valid}, "have the same name TestFoo"},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir, err := ioutil.TempDir("", "scenarios")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			for name, contents := range testCase.files {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+			}
+
+			_, err = loadScenariosE(dir)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), testCase.expectedError)
+			}
+		})
+	}
+}
@@ -5,10 +5,10 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
 	"testing"
-
-	"github.com/gruntwork-io/terratest/modules/shell"
 )
 
 // Represents a Java KeyStore
@@ -21,196 +21,104 @@ type keystore struct {
 	KeyStorePassword   string
 	TrustStorePath     string
 	TrustStorePassword string
+	// The name to verify server certificates against when it differs from the host being connected to, e.g. when
+	// connecting to a load balancer by its AWS DNS name. Defaults to the host.
+	ServerName string
 }
 
-func createKeyStoreFiles(t *testing.T, name string, repoPath string, amiDir string, domain string) *keystore {
+// The alias of the private key entry in the generated Java KeyStores
+const KEYSTORE_CERT_ALIAS = "localhost"
+
+// createKeyStoreFiles generates a CA and a certificate for domain and 127.0.0.1 in Go, and writes them to the ssl folder
+// of amiDir as PEM files, a PKCS#8 key, a Java KeyStore and a Java TrustStore
+func createKeyStoreFiles(t *testing.T, name string, amiDir string, domain string) *keystore {
 	sslBasePath := filepath.Join(amiDir, "ssl")
-	keyStoreFile := filepath.Join(sslBasePath, fmt.Sprintf("%s.server.keystore.jks", name))
-	trustStoreFile := filepath.Join(sslBasePath, fmt.Sprintf("%s.server.truststore.jks", name))
-	certFile := filepath.Join(sslBasePath, "localhost.pem")
-	keyFile := filepath.Join(sslBasePath, "localhost.key")
-	caFile := filepath.Join(sslBasePath, "caFile")
 	password := "password"
 
-	generateKeyStores(t, repoPath, password, keyStoreFile, trustStoreFile, certFile, keyFile, caFile, domain)
-
-	keystore := &keystore{
-		CertFile:           certFile,
-		KeyFile:            keyFile,
-		CaFile:             caFile,
-		KeyStorePath:       keyStoreFile,
+	keyStore := &keystore{
+		CertFile:           filepath.Join(sslBasePath, fmt.Sprintf("%s.pem", KEYSTORE_CERT_ALIAS)),
+		KeyFile:            filepath.Join(sslBasePath, fmt.Sprintf("%s.key", KEYSTORE_CERT_ALIAS)),
+		P8KeyFile:          filepath.Join(sslBasePath, fmt.Sprintf("%s.p8", KEYSTORE_CERT_ALIAS)),
+		CaFile:             filepath.Join(sslBasePath, "caFile"),
+		KeyStorePath:       filepath.Join(sslBasePath, fmt.Sprintf("%s.server.keystore.jks", name)),
 		KeyStorePassword:   password,
-		TrustStorePath:     trustStoreFile,
+		TrustStorePath:     filepath.Join(sslBasePath, fmt.Sprintf("%s.server.truststore.jks", name)),
 		TrustStorePassword: password,
 	}
 
-	return keystore
-}
-
-func generateKeyStores(t *testing.T, repoCopyPath string, password string, keyStoreFile string, trustStoreFile string, certFile string, keyFile string, caFile string, domain string) {
-	cmdDeletePrevious := shell.Command{
-		Command: "rm",
-		Args: []string{
-			"-rf",
-			keyStoreFile,
-			trustStoreFile,
-			certFile,
-			caFile,
-		},
+	if err := os.MkdirAll(sslBasePath, 0755); err != nil {
+		t.Fatalf("Failed to create folder %s: %v", sslBasePath, err)
 	}
 
-	shell.RunCommand(t, cmdDeletePrevious)
-
-	cmdGenerateKeyStore := shell.Command{
-		Command: filepath.Join(repoCopyPath, "modules", "generate-key-stores", "generate-key-stores.sh"),
-		Args: []string{
-			"--key-store-path", keyStoreFile,
-			"--trust-store-path", trustStoreFile,
-			"--cert-path", certFile,
-			"--ca-path", caFile,
-			"--org", "Gruntwork",
-			"--org-unit", "Engineering",
-			"--city", "Phoenix",
-			"--state", "AZ",
-			"--country", "US",
-			"--cert-common-name", domain,
-			"--domain", domain,
-			"--ip", "127.0.0.1",
-			"--out-cert-key-path", keyFile,
-		},
-		Env: map[string]string{
-			"KEY_STORE_PASSWORD":   password,
-			"TRUST_STORE_PASSWORD": password,
-		},
+	if err := generateKeyStores(keyStore, domain); err != nil {
+		t.Fatalf("Failed to generate key stores in %s: %v", sslBasePath, err)
 	}
 
-	shell.RunCommand(t, cmdGenerateKeyStore)
+	return keyStore
 }
 
-func (k *keystore) getTlsConfig(t *testing.T) *tls.Config {
-	caCert, err := ioutil.ReadFile(k.CaFile)
+func generateKeyStores(keyStore *keystore, domain string) error {
+	ca, err := newCertificateAuthorityE(CertificateOptions{CommonName: fmt.Sprintf("%s CA", domain)})
 	if err != nil {
-		t.Fatalf("Failed to read CA file %s due to error: %v", k.CaFile, err)
+		return err
 	}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-
-	return &tls.Config{
-		RootCAs:            caCertPool,
-		InsecureSkipVerify: true,
+	cert, err := ca.issueCertificateE(CertificateOptions{
+		CommonName:  domain,
+		DnsNames:    []string{domain},
+		IpAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	})
+	if err != nil {
+		return err
 	}
-}
 
-func downloadGenerateKeystoreScript(t *testing.T, downloadLocation string) {
-	cmdClearDestination := shell.Command{
-		Command: "rm",
-		Args: []string{
-			"-rf",
-			downloadLocation,
-		},
+	if err := writeCertificatesPemE(keyStore.CaFile, ca.Certificate); err != nil {
+		return err
 	}
-	shell.RunCommand(t, cmdClearDestination)
-
-	cmdClone := shell.Command{
-		Command: "git",
-		Args: []string{
-			"clone",
-			// Uncomment the following lines in order to force using
-			// a specific branch.
-			//"--single-branch",
-			//"-b", "<__BRANCH_NAME_HERE__>",
-			"https://github.com/gruntwork-io/package-kafka.git",
-			downloadLocation,
-		},
+	if err := writeCertificatesPemE(keyStore.CertFile, cert.Certificate); err != nil {
+		return err
+	}
+	if err := writePrivateKeyPemE(keyStore.KeyFile, cert.PrivateKey); err != nil {
+		return err
+	}
+	if err := writePkcs8PrivateKeyPemE(keyStore.P8KeyFile, cert.PrivateKey); err != nil {
+		return err
+	}
+
+	chain := append([]*x509.Certificate{cert.Certificate}, cert.Chain...)
+	if err := writeJavaKeyStoreE(keyStore.KeyStorePath, keyStore.KeyStorePassword, KEYSTORE_CERT_ALIAS, cert.PrivateKey, chain); err != nil {
+		return err
 	}
 
-	shell.RunCommand(t, cmdClone)
+	return writeJavaTrustStoreE(keyStore.TrustStorePath, keyStore.TrustStorePassword, map[string]*x509.Certificate{"caroot": ca.Certificate})
 }
 
-func exportCertAndKeyFromJks(t *testing.T, tlsCert *keystore, certAlias string, outputPath string, outputCertKey string) (string, string, string) {
-	//https://serverfault.com/questions/715827/how-to-generate-key-and-crt-file-from-jks-file-for-httpd-apache-server
-
-	storePass := "password"
-	//keytool -exportcert -alias localhost -keystore elk.server.keystore.jks -rfc -file cert.pem
-	certFileName := fmt.Sprintf("%s.pem", certAlias)
-	certFilePath := fmt.Sprintf("%s/%s", outputPath, certFileName)
-	cmdExportCert := shell.Command{
-		Command: "keytool",
-		Args: []string{
-			"-exportcert",
-			"-alias",
-			certAlias,
-			"-keystore",
-			tlsCert.KeyStorePath,
-			"-storepass",
-			storePass,
-			"-rfc",
-			"-file",
-			certFilePath,
-		},
+func (k *keystore) getTlsConfig(t *testing.T) *tls.Config {
+	tlsConfig, err := k.getTlsConfigE()
+	if err != nil {
+		t.Fatal(err)
 	}
+	return tlsConfig
+}
 
-	shell.RunCommand(t, cmdExportCert)
-
-	//keytool -importkeystore -srckeystore mycert.jks -destkeystore keystore.p12 -deststoretype PKCS12
-	cmdExportKey := shell.Command{
-		Command: "keytool",
-		Args: []string{
-			"-importkeystore",
-			"-srckeystore",
-			tlsCert.KeyStorePath,
-			"-destkeystore",
-			outputCertKey,
-			"-srcstorepass",
-			storePass,
-			"-deststorepass",
-			storePass,
-			"-deststoretype",
-			"PKCS12",
-		},
+// getTlsConfigE returns a TLS config that trusts the keystore's CA in addition to the system roots, as the ALB serves
+// an ACM certificate on some listeners and the keystore's certificate on others
+func (k *keystore) getTlsConfigE() (*tls.Config, error) {
+	caCert, err := ioutil.ReadFile(k.CaFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA file %s due to error: %v", k.CaFile, err)
 	}
 
-	shell.RunCommand(t, cmdExportKey)
-
-	//convert PKCS12 key to unencrypted PEM:
-	//openssl pkcs12 -in keystore.p12  -nodes -nocerts -out mydomain.key
-	keyFileName := fmt.Sprintf("%s.key", certAlias)
-	keyFilePath := fmt.Sprintf("%s/%s", outputPath, keyFileName)
-	cmdConvertKey := shell.Command{
-		Command: "openssl",
-		Args: []string{
-			"pkcs12",
-			"-in",
-			outputCertKey,
-			"-nodes",
-			"-nocerts",
-			"-password",
-			fmt.Sprintf("pass:%s", storePass),
-			"-out",
-			keyFilePath,
-		},
+	caCertPool, err := x509.SystemCertPool()
+	if err != nil {
+		caCertPool = x509.NewCertPool()
 	}
-	shell.RunCommand(t, cmdConvertKey)
-
-	//convert PKCS12 key to unencrypted PEM:
-	//openssl pkcs12 -in keystore.p12  -nodes -nocerts -out mydomain.key
-	p8KeyFileName := fmt.Sprintf("%s.p8", certAlias)
-	p8KeyFilePath := fmt.Sprintf("%s/%s", outputPath, p8KeyFileName)
-	cmdConvertKeyP8 := shell.Command{
-		Command: "openssl",
-		Args: []string{
-			"pkcs8",
-			"-in",
-			keyFilePath,
-			"-topk8",
-			"-nocrypt",
-			"-out",
-			p8KeyFilePath,
-		},
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No PEM certificates found in CA file %s", k.CaFile)
 	}
-	shell.RunCommand(t, cmdConvertKeyP8)
 
-	shell.RunCommand(t, shell.Command{Command: "rm", Args: []string{outputCertKey}})
-	return certFilePath, keyFilePath, p8KeyFilePath
+	return &tls.Config{
+		RootCAs:    caCertPool,
+		ServerName: k.ServerName,
+	}, nil
 }
@@ -1,115 +1,160 @@
 package test
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
-	"os/user"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
-
-	"github.com/gruntwork-io/terratest/modules/retry"
-	"github.com/gruntwork-io/terratest/modules/terraform"
-	test_structure "github.com/gruntwork-io/terratest/modules/test-structure"
 )
 
+// TlsCert points to the PEM files of a certificate generated by generateSelfSignedTlsCert
 type TlsCert struct {
+	// The root CA certificate
 	CAPublicKeyPath string
-	PublicKeyPath   string
-	PrivateKeyPath  string
+	// The certificate, followed by the intermediate CA certificate if there is one
+	PublicKeyPath string
+	// The private key in the traditional OpenSSL format
+	PrivateKeyPath string
+	// The private key as PKCS#8, which the Logstash beats input requires
+	Pkcs8PrivateKeyPath string
 }
 
-const PRIVATE_TLS_CERT_PATH = "modules/private-tls-cert"
+// TlsCertOptions configures the certificate generated by generateSelfSignedTlsCert
+type TlsCertOptions struct {
+	// Defaults to the first DNS name
+	CommonName string
+	// Defaults to localhost
+	DnsNames    []string
+	IpAddresses []string
+	// Defaults to DEFAULT_CERTIFICATE_VALIDITY
+	Validity time.Duration
+	// One of KEY_ALGORITHM_RSA or KEY_ALGORITHM_ECDSA. Defaults to KEY_ALGORITHM_RSA. Used for the CAs too.
+	KeyAlgorithm string
+	// If true, the certificate is signed by an intermediate CA, which in turn is signed by the root CA
+	UseIntermediateCa bool
+}
 
-const REPO_ROOT = "../"
+// generateSelfSignedTlsCert generates a root CA and a certificate signed by it, and writes them to outputDir
+func generateSelfSignedTlsCert(t *testing.T, outputDir string, options TlsCertOptions) TlsCert {
+	tlsCert, err := generateSelfSignedTlsCertE(outputDir, options)
+	if err != nil {
+		t.Fatalf("Failed to generate TLS certificate in %s: %v", outputDir, err)
+	}
+	return tlsCert
+}
 
-const VAR_CA_PUBLIC_KEY_FILE_PATH = "ca_public_key_file_path"
-const VAR_PUBLIC_KEY_FILE_PATH = "public_key_file_path"
-const VAR_PRIVATE_KEY_FILE_PATH = "private_key_file_path"
-const VAR_OWNER = "owner"
-const VAR_ORGANIZATION_NAME = "organization_name"
-const VAR_CA_COMMON_NAME = "ca_common_name"
-const VAR_COMMON_NAME = "common_name"
-const VAR_DNS_NAMES = "dns_names"
-const VAR_IP_ADDRESSES = "ip_addresses"
-const VAR_VALIDITY_PERIOD_HOURS = "validity_period_hours"
+func generateSelfSignedTlsCertE(outputDir string, options TlsCertOptions) (TlsCert, error) {
+	tlsCert := TlsCert{
+		CAPublicKeyPath:     filepath.Join(outputDir, "ca.crt"),
+		PublicKeyPath:       filepath.Join(outputDir, "tls.crt"),
+		PrivateKeyPath:      filepath.Join(outputDir, "tls.key"),
+		Pkcs8PrivateKeyPath: filepath.Join(outputDir, "tls.p8"),
+	}
 
-// Use the private-tls-cert module to generate a self-signed TLS certificate
-func generateSelfSignedTlsCert(t *testing.T) TlsCert {
-	currentUser, err := user.Current()
-	if err != nil {
-		t.Fatalf("Couldn't get current OS user: %v", err)
+	dnsNames := options.DnsNames
+	if len(dnsNames) == 0 {
+		dnsNames = []string{"localhost"}
 	}
 
-	caPublicKeyFilePath, err := ioutil.TempFile("", "ca-public-key")
-	if err != nil {
-		t.Fatalf("Couldn't create temp file: %v", err)
+	commonName := options.CommonName
+	if commonName == "" {
+		commonName = dnsNames[0]
 	}
 
-	publicKeyFilePath, err := ioutil.TempFile("", "tls-public-key")
+	ipAddresses := []net.IP{}
+	for _, ipAddress := range options.IpAddresses {
+		ip := net.ParseIP(ipAddress)
+		if ip == nil {
+			return tlsCert, fmt.Errorf("Invalid IP address %s", ipAddress)
+		}
+		ipAddresses = append(ipAddresses, ip)
+	}
+
+	rootCa, err := newCertificateAuthorityE(CertificateOptions{
+		CommonName:   "ELK Module Test CA",
+		Validity:     options.Validity,
+		KeyAlgorithm: options.KeyAlgorithm,
+	})
 	if err != nil {
-		t.Fatalf("Couldn't create temp file: %v", err)
+		return tlsCert, err
+	}
+
+	issuingCa := rootCa
+	if options.UseIntermediateCa {
+		issuingCa, err = rootCa.issueIntermediateCertificateAuthorityE(CertificateOptions{
+			CommonName:   "ELK Module Test Intermediate CA",
+			Validity:     options.Validity,
+			KeyAlgorithm: options.KeyAlgorithm,
+		})
+		if err != nil {
+			return tlsCert, err
+		}
 	}
 
-	privateKeyFilePath, err := ioutil.TempFile("", "tls-private-key")
+	cert, err := issuingCa.issueCertificateE(CertificateOptions{
+		CommonName:   commonName,
+		DnsNames:     dnsNames,
+		IpAddresses:  ipAddresses,
+		Validity:     options.Validity,
+		KeyAlgorithm: options.KeyAlgorithm,
+	})
 	if err != nil {
-		t.Fatalf("Couldn't create temp file: %v", err)
+		return tlsCert, err
 	}
 
-	examplesDir := test_structure.CopyTerraformFolderToTemp(t, REPO_ROOT, PRIVATE_TLS_CERT_PATH)
-
-	terraformOptions := &terraform.Options{
-		TerraformDir: examplesDir,
-		Vars: map[string]interface{}{
-			VAR_CA_PUBLIC_KEY_FILE_PATH: caPublicKeyFilePath.Name(),
-			VAR_PUBLIC_KEY_FILE_PATH:    publicKeyFilePath.Name(),
-			VAR_PRIVATE_KEY_FILE_PATH:   privateKeyFilePath.Name(),
-			VAR_OWNER:                   currentUser.Username,
-			VAR_ORGANIZATION_NAME:       "Gruntwork",
-			VAR_CA_COMMON_NAME:          "Vault Module Test CA",
-			VAR_COMMON_NAME:             "Vault Module Test",
-			VAR_DNS_NAMES:               []string{"vault.service.consul"},
-			VAR_IP_ADDRESSES:            []string{"127.0.0.1"},
-			VAR_VALIDITY_PERIOD_HOURS:   1000,
-		},
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return tlsCert, err
 	}
 
-	defer terraform.Destroy(t, terraformOptions)
+	// Servers need to send the intermediate CA along with their certificate, but clients should only trust the root
+	intermediates := cert.Chain[:len(cert.Chain)-1]
+	if err := writeCertificatesPemE(tlsCert.PublicKeyPath, append([]*x509.Certificate{cert.Certificate}, intermediates...)...); err != nil {
+		return tlsCert, err
+	}
+	if err := writeCertificatesPemE(tlsCert.CAPublicKeyPath, rootCa.Certificate); err != nil {
+		return tlsCert, err
+	}
+	if err := writePrivateKeyPemE(tlsCert.PrivateKeyPath, cert.PrivateKey); err != nil {
+		return tlsCert, err
+	}
+	if err := writePkcs8PrivateKeyPemE(tlsCert.Pkcs8PrivateKeyPath, cert.PrivateKey); err != nil {
+		return tlsCert, err
+	}
 
-	terraform.InitAndApply(t, terraformOptions)
+	return tlsCert, nil
+}
 
-	return TlsCert{
-		CAPublicKeyPath: caPublicKeyFilePath.Name(),
-		PublicKeyPath:   publicKeyFilePath.Name(),
-		PrivateKeyPath:  privateKeyFilePath.Name(),
+// toKeyStore returns the PEM files of the certificate as a keystore, so that it can be used with the Elasticsearch,
+// Kibana and Logstash TLS checks. The Java KeyStore fields are left empty.
+func (tlsCert TlsCert) toKeyStore() *keystore {
+	return &keystore{
+		CertFile:  tlsCert.PublicKeyPath,
+		KeyFile:   tlsCert.PrivateKeyPath,
+		P8KeyFile: tlsCert.Pkcs8PrivateKeyPath,
+		CaFile:    tlsCert.CAPublicKeyPath,
 	}
 }
 
 func validateGetHttps(t *testing.T, messageToVerify string, queryUrl string, keyStore *keystore, kibanaPass string) {
-	maxRetries := 180
-	sleepBetweenRetries := 5 * time.Second
-	_, err := retry.DoWithRetryE(t, "HTTPS GET", maxRetries, sleepBetweenRetries, func() (string, error) {
-		caCert, err := ioutil.ReadFile(keyStore.CaFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-
-		client := &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: keyStore.getTlsConfig(t),
-			},
-		}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: keyStore.getTlsConfig(t),
+		},
+		Timeout: 30 * time.Second,
+	}
 
-		req, err := http.NewRequest("GET", queryUrl, nil)
+	waitFor(t, elasticsearchWaitBudget, fmt.Sprintf("HTTPS GET %s", queryUrl), func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", queryUrl, nil)
 		if err != nil {
-			return "", err
+			return err
 		}
 
 		// Add basic auth info, which is required to access ES when we introduce readonlyrest
@@ -121,26 +166,21 @@ func validateGetHttps(t *testing.T, messageToVerify string, queryUrl string, key
 
 		resp, err := client.Do(req)
 		if err != nil {
-			return "", err
+			return err
 		}
+		defer resp.Body.Close()
 
 		htmlData, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			fmt.Println(err)
-			return "", err
+			return err
 		}
 
 		htmlBody := string(htmlData)
 
 		if !strings.Contains(htmlBody, messageToVerify) {
-			return "", errors.New(fmt.Sprintf("Resulting data: [ \n%s\n ] from URL %s did not contain verificationText: %s", htmlBody, queryUrl, messageToVerify))
+			return fmt.Errorf("Resulting data: [ \n%s\n ] from URL %s did not contain verificationText: %s", htmlBody, queryUrl, messageToVerify)
 		}
 
-		return htmlBody, nil
-
+		return nil
 	})
-
-	if err != nil {
-		t.Fatalf("Error: %s", err.Error())
-	}
 }
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineGenerateSelfSignedTlsCert(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name              string
+		keyAlgorithm      string
+		useIntermediateCa bool
+	}{
+		{"RSA", KEY_ALGORITHM_RSA, false},
+		{"ECDSA", KEY_ALGORITHM_ECDSA, false},
+		{"RSAWithIntermediateCa", KEY_ALGORITHM_RSA, true},
+		{"ECDSAWithIntermediateCa", KEY_ALGORITHM_ECDSA, true},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			outputDir, err := ioutil.TempDir("", "tls-cert-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(outputDir)
+
+			tlsCert := generateSelfSignedTlsCert(t, outputDir, TlsCertOptions{
+				DnsNames:          []string{"elk.test.gruntwork.in"},
+				IpAddresses:       []string{"127.0.0.1"},
+				Validity:          48 * time.Hour,
+				KeyAlgorithm:      testCase.keyAlgorithm,
+				UseIntermediateCa: testCase.useIntermediateCa,
+			})
+
+			keyPair, err := tls.LoadX509KeyPair(tlsCert.PublicKeyPath, tlsCert.PrivateKeyPath)
+			require.NoError(t, err)
+			_, err = tls.LoadX509KeyPair(tlsCert.PublicKeyPath, tlsCert.Pkcs8PrivateKeyPath)
+			require.NoError(t, err)
+
+			switch testCase.keyAlgorithm {
+			case KEY_ALGORITHM_RSA:
+				assert.IsType(t, &rsa.PrivateKey{}, keyPair.PrivateKey)
+			case KEY_ALGORITHM_ECDSA:
+				assert.IsType(t, &ecdsa.PrivateKey{}, keyPair.PrivateKey)
+			}
+
+			expectedChainLength := 1
+			if testCase.useIntermediateCa {
+				expectedChainLength = 2
+			}
+			require.Len(t, keyPair.Certificate, expectedChainLength)
+
+			leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+			require.NoError(t, err)
+			assert.Equal(t, "elk.test.gruntwork.in", leaf.Subject.CommonName)
+			assert.WithinDuration(t, time.Now().Add(47*time.Hour), leaf.NotAfter, time.Minute)
+
+			intermediates := x509.NewCertPool()
+			for _, der := range keyPair.Certificate[1:] {
+				intermediate, err := x509.ParseCertificate(der)
+				require.NoError(t, err)
+				intermediates.AddCert(intermediate)
+			}
+
+			roots := x509.NewCertPool()
+			require.True(t, roots.AppendCertsFromPEM(mustReadFile(t, tlsCert.CAPublicKeyPath)))
+
+			for _, name := range []string{"elk.test.gruntwork.in", "127.0.0.1"} {
+				_, err = leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: intermediates})
+				assert.NoError(t, err, "Certificate should be valid for %s", name)
+			}
+		})
+	}
+}
+
+func TestOfflineFakeElasticsearchWithTlsCert(t *testing.T) {
+	t.Parallel()
+
+	outputDir, err := ioutil.TempDir("", "tls-cert-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(outputDir)
+
+	tlsCert := generateSelfSignedTlsCert(t, outputDir, TlsCertOptions{
+		IpAddresses:       []string{"127.0.0.1"},
+		KeyAlgorithm:      KEY_ALGORITHM_ECDSA,
+		UseIntermediateCa: true,
+	})
+
+	server := startFakeElasticsearchTLS(t, defaultFakeElasticsearchState(), tlsCert.toKeyStore())
+	defer server.Close()
+
+	checkElasticsearchRunning(t, "mock-elasticsearch-server", server.URL, tlsCert.toKeyStore(), "")
+}
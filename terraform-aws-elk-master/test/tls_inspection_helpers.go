@@ -0,0 +1,376 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+)
+
+// Fail the inspection if the certificate expires sooner than this, so a test run doesn't pass with a certificate that
+// is about to break the deployment
+const DEFAULT_MIN_CERTIFICATE_REMAINING_VALIDITY = 24 * time.Hour
+
+// RSA keys shorter than this are rejected by the inspection
+const DEFAULT_MIN_RSA_KEY_BITS = 2048
+
+// AlbSslPolicy describes which protocol versions and cipher suites (by IANA name) a predefined ALB security policy
+// allows. See https://docs.aws.amazon.com/elasticloadbalancing/latest/application/create-https-listener.html#describe-ssl-policies
+type AlbSslPolicy struct {
+	MinVersion   uint16
+	CipherSuites []string
+}
+
+var albDefaultCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	"TLS_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_RSA_WITH_AES_128_CBC_SHA256",
+	"TLS_RSA_WITH_AES_128_CBC_SHA",
+	"TLS_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_RSA_WITH_AES_256_CBC_SHA256",
+	"TLS_RSA_WITH_AES_256_CBC_SHA",
+}
+
+// The ALB security policies the examples and tests use
+var albSslPolicies = map[string]AlbSslPolicy{
+	// On ALBs, the 2015-05 policy is identical to the 2016-08 one
+	"ELBSecurityPolicy-2015-05":             {MinVersion: tls.VersionTLS10, CipherSuites: albDefaultCipherSuites},
+	"ELBSecurityPolicy-2016-08":             {MinVersion: tls.VersionTLS10, CipherSuites: albDefaultCipherSuites},
+	"ELBSecurityPolicy-TLS-1-1-2017-01":     {MinVersion: tls.VersionTLS11, CipherSuites: albDefaultCipherSuites},
+	"ELBSecurityPolicy-TLS-1-2-Ext-2018-06": {MinVersion: tls.VersionTLS12, CipherSuites: albDefaultCipherSuites},
+	"ELBSecurityPolicy-TLS-1-2-2017-01": {
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384",
+			"TLS_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_RSA_WITH_AES_256_CBC_SHA256",
+		},
+	},
+	"ELBSecurityPolicy-FS-2018-06": {MinVersion: tls.VersionTLS10, CipherSuites: albDefaultCipherSuites[:12]},
+	"ELBSecurityPolicy-FS-1-2-Res-2020-10": {
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+		},
+	},
+}
+
+// TlsInspectionOptions configures an inspection of the certificate and TLS parameters of an endpoint
+type TlsInspectionOptions struct {
+	// The host:port to connect to
+	Address string
+	// The name the certificate must be valid for, e.g. the Route 53 name of the ALB. Defaults to the host in Address.
+	ServerName string
+	// If set, the chain must verify against this CA file. Otherwise it must verify against the system roots, e.g. for
+	// an ALB listener with an ACM certificate.
+	CaFile string
+	// If set, present this client certificate and key, e.g. for a Logstash beats input with ssl_verify_mode => "peer"
+	ClientCertFile string
+	ClientKeyFile  string
+	// If set, the negotiated protocol version and cipher suite must be allowed by this ALB security policy
+	SslPolicy string
+	// Defaults to DEFAULT_MIN_CERTIFICATE_REMAINING_VALIDITY
+	MinRemainingValidity time.Duration
+	// Defaults to DEFAULT_MIN_RSA_KEY_BITS
+	MinRsaKeyBits int
+	// Defaults to DEFAULT_PROBE_DIAL_TIMEOUT
+	Timeout time.Duration
+}
+
+// TlsInspectionReport describes what an endpoint presented during the TLS handshake
+type TlsInspectionReport struct {
+	Address      string
+	ServerName   string
+	Version      string
+	CipherSuite  string
+	Subject      string
+	Issuer       string
+	DnsNames     []string
+	IpAddresses  []string
+	NotAfter     time.Time
+	KeyAlgorithm string
+	KeySize      int
+	// The number of certificates the endpoint sent, including its own
+	ChainLength int
+}
+
+func (report TlsInspectionReport) String() string {
+	return fmt.Sprintf(
+		"%s (server name %s): %s with %s. Certificate %s issued by %s for %v %v, %s %d bits, %d certificates in chain, expires %s (in %s).",
+		report.Address, report.ServerName, report.Version, report.CipherSuite, report.Subject, report.Issuer,
+		report.DnsNames, report.IpAddresses, report.KeyAlgorithm, report.KeySize, report.ChainLength,
+		report.NotAfter.Format(time.RFC3339), time.Until(report.NotAfter).Round(time.Hour),
+	)
+}
+
+// TlsInspectionError is returned when an endpoint completed the TLS handshake but its certificate or TLS parameters
+// are not acceptable
+type TlsInspectionError struct {
+	Report   TlsInspectionReport
+	Problems []string
+}
+
+func (err TlsInspectionError) Error() string {
+	return fmt.Sprintf("TLS endpoint %s failed inspection: %s. %s", err.Report.Address, strings.Join(err.Problems, "; "), err.Report)
+}
+
+// inspectTlsEndpointE does a TLS handshake with options.Address and checks the certificate chain, the names it is
+// valid for, its expiry and key size, and the negotiated protocol version and cipher suite. Dial and handshake errors
+// are returned as is, while problems with the certificate or the TLS parameters are returned as a TlsInspectionError.
+func inspectTlsEndpointE(ctx context.Context, options TlsInspectionOptions) (*TlsInspectionReport, error) {
+	host, _, err := net.SplitHostPort(options.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	serverName := options.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	roots, err := options.rootCAs()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		// The chain and names are verified explicitly below, so that a misissued certificate still produces a report
+		InsecureSkipVerify: true,
+	}
+
+	if options.ClientCertFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(options.ClientCertFile, options.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_PROBE_DIAL_TIMEOUT
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", options.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s failed: %v", options.Address, err)
+	}
+
+	state := tlsConn.ConnectionState()
+	report := newTlsInspectionReport(options.Address, serverName, state)
+	problems := options.checkConnectionState(state, roots, serverName)
+
+	if len(problems) > 0 {
+		return &report, TlsInspectionError{Report: report, Problems: problems}
+	}
+	return &report, nil
+}
+
+func (options TlsInspectionOptions) rootCAs() (*x509.CertPool, error) {
+	if options.CaFile == "" {
+		return x509.SystemCertPool()
+	}
+
+	caCert, err := ioutil.ReadFile(options.CaFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA file %s due to error: %v", options.CaFile, err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No PEM certificates found in CA file %s", options.CaFile)
+	}
+	return roots, nil
+}
+
+func (options TlsInspectionOptions) checkConnectionState(state tls.ConnectionState, roots *x509.CertPool, serverName string) []string {
+	problems := []string{}
+
+	if len(state.PeerCertificates) == 0 {
+		return append(problems, "the server did not present a certificate")
+	}
+	leaf := state.PeerCertificates[0]
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range state.PeerCertificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	// Check the chain and the names separately so the report says which of the two is wrong
+	_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("certificate chain does not verify: %v", err))
+	}
+	if err := leaf.VerifyHostname(serverName); err != nil {
+		problems = append(problems, fmt.Sprintf("certificate is not valid for %s: %v", serverName, err))
+	}
+
+	minRemainingValidity := options.MinRemainingValidity
+	if minRemainingValidity == 0 {
+		minRemainingValidity = DEFAULT_MIN_CERTIFICATE_REMAINING_VALIDITY
+	}
+	if time.Until(leaf.NotAfter) < minRemainingValidity {
+		problems = append(problems, fmt.Sprintf("certificate expires at %s, which is less than %s from now", leaf.NotAfter.Format(time.RFC3339), minRemainingValidity))
+	}
+
+	minRsaKeyBits := options.MinRsaKeyBits
+	if minRsaKeyBits == 0 {
+		minRsaKeyBits = DEFAULT_MIN_RSA_KEY_BITS
+	}
+	if key, isRsa := leaf.PublicKey.(*rsa.PublicKey); isRsa && key.N.BitLen() < minRsaKeyBits {
+		problems = append(problems, fmt.Sprintf("RSA key has %d bits, expected at least %d", key.N.BitLen(), minRsaKeyBits))
+	}
+
+	if options.SslPolicy != "" {
+		policy, ok := albSslPolicies[options.SslPolicy]
+		if !ok {
+			return append(problems, fmt.Sprintf("unknown ALB SSL policy %s", options.SslPolicy))
+		}
+		if state.Version < policy.MinVersion {
+			problems = append(problems, fmt.Sprintf("negotiated %s, but %s requires at least %s", tlsVersionName(state.Version), options.SslPolicy, tlsVersionName(policy.MinVersion)))
+		}
+		cipherSuite := tls.CipherSuiteName(state.CipherSuite)
+		if !containsString(policy.CipherSuites, cipherSuite) {
+			problems = append(problems, fmt.Sprintf("negotiated cipher suite %s, which %s does not allow", cipherSuite, options.SslPolicy))
+		}
+	}
+
+	return problems
+}
+
+func newTlsInspectionReport(address string, serverName string, state tls.ConnectionState) TlsInspectionReport {
+	report := TlsInspectionReport{
+		Address:     address,
+		ServerName:  serverName,
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ChainLength: len(state.PeerCertificates),
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return report
+	}
+	leaf := state.PeerCertificates[0]
+
+	report.Subject = leaf.Subject.String()
+	report.Issuer = leaf.Issuer.String()
+	report.DnsNames = leaf.DNSNames
+	for _, ip := range leaf.IPAddresses {
+		report.IpAddresses = append(report.IpAddresses, ip.String())
+	}
+	report.NotAfter = leaf.NotAfter
+	report.KeyAlgorithm = leaf.PublicKeyAlgorithm.String()
+
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		report.KeySize = key.N.BitLen()
+	case *ecdsa.PublicKey:
+		report.KeySize = key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		report.KeySize = 256
+	}
+
+	return report
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("TLS version 0x%04x", version)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTlsEndpoint waits for options.Address to complete a TLS handshake, logs what it presented and fails the test
+// if the certificate or TLS parameters are not acceptable. Those problems don't go away by waiting, so they fail the
+// test right away.
+func checkTlsEndpoint(t *testing.T, options TlsInspectionOptions) TlsInspectionReport {
+	ctx, cancel := testContext(t)
+	defer cancel()
+
+	var report TlsInspectionReport
+	err := waitForE(t, ctx, tlsInspectionWaitBudget, fmt.Sprintf("TLS inspection of %s", options.Address), func(ctx context.Context) error {
+		inspected, err := inspectTlsEndpointE(ctx, options)
+		if inspectionErr, ok := err.(TlsInspectionError); ok {
+			return retry.FatalError{Underlying: inspectionErr}
+		}
+		if err != nil {
+			return err
+		}
+		report = *inspected
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Logf(t, "TLS endpoint %s", report)
+	return report
+}
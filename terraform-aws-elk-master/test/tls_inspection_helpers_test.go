@@ -0,0 +1,155 @@
+package test
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeTlsListener accepts connections, completes the TLS handshake with tlsCert and closes them
+func startFakeTlsListener(t *testing.T, tlsCert TlsCert, cipherSuites []uint16) net.Listener {
+	keyPair, err := tls.LoadX509KeyPair(tlsCert.PublicKeyPath, tlsCert.PrivateKeyPath)
+	require.NoError(t, err)
+
+	config := &tls.Config{Certificates: []tls.Certificate{keyPair}}
+	if len(cipherSuites) > 0 {
+		// Cipher suites can only be restricted up to TLS 1.2
+		config.CipherSuites = cipherSuites
+		config.MaxVersion = tls.VersionTLS12
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestOfflineInspectTlsEndpoint(t *testing.T) {
+	t.Parallel()
+
+	outputDir, err := ioutil.TempDir("", "tls-inspection-test")
+	require.NoError(t, err)
+	// Unlike a defer, this runs after the parallel subtests below have finished
+	t.Cleanup(func() { os.RemoveAll(outputDir) })
+
+	validCert := generateSelfSignedTlsCert(t, outputDir+"/valid", TlsCertOptions{
+		DnsNames:          []string{"elk.test.gruntwork.in"},
+		IpAddresses:       []string{"127.0.0.1"},
+		UseIntermediateCa: true,
+	})
+	expiringCert := generateSelfSignedTlsCert(t, outputDir+"/expiring", TlsCertOptions{
+		DnsNames: []string{"elk.test.gruntwork.in"},
+		// Certificates are backdated by an hour, so this one expires in an hour
+		Validity: 2 * time.Hour,
+	})
+	otherCa := generateSelfSignedTlsCert(t, outputDir+"/other", TlsCertOptions{})
+
+	testCases := []struct {
+		name            string
+		tlsCert         TlsCert
+		cipherSuites    []uint16
+		options         TlsInspectionOptions
+		expectedProblem string
+	}{
+		{"Valid", validCert, nil, TlsInspectionOptions{ServerName: "elk.test.gruntwork.in", CaFile: validCert.CAPublicKeyPath}, ""},
+		{"ValidForIp", validCert, nil, TlsInspectionOptions{CaFile: validCert.CAPublicKeyPath}, ""},
+		{"WrongName", validCert, nil, TlsInspectionOptions{ServerName: "kibana.test.gruntwork.in", CaFile: validCert.CAPublicKeyPath}, "not valid for kibana.test.gruntwork.in"},
+		{"WrongCa", validCert, nil, TlsInspectionOptions{ServerName: "elk.test.gruntwork.in", CaFile: otherCa.CAPublicKeyPath}, "chain does not verify"},
+		{"Expiring", expiringCert, nil, TlsInspectionOptions{ServerName: "elk.test.gruntwork.in", CaFile: expiringCert.CAPublicKeyPath}, "less than 24h0m0s from now"},
+		{
+			"AllowedCipher",
+			validCert,
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			TlsInspectionOptions{ServerName: "elk.test.gruntwork.in", CaFile: validCert.CAPublicKeyPath, SslPolicy: "ELBSecurityPolicy-FS-1-2-Res-2020-10"},
+			"",
+		},
+		{
+			"DisallowedCipher",
+			validCert,
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+			TlsInspectionOptions{ServerName: "elk.test.gruntwork.in", CaFile: validCert.CAPublicKeyPath, SslPolicy: "ELBSecurityPolicy-FS-1-2-Res-2020-10"},
+			"negotiated cipher suite TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+		},
+		{"UnknownPolicy", validCert, nil, TlsInspectionOptions{CaFile: validCert.CAPublicKeyPath, SslPolicy: "NoSuchPolicy"}, "unknown ALB SSL policy"},
+	}
+
+	for _, testCase := range testCases {
+		// The following is necessary to make sure testCase's values don't
+		// get updated due to concurrency within the scope of t.Run(..) below
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			listener := startFakeTlsListener(t, testCase.tlsCert, testCase.cipherSuites)
+			defer listener.Close()
+
+			options := testCase.options
+			options.Address = listener.Addr().String()
+
+			report, err := inspectTlsEndpointE(context.Background(), options)
+			require.NotNil(t, report, "Expected a report, even for a misissued certificate. Error: %v", err)
+			assert.Equal(t, "RSA", report.KeyAlgorithm)
+			assert.Equal(t, 2048, report.KeySize)
+
+			if testCase.expectedProblem == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			inspectionErr, ok := err.(TlsInspectionError)
+			require.True(t, ok, "Expected a TlsInspectionError but got %T", err)
+			assert.Contains(t, inspectionErr.Error(), testCase.expectedProblem)
+		})
+	}
+}
+
+func TestOfflineInspectTlsEndpointReportsChain(t *testing.T) {
+	t.Parallel()
+
+	outputDir, err := ioutil.TempDir("", "tls-inspection-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(outputDir)
+
+	tlsCert := generateSelfSignedTlsCert(t, outputDir, TlsCertOptions{
+		DnsNames:          []string{"elk.test.gruntwork.in"},
+		KeyAlgorithm:      KEY_ALGORITHM_ECDSA,
+		UseIntermediateCa: true,
+	})
+
+	listener := startFakeTlsListener(t, tlsCert, nil)
+	defer listener.Close()
+
+	report := checkTlsEndpoint(t, TlsInspectionOptions{
+		Address:    listener.Addr().String(),
+		ServerName: "elk.test.gruntwork.in",
+		CaFile:     tlsCert.CAPublicKeyPath,
+	})
+
+	assert.Equal(t, 2, report.ChainLength)
+	assert.Equal(t, "ECDSA", report.KeyAlgorithm)
+	assert.Equal(t, 256, report.KeySize)
+	assert.Equal(t, []string{"elk.test.gruntwork.in"}, report.DnsNames)
+	assert.Equal(t, "TLS 1.3", report.Version)
+}
@@ -0,0 +1,191 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/logger"
+	"github.com/gruntwork-io/terratest/modules/retry"
+)
+
+// WaitBudget describes how long a stage may wait for a condition and how to back off between attempts. The timeout
+// and max backoff of each stage can be overridden with the WAIT_TIMEOUT_<STAGE> and WAIT_MAX_BACKOFF_<STAGE> env vars,
+// which take a Go duration such as "20m" or "45s".
+type WaitBudget struct {
+	Stage          string
+	Timeout        time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Fraction of each backoff, between 0 and 1, that is randomized so parallel tests don't poll in lockstep
+	Jitter float64
+}
+
+// How much of the `go test -timeout` deadline to keep free for teardown stages. Override with TEARDOWN_RESERVE.
+const DEFAULT_TEARDOWN_RESERVE = 10 * time.Minute
+
+var (
+	asgWaitBudget                 = newWaitBudget("asg", 10*time.Minute)
+	asgReplacementWaitBudget      = newWaitBudget("asg_replacement", 15*time.Minute)
+	cloudWatchLogsWaitBudget      = newWaitBudget("cloudwatch_logs", 2*time.Minute)
+	elastalertWaitBudget          = newWaitBudget("elastalert", 10*time.Minute)
+	elasticsearchWaitBudget       = newWaitBudget("elasticsearch", 15*time.Minute)
+	elasticsearchSearchWaitBudget = newWaitBudget("elasticsearch_search", 5*time.Minute)
+	kibanaWaitBudget              = newWaitBudget("kibana", 3*time.Minute)
+	localStackWaitBudget          = newWaitBudget("localstack", 3*time.Minute)
+	logstashWaitBudget            = newWaitBudget("logstash", 15*time.Minute)
+	logstashOutputLogWaitBudget   = newWaitBudget("logstash_output_log", 5*time.Minute)
+	snapshotWaitBudget            = newWaitBudget("snapshot", 15*time.Minute)
+	restoreWaitBudget             = newWaitBudget("restore", 15*time.Minute)
+	sshWaitBudget                 = newWaitBudget("ssh", 5*time.Minute)
+	tlsInspectionWaitBudget       = newWaitBudget("tls_inspection", 5*time.Minute)
+	userDataWaitBudget            = newWaitBudget("user_data", 5*time.Minute)
+)
+
+func newWaitBudget(stage string, timeout time.Duration) WaitBudget {
+	return WaitBudget{
+		Stage:          stage,
+		Timeout:        timeout,
+		InitialBackoff: 2 * time.Second,
+		MaxBackoff:     30 * time.Second,
+		Jitter:         0.2,
+	}
+}
+
+var nonAlphanumericRegexp = regexp.MustCompile("[^A-Za-z0-9]+")
+
+// withEnvOverrides returns a copy of the budget with any WAIT_TIMEOUT_<STAGE> and WAIT_MAX_BACKOFF_<STAGE> env vars
+// applied
+func (budget WaitBudget) withEnvOverrides() (WaitBudget, error) {
+	envSuffix := strings.ToUpper(nonAlphanumericRegexp.ReplaceAllString(budget.Stage, "_"))
+
+	overrides := map[string]*time.Duration{
+		fmt.Sprintf("WAIT_TIMEOUT_%s", envSuffix):     &budget.Timeout,
+		fmt.Sprintf("WAIT_MAX_BACKOFF_%s", envSuffix): &budget.MaxBackoff,
+	}
+
+	for envVar, field := range overrides {
+		value := os.Getenv(envVar)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return budget, fmt.Errorf("Invalid duration '%s' in env var %s: %v", value, envVar, err)
+		}
+		*field = duration
+	}
+
+	return budget, nil
+}
+
+// nextBackoff returns how long to sleep before the given attempt (starting at 1), with exponential growth capped at
+// MaxBackoff and jitter applied
+func (budget WaitBudget) nextBackoff(attempt int) time.Duration {
+	backoff := budget.InitialBackoff
+	for i := 1; i < attempt && backoff < budget.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > budget.MaxBackoff {
+		backoff = budget.MaxBackoff
+	}
+
+	if budget.Jitter > 0 {
+		spread := float64(backoff) * budget.Jitter
+		backoff = time.Duration(float64(backoff) - spread + rand.Float64()*2*spread)
+	}
+
+	return backoff
+}
+
+// WaitTimeoutError is returned when a condition did not succeed within its budget or before the context expired
+type WaitTimeoutError struct {
+	Description string
+	Waited      time.Duration
+	Attempts    int
+	LastError   error
+}
+
+func (err WaitTimeoutError) Error() string {
+	return fmt.Sprintf("Waited %s for %s (%d attempts). Last error: %v", err.Waited.Round(time.Second), err.Description, err.Attempts, err.LastError)
+}
+
+func (err WaitTimeoutError) Unwrap() error {
+	return err.LastError
+}
+
+// testContext returns a context that expires before the `go test -timeout` deadline, leaving TEARDOWN_RESERVE (or
+// DEFAULT_TEARDOWN_RESERVE) for the teardown stages to run before the test binary is killed. For short timeouts, such
+// as the default 10m, the reserve is capped at a quarter of the remaining time.
+func testContext(t *testing.T) (context.Context, context.CancelFunc) {
+	deadline, ok := t.Deadline()
+	if !ok {
+		return context.WithCancel(context.Background())
+	}
+
+	reserve := DEFAULT_TEARDOWN_RESERVE
+	if value := os.Getenv("TEARDOWN_RESERVE"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			t.Fatalf("Invalid duration '%s' in env var TEARDOWN_RESERVE: %v", value, err)
+		}
+		reserve = parsed
+	}
+
+	if remaining := time.Until(deadline); reserve > remaining/4 {
+		reserve = remaining / 4
+	}
+
+	return context.WithDeadline(context.Background(), deadline.Add(-reserve))
+}
+
+// waitFor polls condition until it returns nil, failing the test with a "waited X for Y" error if the budget runs out
+// or the test deadline (minus the teardown reserve) is reached first.
+func waitFor(t *testing.T, budget WaitBudget, description string, condition func(ctx context.Context) error) {
+	ctx, cancel := testContext(t)
+	defer cancel()
+
+	if err := waitForE(t, ctx, budget, description, condition); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForE polls condition until it returns nil, ctx is done or the budget runs out. The condition can return a
+// retry.FatalError to stop waiting immediately.
+func waitForE(t *testing.T, ctx context.Context, budget WaitBudget, description string, condition func(ctx context.Context) error) error {
+	budget, err := budget.withEnvOverrides()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, budget.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var lastErr error
+
+	for attempt := 1; ; attempt++ {
+		lastErr = condition(ctx)
+		if lastErr == nil {
+			return nil
+		}
+
+		if fatalErr, isFatal := lastErr.(retry.FatalError); isFatal {
+			return fmt.Errorf("Gave up waiting for %s after %d attempts: %v", description, attempt, fatalErr.Underlying)
+		}
+
+		backoff := budget.nextBackoff(attempt)
+		logger.Logf(t, "%s not ready after attempt %d: %v. Sleeping for %s.", description, attempt, lastErr, backoff.Round(time.Millisecond))
+
+		select {
+		case <-ctx.Done():
+			return WaitTimeoutError{Description: description, Waited: time.Since(start), Attempts: attempt, LastError: lastErr}
+		case <-time.After(backoff):
+		}
+	}
+}
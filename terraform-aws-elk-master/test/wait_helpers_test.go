@@ -0,0 +1,71 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineWaitForReportsLastErrorOnTimeout(t *testing.T) {
+	t.Parallel()
+
+	budget := WaitBudget{Stage: "offline_timeout", Timeout: 300 * time.Millisecond, InitialBackoff: 50 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+
+	attempts := 0
+	err := waitForE(t, context.Background(), budget, "the thing", func(ctx context.Context) error {
+		attempts++
+		return errors.New("still broken")
+	})
+
+	require.Error(t, err)
+	timeoutErr, ok := err.(WaitTimeoutError)
+	require.True(t, ok, "Expected a WaitTimeoutError but got %T", err)
+	assert.Equal(t, attempts, timeoutErr.Attempts)
+	assert.Contains(t, err.Error(), "for the thing")
+	assert.Contains(t, err.Error(), "still broken")
+}
+
+func TestOfflineWaitForStopsOnFatalError(t *testing.T) {
+	t.Parallel()
+
+	budget := WaitBudget{Stage: "offline_fatal", Timeout: time.Minute, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	attempts := 0
+	err := waitForE(t, context.Background(), budget, "the thing", func(ctx context.Context) error {
+		attempts++
+		if attempts == 2 {
+			return retry.FatalError{Underlying: errors.New("permanently broken")}
+		}
+		return errors.New("still broken")
+	})
+
+	require.Error(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Contains(t, err.Error(), "permanently broken")
+}
+
+func TestOfflineWaitBudgetEnvOverrides(t *testing.T) {
+	os.Setenv("WAIT_TIMEOUT_OFFLINE_ENV_STAGE", "42s")
+	defer os.Unsetenv("WAIT_TIMEOUT_OFFLINE_ENV_STAGE")
+
+	budget, err := newWaitBudget("offline-env-stage", time.Minute).withEnvOverrides()
+	require.NoError(t, err)
+	assert.Equal(t, 42*time.Second, budget.Timeout)
+	assert.Equal(t, 30*time.Second, budget.MaxBackoff)
+}
+
+func TestOfflineWaitBudgetBackoffIsCapped(t *testing.T) {
+	t.Parallel()
+
+	budget := WaitBudget{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	assert.Equal(t, time.Second, budget.nextBackoff(1))
+	assert.Equal(t, 4*time.Second, budget.nextBackoff(3))
+	assert.Equal(t, 5*time.Second, budget.nextBackoff(10))
+}